@@ -14,6 +14,7 @@ import (
 
 	"github.com/NORMAL-EX/stream-7z/lib"
 	"github.com/NORMAL-EX/stream-7z/lib/formats"
+	"github.com/NORMAL-EX/stream-7z/lib/utils"
 	"github.com/schollz/progressbar/v3"
 )
 
@@ -92,6 +93,7 @@ func main() {
 	var password string
 	var info *formats.ArchiveInfo
 
+	promptedOptional := false
 	for {
 		info, err = archive.GetInfo(password)
 		if err != nil {
@@ -114,6 +116,24 @@ func main() {
 			printError("Failed to get archive info: " + err.Error())
 			return
 		}
+
+		// Some formats list encrypted entries without a password; ask once so
+		// those entries can be extracted later
+		if info.RequiresPassword && password == "" && !promptedOptional {
+			promptedOptional = true
+			printWarning("Archive contains encrypted files")
+
+			fmt.Printf("%sEnter password (leave empty to skip): %s", colorCyan, colorReset)
+			password, err = reader.ReadString('\n')
+			if err != nil {
+				printError("Failed to read password: " + err.Error())
+				return
+			}
+			password = strings.TrimSpace(password)
+			if password != "" {
+				continue
+			}
+		}
 		break
 	}
 
@@ -259,7 +279,9 @@ func printTree(node *treeNode, prefix string, isLast bool, depth int) {
 			suffix = fmt.Sprintf(" (%s)", formatBytes(node.size))
 		}
 
-		fmt.Printf("%s%s%s %s%s%s\n", prefix, connector, icon, node.name, suffix, colorReset)
+		// Names come from the archive and may carry terminal escapes
+		name, _ := utils.SanitizeName(node.name)
+		fmt.Printf("%s%s%s %s%s%s\n", prefix, connector, icon, name, suffix, colorReset)
 	}
 
 	// Print children
@@ -2,15 +2,19 @@ package main
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/NORMAL-EX/stream-7z/cmd/server/handlers"
 	"github.com/spf13/viper"
+	"go.uber.org/zap/zapcore"
 )
 
 // ServerConfig holds the server configuration
 type ServerConfig struct {
 	Server  ServerSettings  `mapstructure:"server"`
 	Library LibrarySettings `mapstructure:"library"`
+	Logging LoggingSettings `mapstructure:"logging"`
 }
 
 // ServerSettings contains HTTP server settings
@@ -22,6 +26,36 @@ type ServerSettings struct {
 	RateLimit     RateLimitConfig `mapstructure:"rate_limit"`
 	IPWhitelist   IPWhitelistConfig `mapstructure:"ip_whitelist"` // Enhanced IP whitelist
 	MaxConcurrent int             `mapstructure:"max_concurrent"`
+	Archives      ArchivesConfig  `mapstructure:"archives"`
+	Sink          SinkConfig      `mapstructure:"sink"`
+	Idempotency   IdempotencyConfig `mapstructure:"idempotency"`
+	Admin         AdminConfig     `mapstructure:"admin"`
+	RangeBudget   RangeBudgetConfig `mapstructure:"range_budget"`
+
+	// Headers of API requests forwarded to the archive origin, e.g. a
+	// per-user token (empty = none). Host and the API key headers are
+	// never forwarded.
+	ForwardHeaders []string `mapstructure:"forward_headers"`
+
+	// Gzip text members /api/extract serves to clients sending
+	// Accept-Encoding: gzip
+	GzipExtract bool `mapstructure:"gzip_extract"`
+
+	// Key /api/list cursors are signed with. Replicas behind a load
+	// balancer need the same one; empty = a random key per process.
+	ListCursorSecret string `mapstructure:"list_cursor_secret"`
+
+	// List members under canonical paths: forward slashes, no leading
+	// slash, trailing slash only for directories
+	CanonicalPaths bool `mapstructure:"canonical_paths"`
+
+	// Concurrent requests allowed per client IP, counted until each one
+	// completes (0 = no per-IP limit)
+	MaxConcurrentPerIP int `mapstructure:"max_concurrent_per_ip"`
+
+	// Reverse proxies (IPs or CIDR ranges) whose X-Forwarded-For and
+	// X-Real-IP headers name the client for max_concurrent_per_ip
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
 }
 
 // AuthSettings contains authentication settings
@@ -36,6 +70,11 @@ type AuthSettings struct {
 type TimeoutConfig struct {
 	Read  time.Duration `mapstructure:"read"`
 	Write time.Duration `mapstructure:"write"`
+
+	// How long /api/extract waits for a client that stops accepting data
+	// (0 = write timeout only). While data keeps flowing the write
+	// timeout is extended, so large downloads aren't cut off.
+	ExtractIdle time.Duration `mapstructure:"extract_idle_timeout"`
 }
 
 // CORSConfig contains CORS settings
@@ -51,6 +90,51 @@ type RateLimitConfig struct {
 	Whitelist      []string `mapstructure:"whitelist"`
 }
 
+// ArchivesConfig limits how many archives the server keeps open at once
+type ArchivesConfig struct {
+	MaxOpen     int           `mapstructure:"max_open"`     // 0 = unlimited
+	WaitTimeout time.Duration `mapstructure:"wait_timeout"` // How long to queue for a slot (0 = reject immediately)
+
+	// How long an archive whose /api/info request needs a password stays
+	// open for the retry with the password (0 = always reopen). Must be
+	// below library.timeout, which bounds the archive's lifetime.
+	PasswordRetryTTL time.Duration `mapstructure:"password_retry_ttl"`
+	PasswordRetryMax int           `mapstructure:"password_retry_max"` // Most archives kept for a retry at once (0 = unlimited)
+}
+
+// SinkConfig enables write-through extraction via /api/extract-to
+type SinkConfig struct {
+	Enabled   bool     `mapstructure:"enabled"`
+	Directory string   `mapstructure:"directory"` // Where extracted files are written
+	APIKeys   []string `mapstructure:"api_keys"`  // Keys allowed to use the endpoint (empty = all keys)
+
+	// Disk space files still being written may take up together (0 = no
+	// limit); writes that don't fit fail with SINK_FULL
+	MaxSpillBytes int64 `mapstructure:"max_spill_bytes"`
+}
+
+// IdempotencyConfig controls deduplication of requests carrying an
+// Idempotency-Key header
+type IdempotencyConfig struct {
+	Enabled bool          `mapstructure:"enabled"`
+	TTL     time.Duration `mapstructure:"ttl"` // How long finished responses are replayed
+}
+
+// AdminConfig enables the admin endpoints for listing and canceling
+// operations in flight. They take their own key instead of the API keys.
+type AdminConfig struct {
+	Enabled   bool   `mapstructure:"enabled"`
+	HeaderKey string `mapstructure:"header_key"`
+	Key       string `mapstructure:"key"`
+}
+
+// RangeBudgetConfig limits the range requests one API call may make to
+// the origin, per route (0 = unlimited)
+type RangeBudgetConfig struct {
+	Info int `mapstructure:"info"`
+	List int `mapstructure:"list"`
+}
+
 // IPWhitelistConfig contains IP whitelist settings
 type IPWhitelistConfig struct {
 	Enabled bool     `mapstructure:"enabled"`
@@ -62,6 +146,66 @@ type LibrarySettings struct {
 	MaxFileSize int64         `mapstructure:"max_file_size"`
 	Timeout     time.Duration `mapstructure:"timeout"`
 	Debug       bool          `mapstructure:"debug"`
+	DNSServer   string        `mapstructure:"dns_server"`   // "host:port", empty = system resolver
+	DialTimeout time.Duration `mapstructure:"dial_timeout"` // 0 = no separate dial timeout
+
+	// How long to wait for the origin's response headers (0 = library default of 30s)
+	ResponseHeaderTimeout time.Duration `mapstructure:"response_header_timeout"`
+
+	// Retries of the HEAD request opening an archive after a network error or 5xx/429
+	HeadRetries    int           `mapstructure:"head_retries"`
+	HeadRetryDelay time.Duration `mapstructure:"head_retry_delay"` // Doubles after each retry
+
+	// Retries of a range request after a network error or 5xx/429, and
+	// the cap on the retries of all range requests of one API call
+	RangeRetries    int           `mapstructure:"range_retries"`
+	RangeRetryDelay time.Duration `mapstructure:"range_retry_delay"` // Doubles after each retry
+	RetryBudget     int           `mapstructure:"retry_budget"`      // 0 = no cap
+
+	// Times reading a member is resumed after a transfer error the range
+	// retries didn't recover from; corrupt data is never read again
+	ExtractRetries int `mapstructure:"extract_retries"`
+
+	// Whether a read past the end of an archive that shrank on the origin
+	// ends the file early instead of failing with ARCHIVE_CHANGED
+	TruncateOnShrink bool `mapstructure:"truncate_on_shrink"`
+
+	// How long a URL that failed with 404 or as an unsupported format is
+	// failed again without contacting the origin (0 = no caching)
+	NegativeCacheTTL time.Duration `mapstructure:"negative_cache_ttl"`
+
+	// Maximum decoded size of an archive passed inline as a data: URL
+	// (0 = data: URLs are rejected)
+	MaxDataURLSize int64 `mapstructure:"max_data_url_size"`
+
+	// Bytes an archive may transfer from an origin without Range support
+	// (0 = no limit); smaller archives are downloaded whole on open
+	MaxFallbackBytes int64 `mapstructure:"max_fallback_bytes"`
+
+	// Size of the cache of ranges shared by all archives opened for the
+	// same URL and ETag (0 = no shared cache)
+	SharedCacheSize int64 `mapstructure:"shared_cache_size"`
+
+	// Most bytes one operation buffers in memory (0 = no limit); larger
+	// whole downloads are written to SpillDir, or read by range without one.
+	// MaxSpillBytes caps the files in SpillDir together (0 = no limit).
+	MaxMemoryBuffer int64  `mapstructure:"max_memory_buffer"`
+	SpillDir        string `mapstructure:"spill_dir"`
+	MaxSpillBytes   int64  `mapstructure:"max_spill_bytes"`
+
+	// Send only Range, Host and the configured User-Agent to origins,
+	// without Accept or Accept-Encoding
+	MinimalHeaders bool `mapstructure:"minimal_headers"`
+
+	// User-Agent sent to origins (empty = Stream-7z/1.0, or none with
+	// minimal_headers)
+	UserAgent string `mapstructure:"user_agent"`
+}
+
+// LoggingSettings controls the server's own log output
+type LoggingSettings struct {
+	Level  string `mapstructure:"level"`  // debug, info, warn or error
+	Format string `mapstructure:"format"` // json or console
 }
 
 // LoadConfig loads configuration from file or environment variables
@@ -76,6 +220,7 @@ func LoadConfig(configPath string) (*ServerConfig, error) {
 	v.SetDefault("server.auth.api_keys", []string{})
 	v.SetDefault("server.timeout.read", 30*time.Second)
 	v.SetDefault("server.timeout.write", 30*time.Second)
+	v.SetDefault("server.timeout.extract_idle_timeout", 30*time.Second)
 	v.SetDefault("server.cors.enabled", true)
 	v.SetDefault("server.cors.origins", []string{"*"})
 	v.SetDefault("server.rate_limit.enabled", true)
@@ -84,9 +229,51 @@ func LoadConfig(configPath string) (*ServerConfig, error) {
 	v.SetDefault("server.ip_whitelist.enabled", false)
 	v.SetDefault("server.ip_whitelist.ips", []string{})
 	v.SetDefault("server.max_concurrent", 100)
+	v.SetDefault("server.max_concurrent_per_ip", 0)
+	v.SetDefault("server.trusted_proxies", []string{})
+	v.SetDefault("server.archives.max_open", 0)
+	v.SetDefault("server.archives.wait_timeout", 5*time.Second)
+	v.SetDefault("server.archives.password_retry_ttl", 0)
+	v.SetDefault("server.archives.password_retry_max", 16)
+	v.SetDefault("server.sink.enabled", false)
+	v.SetDefault("server.sink.directory", "")
+	v.SetDefault("server.sink.api_keys", []string{})
+	v.SetDefault("server.sink.max_spill_bytes", 0)
+	v.SetDefault("server.idempotency.enabled", true)
+	v.SetDefault("server.idempotency.ttl", time.Minute)
+	v.SetDefault("server.admin.enabled", false)
+	v.SetDefault("server.admin.header_key", "X-Admin-Key")
+	v.SetDefault("server.admin.key", "")
+	v.SetDefault("server.range_budget.info", 0)
+	v.SetDefault("server.range_budget.list", 0)
+	v.SetDefault("server.forward_headers", []string{})
+	v.SetDefault("server.gzip_extract", false)
+	v.SetDefault("server.list_cursor_secret", "")
+	v.SetDefault("server.canonical_paths", true)
 	v.SetDefault("library.max_file_size", 500*1024*1024) // 500MB
 	v.SetDefault("library.timeout", 30*time.Second)
 	v.SetDefault("library.debug", false)
+	v.SetDefault("library.dns_server", "")
+	v.SetDefault("library.dial_timeout", 0)
+	v.SetDefault("library.response_header_timeout", 0)
+	v.SetDefault("library.head_retries", 2)
+	v.SetDefault("library.head_retry_delay", 250*time.Millisecond)
+	v.SetDefault("library.range_retries", 2)
+	v.SetDefault("library.range_retry_delay", 250*time.Millisecond)
+	v.SetDefault("library.retry_budget", 10)
+	v.SetDefault("library.extract_retries", 1)
+	v.SetDefault("library.truncate_on_shrink", false)
+	v.SetDefault("library.negative_cache_ttl", 5*time.Second)
+	v.SetDefault("library.max_data_url_size", 0)
+	v.SetDefault("library.max_fallback_bytes", 64*1024*1024) // 64MB
+	v.SetDefault("library.shared_cache_size", 64*1024*1024)  // 64MB
+	v.SetDefault("library.max_memory_buffer", 0)
+	v.SetDefault("library.spill_dir", "")
+	v.SetDefault("library.max_spill_bytes", 0)
+	v.SetDefault("library.minimal_headers", false)
+	v.SetDefault("library.user_agent", "")
+	v.SetDefault("logging.level", "info")
+	v.SetDefault("logging.format", "json")
 
 	// Read from config file if provided
 	if configPath != "" {
@@ -138,10 +325,129 @@ func (c *ServerConfig) Validate() error {
 		return fmt.Errorf("max_concurrent must be at least 1")
 	}
 
+	if c.Server.MaxConcurrentPerIP < 0 {
+		return fmt.Errorf("max_concurrent_per_ip cannot be negative")
+	}
+
+	if _, err := handlers.NewTrustedProxies(c.Server.TrustedProxies); err != nil {
+		return err
+	}
+
+	if c.Server.Archives.MaxOpen < 0 {
+		return fmt.Errorf("archives.max_open cannot be negative")
+	}
+
+	if c.Server.Archives.PasswordRetryTTL < 0 {
+		return fmt.Errorf("archives.password_retry_ttl cannot be negative")
+	}
+	if c.Server.Archives.PasswordRetryTTL > 0 && c.Library.Timeout > 0 && c.Server.Archives.PasswordRetryTTL >= c.Library.Timeout {
+		return fmt.Errorf("archives.password_retry_ttl must be shorter than library.timeout")
+	}
+	if c.Server.Archives.PasswordRetryMax < 0 {
+		return fmt.Errorf("archives.password_retry_max cannot be negative")
+	}
+
+	if c.Server.Idempotency.TTL < 0 {
+		return fmt.Errorf("idempotency.ttl cannot be negative")
+	}
+
+	if c.Server.Sink.Enabled {
+		if c.Server.Sink.Directory == "" {
+			return fmt.Errorf("sink is enabled but no directory is configured")
+		}
+		// Writing to server-side storage must never be open to anonymous clients
+		if !c.Server.Auth.Enabled {
+			return fmt.Errorf("sink requires auth to be enabled")
+		}
+	}
+
+	if c.Server.Sink.MaxSpillBytes < 0 {
+		return fmt.Errorf("sink.max_spill_bytes cannot be negative")
+	}
+
+	if c.Server.Admin.Enabled {
+		if c.Server.Admin.Key == "" {
+			return fmt.Errorf("admin is enabled but no admin key is configured")
+		}
+		for _, key := range c.GetAllAPIKeys() {
+			if key == c.Server.Admin.Key {
+				return fmt.Errorf("admin key must differ from the API keys")
+			}
+		}
+	}
+
+	if c.Server.Timeout.ExtractIdle < 0 {
+		return fmt.Errorf("extract_idle_timeout cannot be negative")
+	}
+
+	if c.Server.RangeBudget.Info < 0 || c.Server.RangeBudget.List < 0 {
+		return fmt.Errorf("range_budget limits cannot be negative")
+	}
+
+	for _, name := range c.Server.ForwardHeaders {
+		if strings.EqualFold(name, "Host") ||
+			strings.EqualFold(name, c.Server.Auth.HeaderKey) ||
+			strings.EqualFold(name, c.Server.Admin.HeaderKey) {
+			return fmt.Errorf("forward_headers cannot include %s", name)
+		}
+	}
+
 	if c.Library.MaxFileSize < 0 {
 		return fmt.Errorf("max_file_size cannot be negative")
 	}
 
+	if c.Library.DialTimeout < 0 {
+		return fmt.Errorf("dial_timeout cannot be negative")
+	}
+
+	if c.Library.ResponseHeaderTimeout < 0 {
+		return fmt.Errorf("response_header_timeout cannot be negative")
+	}
+
+	if c.Library.HeadRetries < 0 || c.Library.HeadRetryDelay < 0 {
+		return fmt.Errorf("head_retries and head_retry_delay cannot be negative")
+	}
+
+	if c.Library.RangeRetries < 0 || c.Library.RangeRetryDelay < 0 || c.Library.RetryBudget < 0 {
+		return fmt.Errorf("range_retries, range_retry_delay and retry_budget cannot be negative")
+	}
+
+	if c.Library.ExtractRetries < 0 {
+		return fmt.Errorf("extract_retries cannot be negative")
+	}
+
+	if c.Library.NegativeCacheTTL < 0 {
+		return fmt.Errorf("negative_cache_ttl cannot be negative")
+	}
+
+	if c.Library.MaxDataURLSize < 0 {
+		return fmt.Errorf("max_data_url_size cannot be negative")
+	}
+
+	if c.Library.MaxFallbackBytes < 0 {
+		return fmt.Errorf("max_fallback_bytes cannot be negative")
+	}
+
+	if c.Library.SharedCacheSize < 0 {
+		return fmt.Errorf("shared_cache_size cannot be negative")
+	}
+
+	if c.Library.MaxMemoryBuffer < 0 {
+		return fmt.Errorf("max_memory_buffer cannot be negative")
+	}
+
+	if c.Library.MaxSpillBytes < 0 {
+		return fmt.Errorf("max_spill_bytes cannot be negative")
+	}
+
+	if _, err := zapcore.ParseLevel(c.Logging.Level); err != nil {
+		return fmt.Errorf("logging.level must be debug, info, warn or error")
+	}
+
+	if c.Logging.Format != "json" && c.Logging.Format != "console" {
+		return fmt.Errorf("logging.format must be json or console")
+	}
+
 	if c.Server.IPWhitelist.Enabled && len(c.Server.IPWhitelist.IPs) == 0 {
 		return fmt.Errorf("ip_whitelist is enabled but no IPs are configured")
 	}
@@ -190,6 +496,9 @@ server:
   timeout:
     read: 30s   # 读取超时 / Read timeout
     write: 30s  # 写入超时 / Write timeout
+    # 提取时客户端停止接收数据的最长时间，持续有进展时不受写入超时限制（0 表示只用写入超时）
+    # How long an extraction may stall (0 = write timeout only); progressing downloads outlive the write timeout
+    extract_idle_timeout: 30s
   
   # CORS 跨域配置 / CORS configuration
   cors:
@@ -223,6 +532,69 @@ server:
   # 最大并发请求数 / Maximum concurrent requests
   max_concurrent: 100
 
+  # Concurrent requests per client IP (0 = no limit)
+  max_concurrent_per_ip: 0
+
+  # Proxies allowed to name the client in X-Forwarded-For (IPs or CIDR)
+  trusted_proxies: []
+
+  # 同时打开的压缩包数量限制 / Limit on simultaneously open archives
+  archives:
+    # 最大打开数量（0 表示不限制）/ Max open archives (0 = unlimited)
+    max_open: 0
+    # 等待空闲名额的时间 / How long to wait for a free slot
+    wait_timeout: 5s
+    # 需要密码的压缩包保持打开、等待带密码重试的时间（0 表示关闭，需小于 library.timeout）
+    # How long an archive needing a password stays open for the retry (0 = off, below library.timeout)
+    password_retry_ttl: 0s
+    password_retry_max: 16
+
+  # 服务端写入（/api/extract-to），需要启用认证 / Write-through extraction (/api/extract-to), requires auth
+  sink:
+    # 是否启用 / Enable write-through extraction
+    enabled: false
+    # 提取文件的写入目录 / Directory extracted files are written to
+    directory: ""
+    # 允许使用该端点的密钥（留空表示所有密钥）/ Keys allowed to use it (empty = all keys)
+    api_keys: []
+    # 正在写入的临时文件总大小上限（0 表示不限制）/ Max disk space of files still being written (0 = no limit)
+    max_spill_bytes: 0
+
+  # 带 Idempotency-Key 请求头的相同请求只执行一次 / Deduplicate requests with the same Idempotency-Key
+  idempotency:
+    # 是否启用 / Enable deduplication
+    enabled: true
+    # 完成后结果的保留时间 / How long finished responses are replayed
+    ttl: 1m
+
+  # 管理端点：查看和取消进行中的操作 / Admin endpoints: list and cancel operations in flight
+  admin:
+    # 是否启用 / Enable admin endpoints
+    enabled: false
+    # 管理密钥请求头名称 / Admin key header name
+    header_key: "X-Admin-Key"
+    # 管理密钥，须与 API 密钥不同 / Admin key, must differ from the API keys
+    key: ""
+
+  # 单次请求向源站发出的 Range 请求上限（0 表示不限制）/ Max range requests per API call (0 = unlimited)
+  range_budget:
+    info: 0
+    list: 0
+
+  # 转发给源站的 API 请求头（如用户自己的令牌），Host 和 API 密钥请求头永不转发
+  # API request headers forwarded to the origin (e.g. a per-user token); never Host or the API key headers
+  forward_headers: []
+
+  # 客户端接受 gzip 时压缩 /api/extract 返回的文本文件 / Gzip text files from /api/extract for clients accepting it
+  gzip_extract: false
+
+  # 签名 /api/list 分页游标的密钥，多副本部署需一致（空表示每个进程随机生成）
+  # Key list cursors are signed with; must match across replicas (empty = random per process)
+  list_cursor_secret: ""
+
+  # 列出的路径统一为正斜杠、无前导斜杠、仅目录以斜杠结尾 / List canonical paths: forward slashes, no leading slash, trailing slash only for directories
+  canonical_paths: true
+
 # 压缩包库配置 / Archive library configuration
 library:
   # 最大文件大小（字节）/ Maximum file size (bytes)
@@ -231,4 +603,55 @@ library:
   timeout: 30s
   # 调试模式 / Debug mode
   debug: false
+  # 自定义 DNS 服务器（留空使用系统解析）/ Custom DNS server (empty = system resolver)
+  # 使用代理时只用于解析代理地址 / With a proxy, only the proxy address is resolved this way
+  dns_server: ""
+  # 建立连接的超时（0 表示不单独限制）/ Connection dial timeout (0 = no separate limit)
+  dial_timeout: 0s
+  # 等待源站响应头的超时（0 表示默认 30 秒）/ Response header timeout (0 = default 30s)
+  response_header_timeout: 0s
+  # 打开压缩包的 HEAD 请求在网络错误或 5xx/429 时的重试次数 / HEAD retries on network errors or 5xx/429
+  head_retries: 2
+  # 第一次重试前的等待时间，之后每次翻倍 / Delay before the first retry, doubling afterwards
+  head_retry_delay: 250ms
+  # 读取压缩包的 Range 请求在网络错误或 5xx/429 时的重试次数与首次重试延迟
+  # Range request retries on network errors or 5xx/429, and the delay before the first one
+  range_retries: 2
+  range_retry_delay: 250ms
+  # 单次请求所有 Range 请求合计的重试上限，用完后立即失败（0 表示不限制）
+  # Retries allowed across all range requests of one API call; fails at once when spent (0 = no cap)
+  retry_budget: 10
+  # 读取文件内容时传输失败（Range 重试后仍失败）重新打开并续读的次数；数据损坏不会重试
+  # Times reading a file is resumed after a transfer error; corrupt data is never retried
+  extract_retries: 1
+  truncate_on_shrink: false
+  # 打开失败（404、不支持的格式等）的 URL 在此时间内直接返回相同错误（0 表示不缓存）
+  # How long failures like 404 or an unsupported format are answered from cache (0 = off)
+  negative_cache_ttl: 5s
+  # 以 data: URL 内联传入的压缩包的最大解码大小（0 表示不接受 data: URL）
+  # Max decoded size of archives passed inline as data: URLs (0 = rejected)
+  max_data_url_size: 0
+  # 源站不支持 Range 时每个压缩包最多传输的字节数（0 表示不限制）/ Max bytes from origins without Range support (0 = no limit)
+  max_fallback_bytes: 67108864
+  # 所有请求共享的范围缓存大小，同一 URL 和 ETag 的压缩包复用已获取的数据（0 表示关闭）
+  # Size of the range cache shared by all requests for the same URL and ETag (0 = off)
+  shared_cache_size: 67108864
+  # 单个操作最多在内存中缓冲的字节数（0 表示不限制）/ Most bytes one operation buffers in memory (0 = no limit)
+  max_memory_buffer: 0
+  # 超出上限的压缩包写入的临时目录（留空改用 Range 请求）/ Where larger archives are spilled (empty = read by range)
+  spill_dir: ""
+  # spill_dir 中临时文件的合计上限，放不下时改用 Range 请求（0 表示不限制）/ Cap on the files in spill_dir together (0 = no limit)
+  max_spill_bytes: 0
+  # 只向源站发送 Range、Host 和下面的 User-Agent / Send only Range, Host and the User-Agent below to origins
+  minimal_headers: false
+  # 发送给源站的 User-Agent（留空为 Stream-7z/1.0，启用 minimal_headers 时不发送）
+  # User-Agent sent to origins (empty = Stream-7z/1.0, or none with minimal_headers)
+  user_agent: ""
+
+# 日志配置 / Logging configuration
+logging:
+  # 日志级别：debug、info、warn、error（-log-level 参数优先）/ Log level (the -log-level flag takes precedence)
+  level: info
+  # 输出格式：json 或 console（适合本地开发）/ Output format: json or console (readable, for local development)
+  format: json
 `
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrTooManyArchives is returned when no archive slot became available in time
+var ErrTooManyArchives = errors.New("too many open archives")
+
+// ArchiveLimiter caps the number of archives open at the same time.
+// Each open archive holds its own upstream connections, so this protects
+// the origin from connection storms independently of the request limit.
+type ArchiveLimiter struct {
+	slots       chan struct{}
+	waitTimeout time.Duration
+	open        int64
+}
+
+// NewArchiveLimiter creates a new archive limiter
+// maxOpen <= 0 disables the limit; waitTimeout is how long a request may
+// queue for a slot before being rejected (0 = reject immediately)
+func NewArchiveLimiter(maxOpen int, waitTimeout time.Duration) *ArchiveLimiter {
+	l := &ArchiveLimiter{
+		waitTimeout: waitTimeout,
+	}
+	if maxOpen > 0 {
+		l.slots = make(chan struct{}, maxOpen)
+	}
+	return l
+}
+
+// Acquire reserves a slot for one open archive
+func (l *ArchiveLimiter) Acquire(ctx context.Context) error {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			if l.waitTimeout <= 0 {
+				return ErrTooManyArchives
+			}
+
+			timer := time.NewTimer(l.waitTimeout)
+			defer timer.Stop()
+
+			select {
+			case l.slots <- struct{}{}:
+			case <-timer.C:
+				return ErrTooManyArchives
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	atomic.AddInt64(&l.open, 1)
+	return nil
+}
+
+// Release frees a slot reserved by Acquire
+func (l *ArchiveLimiter) Release() {
+	atomic.AddInt64(&l.open, -1)
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// OpenCount returns the number of archives currently open
+func (l *ArchiveLimiter) OpenCount() int64 {
+	return atomic.LoadInt64(&l.open)
+}
+
+// acquireArchive reserves an archive slot for the request, responding with
+// 503 when none is available. The returned func must be called to release it.
+func (h *Handler) acquireArchive(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	if err := h.archives.Acquire(r.Context()); err != nil {
+		h.logger.Warn("max open archives reached",
+			zap.String("remote_addr", r.RemoteAddr),
+			zap.Int64("open_archives", h.archives.OpenCount()),
+			zap.Error(err),
+		)
+		respondError(w, http.StatusServiceUnavailable, "Too many archives open, please try again later", "TOO_MANY_ARCHIVES")
+		return nil, false
+	}
+	return h.archives.Release, true
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/NORMAL-EX/stream-7z/internal/testarchive"
+	"github.com/NORMAL-EX/stream-7z/lib"
+	"go.uber.org/zap"
+)
+
+func TestArchiveLimiterBlocksAtCapacity(t *testing.T) {
+	limiter := NewArchiveLimiter(2, 0)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if err := limiter.Acquire(ctx); err != nil {
+			t.Fatalf("Acquire %d failed: %v", i, err)
+		}
+	}
+	if err := limiter.Acquire(ctx); !errors.Is(err, ErrTooManyArchives) {
+		t.Fatalf("expected ErrTooManyArchives at capacity, got %v", err)
+	}
+	if n := limiter.OpenCount(); n != 2 {
+		t.Errorf("expected 2 open archives, got %d", n)
+	}
+
+	limiter.Release()
+	if err := limiter.Acquire(ctx); err != nil {
+		t.Errorf("expected a released slot to be reusable, got %v", err)
+	}
+}
+
+func TestArchiveLimiterWaitsForSlot(t *testing.T) {
+	limiter := NewArchiveLimiter(1, time.Minute)
+	if err := limiter.Acquire(context.Background()); err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+
+	acquired := make(chan error, 1)
+	go func() { acquired <- limiter.Acquire(context.Background()) }()
+
+	select {
+	case err := <-acquired:
+		t.Fatalf("expected Acquire to wait at capacity, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	limiter.Release()
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Errorf("expected the waiting Acquire to get the released slot, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the waiting Acquire to return after a release")
+	}
+}
+
+func TestArchiveLimiterWaitTimeout(t *testing.T) {
+	limiter := NewArchiveLimiter(1, 20*time.Millisecond)
+	limiter.Acquire(context.Background())
+
+	if err := limiter.Acquire(context.Background()); !errors.Is(err, ErrTooManyArchives) {
+		t.Errorf("expected ErrTooManyArchives after the wait timeout, got %v", err)
+	}
+}
+
+func TestArchiveLimiterHonoursContext(t *testing.T) {
+	limiter := NewArchiveLimiter(1, time.Minute)
+	limiter.Acquire(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	acquired := make(chan error, 1)
+	go func() { acquired <- limiter.Acquire(ctx) }()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-acquired:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected a canceled Acquire to stop waiting")
+	}
+	if n := limiter.OpenCount(); n != 1 {
+		t.Errorf("expected a canceled Acquire not to take a slot, %d open", n)
+	}
+}
+
+func TestArchiveLimiterUnlimited(t *testing.T) {
+	limiter := NewArchiveLimiter(0, 0)
+	for i := 0; i < 100; i++ {
+		if err := limiter.Acquire(context.Background()); err != nil {
+			t.Fatalf("Acquire %d failed without a limit: %v", i, err)
+		}
+	}
+	if n := limiter.OpenCount(); n != 100 {
+		t.Errorf("expected 100 open archives, got %d", n)
+	}
+}
+
+func TestArchiveLimiterReleasedByHandlers(t *testing.T) {
+	server := newArchiveServer(t, testarchive.Tar(t, testarchive.Files("a.txt")...))
+	missing := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(missing.Close)
+
+	limiter := NewArchiveLimiter(1, 0)
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop()).WithArchiveLimiter(limiter)
+
+	tests := []struct {
+		name string
+		url  string
+		ok   bool
+	}{
+		{"closed archive", server.URL + "/test.tar", true},
+		{"failed open", missing.URL + "/test.tar", false},
+	}
+	for _, test := range tests {
+		// With a single slot, a leaked one fails the second request
+		for i := 0; i < 2; i++ {
+			rec := postJSON(h.Info(), "/api/info", InfoRequest{URL: test.url}, nil)
+			if rec.Code == http.StatusServiceUnavailable || (rec.Code == http.StatusOK) != test.ok {
+				t.Fatalf("%s: unexpected status %d: %s", test.name, rec.Code, rec.Body.String())
+			}
+		}
+		if n := limiter.OpenCount(); n != 0 {
+			t.Errorf("%s: expected the slot to be released, %d open", test.name, n)
+		}
+	}
+}
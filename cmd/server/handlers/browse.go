@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/NORMAL-EX/stream-7z/lib"
+	"github.com/NORMAL-EX/stream-7z/lib/formats"
+	"go.uber.org/zap"
+)
+
+// defaultBrowseLimit is the page size when a browse request sets no limit
+const defaultBrowseLimit = 1000
+
+// maxBrowseLimit caps the page size of a browse request
+const maxBrowseLimit = 10000
+
+// maxPreviewSize caps how much of the previewed file is returned inline
+const maxPreviewSize = 1 << 20
+
+// Browse handles POST /api/browse requests. It returns the archive info,
+// one page of a directory listing and optionally the content of a small
+// file, all from a single opened archive, which is everything a file
+// browser needs to render a directory with a preview pane.
+func (h *Handler) Browse() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req BrowseRequest
+		if err := parseJSONRequest(w, r, &req); err != nil {
+			return
+		}
+
+		if req.URL == "" {
+			respondError(w, http.StatusBadRequest, "url is required", "MISSING_URL")
+			return
+		}
+
+		if req.Offset < 0 || req.Limit < 0 {
+			respondError(w, http.StatusBadRequest, "offset and limit cannot be negative", "INVALID_PAGE")
+			return
+		}
+		limit := req.Limit
+		if limit == 0 {
+			limit = defaultBrowseLimit
+		}
+		if limit > maxBrowseLimit {
+			limit = maxBrowseLimit
+		}
+
+		release, ok := h.acquireArchive(w, r)
+		if !ok {
+			return
+		}
+		defer release()
+
+		h.logger.Info("browsing archive",
+			zap.String("url", lib.DisplayURL(req.URL)),
+			zap.String("inner_path", req.InnerPath),
+			zap.String("preview", req.Preview),
+			zap.Bool("has_password", req.Password != ""),
+		)
+
+		listReq := ListRequest{URL: req.URL, Password: req.Password, InnerPath: req.InnerPath}
+
+		archive, err := lib.NewArchiveWithContext(r.Context(), req.URL, h.requestConfig(r, 0))
+		if err != nil {
+			h.logger.Error("failed to open archive",
+				zap.String("url", lib.DisplayURL(req.URL)),
+				zap.Error(err),
+			)
+			h.respondListError(w, listReq, err)
+			return
+		}
+		defer archive.Close()
+
+		// ZIP and 7z read their directory once; the listing reuses it
+		info, err := archive.GetInfo(req.Password)
+		if err != nil {
+			h.logger.Error("failed to get archive info",
+				zap.String("url", lib.DisplayURL(req.URL)),
+				zap.Error(err),
+			)
+			h.respondListError(w, listReq, err)
+			return
+		}
+
+		files, err := archive.ListFiles(req.InnerPath, req.Password)
+		if err != nil {
+			h.logger.Error("failed to list archive files",
+				zap.String("url", lib.DisplayURL(req.URL)),
+				zap.String("inner_path", req.InnerPath),
+				zap.Error(err),
+			)
+			h.respondListError(w, listReq, err)
+			return
+		}
+
+		response := BrowseResponse{
+			Info:   newInfoResponse(info, archive),
+			Files:  h.convertFileEntries(pageEntries(files, req.Offset, limit)),
+			Total:  len(files),
+			Offset: req.Offset,
+			Limit:  limit,
+		}
+
+		if req.Preview != "" {
+			response.Preview = h.preview(archive, req.Preview, req.Password)
+		}
+
+		h.logger.Info("successfully browsed archive",
+			zap.String("url", lib.DisplayURL(req.URL)),
+			zap.String("inner_path", req.InnerPath),
+			zap.Int("file_count", len(response.Files)),
+			zap.Int("total", response.Total),
+		)
+
+		respondJSON(w, http.StatusOK, response)
+	}
+}
+
+// preview reads up to maxPreviewSize bytes of filePath. Failures are
+// reported in the preview itself so the listing is still returned.
+func (h *Handler) preview(archive *lib.Archive, filePath, password string) *PreviewResponse {
+	preview := &PreviewResponse{File: filePath}
+
+	reader, size, err := archive.ExtractFile(filePath, password)
+	if err == nil {
+		defer reader.Close()
+		preview.Size = size
+		preview.Content, err = io.ReadAll(io.LimitReader(reader, maxPreviewSize+1))
+	}
+	if err != nil {
+		h.logger.Warn("failed to read preview",
+			append([]zap.Field{
+				zap.String("url", lib.DisplayURL(archive.URL())),
+				zap.String("file_path", filePath),
+				zap.Error(err),
+			}, extractErrorFields(err)...)...,
+		)
+		_, preview.Error, preview.Code = classifyExtractError(err, password)
+		preview.Content = nil
+		return preview
+	}
+
+	if len(preview.Content) > maxPreviewSize {
+		preview.Content = preview.Content[:maxPreviewSize]
+		preview.Truncated = true
+	}
+	return preview
+}
+
+// pageEntries returns one page of entries
+func pageEntries(entries []formats.FileEntry, offset, limit int) []formats.FileEntry {
+	if offset >= len(entries) {
+		return entries[:0]
+	}
+	end := offset + limit
+	if end > len(entries) {
+		end = len(entries)
+	}
+	return entries[offset:end]
+}
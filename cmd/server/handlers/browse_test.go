@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/NORMAL-EX/stream-7z/internal/testarchive"
+	"github.com/NORMAL-EX/stream-7z/lib"
+	"go.uber.org/zap"
+)
+
+func TestBrowseCombinedResponse(t *testing.T) {
+	server := newArchiveServer(t, testarchive.Tar(t, testarchive.Files("readme.txt", "docs/a.txt", "docs/b.txt", "docs/c.txt")...))
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop())
+
+	rec := postJSON(h.Browse(), "/api/browse", BrowseRequest{
+		URL:       server.URL + "/test.tar",
+		InnerPath: "docs/",
+		Offset:    1,
+		Limit:     1,
+		Preview:   "readme.txt",
+	}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var resp BrowseResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+
+	if resp.Info.Format != "tar" || resp.Info.TotalFiles != 4 {
+		t.Errorf("unexpected info: %+v", resp.Info)
+	}
+	if resp.Total != 3 || resp.Offset != 1 || resp.Limit != 1 {
+		t.Errorf("unexpected paging: total=%d offset=%d limit=%d", resp.Total, resp.Offset, resp.Limit)
+	}
+	if len(resp.Files) != 1 || resp.Files[0].Path != "docs/b.txt" {
+		t.Errorf("expected page [docs/b.txt], got %+v", resp.Files)
+	}
+	if resp.Preview == nil || string(resp.Preview.Content) != "content of readme.txt" || resp.Preview.Truncated {
+		t.Errorf("unexpected preview: %+v", resp.Preview)
+	}
+}
+
+func TestBrowsePreviewErrorKeepsListing(t *testing.T) {
+	server := newArchiveServer(t, testarchive.Tar(t, testarchive.Files("readme.txt")...))
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop())
+
+	rec := postJSON(h.Browse(), "/api/browse", BrowseRequest{
+		URL:     server.URL + "/test.tar",
+		Preview: "missing.txt",
+	}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var resp BrowseResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	if len(resp.Files) != 1 {
+		t.Errorf("expected the listing despite the failed preview, got %+v", resp.Files)
+	}
+	if resp.Preview == nil || resp.Preview.Code != "FILE_NOT_FOUND" || resp.Preview.Content != nil {
+		t.Errorf("expected a FILE_NOT_FOUND preview, got %+v", resp.Preview)
+	}
+}
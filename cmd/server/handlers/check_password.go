@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/NORMAL-EX/stream-7z/lib"
+	"go.uber.org/zap"
+)
+
+// CheckPassword handles POST /api/check-password requests. It only tells
+// whether the password opens the archive, which for ZIP costs a single
+// entry header instead of the whole listing, so a client can verify a
+// password before browsing. A wrong password is a normal result, not an
+// error response.
+func (h *Handler) CheckPassword() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req CheckPasswordRequest
+		if err := parseJSONRequest(w, r, &req); err != nil {
+			return
+		}
+
+		if req.URL == "" {
+			respondError(w, http.StatusBadRequest, "url is required", "MISSING_URL")
+			return
+		}
+
+		release, ok := h.acquireArchive(w, r)
+		if !ok {
+			return
+		}
+		defer release()
+
+		h.logger.Info("checking archive password",
+			zap.String("url", lib.DisplayURL(req.URL)),
+			zap.Bool("has_password", req.Password != ""),
+		)
+
+		listReq := ListRequest{URL: req.URL, Password: req.Password}
+
+		archive, err := lib.NewArchiveWithContext(r.Context(), req.URL, h.requestConfig(r, 0))
+		if err != nil {
+			h.logger.Error("failed to open archive",
+				zap.String("url", lib.DisplayURL(req.URL)),
+				zap.Error(err),
+			)
+			h.respondListError(w, listReq, err)
+			return
+		}
+		defer archive.Close()
+
+		status, err := archive.VerifyPassword(req.Password)
+		if err != nil {
+			h.logger.Error("failed to check password",
+				zap.String("url", lib.DisplayURL(req.URL)),
+				zap.Error(err),
+			)
+			h.respondListError(w, listReq, err)
+			return
+		}
+
+		response := CheckPasswordResponse{
+			Encrypted: status != lib.PasswordNotRequired,
+			Valid:     status != lib.PasswordIncorrect,
+			Format:    archive.Format(),
+		}
+
+		h.logger.Info("checked archive password",
+			zap.String("url", lib.DisplayURL(req.URL)),
+			zap.Bool("encrypted", response.Encrypted),
+			zap.Bool("valid", response.Valid),
+		)
+
+		respondJSON(w, http.StatusOK, response)
+	}
+}
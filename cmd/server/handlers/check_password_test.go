@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/NORMAL-EX/stream-7z/internal/testarchive"
+	"github.com/NORMAL-EX/stream-7z/lib"
+	"github.com/yeka/zip"
+	"go.uber.org/zap"
+)
+
+func TestCheckPassword(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	fw, err := zw.Encrypt("secret.txt", "pass", zip.AES256Encryption)
+	if err != nil {
+		t.Fatalf("failed to create encrypted zip entry: %v", err)
+	}
+	fw.Write([]byte("secret content"))
+	if err := zw.Close(); err != nil {
+		t.Fatalf("failed to close zip writer: %v", err)
+	}
+	encrypted := newArchiveServer(t, buf.Bytes())
+	plain := newArchiveServer(t, testarchive.Tar(t, testarchive.Files("a.txt")...))
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop())
+
+	tests := []struct {
+		name      string
+		url       string
+		password  string
+		encrypted bool
+		valid     bool
+	}{
+		{"not encrypted", plain.URL + "/test.tar", "anything", false, true},
+		{"correct", encrypted.URL + "/test.zip", "pass", true, true},
+		{"incorrect", encrypted.URL + "/test.zip", "wrong", true, false},
+		{"missing", encrypted.URL + "/test.zip", "", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := postJSON(h.CheckPassword(), "/api/check-password", CheckPasswordRequest{URL: tt.url, Password: tt.password}, nil)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+			}
+
+			var resp CheckPasswordResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+			if resp.Encrypted != tt.encrypted || resp.Valid != tt.valid {
+				t.Errorf("expected encrypted=%v valid=%v, got %+v", tt.encrypted, tt.valid, resp)
+			}
+		})
+	}
+}
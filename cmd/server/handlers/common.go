@@ -2,11 +2,14 @@ package handlers
 
 import (
 	"encoding/json"
+	"math"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/NORMAL-EX/stream-7z/lib"
 	"github.com/NORMAL-EX/stream-7z/lib/formats"
+	"github.com/NORMAL-EX/stream-7z/lib/utils"
 	"go.uber.org/zap"
 )
 
@@ -20,6 +23,20 @@ type ListRequest struct {
 	URL       string `json:"url"`
 	Password  string `json:"password,omitempty"`
 	InnerPath string `json:"innerPath,omitempty"`
+	MaxDepth  int    `json:"maxDepth,omitempty"` // Levels below innerPath to include (0 = unlimited)
+
+	// Leave out directories with no file below them
+	HideEmptyDirs bool `json:"hideEmptyDirs,omitempty"`
+
+	// Order each directory's entries, directories first, then by name.
+	// Only listings limited by maxDepth are sorted: they are bounded, so
+	// holding them back costs little. Full listings stay in archive order.
+	Sort bool `json:"sort,omitempty"`
+
+	// Paging: at most Limit entries are returned (0 = all), and Cursor,
+	// the nextCursor of the previous page, continues the listing
+	Limit  int    `json:"limit,omitempty"`
+	Cursor string `json:"cursor,omitempty"`
 }
 
 type ExtractRequest struct {
@@ -28,6 +45,67 @@ type ExtractRequest struct {
 	File     string `json:"file"`
 }
 
+type BrowseRequest struct {
+	URL       string `json:"url"`
+	Password  string `json:"password,omitempty"`
+	InnerPath string `json:"innerPath,omitempty"`
+	Offset    int    `json:"offset,omitempty"`
+	Limit     int    `json:"limit,omitempty"`   // Page size, 0 = defaultBrowseLimit
+	Preview   string `json:"preview,omitempty"` // File whose content is returned inline
+}
+
+type HashRequest struct {
+	URL       string `json:"url"`
+	Password  string `json:"password,omitempty"`
+	File      string `json:"file"`
+	Algorithm string `json:"algorithm,omitempty"` // md5, sha1 or sha256 (default)
+}
+
+type ExtractToRequest struct {
+	URL      string `json:"url"`
+	Password string `json:"password,omitempty"`
+	File     string `json:"file"`
+	Target   string `json:"target,omitempty"` // Destination name in the sink, defaults to file
+}
+
+type DownloadRequest struct {
+	URL       string   `json:"url"`
+	Password  string   `json:"password,omitempty"`
+	Files     []string `json:"files,omitempty"`     // Members to include, defaults to every file below innerPath
+	InnerPath string   `json:"innerPath,omitempty"` // Directory to download when files is empty ("" = whole archive)
+	Strict    bool     `json:"strict,omitempty"`    // Abort the download when a member fails instead of listing it in _errors.txt
+
+	// How members are compressed in the ZIP: "deflate" (default), "store"
+	// or "copy-if-possible" (store already-compressed files, deflate the rest)
+	Compression string `json:"compression,omitempty"`
+
+	// Leave out the first members, in the order the download would send
+	// them, so a client resumes an interrupted download with the members
+	// it didn't receive completely
+	SkipMembers int `json:"skipMembers,omitempty"`
+}
+
+type DiffRequest struct {
+	URLA      string `json:"urlA"` // Old archive
+	PasswordA string `json:"passwordA,omitempty"`
+	URLB      string `json:"urlB"` // New archive
+	PasswordB string `json:"passwordB,omitempty"`
+}
+
+type DebugInfoRequest struct {
+	URL      string `json:"url"`
+	Password string `json:"password,omitempty"`
+}
+
+type CheckPasswordRequest struct {
+	URL      string `json:"url"`
+	Password string `json:"password,omitempty"`
+}
+
+type ValidateRequest struct {
+	URL string `json:"url"`
+}
+
 // ErrorResponse represents an API error response
 type ErrorResponse struct {
 	Error   string `json:"error"`
@@ -37,17 +115,129 @@ type ErrorResponse struct {
 
 // InfoResponse represents the response for /api/info
 type InfoResponse struct {
-	IsEncrypted      bool        `json:"isEncrypted"`
-	RequiresPassword bool        `json:"requiresPassword"`
-	TotalFiles       int         `json:"totalFiles"`
-	TotalSize        int64       `json:"totalSize"`
-	Format           string      `json:"format"`
-	Comment          string      `json:"comment,omitempty"`
+	IsEncrypted      bool              `json:"isEncrypted"`
+	RequiresPassword bool              `json:"requiresPassword"`
+	TotalFiles       int               `json:"totalFiles"`
+	TotalSize        int64             `json:"totalSize"`
+	RandomAccess     bool              `json:"randomAccess"`
+	Solid            bool              `json:"solid"`
+	ExactSizes       bool              `json:"exactSizes"`
+	Format           string            `json:"format"`
+	Comment          string            `json:"comment,omitempty"`
+	Metadata         map[string]string `json:"metadata,omitempty"`
+
+	// Compressed size of the members, or of the whole archive for formats
+	// not recording it per member, and its ratio to totalSize (0 when the
+	// archive has no data)
+	TotalCompressedSize int64   `json:"totalCompressedSize"`
+	CompressionRatio    float64 `json:"compressionRatio"`
 }
 
 // ListResponse represents the response for /api/list
 type ListResponse struct {
-	Files []FileEntryResponse `json:"files"`
+	Files      []FileEntryResponse `json:"files"`
+	NextCursor string              `json:"nextCursor,omitempty"` // Set when more entries follow this page
+	Sorted     bool                `json:"sorted,omitempty"`     // Whether the entries were sorted
+}
+
+// ExtractToResponse represents the response for /api/extract-to
+type ExtractToResponse struct {
+	File    string `json:"file"`
+	Target  string `json:"target"`
+	Size    int64  `json:"size"`
+	Written int64  `json:"written"`
+}
+
+// BrowseResponse represents the response for /api/browse
+type BrowseResponse struct {
+	Info    InfoResponse        `json:"info"`
+	Files   []FileEntryResponse `json:"files"`
+	Total   int                 `json:"total"` // Entries in innerPath before paging
+	Offset  int                 `json:"offset"`
+	Limit   int                 `json:"limit"`
+	Preview *PreviewResponse    `json:"preview,omitempty"`
+}
+
+// PreviewResponse holds the inline content of the file previewed by /api/browse
+type PreviewResponse struct {
+	File      string `json:"file"`
+	Size      int64  `json:"size"`
+	Content   []byte `json:"content,omitempty"`   // Base64 encoded in JSON
+	Truncated bool   `json:"truncated,omitempty"` // Content holds only the first maxPreviewSize bytes
+	Error     string `json:"error,omitempty"`
+	Code      string `json:"code,omitempty"`
+}
+
+// CheckPasswordResponse represents the response for /api/check-password
+type CheckPasswordResponse struct {
+	Encrypted bool   `json:"encrypted"` // False when the archive needs no password
+	Valid     bool   `json:"valid"`     // Always true when not encrypted
+	Format    string `json:"format"`
+}
+
+// ValidateResponse represents the response for /api/validate
+type ValidateResponse struct {
+	Valid         bool   `json:"valid"`
+	Format        string `json:"format,omitempty"`
+	Size          int64  `json:"size,omitempty"`
+	SupportsRange bool   `json:"supportsRange"`
+
+	// Nil when the format can't tell without reading its directory
+	RequiresPassword *bool `json:"requiresPassword,omitempty"`
+
+	// Why the URL isn't a usable archive, e.g. NOT_FOUND, and a message
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// HashResponse represents the response for /api/hash
+type HashResponse struct {
+	File      string `json:"file"`
+	Algorithm string `json:"algorithm"`
+	Hash      string `json:"hash"` // Lowercase hex digest
+	Size      int64  `json:"size"`
+}
+
+// DiffResponse represents the response for /api/diff
+type DiffResponse struct {
+	Changes   []FileChangeResponse `json:"changes"`
+	Added     int                  `json:"added"`
+	Removed   int                  `json:"removed"`
+	Changed   int                  `json:"changed"`
+	Unchanged int                  `json:"unchanged"`
+}
+
+// FileChangeResponse is a file that differs between the two archives of a diff
+type FileChangeResponse struct {
+	Change string             `json:"change"` // added, removed or changed
+	Path   string             `json:"path"`
+	Old    *FileEntryResponse `json:"old,omitempty"` // Entry in archive A, absent for added files
+	New    *FileEntryResponse `json:"new,omitempty"` // Entry in archive B, absent for removed files
+}
+
+// OperationResponse describes an operation in flight
+type OperationResponse struct {
+	RequestID        string `json:"requestId"`
+	Kind             string `json:"kind"` // extract, download, hash or extract-to
+	URL              string `json:"url"`
+	StartedAt        string `json:"startedAt"`
+	BytesTransferred int64  `json:"bytesTransferred"` // Written to the client or sink so far
+}
+
+// OperationsResponse represents the response for /api/admin/operations
+type OperationsResponse struct {
+	Operations []OperationResponse `json:"operations"`
+}
+
+// CancelOperationRequest represents a request to /api/admin/operations/cancel
+type CancelOperationRequest struct {
+	RequestID string `json:"requestId"`
+}
+
+// CancelOperationResponse represents the response for /api/admin/operations/cancel
+type CancelOperationResponse struct {
+	RequestID string `json:"requestId"`
+	Canceled  int    `json:"canceled"` // Operations canceled, more than one if clients reused the ID
 }
 
 // FileEntryResponse represents a file entry in the response
@@ -57,6 +247,17 @@ type FileEntryResponse struct {
 	CompressedSize int64     `json:"compressedSize"`
 	ModTime        time.Time `json:"modTime"`
 	IsDir          bool      `json:"isDir"`
+	Method         string    `json:"method,omitempty"`
+	IsEncrypted    bool      `json:"isEncrypted"`
+	UnsafePath     bool      `json:"unsafePath,omitempty"` // Absolute or ".." name that would escape an extraction directory
+
+	// Extended attributes from TAR PAX headers, e.g. "user.comment"
+	Xattrs map[string]string `json:"xattrs,omitempty"`
+
+	// Suspicious names (control characters, overlong) have Path escaped
+	// for display and the original name, to address the member, in RawPath
+	Suspicious bool   `json:"suspicious,omitempty"`
+	RawPath    string `json:"rawPath,omitempty"`
 }
 
 // respondJSON sends a JSON response
@@ -117,41 +318,266 @@ func (e *HandlerError) Error() string {
 	return e.Message
 }
 
+// newInfoResponse converts library archive info to response format
+func newInfoResponse(info *formats.ArchiveInfo, archive *lib.Archive) InfoResponse {
+	return InfoResponse{
+		IsEncrypted:      info.IsEncrypted,
+		RequiresPassword: info.RequiresPassword,
+		TotalFiles:       info.TotalFiles,
+		TotalSize:        info.TotalSize,
+		RandomAccess:     info.RandomAccess,
+		Solid:            info.Solid,
+		ExactSizes:       archive.ExactSizes(),
+		Format:           archive.Format(),
+		Comment:          info.Comment,
+		Metadata:         info.Metadata,
+
+		TotalCompressedSize: info.TotalCompressedSize,
+		CompressionRatio:    compressionRatio(info.TotalCompressedSize, info.TotalSize),
+	}
+}
+
+// compressionRatio returns compressed/uncompressed rounded to 4 decimal
+// places, or 0 for an archive without data
+func compressionRatio(compressed, uncompressed int64) float64 {
+	if uncompressed <= 0 {
+		return 0
+	}
+	return math.Round(float64(compressed)/float64(uncompressed)*10000) / 10000
+}
+
 // convertFileEntries converts library file entries to response format
-func convertFileEntries(entries []formats.FileEntry) []FileEntryResponse {
+func (h *Handler) convertFileEntries(entries []formats.FileEntry) []FileEntryResponse {
 	result := make([]FileEntryResponse, len(entries))
 	for i, entry := range entries {
-		result[i] = FileEntryResponse{
-			Path:           entry.Path,
-			Size:           entry.Size,
-			CompressedSize: entry.CompressedSize,
-			ModTime:        entry.ModTime,
-			IsDir:          entry.IsDir,
-		}
+		result[i] = h.convertFileEntry(entry)
 	}
 	return result
 }
 
+// convertFileEntry converts a single library file entry to response format
+func (h *Handler) convertFileEntry(entry formats.FileEntry) FileEntryResponse {
+	path := h.displayPath(entry.Path, entry.IsDir)
+	response := FileEntryResponse{
+		Path:           path,
+		Size:           entry.Size,
+		CompressedSize: entry.CompressedSize,
+		ModTime:        entry.ModTime,
+		IsDir:          entry.IsDir,
+		Method:         entry.Method,
+		IsEncrypted:    entry.IsEncrypted,
+		UnsafePath:     entry.UnsafePath,
+		Xattrs:         entry.Xattrs,
+	}
+	if sanitized, suspicious := utils.SanitizeName(path); suspicious {
+		response.Path = sanitized
+		response.Suspicious = true
+		response.RawPath = entry.Path
+	} else if utils.NormalizePath(path) != utils.NormalizePath(entry.Path) {
+		// e.g. a name stored with backslashes, which only the stored name
+		// addresses
+		response.RawPath = entry.Path
+	}
+	return response
+}
+
+// displayPath returns the path a member is listed under: the canonical
+// form with canonical paths enabled, the stored name otherwise
+func (h *Handler) displayPath(name string, isDir bool) string {
+	if !h.canonicalPaths {
+		return name
+	}
+	return utils.CanonicalPath(name, isDir)
+}
+
 // Handler provides the main HTTP handlers
 type Handler struct {
-	config *lib.Config
-	logger *zap.Logger
+	config      *lib.Config
+	logger      *zap.Logger
+	archives    *ArchiveLimiter
+	operations  *OperationRegistry
+	rangeBudget RangeBudget
+	sink        Sink          // nil unless write-through extraction is enabled
+	idleTimeout time.Duration // Longest a client may stall an extraction (0 = server write timeout only)
+	gzipExtract bool          // Gzip compressible /api/extract responses for clients accepting it
+
+	canonicalPaths bool // List members under utils.CanonicalPath instead of their stored names
+
+	forwardHeaders []string // Client headers sent on to the origin, canonical names
+
+	passwordRetries *PasswordRetryPool // nil = every /api/info request opens the archive
+
+	cursorSecret []byte // Signs /api/list cursors
+}
+
+// RangeBudget caps the range requests one API call may make to the origin,
+// per route (0 = no limit). It protects against archives crafted to
+// amplify a cheap request into thousands of upstream reads.
+type RangeBudget struct {
+	Info int // /api/info
+	List int // /api/list
 }
 
 // NewHandler creates a new Handler instance
 func NewHandler(config *lib.Config, logger *zap.Logger) *Handler {
 	return &Handler{
-		config: config,
-		logger: logger,
+		config:     config,
+		logger:     logger,
+		archives:   NewArchiveLimiter(0, 0),
+		operations: NewOperationRegistry(),
+
+		cursorSecret: randomCursorSecret(),
+	}
+}
+
+// WithArchiveLimiter sets the limiter that caps simultaneously open archives
+func (h *Handler) WithArchiveLimiter(limiter *ArchiveLimiter) *Handler {
+	h.archives = limiter
+	return h
+}
+
+// WithOperationRegistry sets the registry long-running operations are tracked in
+func (h *Handler) WithOperationRegistry(registry *OperationRegistry) *Handler {
+	h.operations = registry
+	return h
+}
+
+// WithRangeBudget sets the per-route limits on range requests
+func (h *Handler) WithRangeBudget(budget RangeBudget) *Handler {
+	h.rangeBudget = budget
+	return h
+}
+
+// requestConfig returns the library config for archives opened by r:
+// limited to maxRequests range requests per archive (0 = no limit), and
+// sending the allow-listed headers r carries on to the origin
+func (h *Handler) requestConfig(r *http.Request, maxRequests int) *lib.Config {
+	forwarded := h.forwardedHeaders(r)
+	if maxRequests <= 0 && len(forwarded) == 0 {
+		return h.config
+	}
+
+	config := h.config.Clone()
+	if maxRequests > 0 {
+		config.WithMaxRangeRequests(maxRequests)
+	}
+	if len(forwarded) > 0 {
+		for name, value := range forwarded {
+			config.WithHeader(name, value)
+		}
+		// Whether the origin answers may depend on the forwarded
+		// headers, so one client's 403 must not be replayed to another
+		config.WithOpenErrorCache(nil)
+	}
+	return config
+}
+
+// forwardedHeaders returns the allow-listed headers r carries
+func (h *Handler) forwardedHeaders(r *http.Request) map[string]string {
+	forwarded := make(map[string]string)
+	for _, name := range h.forwardHeaders {
+		if value := r.Header.Get(name); value != "" {
+			forwarded[name] = value
+		}
+	}
+	return forwarded
+}
+
+// neverForwarded are headers that describe the connection to this server
+// or identify the client to it, and are never sent on to an origin
+var neverForwarded = map[string]bool{
+	"Host":                true,
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"Content-Length":      true,
+	"Content-Type":        true,
+	"Range":               true,
+	"Accept-Encoding":     true,
+}
+
+// WithForwardHeaders sends the named headers of API requests on to the
+// origin when archives are fetched, e.g. a per-user token the client
+// holds. Only these headers are forwarded. Connection-level headers like
+// Host are never forwarded, and neither is any name in exclude, which
+// should list the API key headers.
+func (h *Handler) WithForwardHeaders(names []string, exclude ...string) *Handler {
+	excluded := make(map[string]bool)
+	for _, name := range exclude {
+		excluded[http.CanonicalHeaderKey(name)] = true
+	}
+
+	h.forwardHeaders = nil
+	for _, name := range names {
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if name == "" || neverForwarded[name] || excluded[name] {
+			h.logger.Warn("header is never forwarded to the origin", zap.String("header", name))
+			continue
+		}
+		h.forwardHeaders = append(h.forwardHeaders, name)
+	}
+	return h
+}
+
+// WithPasswordRetryPool keeps archives whose /api/info request needs a
+// password open in pool, for the client's retry with the password
+func (h *Handler) WithPasswordRetryPool(pool *PasswordRetryPool) *Handler {
+	h.passwordRetries = pool
+	return h
+}
+
+// WithExtractIdleTimeout makes /api/extract fail once the client accepts
+// no data for idle, and lets extractions that keep making progress run
+// past the server's write timeout
+func (h *Handler) WithExtractIdleTimeout(idle time.Duration) *Handler {
+	h.idleTimeout = idle
+	return h
+}
+
+// WithExtractGzip makes /api/extract gzip text members stored without
+// compression when the client sends Accept-Encoding: gzip
+func (h *Handler) WithExtractGzip(enabled bool) *Handler {
+	h.gzipExtract = enabled
+	return h
+}
+
+// WithCanonicalPaths lists members under their canonical paths: forward
+// slashes, no leading slash and a trailing slash only for directories.
+// Members whose stored name the canonical path doesn't address, like names
+// with backslashes, also get rawPath.
+func (h *Handler) WithCanonicalPaths(enabled bool) *Handler {
+	h.canonicalPaths = enabled
+	return h
+}
+
+// WithSink sets the destination for write-through extraction
+func (h *Handler) WithSink(sink Sink) *Handler {
+	h.sink = sink
+	return h
+}
+
+// WithCursorSecret sets the key /api/list cursors are signed with. Every
+// replica behind a load balancer needs the same secret to resume the
+// others' cursors; without one, a random key per process is used.
+func (h *Handler) WithCursorSecret(secret []byte) *Handler {
+	if len(secret) > 0 {
+		h.cursorSecret = secret
 	}
+	return h
 }
 
 // Health returns a simple health check handler
 func (h *Handler) Health() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		respondJSON(w, http.StatusOK, map[string]string{
-			"status": "ok",
-			"time":   time.Now().Format(time.RFC3339),
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"status":        "ok",
+			"time":          time.Now().Format(time.RFC3339),
+			"open_archives": h.archives.OpenCount(),
 		})
 	}
 }
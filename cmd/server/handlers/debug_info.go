@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/NORMAL-EX/stream-7z/lib"
+	"github.com/NORMAL-EX/stream-7z/lib/formats"
+	"go.uber.org/zap"
+)
+
+// DebugInfo handles POST /api/admin/debug-info requests. It returns the
+// archive's low-level structure as the format describes it (ZIP record
+// offsets, the 7z header and stream layout, TAR block offsets), so an
+// archive that won't list or extract can be diagnosed without collecting
+// server logs. Only registered in debug mode.
+func (h *Handler) DebugInfo() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req DebugInfoRequest
+		if err := parseJSONRequest(w, r, &req); err != nil {
+			return
+		}
+
+		if req.URL == "" {
+			respondError(w, http.StatusBadRequest, "url is required", "MISSING_URL")
+			return
+		}
+
+		release, ok := h.acquireArchive(w, r)
+		if !ok {
+			return
+		}
+		defer release()
+
+		h.logger.Info("reading archive debug info",
+			zap.String("url", lib.DisplayURL(req.URL)),
+			zap.Bool("has_password", req.Password != ""),
+		)
+
+		listReq := ListRequest{URL: req.URL, Password: req.Password}
+
+		archive, err := lib.NewArchiveWithContext(r.Context(), req.URL, h.requestConfig(r, 0))
+		if err != nil {
+			h.logger.Error("failed to open archive",
+				zap.String("url", lib.DisplayURL(req.URL)),
+				zap.Error(err),
+			)
+			h.respondListError(w, listReq, err)
+			return
+		}
+		defer archive.Close()
+
+		info, err := archive.DebugInfo(req.Password)
+		if err != nil {
+			h.logger.Error("failed to read archive debug info",
+				zap.String("url", lib.DisplayURL(req.URL)),
+				zap.Error(err),
+			)
+			if errors.Is(err, formats.ErrNotSupported) {
+				respondError(w, http.StatusNotImplemented, "Debug info is not available for "+archive.Format()+" archives", "DEBUG_INFO_UNAVAILABLE")
+				return
+			}
+			h.respondListError(w, listReq, err)
+			return
+		}
+
+		respondJSON(w, http.StatusOK, info)
+	}
+}
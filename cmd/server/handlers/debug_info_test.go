@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/NORMAL-EX/stream-7z/internal/testarchive"
+	"github.com/NORMAL-EX/stream-7z/lib"
+	"go.uber.org/zap"
+)
+
+func TestDebugInfo(t *testing.T) {
+	server := newArchiveServer(t, testarchive.Tar(t, testarchive.Files("a.txt", "b.txt")...))
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop())
+
+	rec := postJSON(h.DebugInfo(), "/api/admin/debug-info", DebugInfoRequest{URL: server.URL + "/test.tar"}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var info struct {
+		Format string `json:"format"`
+		Files  []struct {
+			Name         string `json:"name"`
+			HeaderOffset int64  `json:"headerOffset"`
+			DataOffset   int64  `json:"dataOffset"`
+		} `json:"files"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if info.Format != "tar" || len(info.Files) != 2 {
+		t.Fatalf("unexpected debug info %s", rec.Body.String())
+	}
+	if f := info.Files[1]; f.Name != "b.txt" || f.HeaderOffset == 0 || f.DataOffset != f.HeaderOffset+512 {
+		t.Errorf("unexpected entry %+v", f)
+	}
+
+	rec = postJSON(h.DebugInfo(), "/api/admin/debug-info", DebugInfoRequest{}, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without a url, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/NORMAL-EX/stream-7z/lib"
+	"github.com/NORMAL-EX/stream-7z/lib/utils"
+	"go.uber.org/zap"
+)
+
+// Diff handles POST /api/diff requests, reporting the files added, removed
+// and changed from archive A to archive B.
+// With "Accept: application/x-ndjson" each change is streamed as a
+// FileChangeResponse line while archive B is read, so large archives
+// never have to be collected into one response.
+func (h *Handler) Diff() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req DiffRequest
+		if err := parseJSONRequest(w, r, &req); err != nil {
+			return
+		}
+
+		if req.URLA == "" || req.URLB == "" {
+			respondError(w, http.StatusBadRequest, "urlA and urlB are required", "MISSING_URL")
+			return
+		}
+
+		// Both archives are open at once, so each takes a slot
+		releaseA, ok := h.acquireArchive(w, r)
+		if !ok {
+			return
+		}
+		defer releaseA()
+		releaseB, ok := h.acquireArchive(w, r)
+		if !ok {
+			return
+		}
+		defer releaseB()
+
+		h.logger.Info("comparing archives",
+			zap.String("url_a", lib.DisplayURL(req.URLA)),
+			zap.String("url_b", lib.DisplayURL(req.URLB)),
+		)
+
+		// Password errors can't be told apart by archive; any password
+		// given makes them "incorrect" rather than "required"
+		errReq := ListRequest{URL: req.URLA, Password: req.PasswordA}
+		if errReq.Password == "" {
+			errReq.Password = req.PasswordB
+		}
+
+		config := h.requestConfig(r, h.rangeBudget.List)
+		archiveA, err := lib.NewArchiveWithContext(r.Context(), req.URLA, config)
+		if err != nil {
+			h.logger.Error("failed to open archive", zap.String("url", lib.DisplayURL(req.URLA)), zap.Error(err))
+			h.respondListError(w, errReq, err)
+			return
+		}
+		defer archiveA.Close()
+
+		archiveB, err := lib.NewArchiveWithContext(r.Context(), req.URLB, config)
+		if err != nil {
+			h.logger.Error("failed to open archive", zap.String("url", lib.DisplayURL(req.URLB)), zap.Error(err))
+			h.respondListError(w, errReq, err)
+			return
+		}
+		defer archiveB.Close()
+
+		if acceptsNDJSON(r) {
+			h.streamDiff(w, req, errReq, archiveA, archiveB)
+			return
+		}
+
+		response := DiffResponse{Changes: make([]FileChangeResponse, 0)}
+		response.Unchanged, err = lib.WalkDiff(archiveA, archiveB, req.PasswordA, req.PasswordB, func(change lib.FileChange) error {
+			response.Changes = append(response.Changes, h.convertFileChange(change))
+			switch change.Kind {
+			case lib.ChangeAdded:
+				response.Added++
+			case lib.ChangeRemoved:
+				response.Removed++
+			default:
+				response.Changed++
+			}
+			return nil
+		})
+		if err != nil {
+			h.logger.Error("failed to compare archives",
+				zap.String("url_a", lib.DisplayURL(req.URLA)),
+				zap.String("url_b", lib.DisplayURL(req.URLB)),
+				zap.Error(err),
+			)
+			h.respondListError(w, errReq, err)
+			return
+		}
+
+		h.logger.Info("successfully compared archives",
+			zap.String("url_a", lib.DisplayURL(req.URLA)),
+			zap.String("url_b", lib.DisplayURL(req.URLB)),
+			zap.Int("added", response.Added),
+			zap.Int("removed", response.Removed),
+			zap.Int("changed", response.Changed),
+		)
+
+		respondJSON(w, http.StatusOK, response)
+	}
+}
+
+// streamDiff writes the changes as newline-delimited JSON. Like
+// streamList, a failure after the first line is reported as a final
+// ErrorResponse line.
+func (h *Handler) streamDiff(w http.ResponseWriter, req DiffRequest, errReq ListRequest, archiveA, archiveB *lib.Archive) {
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+
+	count := 0
+	_, err := lib.WalkDiff(archiveA, archiveB, req.PasswordA, req.PasswordB, func(change lib.FileChange) error {
+		if count == 0 {
+			w.Header().Set("Content-Type", ndjsonContentType)
+			w.WriteHeader(http.StatusOK)
+		}
+		count++
+
+		if err := encoder.Encode(h.convertFileChange(change)); err != nil {
+			return err
+		}
+		if flusher != nil && count%ndjsonFlushInterval == 0 {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		h.logger.Error("failed to stream archive comparison",
+			zap.String("url_a", lib.DisplayURL(req.URLA)),
+			zap.String("url_b", lib.DisplayURL(req.URLB)),
+			zap.Int("change_count", count),
+			zap.Error(err),
+		)
+
+		if count == 0 {
+			h.respondListError(w, errReq, err)
+			return
+		}
+		encoder.Encode(ErrorResponse{
+			Error: "Comparison stopped before completion",
+			Code:  "LISTING_INCOMPLETE",
+		})
+		return
+	}
+
+	if count == 0 {
+		w.Header().Set("Content-Type", ndjsonContentType)
+		w.WriteHeader(http.StatusOK)
+	}
+
+	h.logger.Info("successfully streamed archive comparison",
+		zap.String("url_a", lib.DisplayURL(req.URLA)),
+		zap.String("url_b", lib.DisplayURL(req.URLB)),
+		zap.Int("change_count", count),
+	)
+}
+
+// convertFileChange converts a library file change to response format
+func (h *Handler) convertFileChange(change lib.FileChange) FileChangeResponse {
+	isDir := (change.New != nil && change.New.IsDir) || (change.Old != nil && change.Old.IsDir)
+	path, _ := utils.SanitizeName(h.displayPath(change.Path, isDir))
+	response := FileChangeResponse{
+		Change: string(change.Kind),
+		Path:   path,
+	}
+	if change.Old != nil {
+		old := h.convertFileEntry(*change.Old)
+		response.Old = &old
+	}
+	if change.New != nil {
+		entry := h.convertFileEntry(*change.New)
+		response.New = &entry
+	}
+	return response
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/NORMAL-EX/stream-7z/internal/testarchive"
+	"github.com/NORMAL-EX/stream-7z/lib"
+	"go.uber.org/zap"
+)
+
+func TestDiff(t *testing.T) {
+	serverA := newArchiveServer(t, testarchive.Tar(t, testarchive.Files("a.txt", "b.txt")...))
+	serverB := newArchiveServer(t, testarchive.Tar(t, testarchive.Files("a.txt", "c.txt")...))
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop())
+	req := DiffRequest{URLA: serverA.URL + "/a.tar", URLB: serverB.URL + "/b.tar"}
+
+	rec := postJSON(h.Diff(), "/api/diff", req, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp DiffResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.Added != 1 || resp.Removed != 1 || resp.Changed != 0 || resp.Unchanged != 1 || len(resp.Changes) != 2 {
+		t.Fatalf("unexpected diff %+v", resp)
+	}
+	if c := resp.Changes[0]; c.Change != "added" || c.Path != "c.txt" || c.Old != nil || c.New == nil {
+		t.Errorf("expected c.txt to be added, got %+v", c)
+	}
+	if c := resp.Changes[1]; c.Change != "removed" || c.Path != "b.txt" || c.Old == nil || c.New != nil {
+		t.Errorf("expected b.txt to be removed, got %+v", c)
+	}
+
+	// Streamed, one change per line
+	rec = postJSON(h.Diff(), "/api/diff", req, http.Header{"Accept": {ndjsonContentType}})
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != ndjsonContentType {
+		t.Fatalf("expected a streamed 200, got %d %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n"); len(lines) != 2 {
+		t.Errorf("expected 2 lines, got %q", rec.Body.String())
+	}
+
+	if rec := postJSON(h.Diff(), "/api/diff", DiffRequest{URLA: req.URLA}, nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without urlB, got %d", rec.Code)
+	}
+}
+
+func TestDiffTakesASlotPerArchive(t *testing.T) {
+	dataA, dataB := testarchive.Tar(t, testarchive.Files("a.txt")...), testarchive.Tar(t, testarchive.Files("b.txt")...)
+	limiter := NewArchiveLimiter(2, 0)
+	var maxOpen int64
+	serve := func(data []byte) *httptest.Server {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if open := limiter.OpenCount(); open > atomic.LoadInt64(&maxOpen) {
+				atomic.StoreInt64(&maxOpen, open)
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+		}))
+		t.Cleanup(server.Close)
+		return server
+	}
+	req := DiffRequest{URLA: serve(dataA).URL + "/a.tar", URLB: serve(dataB).URL + "/b.tar"}
+
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop()).WithArchiveLimiter(limiter)
+	if rec := postJSON(h.Diff(), "/api/diff", req, nil); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if n := atomic.LoadInt64(&maxOpen); n != 2 {
+		t.Errorf("expected 2 archive slots held while comparing, got %d", n)
+	}
+	if n := limiter.OpenCount(); n != 0 {
+		t.Errorf("expected both slots released, %d still held", n)
+	}
+
+	// One free slot isn't enough for two archives
+	h.WithArchiveLimiter(NewArchiveLimiter(1, 0))
+	rec := postJSON(h.Diff(), "/api/diff", req, nil)
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "TOO_MANY_ARCHIVES") {
+		t.Errorf("expected 503 TOO_MANY_ARCHIVES with one slot, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
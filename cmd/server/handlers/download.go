@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/NORMAL-EX/stream-7z/lib"
+	"github.com/NORMAL-EX/stream-7z/lib/formats"
+	"github.com/NORMAL-EX/stream-7z/lib/utils"
+	"go.uber.org/zap"
+)
+
+// downloadErrorsName is the manifest added to a download when members fail
+const downloadErrorsName = "_errors.txt"
+
+// Values of DownloadRequest.Compression
+const (
+	compressionDeflate        = "deflate"
+	compressionStore          = "store"
+	compressionCopyIfPossible = "copy-if-possible"
+)
+
+// precompressedExtensions are file types whose content is already
+// compressed, so deflating them again costs CPU for next to no gain
+var precompressedExtensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true, ".heic": true, ".avif": true,
+	".mp4": true, ".m4v": true, ".mkv": true, ".mov": true, ".webm": true, ".avi": true,
+	".mp3": true, ".m4a": true, ".aac": true, ".ogg": true, ".opus": true, ".flac": true,
+	".zip": true, ".7z": true, ".rar": true, ".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".zst": true,
+	".docx": true, ".xlsx": true, ".pptx": true, ".epub": true, ".jar": true, ".apk": true,
+}
+
+// Download handles POST /api/download requests. The selected members are
+// extracted and streamed back as a new ZIP, whatever the source format.
+//
+// Members are only known to fail once the response has started, when the
+// status can't be changed anymore. By default failed members are skipped
+// and listed in an _errors.txt manifest at the end of the ZIP. With strict
+// set the connection is aborted instead, so the truncated download fails
+// visibly rather than looking complete.
+//
+// Members are always sent in archive order, and the X-Download-Members
+// header counts them before skipMembers is applied. A client whose
+// download broke off can request the rest with skipMembers set to the
+// members it received completely. The response is a new ZIP with its own
+// central directory, not a continuation of the broken one, so resuming
+// is best effort: the client has to merge the members itself.
+func (h *Handler) Download() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req DownloadRequest
+		if err := parseJSONRequest(w, r, &req); err != nil {
+			return
+		}
+
+		if req.URL == "" {
+			respondError(w, http.StatusBadRequest, "url is required", "MISSING_URL")
+			return
+		}
+
+		for _, file := range req.Files {
+			if !utils.IsValidPath(file) {
+				respondError(w, http.StatusBadRequest, "Invalid file path", "INVALID_PATH")
+				return
+			}
+		}
+
+		if req.SkipMembers < 0 {
+			respondError(w, http.StatusBadRequest, "skipMembers cannot be negative", "INVALID_SKIP")
+			return
+		}
+
+		switch req.Compression {
+		case "":
+			req.Compression = compressionDeflate
+		case compressionDeflate, compressionStore, compressionCopyIfPossible:
+		default:
+			respondError(w, http.StatusBadRequest, "compression must be deflate, store or copy-if-possible", "INVALID_COMPRESSION")
+			return
+		}
+
+		r, op := h.operations.Start(r, "download", req.URL)
+		defer op.Finish()
+
+		release, ok := h.acquireArchive(w, r)
+		if !ok {
+			return
+		}
+		defer release()
+
+		h.logger.Info("downloading archive members as zip",
+			zap.String("url", lib.DisplayURL(req.URL)),
+			zap.String("inner_path", req.InnerPath),
+			zap.Int("requested_files", len(req.Files)),
+			zap.Bool("strict", req.Strict),
+			zap.String("compression", req.Compression),
+			zap.Int("skip_members", req.SkipMembers),
+			zap.Bool("has_password", req.Password != ""),
+		)
+
+		listReq := ListRequest{URL: req.URL, Password: req.Password, InnerPath: req.InnerPath}
+
+		// Members are extracted in archive order, so TAR decompresses once
+		archive, err := lib.NewArchiveWithContext(r.Context(), req.URL, h.requestConfig(r, 0).Clone().WithSequentialExtraction(true))
+		if err != nil {
+			h.logger.Error("failed to open archive",
+				zap.String("url", lib.DisplayURL(req.URL)),
+				zap.Error(err),
+			)
+			h.respondListError(w, listReq, err)
+			return
+		}
+		defer archive.Close()
+
+		info, err := archive.GetInfo(req.Password)
+		if err != nil {
+			h.logger.Error("failed to get archive info",
+				zap.String("url", lib.DisplayURL(req.URL)),
+				zap.Error(err),
+			)
+			h.respondListError(w, listReq, err)
+			return
+		}
+
+		members, missing := selectDownloadMembers(info.Files, req.Files, req.InnerPath)
+		if missing != "" {
+			respondError(w, http.StatusNotFound, "File not found in archive: "+missing, "FILE_NOT_FOUND")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", contentDisposition(downloadName(req)))
+		w.Header().Set("X-Download-Members", strconv.Itoa(len(members)))
+		w.WriteHeader(http.StatusOK)
+
+		if req.SkipMembers >= len(members) {
+			members = nil
+		} else {
+			members = members[req.SkipMembers:]
+		}
+
+		zw := zip.NewWriter(op.Writer(w))
+		var failures []string
+		var written int64
+		for _, member := range members {
+			n, err := h.writeDownloadMember(zw, archive, member, req.Password, req.Compression)
+			written += n
+			if err == nil {
+				continue
+			}
+
+			h.logger.Warn("failed to add member to download",
+				append([]zap.Field{
+					zap.String("url", lib.DisplayURL(req.URL)),
+					zap.String("file_path", member.Path),
+					zap.Int64("written", n),
+					zap.Bool("strict", req.Strict),
+					zap.Error(err),
+				}, extractErrorFields(err)...)...,
+			)
+			if req.Strict {
+				// Without the central directory the client sees a broken ZIP
+				panic(http.ErrAbortHandler)
+			}
+
+			_, message, code := classifyExtractError(err, req.Password)
+			failures = append(failures, fmt.Sprintf("%s: %s (%s)", member.Path, message, code))
+		}
+
+		if len(failures) > 0 {
+			if manifest, err := zw.Create(downloadErrorsName); err == nil {
+				io.WriteString(manifest, strings.Join(failures, "\n")+"\n")
+			}
+		}
+		if err := zw.Close(); err != nil {
+			h.logger.Error("failed to finish download",
+				zap.String("url", lib.DisplayURL(req.URL)),
+				zap.Error(err),
+			)
+			return
+		}
+
+		h.logger.Info("successfully downloaded archive members",
+			zap.String("url", lib.DisplayURL(req.URL)),
+			zap.Int("file_count", len(members)-len(failures)),
+			zap.Int("failed_count", len(failures)),
+			zap.Int64("written", written),
+		)
+	}
+}
+
+// writeDownloadMember copies one member into zw. A member failing after
+// some of its bytes were written stays in the ZIP truncated.
+func (h *Handler) writeDownloadMember(zw *zip.Writer, archive *lib.Archive, member formats.FileEntry, password string, compression string) (int64, error) {
+	reader, _, err := archive.ExtractFile(member.Path, password)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	dst, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     utils.NormalizePath(member.Path),
+		Method:   downloadMethod(compression, member.Path),
+		Modified: member.ModTime,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return copyPooled(dst, reader)
+}
+
+// downloadMethod picks the ZIP method for a member under compression
+func downloadMethod(compression string, name string) uint16 {
+	switch compression {
+	case compressionStore:
+		return zip.Store
+	case compressionCopyIfPossible:
+		if precompressedExtensions[strings.ToLower(path.Ext(name))] {
+			return zip.Store
+		}
+	}
+	return zip.Deflate
+}
+
+// selectDownloadMembers returns the entries named by files, or with no
+// files every file below innerPath, in archive order. missing is the first
+// requested file that isn't in the archive.
+func selectDownloadMembers(entries []formats.FileEntry, files []string, innerPath string) (members []formats.FileEntry, missing string) {
+	if len(files) > 0 {
+		wanted := make(map[string]bool, len(files))
+		for _, file := range files {
+			wanted[utils.NormalizePath(file)] = true
+		}
+		for _, entry := range entries {
+			name := utils.NormalizePath(entry.Path)
+			if !entry.IsDir && wanted[name] {
+				members = append(members, entry)
+				delete(wanted, name)
+			}
+		}
+		for _, file := range files {
+			if wanted[utils.NormalizePath(file)] {
+				return nil, file
+			}
+		}
+		return members, ""
+	}
+
+	prefix := utils.NormalizePath(innerPath)
+	for _, entry := range entries {
+		if entry.IsDir {
+			continue
+		}
+		if prefix != "." && !strings.HasPrefix(utils.NormalizePath(entry.Path), prefix+"/") {
+			continue
+		}
+		members = append(members, entry)
+	}
+	return members, ""
+}
+
+// downloadName names the ZIP after the selected directory or the archive
+func downloadName(req DownloadRequest) string {
+	name := path.Base(utils.NormalizePath(req.InnerPath))
+	if name == "." {
+		if u, err := url.Parse(req.URL); err == nil {
+			name = path.Base(u.Path)
+		}
+		if ext := path.Ext(name); ext != "" {
+			name = strings.TrimSuffix(name, ext)
+		}
+	}
+	if name == "." || name == "/" || name == "" {
+		name = "download"
+	}
+	return name + ".zip"
+}
@@ -0,0 +1,233 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/NORMAL-EX/stream-7z/internal/testarchive"
+	"github.com/NORMAL-EX/stream-7z/lib"
+	"github.com/NORMAL-EX/stream-7z/lib/formats"
+	"go.uber.org/zap"
+)
+
+// brokenFormat is an archive of two members where bad.txt is corrupt
+type brokenFormat struct{}
+
+const brokenMagic = "BROKEN01"
+
+func (brokenFormat) Name() string         { return "broken" }
+func (brokenFormat) Extensions() []string { return []string{".broken"} }
+
+func (brokenFormat) Detect(ctx context.Context, reader io.ReaderAt, size int64) (bool, error) {
+	magic := make([]byte, len(brokenMagic))
+	if _, err := reader.ReadAt(magic, 0); err != nil {
+		return false, err
+	}
+	return string(magic) == brokenMagic, nil
+}
+
+func (f brokenFormat) GetInfo(ctx context.Context, reader io.ReaderAt, size int64, password string) (*formats.ArchiveInfo, error) {
+	files, _ := f.ListFiles(ctx, reader, size, "", password)
+	return &formats.ArchiveInfo{TotalFiles: len(files), Files: files}, nil
+}
+
+func (brokenFormat) ListFiles(ctx context.Context, reader io.ReaderAt, size int64, innerPath string, password string) ([]formats.FileEntry, error) {
+	return []formats.FileEntry{{Path: "bad.txt", Size: 3}, {Path: "good.txt", Size: 4}}, nil
+}
+
+func (brokenFormat) ExtractFile(ctx context.Context, reader io.ReaderAt, size int64, filePath string, password string) (io.ReadCloser, int64, error) {
+	switch filePath {
+	case "good.txt":
+		return io.NopCloser(strings.NewReader("good")), 4, nil
+	case "bad.txt":
+		return nil, 0, errors.New("corrupt member data")
+	}
+	return nil, 0, formats.ErrFileNotFound
+}
+
+func TestDownloadListsFailedMembers(t *testing.T) {
+	registerTestFormat(t, brokenFormat{})
+	server := newArchiveServer(t, []byte(brokenMagic+"padding"))
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop())
+
+	rec := postJSON(h.Download(), "/api/download", DownloadRequest{URL: server.URL + "/test.broken"}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if cd := rec.Header().Get("Content-Disposition"); cd != `attachment; filename="test.zip"` {
+		t.Errorf("unexpected Content-Disposition %q", cd)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatalf("download is not a valid zip: %v", err)
+	}
+
+	contents := make(map[string]string)
+	for _, file := range zr.File {
+		rc, err := file.Open()
+		if err != nil {
+			t.Fatalf("failed to open %s: %v", file.Name, err)
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		contents[file.Name] = string(data)
+	}
+
+	if contents["good.txt"] != "good" {
+		t.Errorf("expected good.txt to be included, got %q", contents["good.txt"])
+	}
+	if _, ok := contents["bad.txt"]; ok {
+		t.Errorf("expected bad.txt to be left out")
+	}
+	if !strings.HasPrefix(contents[downloadErrorsName], "bad.txt: ") {
+		t.Errorf("expected %s to list bad.txt, got %q", downloadErrorsName, contents[downloadErrorsName])
+	}
+}
+
+func TestDownloadStrictAborts(t *testing.T) {
+	registerTestFormat(t, brokenFormat{})
+	archiveServer := newArchiveServer(t, []byte(brokenMagic+"padding"))
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop())
+
+	server := httptest.NewServer(RecoveryMiddleware(zap.NewNop())(h.Download()))
+	t.Cleanup(server.Close)
+
+	payload, _ := json.Marshal(DownloadRequest{URL: archiveServer.URL + "/test.broken", Strict: true})
+	resp, err := http.Post(server.URL, "application/json", bytes.NewReader(payload))
+	if err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Fatalf("expected a strict download with a failed member to be cut off")
+	}
+}
+
+func TestSelectDownloadMembers(t *testing.T) {
+	entries := []formats.FileEntry{
+		{Path: "readme.txt"},
+		{Path: "docs/", IsDir: true},
+		{Path: "docs/a.txt"},
+		{Path: "docs/sub/b.txt"},
+		{Path: "docsextra/c.txt"},
+	}
+
+	paths := func(members []formats.FileEntry) string {
+		var names []string
+		for _, m := range members {
+			names = append(names, m.Path)
+		}
+		return strings.Join(names, ",")
+	}
+
+	if members, _ := selectDownloadMembers(entries, nil, ""); paths(members) != "readme.txt,docs/a.txt,docs/sub/b.txt,docsextra/c.txt" {
+		t.Errorf("whole archive: got %s", paths(members))
+	}
+	if members, _ := selectDownloadMembers(entries, nil, "/docs/"); paths(members) != "docs/a.txt,docs/sub/b.txt" {
+		t.Errorf("innerPath docs: got %s", paths(members))
+	}
+	if members, _ := selectDownloadMembers(entries, []string{"docs/sub/b.txt", "/readme.txt"}, ""); paths(members) != "readme.txt,docs/sub/b.txt" {
+		t.Errorf("explicit files: got %s", paths(members))
+	}
+	if _, missing := selectDownloadMembers(entries, []string{"readme.txt", "nope.txt"}, ""); missing != "nope.txt" {
+		t.Errorf("expected nope.txt to be reported missing, got %q", missing)
+	}
+}
+
+func TestDownloadCompression(t *testing.T) {
+	server := newArchiveServer(t, testarchive.Tar(t, testarchive.Files("notes.txt", "photo.jpg")...))
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop())
+
+	methods := func(compression string) map[string]uint16 {
+		t.Helper()
+		rec := postJSON(h.Download(), "/api/download", DownloadRequest{URL: server.URL + "/test.tar", Compression: compression}, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", compression, rec.Code, rec.Body.String())
+		}
+		zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+		if err != nil {
+			t.Fatalf("%s: download is not a valid zip: %v", compression, err)
+		}
+		found := make(map[string]uint16)
+		for _, file := range zr.File {
+			rc, err := file.Open()
+			if err != nil {
+				t.Fatalf("%s: failed to open %s: %v", compression, file.Name, err)
+			}
+			data, _ := io.ReadAll(rc)
+			rc.Close()
+			if string(data) != "content of "+file.Name {
+				t.Errorf("%s: unexpected content of %s: %q", compression, file.Name, data)
+			}
+			if file.Method == zip.Store && file.CompressedSize64 != file.UncompressedSize64 {
+				t.Errorf("%s: stored %s was recompressed", compression, file.Name)
+			}
+			found[file.Name] = file.Method
+		}
+		return found
+	}
+
+	if m := methods("store"); m["notes.txt"] != zip.Store || m["photo.jpg"] != zip.Store {
+		t.Errorf("store: expected every member stored, got %v", m)
+	}
+	if m := methods(""); m["notes.txt"] != zip.Deflate || m["photo.jpg"] != zip.Deflate {
+		t.Errorf("default: expected every member deflated, got %v", m)
+	}
+	if m := methods("copy-if-possible"); m["notes.txt"] != zip.Deflate || m["photo.jpg"] != zip.Store {
+		t.Errorf("copy-if-possible: expected only the jpg stored, got %v", m)
+	}
+
+	rec := postJSON(h.Download(), "/api/download", DownloadRequest{URL: server.URL + "/test.tar", Compression: "brotli"}, nil)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "INVALID_COMPRESSION") {
+		t.Errorf("expected 400 INVALID_COMPRESSION, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestDownloadSkipMembers(t *testing.T) {
+	server := newArchiveServer(t, testarchive.Tar(t, testarchive.Files("a.txt", "b.txt", "c.txt", "d.txt")...))
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop())
+
+	download := func(skip int) []string {
+		t.Helper()
+		rec := postJSON(h.Download(), "/api/download", DownloadRequest{URL: server.URL + "/test.tar", SkipMembers: skip}, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200 skipping %d, got %d: %s", skip, rec.Code, rec.Body.String())
+		}
+		if total := rec.Header().Get("X-Download-Members"); total != "4" {
+			t.Errorf("expected X-Download-Members 4 skipping %d, got %q", skip, total)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+		if err != nil {
+			t.Fatalf("download is not a valid zip: %v", err)
+		}
+		var names []string
+		for _, file := range zr.File {
+			names = append(names, file.Name)
+		}
+		return names
+	}
+
+	if names := download(0); strings.Join(names, ",") != "a.txt,b.txt,c.txt,d.txt" {
+		t.Errorf("expected every member in archive order, got %v", names)
+	}
+	if names := download(2); strings.Join(names, ",") != "c.txt,d.txt" {
+		t.Errorf("expected the members after the first 2, got %v", names)
+	}
+	if names := download(10); len(names) != 0 {
+		t.Errorf("expected an empty zip skipping past the end, got %v", names)
+	}
+
+	rec := postJSON(h.Download(), "/api/download", DownloadRequest{URL: server.URL + "/test.tar", SkipMembers: -1}, nil)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "INVALID_SKIP") {
+		t.Errorf("expected INVALID_SKIP for a negative skip, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
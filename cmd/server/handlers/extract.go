@@ -1,13 +1,21 @@
 package handlers
 
 import (
+	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/NORMAL-EX/stream-7z/lib"
+	"github.com/NORMAL-EX/stream-7z/lib/formats"
+	"github.com/NORMAL-EX/stream-7z/lib/rangehttp"
+	"github.com/NORMAL-EX/stream-7z/lib/utils"
 	"go.uber.org/zap"
 )
 
@@ -31,40 +39,42 @@ func (h *Handler) Extract() http.HandlerFunc {
 			return
 		}
 
+		r, op := h.operations.Start(r, "extract", req.URL)
+		defer op.Finish()
+
+		release, ok := h.acquireArchive(w, r)
+		if !ok {
+			return
+		}
+		defer release()
+
 		h.logger.Info("extracting file from archive",
-			zap.String("url", req.URL),
+			zap.String("url", lib.DisplayURL(req.URL)),
 			zap.String("file_path", req.File),
 			zap.Bool("has_password", req.Password != ""),
 		)
 
-		// Extract file using QuickExtract
-		reader, size, err := lib.QuickExtract(req.URL, req.File, req.Password, h.config)
+		archive, err := lib.NewArchiveWithContext(r.Context(), req.URL, h.requestConfig(r, 0))
 		if err != nil {
-			h.logger.Error("failed to extract file",
-				zap.String("url", req.URL),
-				zap.String("file_path", req.File),
+			h.logger.Error("failed to open archive",
+				zap.String("url", lib.DisplayURL(req.URL)),
 				zap.Error(err),
 			)
+			h.respondExtractError(w, req, err)
+			return
+		}
+		defer archive.Close()
 
-			// Determine error type
-			errMsg := err.Error()
-			if strings.Contains(errMsg, "password") {
-				if req.Password != "" {
-					respondError(w, http.StatusUnauthorized, "Incorrect password", "WRONG_PASSWORD")
-				} else {
-					respondError(w, http.StatusUnauthorized, "Password required", "PASSWORD_REQUIRED")
-				}
-			} else if strings.Contains(errMsg, "not found") {
-				respondError(w, http.StatusNotFound, "File not found in archive", "FILE_NOT_FOUND")
-			} else if strings.Contains(errMsg, "unsupported") || strings.Contains(errMsg, "format") {
-				respondError(w, http.StatusBadRequest, "Unsupported archive format", "UNSUPPORTED_FORMAT")
-			} else if strings.Contains(errMsg, "URL") || strings.Contains(errMsg, "request failed") {
-				respondError(w, http.StatusBadRequest, "Failed to access URL", "URL_ERROR")
-			} else if strings.Contains(errMsg, "path traversal") {
-				respondError(w, http.StatusBadRequest, "Invalid file path", "INVALID_PATH")
-			} else {
-				respondError(w, http.StatusInternalServerError, "Failed to extract file", "INTERNAL_ERROR")
-			}
+		reader, size, err := archive.ExtractFile(req.File, req.Password)
+		if err != nil {
+			h.logger.Error("failed to extract file",
+				append([]zap.Field{
+					zap.String("url", lib.DisplayURL(req.URL)),
+					zap.String("file_path", req.File),
+					zap.Error(err),
+				}, extractErrorFields(err)...)...,
+			)
+			h.respondExtractError(w, req, err)
 			return
 		}
 		defer reader.Close()
@@ -74,26 +84,265 @@ func (h *Handler) Extract() http.HandlerFunc {
 
 		// Set headers for file download
 		w.Header().Set("Content-Type", "application/octet-stream")
-		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
+		w.Header().Set("Content-Disposition", contentDisposition(filename))
+
+		// Compressed on the fly, so the length of the response isn't
+		// known. Range requests are never answered gzipped: the range
+		// would have to address the compressed bytes.
+		gzipped := false
+		if h.gzipExtract {
+			w.Header().Add("Vary", "Accept-Encoding")
+			gzipped = r.Header.Get("Range") == "" && acceptsGzip(r) && compressibleMember(archive, req.File, req.Password)
+		}
+
+		// A wrong Content-Length makes clients hang or truncate the file;
+		// without one the response is chunked and ends with the stream
+		if gzipped {
+			w.Header().Set("Content-Encoding", "gzip")
+		} else if size >= 0 && archive.ExactSizes() {
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
+		}
 
 		// Stream file to response
-		written, err := io.Copy(w, reader)
+		var dst io.Writer = op.Writer(w)
+		var gz *gzip.Writer
+		if gzipped {
+			gz = gzip.NewWriter(dst)
+			dst = gz
+		}
+		written, err := copyWithIdleTimeout(w, dst, reader, h.idleTimeout)
+		if err == nil && gz != nil {
+			err = gz.Close()
+		}
 		if err != nil {
 			h.logger.Error("failed to stream file",
-				zap.String("url", req.URL),
-				zap.String("file_path", req.File),
-				zap.Int64("written", written),
-				zap.Error(err),
+				append([]zap.Field{
+					zap.String("url", lib.DisplayURL(req.URL)),
+					zap.String("file_path", req.File),
+					zap.Int64("written", written),
+					zap.Error(err),
+				}, extractErrorFields(err)...)...,
 			)
 			return
 		}
 
 		h.logger.Info("successfully extracted file",
-			zap.String("url", req.URL),
+			zap.String("url", lib.DisplayURL(req.URL)),
 			zap.String("file_path", req.File),
 			zap.Int64("size", size),
 			zap.Int64("written", written),
+			zap.Bool("gzipped", gzipped),
 		)
 	}
 }
+
+// compressibleExtensions are text file types worth gzipping that
+// mime.TypeByExtension doesn't know on every system
+var compressibleExtensions = map[string]bool{
+	".txt": true, ".log": true, ".csv": true, ".tsv": true, ".md": true, ".json": true, ".xml": true,
+	".yaml": true, ".yml": true, ".toml": true, ".ini": true, ".conf": true, ".cfg": true, ".properties": true,
+	".html": true, ".htm": true, ".css": true, ".js": true, ".svg": true, ".sql": true, ".sh": true,
+}
+
+// acceptsGzip reports whether the client accepts a gzip Content-Encoding
+func acceptsGzip(r *http.Request) bool {
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+				continue
+			}
+			// gzip;q=0 explicitly refuses it
+			for _, param := range strings.Split(params, ";") {
+				key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if strings.EqualFold(key, "q") {
+					if q, err := strconv.ParseFloat(value, 64); err == nil && q == 0 {
+						return false
+					}
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// compressibleMember reports whether filePath is worth gzipping: a text
+// type by its extension, not a known compressed type, and, when the
+// archive's directory is cached, stored in the archive without
+// compression. Members the archive compressed are sent as they are.
+func compressibleMember(archive *lib.Archive, filePath string, password string) bool {
+	ext := strings.ToLower(path.Ext(filePath))
+	if precompressedExtensions[ext] {
+		return false
+	}
+	if !compressibleExtensions[ext] && !compressibleType(mime.TypeByExtension(ext)) {
+		return false
+	}
+	if entry, ok := archive.CachedEntry(filePath, password); ok {
+		switch entry.Method {
+		case "", "Store", "none":
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// compressibleType reports whether contentType is a text type
+func compressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"),
+		mediaType == "application/json", mediaType == "application/xml", mediaType == "application/javascript":
+		return true
+	}
+	return false
+}
+
+// respondExtractError maps an extraction failure to an error response
+func (h *Handler) respondExtractError(w http.ResponseWriter, req ExtractRequest, err error) {
+	status, message, code := classifyExtractError(err, req.Password)
+	respondError(w, status, message, code)
+}
+
+// classifyExtractError returns the status, message and code reported for
+// an extraction failure
+func classifyExtractError(err error, password string) (int, string, string) {
+	return classifyArchiveError(err, password, extractErrorNames)
+}
+
+// archiveErrorNames is what an endpoint's error responses call a member
+// or path that doesn't exist, and a failure not classified otherwise
+type archiveErrorNames struct {
+	notFound     string
+	notFoundCode string
+	failed       string
+}
+
+var (
+	extractErrorNames = archiveErrorNames{"File not found in archive", "FILE_NOT_FOUND", "Failed to extract file"}
+	listErrorNames    = archiveErrorNames{"Path not found in archive", "PATH_NOT_FOUND", "Failed to list files"}
+	infoErrorNames    = archiveErrorNames{"Path not found in archive", "PATH_NOT_FOUND", "Failed to get archive info"}
+)
+
+// classifyArchiveError returns the status, message and code reported for
+// a failure to open, list or extract from an archive. Every endpoint maps
+// errors through it, so they all report a failure the same way.
+func classifyArchiveError(err error, password string, names archiveErrorNames) (int, string, string) {
+	// Determine error type; the member path is part of extraction
+	// errors, so check the sentinels before matching on the message
+	errMsg := err.Error()
+	switch {
+	case errors.Is(err, utils.ErrNotAnArchive):
+		return http.StatusBadRequest, "The URL returned a web page, not an archive file", "NOT_AN_ARCHIVE"
+	case errors.Is(err, formats.ErrEncryptedContainer):
+		return http.StatusBadRequest, "The file is encrypted as a whole; decrypt it before opening", "ENCRYPTED_CONTAINER"
+	case errors.Is(err, utils.ErrRangeBudgetExceeded):
+		return http.StatusRequestEntityTooLarge, "Archive is too fragmented to read within the range request limit", "ARCHIVE_TOO_FRAGMENTED"
+	case errors.Is(err, utils.ErrRangeNotSupported):
+		return http.StatusBadGateway, "The server does not support range requests and the archive is too large to download", "RANGE_NOT_SUPPORTED"
+	case errors.Is(err, utils.ErrArchiveChanged):
+		return http.StatusConflict, "The archive changed on the server while it was being read", "ARCHIVE_CHANGED"
+	case errors.Is(err, utils.ErrRetryBudgetExceeded):
+		return http.StatusBadGateway, "The archive server kept failing; gave up after the retry budget was spent", "ORIGIN_UNAVAILABLE"
+	case errors.Is(err, utils.ErrUnknownSize):
+		return http.StatusBadGateway, "The archive server reported the file size neither for HEAD nor for a range request", "UNKNOWN_SIZE"
+	case utils.IsDecompressionError(err):
+		return http.StatusUnprocessableEntity, "The file's data is corrupted and can't be decompressed", "DATA_CORRUPTED"
+	case rangehttp.IsTransferError(err):
+		return http.StatusBadGateway, "Failed to read the archive from its server", "TRANSFER_FAILED"
+	case errors.Is(err, utils.ErrPathTraversal):
+		return http.StatusBadRequest, "Invalid file path", "INVALID_PATH"
+	case errors.Is(err, formats.ErrFileNotFound):
+		return http.StatusNotFound, names.notFound, names.notFoundCode
+	case errors.Is(err, formats.ErrUnsupportedMethod):
+		var methodErr *formats.UnsupportedMethodError
+		if errors.As(err, &methodErr) && methodErr.Name != "" {
+			return http.StatusUnprocessableEntity, "This file is compressed with " + methodErr.Name + ", which is not supported", "UNSUPPORTED_METHOD"
+		}
+		return http.StatusUnprocessableEntity, "This file is compressed with a method that is not supported", "UNSUPPORTED_METHOD"
+	case errors.Is(err, formats.ErrPasswordIncorrect):
+		return http.StatusUnauthorized, "Incorrect password", "WRONG_PASSWORD"
+	case errors.Is(err, formats.ErrPasswordRequired):
+		return http.StatusUnauthorized, "Password required", "PASSWORD_REQUIRED"
+	case strings.Contains(errMsg, "password"):
+		if password != "" {
+			return http.StatusUnauthorized, "Incorrect password", "WRONG_PASSWORD"
+		}
+		return http.StatusUnauthorized, "Password required", "PASSWORD_REQUIRED"
+	case strings.Contains(errMsg, "not found"):
+		return http.StatusNotFound, names.notFound, names.notFoundCode
+	case strings.Contains(errMsg, "unsupported") || strings.Contains(errMsg, "format"):
+		return http.StatusBadRequest, "Unsupported archive format", "UNSUPPORTED_FORMAT"
+	case strings.Contains(errMsg, "URL") || strings.Contains(errMsg, "request failed"):
+		return http.StatusBadRequest, "Failed to access URL", "URL_ERROR"
+	case strings.Contains(errMsg, "path traversal"):
+		return http.StatusBadRequest, "Invalid file path", "INVALID_PATH"
+	default:
+		return http.StatusInternalServerError, names.failed, "INTERNAL_ERROR"
+	}
+}
+
+// extractErrorFields returns log fields naming the failed member and the
+// underlying cause when err is a *utils.ExtractError
+func extractErrorFields(err error) []zap.Field {
+	var extractErr *utils.ExtractError
+	if !errors.As(err, &extractErr) {
+		return nil
+	}
+	return []zap.Field{
+		zap.String("member", extractErr.Path),
+		zap.NamedError("cause", extractErr.Cause),
+	}
+}
+
+// contentDisposition builds an attachment Content-Disposition for filename.
+// The quoted filename is an ASCII fallback with quotes and backslashes
+// escaped; names with other characters also get an RFC 5987 filename*
+// parameter carrying the UTF-8 name.
+func contentDisposition(filename string) string {
+	var fallback strings.Builder
+	needsExtended := false
+	for _, r := range filename {
+		switch {
+		case r == '"' || r == '\\':
+			fallback.WriteByte('\\')
+			fallback.WriteRune(r)
+		case r < 0x20 || r == 0x7f:
+			fallback.WriteByte('_')
+		case r > 0x7f:
+			fallback.WriteByte('_')
+			needsExtended = true
+		default:
+			fallback.WriteRune(r)
+		}
+	}
+
+	value := `attachment; filename="` + fallback.String() + `"`
+	if needsExtended {
+		value += "; filename*=UTF-8''" + encodeRFC5987(filename)
+	}
+	return value
+}
+
+// encodeRFC5987 percent-encodes s as an RFC 5987 ext-value, keeping only
+// attr-char bytes unescaped
+func encodeRFC5987(s string) string {
+	const attrChars = "!#$&+-.^_`|~"
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') || strings.IndexByte(attrChars, c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
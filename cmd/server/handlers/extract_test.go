@@ -0,0 +1,339 @@
+package handlers
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/NORMAL-EX/stream-7z/internal/testarchive"
+	"github.com/NORMAL-EX/stream-7z/lib"
+	"github.com/NORMAL-EX/stream-7z/lib/formats"
+	"github.com/NORMAL-EX/stream-7z/lib/rangehttp"
+	"github.com/NORMAL-EX/stream-7z/lib/utils"
+	"github.com/yeka/zip"
+	"go.uber.org/zap"
+)
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		filename string
+		expected string
+	}{
+		{"report.pdf", `attachment; filename="report.pdf"`},
+		{`say "hi".txt`, `attachment; filename="say \"hi\".txt"`},
+		{`back\slash.txt`, `attachment; filename="back\\slash.txt"`},
+		{"报告.pdf", `attachment; filename="__.pdf"; filename*=UTF-8''%E6%8A%A5%E5%91%8A.pdf`},
+		{"my file (1).txt", `attachment; filename="my file (1).txt"`},
+	}
+
+	for _, test := range tests {
+		result := contentDisposition(test.filename)
+		if result != test.expected {
+			t.Errorf("contentDisposition(%q) = %q, expected %q", test.filename, result, test.expected)
+		}
+	}
+}
+
+func TestContentDispositionRoundTrip(t *testing.T) {
+	for _, filename := range []string{`say "hi".txt`, "报告.pdf", "日本語 ファイル.zip"} {
+		_, params, err := mime.ParseMediaType(contentDisposition(filename))
+		if err != nil {
+			t.Fatalf("failed to parse header for %q: %v", filename, err)
+		}
+		if params["filename"] != filename {
+			t.Errorf("parsed filename %q, expected %q", params["filename"], filename)
+		}
+	}
+}
+
+// inexactFormat is a single-member format whose declared size is wrong,
+// like a TAR or RAR header that doesn't match the stored content
+type inexactFormat struct{}
+
+const inexactMagic = "INEXACT1"
+
+func (inexactFormat) Name() string         { return "inexact" }
+func (inexactFormat) Extensions() []string { return []string{".inexact"} }
+func (inexactFormat) ExactSizes() bool     { return false }
+
+func (inexactFormat) Detect(ctx context.Context, reader io.ReaderAt, size int64) (bool, error) {
+	magic := make([]byte, len(inexactMagic))
+	if _, err := reader.ReadAt(magic, 0); err != nil {
+		return false, err
+	}
+	return string(magic) == inexactMagic, nil
+}
+
+func (inexactFormat) GetInfo(ctx context.Context, reader io.ReaderAt, size int64, password string) (*formats.ArchiveInfo, error) {
+	return &formats.ArchiveInfo{TotalFiles: 1}, nil
+}
+
+func (inexactFormat) ListFiles(ctx context.Context, reader io.ReaderAt, size int64, innerPath string, password string) ([]formats.FileEntry, error) {
+	return []formats.FileEntry{{Path: "member.txt", Size: 4}}, nil
+}
+
+func (inexactFormat) ExtractFile(ctx context.Context, reader io.ReaderAt, size int64, filePath string, password string) (io.ReadCloser, int64, error) {
+	if filePath != "member.txt" {
+		return nil, 0, formats.ErrFileNotFound
+	}
+	offset := int64(len(inexactMagic))
+	return io.NopCloser(io.NewSectionReader(reader, offset, size-offset)), 4, nil
+}
+
+// registerTestFormat adds format to the global registry for the rest of
+// the test
+func registerTestFormat(t *testing.T, format formats.Format) {
+	t.Helper()
+	formats.RegisterFormat(format)
+	t.Cleanup(func() { formats.UnregisterFormat(format.Name()) })
+}
+
+func TestExtractOmitsContentLengthForInexactSizes(t *testing.T) {
+	registerTestFormat(t, inexactFormat{})
+
+	content := strings.Repeat("the declared size is only four bytes; ", 100)
+	archiveServer := newArchiveServer(t, []byte(inexactMagic+content))
+
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop())
+	server := httptest.NewServer(h.Extract())
+	t.Cleanup(server.Close)
+
+	payload, _ := json.Marshal(ExtractRequest{URL: archiveServer.URL + "/test.inexact", File: "member.txt"})
+	resp, err := http.Post(server.URL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read body: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+	}
+	if resp.ContentLength != -1 {
+		t.Errorf("expected no Content-Length, got %d", resp.ContentLength)
+	}
+	if len(resp.TransferEncoding) == 0 || resp.TransferEncoding[0] != "chunked" {
+		t.Errorf("expected chunked transfer encoding, got %v", resp.TransferEncoding)
+	}
+	if string(body) != content {
+		t.Errorf("expected %d bytes of content, got %d", len(content), len(body))
+	}
+}
+
+func TestExtractGzip(t *testing.T) {
+	tarServer := newArchiveServer(t, testarchive.Tar(t, testarchive.Files("app.log", "photo.jpg")...))
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	fw, _ := zw.CreateHeader(&zip.FileHeader{Name: "deflated.log", Method: zip.Deflate})
+	fw.Write([]byte("content of deflated.log"))
+	if err := zw.Close(); err != nil {
+		t.Fatalf("failed to close zip writer: %v", err)
+	}
+	zipServer := newArchiveServer(t, buf.Bytes())
+
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop()).WithExtractGzip(true)
+
+	extract := func(file string, headers map[string]string) *httptest.ResponseRecorder {
+		t.Helper()
+		archiveURL := tarServer.URL + "/test.tar"
+		if strings.HasPrefix(file, "deflated") {
+			archiveURL = zipServer.URL + "/test.zip"
+		}
+		payload, _ := json.Marshal(ExtractRequest{URL: archiveURL, File: file})
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		rec := httptest.NewRecorder()
+		h.Extract().ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200 for %s, got %d: %s", file, rec.Code, rec.Body.String())
+		}
+		return rec
+	}
+
+	rec := extract("app.log", map[string]string{"Accept-Encoding": "br, gzip"})
+	if encoding := rec.Header().Get("Content-Encoding"); encoding != "gzip" {
+		t.Fatalf("expected a gzipped log, got Content-Encoding %q", encoding)
+	}
+	if length := rec.Header().Get("Content-Length"); length != "" {
+		t.Errorf("expected no Content-Length on a gzipped response, got %s", length)
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("failed to open gzip body: %v", err)
+	}
+	if body, err := io.ReadAll(gz); err != nil || string(body) != "content of app.log" {
+		t.Errorf("unexpected decompressed body %q (%v)", body, err)
+	}
+
+	plain := []struct {
+		name    string
+		file    string
+		headers map[string]string
+	}{
+		{"no Accept-Encoding", "app.log", nil},
+		{"gzip refused", "app.log", map[string]string{"Accept-Encoding": "gzip;q=0"}},
+		{"range request", "app.log", map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=0-3"}},
+		{"compressed type", "photo.jpg", map[string]string{"Accept-Encoding": "gzip"}},
+		{"compressed in the archive", "deflated.log", map[string]string{"Accept-Encoding": "gzip"}},
+	}
+	for _, test := range plain {
+		rec := extract(test.file, test.headers)
+		if encoding := rec.Header().Get("Content-Encoding"); encoding != "" {
+			t.Errorf("%s: expected no Content-Encoding, got %q", test.name, encoding)
+		}
+		if rec.Body.String() != "content of "+test.file {
+			t.Errorf("%s: unexpected body %q", test.name, rec.Body.String())
+		}
+	}
+}
+
+func TestExtractContentLengthBySizeReliability(t *testing.T) {
+	// Larger than net/http buffers, which would set Content-Length itself
+	content := strings.Repeat("a line of the member\n", 1024)
+
+	var zipBuf bytes.Buffer
+	zw := zip.NewWriter(&zipBuf)
+	fw, _ := zw.Create("member.txt")
+	fw.Write([]byte(content))
+	if err := zw.Close(); err != nil {
+		t.Fatalf("failed to close zip writer: %v", err)
+	}
+
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	tw.WriteHeader(&tar.Header{Name: "member.txt", Mode: 0o644, Size: int64(len(content))})
+	tw.Write([]byte(content))
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to close tar writer: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		url     string
+		chunked bool
+	}{
+		// ZIP records exact sizes in its central directory
+		{"zip", newArchiveServer(t, zipBuf.Bytes()).URL + "/test.zip", false},
+		// TAR headers record the member's size
+		{"tar", newArchiveServer(t, tarBuf.Bytes()).URL + "/test.tar", false},
+	}
+
+	server := httptest.NewServer(NewHandler(lib.DefaultConfig(), zap.NewNop()).Extract())
+	t.Cleanup(server.Close)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			payload, _ := json.Marshal(ExtractRequest{URL: test.url, File: "member.txt"})
+			resp, err := http.Post(server.URL, "application/json", bytes.NewReader(payload))
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			defer resp.Body.Close()
+
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", resp.StatusCode, body)
+			}
+			if string(body) != content {
+				t.Errorf("expected %d bytes of content, got %d", len(content), len(body))
+			}
+
+			chunked := len(resp.TransferEncoding) > 0 && resp.TransferEncoding[0] == "chunked"
+			if chunked != test.chunked {
+				t.Errorf("expected chunked=%v, got transfer encoding %v", test.chunked, resp.TransferEncoding)
+			}
+			if !test.chunked && resp.ContentLength != int64(len(body)) {
+				t.Errorf("expected Content-Length %d, got %d", len(body), resp.ContentLength)
+			}
+			if test.chunked && resp.ContentLength != -1 {
+				t.Errorf("expected no Content-Length, got %d", resp.ContentLength)
+			}
+		})
+	}
+}
+
+func TestExtractUnsupportedMethod(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	fw, _ := zw.CreateHeader(&zip.FileHeader{Name: "a.txt", Method: zip.Store})
+	fw.Write([]byte("content"))
+	zw.Close()
+
+	// Relabel the member as Zstandard in its local header and directory entry
+	data := buf.Bytes()
+	binary.LittleEndian.PutUint16(data[8:], 93)
+	dir := bytes.Index(data, []byte("PK\x01\x02"))
+	binary.LittleEndian.PutUint16(data[dir+10:], 93)
+
+	server := newArchiveServer(t, data)
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop())
+
+	rec := postJSON(h.Extract(), "/api/extract", ExtractRequest{URL: server.URL + "/test.zip", File: "a.txt"}, nil)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp ErrorResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if resp.Code != "UNSUPPORTED_METHOD" || !strings.Contains(resp.Error, "Zstandard") {
+		t.Errorf("expected the error to name the method, got %+v", resp)
+	}
+}
+
+func TestClassifyExtractReadErrors(t *testing.T) {
+	corrupt := &utils.ExtractError{Path: "a.txt", Cause: &utils.DecompressionError{Cause: errors.New("flate: corrupt input before offset 12")}}
+	if status, _, code := classifyExtractError(corrupt, ""); status != http.StatusUnprocessableEntity || code != "DATA_CORRUPTED" {
+		t.Errorf("expected 422 DATA_CORRUPTED for corrupt data, got %d %s", status, code)
+	}
+
+	transfer := &utils.ExtractError{Path: "a.txt", Cause: &rangehttp.TransferError{Offset: 4096, Length: 4096, Err: &rangehttp.StatusError{StatusCode: 503}}}
+	if status, _, code := classifyExtractError(transfer, ""); status != http.StatusBadGateway || code != "TRANSFER_FAILED" {
+		t.Errorf("expected 502 TRANSFER_FAILED for a failed read, got %d %s", status, code)
+	}
+
+	// Sentinels carried by a transfer error keep their own codes
+	spent := &rangehttp.TransferError{Offset: 0, Length: 10, Err: utils.WrapError(utils.ErrRetryBudgetExceeded, "10 retries spent")}
+	if _, _, code := classifyExtractError(spent, ""); code != "ORIGIN_UNAVAILABLE" {
+		t.Errorf("expected ORIGIN_UNAVAILABLE, got %s", code)
+	}
+}
+
+func TestClassifyArchiveErrorNames(t *testing.T) {
+	changed := utils.WrapError(utils.ErrArchiveChanged, "file size changed")
+	for _, names := range []archiveErrorNames{extractErrorNames, listErrorNames, infoErrorNames} {
+		if status, _, code := classifyArchiveError(changed, "", names); status != http.StatusConflict || code != "ARCHIVE_CHANGED" {
+			t.Errorf("%s: expected 409 ARCHIVE_CHANGED, got %d %s", names.failed, status, code)
+		}
+	}
+
+	missing := utils.WrapError(formats.ErrFileNotFound, "docs/")
+	if _, message, code := classifyArchiveError(missing, "", listErrorNames); code != "PATH_NOT_FOUND" || message != "Path not found in archive" {
+		t.Errorf("expected PATH_NOT_FOUND for a listing, got %s %q", code, message)
+	}
+	if _, _, code := classifyArchiveError(missing, "", extractErrorNames); code != "FILE_NOT_FOUND" {
+		t.Errorf("expected FILE_NOT_FOUND for an extraction, got %s", code)
+	}
+	unknown := utils.WrapError(utils.ErrUnknownSize, "unable to open archive")
+	if status, _, code := classifyArchiveError(unknown, "", infoErrorNames); status != http.StatusBadGateway || code != "UNKNOWN_SIZE" {
+		t.Errorf("expected 502 UNKNOWN_SIZE, got %d %s", status, code)
+	}
+	if _, message, _ := classifyArchiveError(errors.New("boom"), "", infoErrorNames); message != "Failed to get archive info" {
+		t.Errorf("expected the info fallback message, got %q", message)
+	}
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/NORMAL-EX/stream-7z/lib"
+	"github.com/NORMAL-EX/stream-7z/lib/utils"
+	"go.uber.org/zap"
+)
+
+// ExtractTo handles POST /api/extract-to requests. The file is written to
+// the configured sink instead of the response, so its bytes never pass
+// through the client; only a status is returned.
+func (h *Handler) ExtractTo() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ExtractToRequest
+		if err := parseJSONRequest(w, r, &req); err != nil {
+			return
+		}
+
+		if h.sink == nil {
+			respondError(w, http.StatusNotImplemented, "Write-through extraction is not enabled", "SINK_NOT_CONFIGURED")
+			return
+		}
+
+		if req.URL == "" {
+			respondError(w, http.StatusBadRequest, "url is required", "MISSING_URL")
+			return
+		}
+
+		if req.File == "" {
+			respondError(w, http.StatusBadRequest, "file is required", "MISSING_FILE")
+			return
+		}
+
+		target := req.Target
+		if target == "" {
+			target = req.File
+		}
+		if !utils.IsValidPath(target) {
+			respondError(w, http.StatusBadRequest, "Invalid target path", "INVALID_TARGET")
+			return
+		}
+
+		r, op := h.operations.Start(r, "extract-to", req.URL)
+		defer op.Finish()
+
+		release, ok := h.acquireArchive(w, r)
+		if !ok {
+			return
+		}
+		defer release()
+
+		h.logger.Info("extracting file to sink",
+			zap.String("url", lib.DisplayURL(req.URL)),
+			zap.String("file_path", req.File),
+			zap.String("target", target),
+			zap.Bool("has_password", req.Password != ""),
+		)
+
+		archive, err := lib.NewArchiveWithContext(r.Context(), req.URL, h.requestConfig(r, 0))
+		var reader io.ReadCloser
+		var size int64
+		if err == nil {
+			defer archive.Close()
+			reader, size, err = archive.ExtractFile(req.File, req.Password)
+		}
+		if err != nil {
+			h.logger.Error("failed to extract file",
+				append([]zap.Field{
+					zap.String("url", lib.DisplayURL(req.URL)),
+					zap.String("file_path", req.File),
+					zap.Error(err),
+				}, extractErrorFields(err)...)...,
+			)
+			h.respondExtractError(w, ExtractRequest{URL: req.URL, Password: req.Password, File: req.File}, err)
+			return
+		}
+		defer reader.Close()
+
+		// Canceling ctx before Close tells the sink to discard a partial write
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		dst, err := h.sink.Create(ctx, target, size)
+		if err != nil {
+			h.logger.Error("failed to open sink",
+				zap.String("target", target),
+				zap.Error(err),
+			)
+			if errors.Is(err, ErrSinkFull) {
+				respondSinkFull(w)
+				return
+			}
+			if errors.Is(err, ErrReservedTarget) || errors.Is(err, utils.ErrPathTraversal) {
+				respondError(w, http.StatusBadRequest, "Invalid target path", "INVALID_TARGET")
+				return
+			}
+			respondError(w, http.StatusBadGateway, "Failed to open destination", "SINK_ERROR")
+			return
+		}
+
+		written, err := copyPooled(op.Writer(dst), reader)
+		if err != nil {
+			cancel()
+			dst.Close()
+			h.logger.Error("failed to write file to sink",
+				append([]zap.Field{
+					zap.String("url", lib.DisplayURL(req.URL)),
+					zap.String("file_path", req.File),
+					zap.String("target", target),
+					zap.Int64("written", written),
+					zap.Error(err),
+				}, extractErrorFields(err)...)...,
+			)
+			if errors.Is(err, ErrSinkFull) {
+				respondSinkFull(w)
+				return
+			}
+			respondError(w, http.StatusBadGateway, "Failed to write file to destination", "SINK_ERROR")
+			return
+		}
+
+		if err := dst.Close(); err != nil {
+			h.logger.Error("failed to finish sink write",
+				zap.String("target", target),
+				zap.Error(err),
+			)
+			respondError(w, http.StatusBadGateway, "Failed to write file to destination", "SINK_ERROR")
+			return
+		}
+
+		h.logger.Info("successfully extracted file to sink",
+			zap.String("url", lib.DisplayURL(req.URL)),
+			zap.String("file_path", req.File),
+			zap.String("target", target),
+			zap.Int64("size", size),
+			zap.Int64("written", written),
+		)
+
+		respondJSON(w, http.StatusOK, ExtractToResponse{
+			File:    req.File,
+			Target:  target,
+			Size:    size,
+			Written: written,
+		})
+	}
+}
+
+// respondSinkFull reports that the sink has no temporary space left for now
+func respondSinkFull(w http.ResponseWriter) {
+	respondError(w, http.StatusInsufficientStorage, "Destination is out of temporary space, please try again later", "SINK_FULL")
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"strings"
+
+	"github.com/NORMAL-EX/stream-7z/lib"
+	"go.uber.org/zap"
+)
+
+// defaultHashAlgorithm is used when a hash request names no algorithm
+const defaultHashAlgorithm = "sha256"
+
+// hashAlgorithms maps the supported algorithm names to their constructors
+var hashAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// Hash handles POST /api/hash requests. The file is extracted and hashed
+// on the server, so only the digest is sent to the client.
+func (h *Handler) Hash() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req HashRequest
+		if err := parseJSONRequest(w, r, &req); err != nil {
+			return
+		}
+
+		if req.URL == "" {
+			respondError(w, http.StatusBadRequest, "url is required", "MISSING_URL")
+			return
+		}
+
+		if req.File == "" {
+			respondError(w, http.StatusBadRequest, "file is required", "MISSING_FILE")
+			return
+		}
+
+		algorithm := strings.ToLower(req.Algorithm)
+		if algorithm == "" {
+			algorithm = defaultHashAlgorithm
+		}
+		newHash, ok := hashAlgorithms[algorithm]
+		if !ok {
+			respondError(w, http.StatusBadRequest, "algorithm must be md5, sha1 or sha256", "INVALID_ALGORITHM")
+			return
+		}
+
+		r, op := h.operations.Start(r, "hash", req.URL)
+		defer op.Finish()
+
+		release, ok := h.acquireArchive(w, r)
+		if !ok {
+			return
+		}
+		defer release()
+
+		h.logger.Info("hashing file in archive",
+			zap.String("url", lib.DisplayURL(req.URL)),
+			zap.String("file_path", req.File),
+			zap.String("algorithm", algorithm),
+			zap.Bool("has_password", req.Password != ""),
+		)
+
+		extractReq := ExtractRequest{URL: req.URL, Password: req.Password, File: req.File}
+
+		archive, err := lib.NewArchiveWithContext(r.Context(), req.URL, h.requestConfig(r, 0))
+		if err != nil {
+			h.logger.Error("failed to open archive",
+				zap.String("url", lib.DisplayURL(req.URL)),
+				zap.Error(err),
+			)
+			h.respondExtractError(w, extractReq, err)
+			return
+		}
+		defer archive.Close()
+
+		digest := newHash()
+		size, err := archive.ExtractFileTo(req.File, req.Password, op.Writer(digest))
+		if err != nil {
+			h.logger.Error("failed to hash file",
+				append([]zap.Field{
+					zap.String("url", lib.DisplayURL(req.URL)),
+					zap.String("file_path", req.File),
+					zap.Int64("written", size),
+					zap.Error(err),
+				}, extractErrorFields(err)...)...,
+			)
+			h.respondExtractError(w, extractReq, err)
+			return
+		}
+
+		h.logger.Info("successfully hashed file",
+			zap.String("url", lib.DisplayURL(req.URL)),
+			zap.String("file_path", req.File),
+			zap.String("algorithm", algorithm),
+			zap.Int64("size", size),
+		)
+
+		respondJSON(w, http.StatusOK, HashResponse{
+			File:      req.File,
+			Algorithm: algorithm,
+			Hash:      hex.EncodeToString(digest.Sum(nil)),
+			Size:      size,
+		})
+	}
+}
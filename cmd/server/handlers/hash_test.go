@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/NORMAL-EX/stream-7z/internal/testarchive"
+	"github.com/NORMAL-EX/stream-7z/lib"
+	"go.uber.org/zap"
+)
+
+func TestHashMember(t *testing.T) {
+	server := newArchiveServer(t, testarchive.Tar(t, testarchive.Files("a.txt", "docs/b.txt")...))
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop())
+
+	content := []byte("content of docs/b.txt")
+	sha := sha256.Sum256(content)
+	md := md5.Sum(content)
+
+	tests := []struct {
+		algorithm string
+		expected  string
+	}{
+		{"", hex.EncodeToString(sha[:])},
+		{"sha256", hex.EncodeToString(sha[:])},
+		{"MD5", hex.EncodeToString(md[:])},
+	}
+
+	for _, test := range tests {
+		rec := postJSON(h.Hash(), "/api/hash", HashRequest{
+			URL:       server.URL + "/test.tar",
+			File:      "docs/b.txt",
+			Algorithm: test.algorithm,
+		}, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("algorithm %q: expected 200, got %d: %s", test.algorithm, rec.Code, rec.Body.String())
+		}
+
+		var resp HashResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("invalid response: %v", err)
+		}
+		if resp.Hash != test.expected {
+			t.Errorf("algorithm %q: hash = %s, expected %s", test.algorithm, resp.Hash, test.expected)
+		}
+		if resp.Size != int64(len(content)) {
+			t.Errorf("algorithm %q: size = %d, expected %d", test.algorithm, resp.Size, len(content))
+		}
+	}
+}
+
+func TestHashErrors(t *testing.T) {
+	server := newArchiveServer(t, testarchive.Tar(t, testarchive.Files("a.txt")...))
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop())
+
+	tests := []struct {
+		req    HashRequest
+		status int
+		code   string
+	}{
+		{HashRequest{URL: server.URL + "/test.tar", File: "a.txt", Algorithm: "crc32"}, http.StatusBadRequest, "INVALID_ALGORITHM"},
+		{HashRequest{URL: server.URL + "/test.tar", File: "missing.txt"}, http.StatusNotFound, "FILE_NOT_FOUND"},
+		{HashRequest{URL: server.URL + "/test.tar"}, http.StatusBadRequest, "MISSING_FILE"},
+	}
+
+	for _, test := range tests {
+		rec := postJSON(h.Hash(), "/api/hash", test.req, nil)
+		var resp ErrorResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		if rec.Code != test.status || resp.Code != test.code {
+			t.Errorf("%+v: got %d %s, expected %d %s", test.req, rec.Code, resp.Code, test.status, test.code)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// IdempotencyKeyHeader is the request header carrying the client's key
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotentBodySize caps the request body read to fingerprint a request
+const maxIdempotentBodySize = 1 << 20
+
+// IdempotencyMiddleware deduplicates requests that carry the same
+// Idempotency-Key header and body. While the first request runs, identical
+// requests wait for it and receive a copy of its response; once it has
+// finished a successful response is replayed for ttl, so a client retrying
+// after a timeout does not fetch the archive from the origin again.
+//
+// Responses are buffered in memory, so the middleware is meant for
+// endpoints with small JSON results such as /api/hash.
+type IdempotencyMiddleware struct {
+	ttl    time.Duration
+	logger *zap.Logger
+
+	// Headers whose values tell otherwise identical requests apart
+	varyHeaders []string
+
+	// Header carrying the API key; keys of different clients never match
+	apiKeyHeader string
+
+	mu    sync.Mutex
+	calls map[string]*idempotentCall
+}
+
+// idempotentCall is a request in flight or a finished response kept for replay
+type idempotentCall struct {
+	done    chan struct{}
+	waiters int
+	expires time.Time
+
+	// The leader's client went away, so its response isn't the result
+	abandoned bool
+
+	status int
+	header http.Header
+	body   []byte
+}
+
+// NewIdempotencyMiddleware creates a middleware replaying finished
+// responses for ttl. A ttl of 0 only shares requests that are in flight.
+func NewIdempotencyMiddleware(ttl time.Duration, logger *zap.Logger) *IdempotencyMiddleware {
+	return &IdempotencyMiddleware{
+		ttl:    ttl,
+		logger: logger,
+		calls:  make(map[string]*idempotentCall),
+	}
+}
+
+// WithVaryHeaders makes the values of the named headers part of what
+// identifies a request. It should list the headers forwarded to the origin
+// (Handler.WithForwardHeaders), since the origin may answer differently,
+// or not at all, depending on them.
+func (im *IdempotencyMiddleware) WithVaryHeaders(names []string) *IdempotencyMiddleware {
+	im.varyHeaders = nil
+	for _, name := range names {
+		if name = http.CanonicalHeaderKey(strings.TrimSpace(name)); name != "" {
+			im.varyHeaders = append(im.varyHeaders, name)
+		}
+	}
+	return im
+}
+
+// WithAPIKeyHeader scopes idempotency keys to the API key sent in the
+// named header, so one client can't be replayed another's response by
+// reusing its Idempotency-Key.
+func (im *IdempotencyMiddleware) WithAPIKeyHeader(name string) *IdempotencyMiddleware {
+	im.apiKeyHeader = name
+	return im
+}
+
+// Handler returns the middleware handler
+func (im *IdempotencyMiddleware) Handler() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(IdempotencyKeyHeader)
+			if key == "" || r.Method != http.MethodPost {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			body, err := io.ReadAll(io.LimitReader(r.Body, maxIdempotentBodySize+1))
+			if err != nil {
+				respondError(w, http.StatusBadRequest, "Invalid JSON: failed to read request body", "INVALID_JSON")
+				return
+			}
+			if len(body) > maxIdempotentBodySize {
+				respondError(w, http.StatusBadRequest, "Invalid JSON: request body too large", "INVALID_JSON")
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			// The same key from another client, with a different body, or
+			// with different headers for the origin, is a different request
+			sum := sha256.Sum256(body)
+			callKey := r.URL.Path + "\x00" + key + "\x00" + hex.EncodeToString(sum[:]) +
+				"\x00" + im.headerFingerprint(r)
+
+			for {
+				call, leader := im.join(callKey)
+				if leader {
+					im.lead(w, r, next, callKey, call)
+					return
+				}
+
+				select {
+				case <-call.done:
+				case <-r.Context().Done():
+					return
+				}
+				if call.abandoned {
+					// The leader's response only says its client left,
+					// so run the request again
+					continue
+				}
+				im.logger.Debug("replaying idempotent response",
+					zap.String("path", r.URL.Path),
+					zap.String("idempotency_key", key),
+				)
+				call.write(w, true)
+				return
+			}
+		})
+	}
+}
+
+// lead runs the request for call and publishes its response
+func (im *IdempotencyMiddleware) lead(w http.ResponseWriter, r *http.Request, next http.Handler, key string, call *idempotentCall) {
+	rec := &bufferedResponse{header: make(http.Header)}
+	defer func() {
+		if p := recover(); p != nil {
+			// Waiting requests get an error instead of hanging
+			rec = &bufferedResponse{header: make(http.Header)}
+			respondError(rec, http.StatusInternalServerError, "Internal server error", "INTERNAL_ERROR")
+			im.finish(key, call, rec, false)
+			panic(p)
+		}
+	}()
+	next.ServeHTTP(rec, r)
+	im.finish(key, call, rec, r.Context().Err() != nil)
+	call.write(w, false)
+}
+
+// headerFingerprint hashes the values r carries for the API key and vary
+// headers
+func (im *IdempotencyMiddleware) headerFingerprint(r *http.Request) string {
+	names := im.varyHeaders
+	if im.apiKeyHeader != "" {
+		names = append([]string{im.apiKeyHeader}, names...)
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	hash := sha256.New()
+	for _, name := range names {
+		values := r.Header.Values(name)
+		fmt.Fprintf(hash, "%s\x00%d\x00", name, len(values))
+		for _, value := range values {
+			fmt.Fprintf(hash, "%d:%s\x00", len(value), value)
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// join returns the call for key, creating it if there is none. leader is
+// true when the caller created the call and must run the request.
+func (im *IdempotencyMiddleware) join(key string) (call *idempotentCall, leader bool) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	now := time.Now()
+	for k, c := range im.calls {
+		if !c.expires.IsZero() && now.After(c.expires) {
+			delete(im.calls, k)
+		}
+	}
+
+	if call, ok := im.calls[key]; ok {
+		call.waiters++
+		return call, false
+	}
+
+	call = &idempotentCall{done: make(chan struct{})}
+	im.calls[key] = call
+	return call, true
+}
+
+// finish publishes the leader's response to waiting requests. Only
+// successful responses are kept for replay, so a retry after an error gets
+// a fresh attempt. When the leader's client went away (abandoned) waiting
+// requests run the request themselves instead.
+func (im *IdempotencyMiddleware) finish(key string, call *idempotentCall, rec *bufferedResponse, abandoned bool) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	call.status = rec.statusCode()
+	call.header = rec.header
+	call.body = rec.body.Bytes()
+	call.abandoned = abandoned
+	if abandoned || call.status < 200 || call.status >= 300 || im.ttl <= 0 {
+		delete(im.calls, key)
+	} else {
+		call.expires = time.Now().Add(im.ttl)
+	}
+	close(call.done)
+}
+
+// write sends the finished response to w, marking replayed copies
+func (c *idempotentCall) write(w http.ResponseWriter, replayed bool) {
+	for k, v := range c.header {
+		w.Header()[k] = v
+	}
+	if replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+	w.WriteHeader(c.status)
+	w.Write(c.body)
+}
+
+// bufferedResponse records a response so it can be sent more than once
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponse) statusCode() int {
+	if b.status == 0 {
+		return http.StatusOK
+	}
+	return b.status
+}
@@ -0,0 +1,257 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/NORMAL-EX/stream-7z/internal/testarchive"
+	"github.com/NORMAL-EX/stream-7z/lib"
+	"go.uber.org/zap"
+)
+
+// waiters returns how many requests are waiting on an in-flight call
+func (im *IdempotencyMiddleware) waiters() int {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	n := 0
+	for _, call := range im.calls {
+		n += call.waiters
+	}
+	return n
+}
+
+func TestIdempotencySharesConcurrentRequests(t *testing.T) {
+	data := testarchive.Tar(t, testarchive.Files("a.txt")...)
+	var opens int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			atomic.AddInt32(&opens, 1)
+			<-release
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop())
+	idempotency := NewIdempotencyMiddleware(time.Minute, zap.NewNop())
+	handler := idempotency.Handler()(h.Hash())
+	req := HashRequest{URL: server.URL + "/test.tar", File: "a.txt"}
+	retry := http.Header{IdempotencyKeyHeader: {"retry-1"}}
+
+	var wg sync.WaitGroup
+	results := make([]*httptest.ResponseRecorder, 2)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = postJSON(handler, "/api/hash", req, retry)
+		}(i)
+	}
+
+	// Hold the origin until the second request is waiting on the first
+	deadline := time.Now().Add(5 * time.Second)
+	for idempotency.waiters() == 0 {
+		if time.Now().After(deadline) {
+			close(release)
+			t.Fatal("second request never joined the first")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&opens); n != 1 {
+		t.Errorf("expected 1 upstream fetch, got %d", n)
+	}
+
+	replayed := 0
+	for _, rec := range results {
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		if rec.Header().Get("Idempotent-Replayed") == "true" {
+			replayed++
+		}
+	}
+	if replayed != 1 {
+		t.Errorf("expected exactly one replayed response, got %d", replayed)
+	}
+	if results[0].Body.String() != results[1].Body.String() {
+		t.Errorf("responses differ: %s vs %s", results[0].Body.String(), results[1].Body.String())
+	}
+
+	// A retry after the first request finished is served from the cache
+	if rec := postJSON(handler, "/api/hash", req, retry); rec.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("expected retry to be replayed")
+	}
+	if n := atomic.LoadInt32(&opens); n != 1 {
+		t.Errorf("expected retry not to fetch again, got %d fetches", n)
+	}
+
+	// A different body under the same key is a new request
+	other := HashRequest{URL: server.URL + "/test.tar", File: "a.txt", Algorithm: "md5"}
+	if rec := postJSON(handler, "/api/hash", other, retry); rec.Header().Get("Idempotent-Replayed") == "true" {
+		t.Errorf("expected a different request not to be replayed")
+	}
+	if n := atomic.LoadInt32(&opens); n != 2 {
+		t.Errorf("expected a second fetch for a different request, got %d", n)
+	}
+}
+
+func TestIdempotencyKeyIncludesForwardedHeaders(t *testing.T) {
+	var calls int32
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		respondJSON(w, http.StatusOK, map[string]string{"token": r.Header.Get("X-Origin-Token")})
+	})
+	idempotency := NewIdempotencyMiddleware(time.Minute, zap.NewNop()).
+		WithVaryHeaders([]string{"x-origin-token"})
+	handler := idempotency.Handler()(next)
+
+	post := func(token string) *httptest.ResponseRecorder {
+		header := http.Header{IdempotencyKeyHeader: {"retry-1"}}
+		if token != "" {
+			header.Set("X-Origin-Token", token)
+		}
+		return postJSON(handler, "/api/hash", map[string]string{"file": "a.txt"}, header)
+	}
+
+	first := post("alice")
+	if rec := post("mallory"); rec.Header().Get("Idempotent-Replayed") == "true" || rec.Body.String() == first.Body.String() {
+		t.Errorf("expected a request with another forwarded token not to get the first response, got %s", rec.Body.String())
+	}
+	if rec := post(""); rec.Header().Get("Idempotent-Replayed") == "true" {
+		t.Errorf("expected a request without the forwarded header not to be replayed")
+	}
+	if rec := post("alice"); rec.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("expected a retry with the same token to be replayed")
+	}
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Errorf("expected 3 handler calls, got %d", n)
+	}
+}
+
+func TestIdempotencyScopesKeysByAPIKey(t *testing.T) {
+	var calls int32
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		respondJSON(w, http.StatusOK, map[string]string{"client": r.Header.Get("X-API-Key")})
+	})
+	handler := NewIdempotencyMiddleware(time.Minute, zap.NewNop()).
+		WithAPIKeyHeader("X-API-Key").
+		Handler()(next)
+
+	post := func(apiKey string) *httptest.ResponseRecorder {
+		header := http.Header{IdempotencyKeyHeader: {"retry-1"}, "X-API-Key": {apiKey}}
+		return postJSON(handler, "/api/hash", map[string]string{"file": "a.txt"}, header)
+	}
+
+	post("key-a")
+	if rec := post("key-b"); rec.Header().Get("Idempotent-Replayed") == "true" {
+		t.Errorf("expected another API key not to be replayed the first client's response, got %s", rec.Body.String())
+	}
+	if rec := post("key-a"); rec.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("expected a retry with the same API key to be replayed")
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("expected 2 handler calls, got %d", n)
+	}
+}
+
+func TestIdempotencyReplaysOnlySuccess(t *testing.T) {
+	var calls int32
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			respondError(w, http.StatusForbidden, "Origin refused the request", "ORIGIN_FORBIDDEN")
+			return
+		}
+		respondJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	handler := NewIdempotencyMiddleware(time.Minute, zap.NewNop()).Handler()(next)
+	req := map[string]string{"file": "a.txt"}
+	retry := http.Header{IdempotencyKeyHeader: {"retry-1"}}
+
+	if rec := postJSON(handler, "/api/hash", req, retry); rec.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", rec.Code)
+	}
+	rec := postJSON(handler, "/api/hash", req, retry)
+	if rec.Code != http.StatusOK || rec.Header().Get("Idempotent-Replayed") == "true" {
+		t.Errorf("expected a retry after a 4xx to run again, got %d (replayed %q)", rec.Code, rec.Header().Get("Idempotent-Replayed"))
+	}
+	if rec := postJSON(handler, "/api/hash", req, retry); rec.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("expected the 200 to be replayed")
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("expected 2 handler calls, got %d", n)
+	}
+}
+
+func TestIdempotencyWaiterRunsAfterLeaderCancels(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-release
+		}
+		if r.Context().Err() != nil {
+			respondError(w, http.StatusInternalServerError, "Request canceled", "REQUEST_CANCELED")
+			return
+		}
+		respondJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	idempotency := NewIdempotencyMiddleware(time.Minute, zap.NewNop())
+	handler := idempotency.Handler()(next)
+
+	post := func(ctx context.Context) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/hash", bytes.NewReader([]byte(`{"file":"a.txt"}`)))
+		req = req.WithContext(ctx)
+		req.Header.Set(IdempotencyKeyHeader, "retry-1")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	leaderCtx, cancel := context.WithCancel(context.Background())
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		post(leaderCtx)
+	}()
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	waiter := make(chan *httptest.ResponseRecorder, 1)
+	go func() { waiter <- post(context.Background()) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for idempotency.waiters() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("second request never joined the first")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The leader's client goes away before its response is ready
+	cancel()
+	close(release)
+	<-leaderDone
+
+	rec := <-waiter
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected the waiting request to get 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Idempotent-Replayed") == "true" {
+		t.Errorf("expected the waiting request to run again, not replay the canceled response")
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("expected 2 handler calls, got %d", n)
+	}
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// idleCopyBufferSize is the chunk size copyWithIdleTimeout writes at a time
+const idleCopyBufferSize = 32 * 1024
+
+// copyBuffers holds the buffers extracted members are copied through, so
+// a server extracting many small files doesn't allocate one per member
+var copyBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, idleCopyBufferSize)
+		return &buf
+	},
+}
+
+// copyPooled copies src to dst like io.Copy, through a buffer from
+// copyBuffers
+func copyPooled(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+// copyWithIdleTimeout copies src to dst like io.Copy, but moves the
+// response's write deadline idle into the future before every chunk. A
+// download that keeps making progress can then run longer than the
+// server's write timeout, while a client that stops reading fails once a
+// single chunk takes longer than idle. dst is w itself or wraps it.
+// With idle <= 0, or when w can't set deadlines, it is a plain io.Copy.
+func copyWithIdleTimeout(w http.ResponseWriter, dst io.Writer, src io.Reader, idle time.Duration) (int64, error) {
+	if idle <= 0 {
+		return copyPooled(dst, src)
+	}
+	rc := http.NewResponseController(w)
+
+	pooled := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(pooled)
+	buf := *pooled
+	var written int64
+	for {
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			if err := rc.SetWriteDeadline(time.Now().Add(idle)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				return written, err
+			}
+
+			nw, err := dst.Write(buf[:n])
+			written += int64(nw)
+			if err != nil {
+				if errors.Is(err, os.ErrDeadlineExceeded) {
+					return written, fmt.Errorf("client made no progress for %s: %w", idle, err)
+				}
+				return written, err
+			}
+			if nw != n {
+				return written, io.ErrShortWrite
+			}
+		}
+		if readErr == io.EOF {
+			return written, nil
+		}
+		if readErr != nil {
+			return written, readErr
+		}
+	}
+}
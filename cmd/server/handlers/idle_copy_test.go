@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// deadlineWriter is a ResponseWriter whose client reads accept bytes and
+// then stops; writes past that block until the write deadline, like a
+// connection with a full send buffer
+type deadlineWriter struct {
+	header  http.Header
+	accept  int
+	delay   time.Duration // Time each accepted write takes
+	written int
+
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func (d *deadlineWriter) Header() http.Header { return d.header }
+
+func (d *deadlineWriter) WriteHeader(int) {}
+
+func (d *deadlineWriter) SetWriteDeadline(deadline time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.deadline = deadline
+	return nil
+}
+
+func (d *deadlineWriter) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	deadline := d.deadline
+	d.mu.Unlock()
+
+	if d.written+len(p) > d.accept {
+		time.Sleep(time.Until(deadline))
+		return 0, os.ErrDeadlineExceeded
+	}
+	time.Sleep(d.delay)
+	if !deadline.IsZero() && time.Now().After(deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	d.written += len(p)
+	return len(p), nil
+}
+
+func TestCopyWithIdleTimeoutStalledClient(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 4*idleCopyBufferSize)
+	w := &deadlineWriter{header: make(http.Header), accept: idleCopyBufferSize}
+
+	start := time.Now()
+	written, err := copyWithIdleTimeout(w, w, bytes.NewReader(data), 50*time.Millisecond)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the stalled copy to fail with a deadline error, got %v", err)
+	}
+	if written != idleCopyBufferSize {
+		t.Errorf("expected %d bytes written before the stall, got %d", idleCopyBufferSize, written)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("stalled copy took %s to fail", elapsed)
+	}
+}
+
+func TestCopyWithIdleTimeoutSlowClient(t *testing.T) {
+	// Each chunk takes a while but well within the idle timeout; the whole
+	// copy takes longer than the timeout and must still succeed
+	data := bytes.Repeat([]byte("x"), 6*idleCopyBufferSize)
+	w := &deadlineWriter{header: make(http.Header), accept: len(data), delay: 20 * time.Millisecond}
+
+	start := time.Now()
+	written, err := copyWithIdleTimeout(w, w, bytes.NewReader(data), 60*time.Millisecond)
+	if err != nil || written != int64(len(data)) {
+		t.Fatalf("expected all %d bytes copied, got %d: %v", len(data), written, err)
+	}
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("expected the copy to outlast the idle timeout, took %s", elapsed)
+	}
+}
@@ -1,10 +1,12 @@
 package handlers
 
 import (
+	"context"
 	"net/http"
 	"strings"
 
 	"github.com/NORMAL-EX/stream-7z/lib"
+	"github.com/NORMAL-EX/stream-7z/lib/formats"
 	"go.uber.org/zap"
 )
 
@@ -23,55 +25,78 @@ func (h *Handler) Info() http.HandlerFunc {
 			return
 		}
 
+		// A retry with a password reuses the archive the attempt without
+		// one left open
+		var archive *lib.Archive
+		var release func()
+		retryKey := ""
+		if h.passwordRetries != nil {
+			retryKey = h.retryKey(r, req.URL)
+			if req.Password != "" {
+				archive, release, _ = h.passwordRetries.take(retryKey)
+			}
+		}
+		reused := archive != nil
+		if !reused {
+			var ok bool
+			if release, ok = h.acquireArchive(w, r); !ok {
+				return
+			}
+		}
+		parked := false
+		defer func() {
+			if parked {
+				return
+			}
+			if archive != nil {
+				archive.Close()
+			}
+			release()
+		}()
+
 		h.logger.Info("getting archive info",
-			zap.String("url", req.URL),
+			zap.String("url", lib.DisplayURL(req.URL)),
 			zap.Bool("has_password", req.Password != ""),
+			zap.Bool("reused", reused),
 		)
 
-		// Get archive info using QuickInfo
-		info, err := lib.QuickInfo(req.URL, req.Password, h.config)
+		var err error
+		if !reused {
+			ctx := r.Context()
+			if h.passwordRetries != nil {
+				// The archive may be parked after the request ends
+				ctx = context.WithoutCancel(ctx)
+			}
+			archive, err = lib.NewArchiveWithContext(ctx, req.URL, h.requestConfig(r, h.rangeBudget.Info))
+		}
+		var info *formats.ArchiveInfo
+		if err == nil {
+			// Closing the archive aborts reading it if the client goes away
+			stop := context.AfterFunc(r.Context(), func() { archive.Close() })
+			info, err = archive.GetInfo(req.Password)
+
+			needsPassword := (err != nil && strings.Contains(err.Error(), "password")) ||
+				(err == nil && info.RequiresPassword && req.Password == "")
+			if stop() && h.passwordRetries != nil && needsPassword {
+				parked = h.passwordRetries.park(retryKey, archive, release)
+			}
+		}
 		if err != nil {
 			h.logger.Error("failed to get archive info",
-				zap.String("url", req.URL),
+				zap.String("url", lib.DisplayURL(req.URL)),
 				zap.Error(err),
 			)
 
-			// Determine error type
-			errMsg := err.Error()
-			if strings.Contains(errMsg, "password") {
-				if req.Password != "" {
-					respondError(w, http.StatusUnauthorized, "Incorrect password", "WRONG_PASSWORD")
-				} else {
-					respondError(w, http.StatusUnauthorized, "Password required", "PASSWORD_REQUIRED")
-				}
-			} else if strings.Contains(errMsg, "unsupported") || strings.Contains(errMsg, "format") {
-				respondError(w, http.StatusBadRequest, "Unsupported archive format", "UNSUPPORTED_FORMAT")
-			} else if strings.Contains(errMsg, "URL") || strings.Contains(errMsg, "request failed") {
-				respondError(w, http.StatusBadRequest, "Failed to access URL", "URL_ERROR")
-			} else {
-				respondError(w, http.StatusInternalServerError, "Failed to get archive info", "INTERNAL_ERROR")
-			}
+			status, message, code := classifyArchiveError(err, req.Password, infoErrorNames)
+			respondError(w, status, message, code)
 			return
 		}
 
 		// Create response
-		response := InfoResponse{
-			IsEncrypted:      info.IsEncrypted,
-			RequiresPassword: info.RequiresPassword,
-			TotalFiles:       info.TotalFiles,
-			TotalSize:        info.TotalSize,
-			Comment:          info.Comment,
-		}
-
-		// Get format from a new archive instance (since QuickInfo closed it)
-		archive, err := lib.NewArchive(req.URL, h.config)
-		if err == nil {
-			response.Format = archive.Format()
-			archive.Close()
-		}
+		response := newInfoResponse(info, archive)
 
 		h.logger.Info("successfully retrieved archive info",
-			zap.String("url", req.URL),
+			zap.String("url", lib.DisplayURL(req.URL)),
 			zap.Int("total_files", info.TotalFiles),
 			zap.Int64("total_size", info.TotalSize),
 		)
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/NORMAL-EX/stream-7z/internal/testarchive"
+	"github.com/NORMAL-EX/stream-7z/lib"
+	"github.com/yeka/zip"
+	"go.uber.org/zap"
+)
+
+func TestInfoCompressionRatio(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, method := range map[string]uint16{"stored.txt": zip.Store, "deflated.txt": zip.Deflate} {
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		if err != nil {
+			t.Fatalf("failed to create %s: %v", name, err)
+		}
+		fw.Write([]byte(strings.Repeat("compressible ", 1000)))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("failed to close zip writer: %v", err)
+	}
+	data := buf.Bytes()
+
+	// The sizes the central directory records
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("failed to read the zip back: %v", err)
+	}
+	var size, compressed int64
+	for _, f := range zr.File {
+		size += int64(f.UncompressedSize64)
+		compressed += int64(f.CompressedSize64)
+	}
+
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop())
+	info := func(name string, data []byte) InfoResponse {
+		t.Helper()
+		server := newArchiveServer(t, data)
+		rec := postJSON(h.Info(), "/api/info", InfoRequest{URL: server.URL + "/" + name}, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		var resp InfoResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("invalid response: %v", err)
+		}
+		return resp
+	}
+
+	resp := info("test.zip", data)
+	if resp.TotalSize != size || resp.TotalCompressedSize != compressed {
+		t.Errorf("expected %d bytes compressed to %d, got %d to %d", size, compressed, resp.TotalSize, resp.TotalCompressedSize)
+	}
+	// The stored half alone keeps the ratio above 0.5
+	if expected := compressionRatio(compressed, size); resp.CompressionRatio != expected || expected <= 0.5 || expected >= 1 {
+		t.Errorf("expected a compression ratio of %v, got %v", expected, resp.CompressionRatio)
+	}
+
+	// TAR records no compressed sizes, so the archive size stands in
+	tarData := testarchive.Tar(t, testarchive.Files("a.txt", "b.txt")...)
+	if resp := info("test.tar", tarData); resp.TotalCompressedSize != int64(len(tarData)) {
+		t.Errorf("expected the archive size %d for a TAR, got %d", len(tarData), resp.TotalCompressedSize)
+	}
+}
+
+func TestCompressionRatio(t *testing.T) {
+	tests := []struct {
+		compressed, uncompressed int64
+		expected                 float64
+	}{
+		{86, 1000, 0.086},
+		{1, 3, 0.3333},
+		{512, 0, 0},
+	}
+	for _, test := range tests {
+		if got := compressionRatio(test.compressed, test.uncompressed); got != test.expected {
+			t.Errorf("compressionRatio(%d, %d) = %v, expected %v", test.compressed, test.uncompressed, got, test.expected)
+		}
+	}
+}
+
+func TestInfoUnknownSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Neither HEAD nor a range request reports the size
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.Header().Set("Content-Range", "bytes 0-0/*")
+		w.WriteHeader(http.StatusPartialContent)
+	}))
+	t.Cleanup(server.Close)
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop())
+
+	rec := postJSON(h.Info(), "/api/info", InfoRequest{URL: server.URL + "/test.zip"}, nil)
+	var resp ErrorResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if rec.Code != http.StatusBadGateway || resp.Code != "UNKNOWN_SIZE" {
+		t.Errorf("expected 502 UNKNOWN_SIZE, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -1,14 +1,24 @@
 package handlers
 
 import (
+	"encoding/json"
 	"net/http"
 	"strings"
 
 	"github.com/NORMAL-EX/stream-7z/lib"
+	"github.com/NORMAL-EX/stream-7z/lib/formats"
 	"go.uber.org/zap"
 )
 
+// ndjsonContentType is the media type of streamed listings
+const ndjsonContentType = "application/x-ndjson"
+
+// ndjsonFlushInterval is how many streamed entries are written between flushes
+const ndjsonFlushInterval = 100
+
 // List handles POST /api/list requests
+// With "Accept: application/x-ndjson" the entries are streamed instead,
+// unless a limit asks for one page of them
 func (h *Handler) List() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Parse JSON request
@@ -17,54 +27,130 @@ func (h *Handler) List() http.HandlerFunc {
 			return
 		}
 
+		// A cursor continues the listing it was issued for
+		var cursor *listCursor
+		if req.Cursor != "" {
+			var err error
+			if cursor, err = h.decodeListCursor(req.Cursor); err != nil {
+				respondError(w, http.StatusBadRequest, "Invalid cursor", "INVALID_CURSOR")
+				return
+			}
+			if req.URL != "" && req.URL != cursor.URL {
+				respondError(w, http.StatusBadRequest, "The cursor belongs to a different archive", "INVALID_CURSOR")
+				return
+			}
+			req.URL = cursor.URL
+			req.InnerPath = cursor.InnerPath
+			req.MaxDepth = cursor.MaxDepth
+			req.HideEmptyDirs = cursor.HideEmptyDirs
+			req.Sort = cursor.Sort
+			if req.Limit == 0 {
+				req.Limit = cursor.Limit
+			}
+		}
+
 		// Validate URL
 		if req.URL == "" {
 			respondError(w, http.StatusBadRequest, "url is required", "MISSING_URL")
 			return
 		}
 
+		if req.MaxDepth < 0 {
+			respondError(w, http.StatusBadRequest, "maxDepth cannot be negative", "INVALID_DEPTH")
+			return
+		}
+
+		if req.Limit < 0 {
+			respondError(w, http.StatusBadRequest, "limit cannot be negative", "INVALID_PAGE")
+			return
+		}
+
+		release, ok := h.acquireArchive(w, r)
+		if !ok {
+			return
+		}
+		defer release()
+
 		h.logger.Info("listing archive files",
-			zap.String("url", req.URL),
+			zap.String("url", lib.DisplayURL(req.URL)),
 			zap.String("inner_path", req.InnerPath),
+			zap.Int("max_depth", req.MaxDepth),
+			zap.Bool("hide_empty_dirs", req.HideEmptyDirs),
+			zap.Bool("sorted", sortsListing(req)),
 			zap.Bool("has_password", req.Password != ""),
 		)
 
-		// List files using QuickList
-		files, err := lib.QuickList(req.URL, req.InnerPath, req.Password, h.config)
+		// A streamed listing isn't paged
+		if acceptsNDJSON(r) && req.Limit == 0 {
+			h.streamList(w, r, req)
+			return
+		}
+
+		archive, err := lib.NewArchiveWithContext(r.Context(), req.URL, h.requestConfig(r, h.rangeBudget.List))
+		var files []formats.FileEntry
+		if err == nil {
+			defer archive.Close()
+			files, err = archive.ListFilesDepth(req.InnerPath, req.Password, req.MaxDepth)
+		}
+		if err == nil && req.HideEmptyDirs {
+			files, err = hideEmptyDirs(archive, files, req)
+		}
 		if err != nil {
 			h.logger.Error("failed to list archive files",
-				zap.String("url", req.URL),
+				zap.String("url", lib.DisplayURL(req.URL)),
 				zap.String("inner_path", req.InnerPath),
 				zap.Error(err),
 			)
+			h.respondListError(w, req, err)
+			return
+		}
+		// The offset of a cursor only means something for the archive it
+		// was issued for
+		if cursor != nil && (cursor.Validator != archive.Validator() || cursor.Size != archive.Size()) {
+			respondError(w, http.StatusConflict, "The archive changed since the cursor was issued; start the listing again", "CURSOR_EXPIRED")
+			return
+		}
+		if sortsListing(req) {
+			formats.SortTree(files)
+		}
 
-			// Determine error type
-			errMsg := err.Error()
-			if strings.Contains(errMsg, "password") {
-				if req.Password != "" {
-					respondError(w, http.StatusUnauthorized, "Incorrect password", "WRONG_PASSWORD")
-				} else {
-					respondError(w, http.StatusUnauthorized, "Password required", "PASSWORD_REQUIRED")
-				}
-			} else if strings.Contains(errMsg, "not found") {
-				respondError(w, http.StatusNotFound, "Path not found in archive", "PATH_NOT_FOUND")
-			} else if strings.Contains(errMsg, "unsupported") || strings.Contains(errMsg, "format") {
-				respondError(w, http.StatusBadRequest, "Unsupported archive format", "UNSUPPORTED_FORMAT")
-			} else if strings.Contains(errMsg, "URL") || strings.Contains(errMsg, "request failed") {
-				respondError(w, http.StatusBadRequest, "Failed to access URL", "URL_ERROR")
-			} else {
-				respondError(w, http.StatusInternalServerError, "Failed to list files", "INTERNAL_ERROR")
+		var nextCursor string
+		if req.Limit > 0 {
+			offset := 0
+			if cursor != nil {
+				offset = cursor.Offset
 			}
-			return
+			if offset > len(files) {
+				offset = len(files)
+			}
+			// Compared before adding so a huge limit can't overflow
+			end := len(files)
+			if req.Limit < len(files)-offset {
+				end = offset + req.Limit
+				nextCursor = h.encodeListCursor(listCursor{
+					URL:           req.URL,
+					InnerPath:     req.InnerPath,
+					MaxDepth:      req.MaxDepth,
+					HideEmptyDirs: req.HideEmptyDirs,
+					Sort:          req.Sort,
+					Limit:         req.Limit,
+					Offset:        end,
+					Validator:     archive.Validator(),
+					Size:          archive.Size(),
+				})
+			}
+			files = files[offset:end]
 		}
 
 		// Convert to response format
 		response := ListResponse{
-			Files: convertFileEntries(files),
+			Files:      h.convertFileEntries(files),
+			NextCursor: nextCursor,
+			Sorted:     sortsListing(req),
 		}
 
 		h.logger.Info("successfully listed archive files",
-			zap.String("url", req.URL),
+			zap.String("url", lib.DisplayURL(req.URL)),
 			zap.String("inner_path", req.InnerPath),
 			zap.Int("file_count", len(files)),
 		)
@@ -72,3 +158,166 @@ func (h *Handler) List() http.HandlerFunc {
 		respondJSON(w, http.StatusOK, response)
 	}
 }
+
+// hideEmptyDirs drops the empty directories from files, the listing of
+// req. Unless it lists every entry, the files deciding whether a directory
+// is empty may lie below it, so they're taken from the full listing.
+func hideEmptyDirs(archive *lib.Archive, files []formats.FileEntry, req ListRequest) ([]formats.FileEntry, error) {
+	if req.InnerPath == "" && req.MaxDepth == 0 {
+		return formats.HideEmptyDirs(files), nil
+	}
+	all, err := archive.ListFiles("", req.Password)
+	if err != nil {
+		return nil, err
+	}
+	return formats.HideEmptyDirsIn(files, all), nil
+}
+
+// sortsListing reports whether the entries of req are sorted: only
+// listings limited by maxDepth are, since sorting needs all of them
+func sortsListing(req ListRequest) bool {
+	return req.Sort && req.MaxDepth > 0
+}
+
+// streamList writes the listing as newline-delimited JSON, one
+// FileEntryResponse per line, while the archive is still being read.
+// If listing fails after entries were sent, the status can't be changed
+// anymore, so an ErrorResponse is written as the final line instead.
+func (h *Handler) streamList(w http.ResponseWriter, r *http.Request, req ListRequest) {
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+
+	archive, err := lib.NewArchiveWithContext(r.Context(), req.URL, h.requestConfig(r, h.rangeBudget.List))
+	if err != nil {
+		h.logger.Error("failed to open archive",
+			zap.String("url", lib.DisplayURL(req.URL)),
+			zap.Error(err),
+		)
+		h.respondListError(w, req, err)
+		return
+	}
+	defer archive.Close()
+
+	// Walk only visits the direct children of a directory, so deeper
+	// levels, and the files telling whether a directory is empty, come
+	// from walking every entry and keeping those below innerPath
+	walkPath, maxDepth := req.InnerPath, req.MaxDepth
+	if req.InnerPath != "" && (req.MaxDepth > 0 || req.HideEmptyDirs) {
+		walkPath = ""
+		if maxDepth == 0 {
+			maxDepth = 1
+		}
+	}
+	listed := func(entry formats.FileEntry) bool {
+		depth := formats.EntryDepth(entry.Path, req.InnerPath)
+		if walkPath != req.InnerPath && depth == 0 {
+			return false
+		}
+		return maxDepth <= 0 || depth <= maxDepth
+	}
+
+	count := 0
+	write := func(entry formats.FileEntry) error {
+		if !listed(entry) {
+			return nil
+		}
+		if count == 0 {
+			w.Header().Set("Content-Type", ndjsonContentType)
+			w.WriteHeader(http.StatusOK)
+		}
+		count++
+
+		if err := encoder.Encode(h.convertFileEntry(entry)); err != nil {
+			return err
+		}
+		if flusher != nil && count%ndjsonFlushInterval == 0 {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	// A sorted listing is bounded by maxDepth, so its entries are held
+	// back and written once the archive has been read
+	var held []formats.FileEntry
+	emit := write
+	if sortsListing(req) {
+		emit = func(entry formats.FileEntry) error {
+			if listed(entry) {
+				held = append(held, entry)
+			}
+			return nil
+		}
+	}
+
+	// With hideEmptyDirs a directory is held back until a file below it
+	// is read, and never sent if none is
+	var pendingDirs []formats.FileEntry
+	err = archive.Walk(walkPath, req.Password, func(entry formats.FileEntry) error {
+		if !req.HideEmptyDirs {
+			return emit(entry)
+		}
+		if entry.IsDir {
+			pendingDirs = append(pendingDirs, entry)
+			return nil
+		}
+
+		kept := pendingDirs[:0]
+		for _, dir := range pendingDirs {
+			if formats.EntryDepth(entry.Path, dir.Path) == 0 {
+				kept = append(kept, dir)
+			} else if err := emit(dir); err != nil {
+				return err
+			}
+		}
+		pendingDirs = kept
+		return emit(entry)
+	})
+	if err == nil && held != nil {
+		formats.SortTree(held)
+		for _, entry := range held {
+			if err = write(entry); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		h.logger.Error("failed to stream archive listing",
+			zap.String("url", lib.DisplayURL(req.URL)),
+			zap.String("inner_path", req.InnerPath),
+			zap.Int("file_count", count),
+			zap.Error(err),
+		)
+
+		if count == 0 {
+			h.respondListError(w, req, err)
+			return
+		}
+		encoder.Encode(ErrorResponse{
+			Error: "Listing stopped before completion",
+			Code:  "LISTING_INCOMPLETE",
+		})
+		return
+	}
+
+	if count == 0 {
+		w.Header().Set("Content-Type", ndjsonContentType)
+		w.WriteHeader(http.StatusOK)
+	}
+
+	h.logger.Info("successfully streamed archive files",
+		zap.String("url", lib.DisplayURL(req.URL)),
+		zap.String("inner_path", req.InnerPath),
+		zap.Int("file_count", count),
+	)
+}
+
+// respondListError maps a listing failure to an error response
+func (h *Handler) respondListError(w http.ResponseWriter, req ListRequest, err error) {
+	status, message, code := classifyArchiveError(err, req.Password, listErrorNames)
+	respondError(w, status, message, code)
+}
+
+// acceptsNDJSON reports whether the client asked for a streamed listing
+func acceptsNDJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), ndjsonContentType)
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// errInvalidCursor is returned for cursors that weren't issued with this
+// server's secret or were altered
+var errInvalidCursor = errors.New("invalid cursor")
+
+// listCursor is what a /api/list cursor carries: the listing it belongs
+// to, where the next page starts, and which version of the archive the
+// offset refers to. It is signed rather than encrypted, so a client can
+// read it but not change it.
+type listCursor struct {
+	URL           string `json:"u"`
+	InnerPath     string `json:"p,omitempty"`
+	MaxDepth      int    `json:"d,omitempty"`
+	HideEmptyDirs bool   `json:"h,omitempty"`
+	Sort          bool   `json:"t,omitempty"`
+	Limit         int    `json:"l"`
+	Offset        int    `json:"o"`
+	Validator     string `json:"v,omitempty"` // ETag or Last-Modified of the archive
+	Size          int64  `json:"s"`
+}
+
+// randomCursorSecret returns a key that only this process knows
+func randomCursorSecret() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic("failed to generate cursor secret: " + err.Error())
+	}
+	return secret
+}
+
+// encodeListCursor returns the token for cursor: its JSON and an
+// HMAC-SHA256 of it, both base64url encoded and joined by a dot
+func (h *Handler) encodeListCursor(cursor listCursor) string {
+	payload, _ := json.Marshal(cursor)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(h.signCursor(encoded))
+}
+
+// decodeListCursor checks the signature of token and returns the cursor
+// it carries
+func (h *Handler) decodeListCursor(token string) (*listCursor, error) {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errInvalidCursor
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(mac, h.signCursor(encoded)) {
+		return nil, errInvalidCursor
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	var cursor listCursor
+	if err := json.Unmarshal(payload, &cursor); err != nil || cursor.Offset < 0 || cursor.Limit <= 0 {
+		return nil, errInvalidCursor
+	}
+	return &cursor, nil
+}
+
+func (h *Handler) signCursor(encoded string) []byte {
+	mac := hmac.New(sha256.New, h.cursorSecret)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/NORMAL-EX/stream-7z/internal/testarchive"
+	"github.com/NORMAL-EX/stream-7z/lib"
+	"go.uber.org/zap"
+)
+
+// listPage requests one page of a listing and decodes it
+func listPage(t *testing.T, h *Handler, req ListRequest, expectedStatus int) (ListResponse, ErrorResponse) {
+	t.Helper()
+
+	rec := postJSON(h.List(), "/api/list", req, nil)
+	if rec.Code != expectedStatus {
+		t.Fatalf("expected %d, got %d: %s", expectedStatus, rec.Code, rec.Body.String())
+	}
+	var resp ListResponse
+	var errResp ErrorResponse
+	if expectedStatus == http.StatusOK {
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+	} else {
+		json.Unmarshal(rec.Body.Bytes(), &errResp)
+	}
+	return resp, errResp
+}
+
+func TestListCursorRoundTrip(t *testing.T) {
+	names := []string{"a.txt", "b.txt", "c.txt", "d.txt", "e.txt"}
+	server := newArchiveServer(t, testarchive.Tar(t, testarchive.Files(names...)...))
+	secret := []byte("shared secret")
+
+	// Each page may be served by a different replica sharing the secret
+	replicas := []*Handler{
+		NewHandler(lib.DefaultConfig(), zap.NewNop()).WithCursorSecret(secret),
+		NewHandler(lib.DefaultConfig(), zap.NewNop()).WithCursorSecret(secret),
+	}
+
+	var paths []string
+	var pages int
+	req := ListRequest{URL: server.URL + "/test.tar", Limit: 2}
+	for {
+		resp, _ := listPage(t, replicas[pages%len(replicas)], req, http.StatusOK)
+		pages++
+		if len(resp.Files) > 2 {
+			t.Fatalf("expected at most 2 entries per page, got %d", len(resp.Files))
+		}
+		for _, file := range resp.Files {
+			paths = append(paths, file.Path)
+		}
+		if resp.NextCursor == "" {
+			break
+		}
+		if pages > len(names) {
+			t.Fatal("the listing never ended")
+		}
+		req = ListRequest{Cursor: resp.NextCursor}
+	}
+	if pages != 3 {
+		t.Errorf("expected 3 pages, got %d", pages)
+	}
+	if !reflect.DeepEqual(paths, names) {
+		t.Errorf("expected %v across the pages, got %v", names, paths)
+	}
+}
+
+func TestListCursorRejected(t *testing.T) {
+	server := newArchiveServer(t, testarchive.Tar(t, testarchive.Files("a.txt", "b.txt", "c.txt")...))
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop()).WithCursorSecret([]byte("secret"))
+
+	resp, _ := listPage(t, h, ListRequest{URL: server.URL + "/test.tar", Limit: 1}, http.StatusOK)
+	if resp.NextCursor == "" {
+		t.Fatal("expected a cursor for the next page")
+	}
+
+	// A cursor whose payload was changed, e.g. to skip ahead
+	tampered := []byte(resp.NextCursor)
+	tampered[3] ^= 1
+	_, errResp := listPage(t, h, ListRequest{Cursor: string(tampered)}, http.StatusBadRequest)
+	if errResp.Code != "INVALID_CURSOR" {
+		t.Errorf("expected INVALID_CURSOR for a tampered cursor, got %q", errResp.Code)
+	}
+
+	// A cursor signed with another secret
+	other := NewHandler(lib.DefaultConfig(), zap.NewNop()).WithCursorSecret([]byte("other"))
+	listPage(t, other, ListRequest{Cursor: resp.NextCursor}, http.StatusBadRequest)
+
+	// A cursor sent with another archive's URL
+	listPage(t, h, ListRequest{URL: server.URL + "/other.tar", Cursor: resp.NextCursor}, http.StatusBadRequest)
+
+	listPage(t, h, ListRequest{URL: server.URL + "/test.tar", Limit: -1}, http.StatusBadRequest)
+}
+
+func TestListCursorHugeLimit(t *testing.T) {
+	names := []string{"a.txt", "b.txt", "c.txt"}
+	server := newArchiveServer(t, testarchive.Tar(t, testarchive.Files(names...)...))
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop())
+
+	resp, _ := listPage(t, h, ListRequest{URL: server.URL + "/test.tar", Limit: 1}, http.StatusOK)
+	if resp.NextCursor == "" {
+		t.Fatal("expected a cursor for the next page")
+	}
+
+	// offset + limit would overflow
+	resp, _ = listPage(t, h, ListRequest{Cursor: resp.NextCursor, Limit: math.MaxInt}, http.StatusOK)
+	if len(resp.Files) != 2 || resp.NextCursor != "" {
+		t.Errorf("expected the remaining 2 entries and no cursor, got %d entries (cursor %q)", len(resp.Files), resp.NextCursor)
+	}
+}
+
+func TestListCursorExpiresWhenArchiveChanges(t *testing.T) {
+	data := testarchive.Tar(t, testarchive.Files("a.txt", "b.txt", "c.txt")...)
+	var version int64 = 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", fmt.Sprintf(`"v%d"`, atomic.LoadInt64(&version)))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop())
+
+	resp, _ := listPage(t, h, ListRequest{URL: server.URL + "/test.tar", Limit: 1}, http.StatusOK)
+	if resp.NextCursor == "" {
+		t.Fatal("expected a cursor for the next page")
+	}
+	listPage(t, h, ListRequest{Cursor: resp.NextCursor}, http.StatusOK)
+
+	// The archive was replaced at the same URL
+	atomic.StoreInt64(&version, 2)
+	_, errResp := listPage(t, h, ListRequest{Cursor: resp.NextCursor}, http.StatusConflict)
+	if errResp.Code != "CURSOR_EXPIRED" {
+		t.Errorf("expected CURSOR_EXPIRED, got %q", errResp.Code)
+	}
+}
@@ -0,0 +1,544 @@
+package handlers
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/NORMAL-EX/stream-7z/internal/testarchive"
+	"github.com/NORMAL-EX/stream-7z/lib"
+	"github.com/NORMAL-EX/stream-7z/lib/formats"
+	"github.com/yeka/zip"
+	"go.uber.org/zap"
+)
+
+// newArchiveServer serves data with Range support
+func newArchiveServer(t *testing.T, data []byte) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// postJSON sends body to handler as a JSON POST request to path, with
+// the extra headers in header (nil = none)
+func postJSON(handler http.Handler, path string, body interface{}, header http.Header) *httptest.ResponseRecorder {
+	payload, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	for name, values := range header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestListStreamsNDJSON(t *testing.T) {
+	names := []string{"a.txt", "docs/b.txt", "docs/c.txt"}
+	server := newArchiveServer(t, testarchive.Tar(t, testarchive.Files(names...)...))
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop())
+
+	rec := postJSON(h.List(), "/api/list", ListRequest{URL: server.URL + "/test.tar"}, http.Header{"Accept": {"application/x-ndjson"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("expected application/x-ndjson, got %q", ct)
+	}
+
+	var paths []string
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		var entry FileEntryResponse
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("line %q is not a file entry: %v", scanner.Text(), err)
+		}
+		paths = append(paths, entry.Path)
+	}
+
+	if strings.Join(paths, ",") != strings.Join(names, ",") {
+		t.Errorf("expected entries %v in archive order, got %v", names, paths)
+	}
+}
+
+func TestListHidesEmptyDirs(t *testing.T) {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for _, name := range []string{"a/", "a/b/", "a/b/c/", "a/b/c/d/", "docs/", "docs/sub/", "docs/sub/readme.txt"} {
+		header := &tar.Header{Name: name, Mode: 0o755, Typeflag: tar.TypeDir}
+		if !strings.HasSuffix(name, "/") {
+			header = &tar.Header{Name: name, Mode: 0o644, Size: 4}
+		}
+		if err := w.WriteHeader(header); err != nil {
+			t.Fatalf("failed to write tar header: %v", err)
+		}
+		if header.Size > 0 {
+			w.Write([]byte("text"))
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close tar writer: %v", err)
+	}
+	server := newArchiveServer(t, buf.Bytes())
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop())
+	expected := []string{"docs/", "docs/sub/", "docs/sub/readme.txt"}
+
+	req := ListRequest{URL: server.URL + "/test.tar", HideEmptyDirs: true}
+	rec := postJSON(h.List(), "/api/list", req, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp ListResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	var paths []string
+	for _, file := range resp.Files {
+		paths = append(paths, file.Path)
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected %v, got %v", expected, paths)
+	}
+
+	rec = postJSON(h.List(), "/api/list", req, http.Header{"Accept": {"application/x-ndjson"}})
+	paths = nil
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		var entry FileEntryResponse
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("line %q is not a file entry: %v", scanner.Text(), err)
+		}
+		paths = append(paths, entry.Path)
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected streamed entries %v, got %v", expected, paths)
+	}
+}
+
+func TestListDepthBelowInnerPath(t *testing.T) {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for _, name := range []string{"readme.txt", "docs/", "docs/a.txt", "docs/empty/", "docs/sub/", "docs/sub/b.txt", "docs/sub/deep/", "docs/sub/deep/c.txt"} {
+		header := &tar.Header{Name: name, Mode: 0o755, Typeflag: tar.TypeDir}
+		if !strings.HasSuffix(name, "/") {
+			header = &tar.Header{Name: name, Mode: 0o644, Size: 4}
+		}
+		if err := w.WriteHeader(header); err != nil {
+			t.Fatalf("failed to write tar header: %v", err)
+		}
+		if header.Size > 0 {
+			w.Write([]byte("text"))
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close tar writer: %v", err)
+	}
+	server := newArchiveServer(t, buf.Bytes())
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop())
+
+	list := func(req ListRequest, accept string) []string {
+		t.Helper()
+		rec := postJSON(h.List(), "/api/list", req, http.Header{"Accept": {accept}})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		var paths []string
+		if accept == "" {
+			var resp ListResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+			for _, file := range resp.Files {
+				paths = append(paths, file.Path)
+			}
+			return paths
+		}
+		scanner := bufio.NewScanner(rec.Body)
+		for scanner.Scan() {
+			var entry FileEntryResponse
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				t.Fatalf("line %q is not a file entry: %v", scanner.Text(), err)
+			}
+			paths = append(paths, entry.Path)
+		}
+		return paths
+	}
+
+	url := server.URL + "/test.tar"
+	tests := []struct {
+		req      ListRequest
+		expected []string
+	}{
+		{ListRequest{URL: url, InnerPath: "docs", MaxDepth: 2}, []string{"docs/a.txt", "docs/empty/", "docs/sub/", "docs/sub/b.txt", "docs/sub/deep/"}},
+		{ListRequest{URL: url, InnerPath: "docs/sub", MaxDepth: 3}, []string{"docs/sub/b.txt", "docs/sub/deep/", "docs/sub/deep/c.txt"}},
+		// Subdirectories holding files stay, whatever the depth
+		{ListRequest{URL: url, InnerPath: "docs", HideEmptyDirs: true}, []string{"docs/a.txt", "docs/sub/"}},
+		{ListRequest{URL: url, InnerPath: "docs/sub", MaxDepth: 1, HideEmptyDirs: true}, []string{"docs/sub/b.txt", "docs/sub/deep/"}},
+	}
+	for _, test := range tests {
+		if paths := list(test.req, ""); !reflect.DeepEqual(paths, test.expected) {
+			t.Errorf("%+v: expected %v, got %v", test.req, test.expected, paths)
+		}
+		if paths := list(test.req, "application/x-ndjson"); !reflect.DeepEqual(paths, test.expected) {
+			t.Errorf("%+v: expected streamed entries %v, got %v", test.req, test.expected, paths)
+		}
+	}
+}
+
+func TestListSortsShallowListings(t *testing.T) {
+	names := []string{"z.txt", "docs/b.txt", "a.txt", "docs/deep/x.txt", "docs/a.txt", "b/c.txt"}
+	server := newArchiveServer(t, testarchive.Tar(t, testarchive.Files(names...)...))
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop())
+
+	list := func(req ListRequest, accept string) ([]string, ListResponse) {
+		t.Helper()
+		rec := postJSON(h.List(), "/api/list", req, http.Header{"Accept": {accept}})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		var paths []string
+		var resp ListResponse
+		if accept == "" {
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+			for _, file := range resp.Files {
+				paths = append(paths, file.Path)
+			}
+			return paths, resp
+		}
+		scanner := bufio.NewScanner(rec.Body)
+		for scanner.Scan() {
+			var entry FileEntryResponse
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				t.Fatalf("line %q is not a file entry: %v", scanner.Text(), err)
+			}
+			paths = append(paths, entry.Path)
+		}
+		return paths, resp
+	}
+
+	// Directories first, then names, each directory followed by its entries
+	sorted := []string{"b/c.txt", "docs/a.txt", "docs/b.txt", "a.txt", "z.txt"}
+	req := ListRequest{URL: server.URL + "/test.tar", MaxDepth: 2, Sort: true}
+	paths, resp := list(req, "")
+	if !reflect.DeepEqual(paths, sorted) || !resp.Sorted {
+		t.Errorf("expected sorted entries %v, got %v (sorted %v)", sorted, paths, resp.Sorted)
+	}
+	if paths, _ := list(req, "application/x-ndjson"); !reflect.DeepEqual(paths, sorted) {
+		t.Errorf("expected streamed sorted entries %v, got %v", sorted, paths)
+	}
+
+	// Pages continue in sorted order
+	req.Limit = 3
+	first, resp := list(req, "")
+	next, _ := list(ListRequest{Cursor: resp.NextCursor}, "")
+	if paged := append(first, next...); !reflect.DeepEqual(paged, sorted) {
+		t.Errorf("expected pages to add up to %v, got %v", sorted, paged)
+	}
+
+	// A full listing isn't sorted, so it can be streamed as it is read
+	paths, resp = list(ListRequest{URL: server.URL + "/test.tar", Sort: true}, "")
+	if !reflect.DeepEqual(paths, names) || resp.Sorted {
+		t.Errorf("expected entries %v in archive order, got %v (sorted %v)", names, paths, resp.Sorted)
+	}
+}
+
+func TestListTarIgnoresPassword(t *testing.T) {
+	server := newArchiveServer(t, testarchive.Tar(t, testarchive.Files("a.txt", "b.txt")...))
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop())
+
+	// A password typed out of habit must not break browsing a tar
+	rec := postJSON(h.List(), "/api/list", ListRequest{URL: server.URL + "/test.tar", Password: "habit"}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var resp ListResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+	if len(resp.Files) != 2 {
+		t.Errorf("expected 2 files, got %d", len(resp.Files))
+	}
+}
+
+func TestListDoesNotForwardClientHeaders(t *testing.T) {
+	data := testarchive.Tar(t, testarchive.Files("a.txt")...)
+	var originHeaders []http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originHeaders = append(originHeaders, r.Header.Clone())
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop())
+	payload, _ := json.Marshal(ListRequest{URL: server.URL + "/test.tar"})
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", "secret")
+	req.Header.Set("Authorization", "Bearer user-token")
+	req.Header.Set("Cookie", "session=1")
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	rec := httptest.NewRecorder()
+	h.List().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if len(originHeaders) == 0 {
+		t.Fatal("expected requests to the origin")
+	}
+	for _, header := range originHeaders {
+		for _, name := range []string{"X-Api-Key", "Authorization", "Cookie", "X-Forwarded-For"} {
+			if value := header.Get(name); value != "" {
+				t.Errorf("client header %s was forwarded to the origin: %q", name, value)
+			}
+		}
+	}
+}
+
+func TestListForwardsAllowListedHeaders(t *testing.T) {
+	data := testarchive.Tar(t, testarchive.Files("a.txt")...)
+	var originHeaders []http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originHeaders = append(originHeaders, r.Header.Clone())
+		if r.Header.Get("X-User-Token") != "user-1" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+
+	config := lib.DefaultConfig().WithOpenErrorCache(lib.NewOpenErrorCache(time.Minute))
+	h := NewHandler(config, zap.NewNop()).
+		WithForwardHeaders([]string{"x-user-token", "Host", "X-API-Key", "Connection"}, "X-API-Key")
+
+	list := func(token string) int {
+		payload, _ := json.Marshal(ListRequest{URL: server.URL + "/test.tar"})
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-Key", "secret")
+		req.Header.Set("Authorization", "Bearer other")
+		if token != "" {
+			req.Header.Set("X-User-Token", token)
+		}
+		rec := httptest.NewRecorder()
+		h.List().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// One user's failure isn't cached for the next
+	if code := list("wrong"); code == http.StatusOK {
+		t.Fatal("expected the wrong token to be refused by the origin")
+	}
+	originHeaders = nil
+	if code := list("user-1"); code != http.StatusOK {
+		t.Fatalf("expected 200 with the forwarded token, got %d", code)
+	}
+
+	if len(originHeaders) == 0 {
+		t.Fatal("expected requests to the origin")
+	}
+	for _, header := range originHeaders {
+		if header.Get("X-User-Token") != "user-1" {
+			t.Errorf("expected the allow-listed header to be forwarded, got %v", header)
+		}
+		if header.Get("X-Api-Key") != "" || header.Get("Authorization") != "" {
+			t.Errorf("expected only allow-listed headers to be forwarded, got %v", header)
+		}
+	}
+	if !reflect.DeepEqual(h.forwardHeaders, []string{"X-User-Token"}) {
+		t.Errorf("expected Host, Connection and the API key header to be dropped, got %v", h.forwardHeaders)
+	}
+}
+
+func TestListStreamErrorBeforeEntries(t *testing.T) {
+	server := newArchiveServer(t, bytes.Repeat([]byte{0x00, 0x01, 0x02, 0x03}, 256))
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop())
+
+	// The data isn't an archive, so the walk fails before any entry is sent
+	rec := postJSON(h.List(), "/api/list", ListRequest{URL: server.URL + "/test.tar"}, http.Header{"Accept": {"application/x-ndjson"}})
+	if rec.Code == http.StatusOK {
+		t.Fatalf("expected an error status, got 200: %s", rec.Body.String())
+	}
+
+	var resp ErrorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Code == "" {
+		t.Errorf("expected a JSON error response, got %q", rec.Body.String())
+	}
+}
+
+func TestRangeBudgetRejectsFragmentedArchive(t *testing.T) {
+	names := make([]string, 100)
+	for i := range names {
+		names[i] = fmt.Sprintf("f%03d.txt", i)
+	}
+	server := newArchiveServer(t, testarchive.Tar(t, testarchive.Files(names...)...))
+	config := lib.DefaultConfig().WithWholeDownloadThreshold(0).WithFetchSizes(0, 0)
+	h := NewHandler(config, zap.NewNop()).WithRangeBudget(RangeBudget{List: 10})
+
+	rec := postJSON(h.List(), "/api/list", ListRequest{URL: server.URL + "/test.tar"}, nil)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp ErrorResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if resp.Code != "ARCHIVE_TOO_FRAGMENTED" {
+		t.Errorf("expected ARCHIVE_TOO_FRAGMENTED, got %q", resp.Code)
+	}
+
+	// The budget is per route: info has none here
+	rec = postJSON(h.Info(), "/api/info", InfoRequest{URL: server.URL + "/test.tar"}, nil)
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200 from info, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestListSanitizesSuspiciousNames(t *testing.T) {
+	server := newArchiveServer(t, testarchive.Tar(t, testarchive.Files("ok.txt", "evil\nname.txt", "\x1b[31mred.txt")...))
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop())
+
+	rec := postJSON(h.List(), "/api/list", ListRequest{URL: server.URL + "/test.tar"}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp ListResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response: %v", err)
+	}
+
+	expected := map[string]string{
+		"ok.txt":           "",
+		`evil\x0aname.txt`: "evil\nname.txt",
+		`\x1b[31mred.txt`:  "\x1b[31mred.txt",
+	}
+	for _, file := range resp.Files {
+		raw, ok := expected[file.Path]
+		if !ok {
+			t.Errorf("unexpected path %q", file.Path)
+			continue
+		}
+		if file.RawPath != raw || file.Suspicious != (raw != "") {
+			t.Errorf("%q: got rawPath %q, suspicious %v", file.Path, file.RawPath, file.Suspicious)
+		}
+	}
+
+	entry := NewHandler(lib.DefaultConfig(), zap.NewNop()).convertFileEntry(formats.FileEntry{Path: "nul\x00.txt"})
+	if entry.Path != `nul\x00.txt` || !entry.Suspicious || entry.RawPath != "nul\x00.txt" {
+		t.Errorf("unexpected entry for a name with NUL: %+v", entry)
+	}
+}
+
+func TestListCanonicalPaths(t *testing.T) {
+	var zipBuf bytes.Buffer
+	zw := zip.NewWriter(&zipBuf)
+	for _, name := range []string{`win\dir\file.txt`, "/abs.txt", "folder/", "folder/inner.txt"} {
+		fw, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("failed to create zip entry: %v", err)
+		}
+		if !strings.HasSuffix(name, "/") {
+			fw.Write([]byte("text"))
+		}
+	}
+	zw.Close()
+
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	for _, name := range []string{"./docs", "./docs/readme.txt", "/etc/passwd"} {
+		header := &tar.Header{Name: name, Mode: 0o644, Size: 4}
+		if name == "./docs" {
+			header = &tar.Header{Name: name, Mode: 0o755, Typeflag: tar.TypeDir}
+		}
+		tw.WriteHeader(header)
+		if header.Size > 0 {
+			tw.Write([]byte("text"))
+		}
+	}
+	tw.Close()
+
+	tests := []struct {
+		name     string
+		data     []byte
+		expected map[string]string // Canonical path to rawPath
+	}{
+		{"test.zip", zipBuf.Bytes(), map[string]string{
+			"win/dir/file.txt": `win\dir\file.txt`,
+			"abs.txt":          "",
+			"folder/":          "",
+			"folder/inner.txt": "",
+		}},
+		{"test.tar", tarBuf.Bytes(), map[string]string{
+			"docs/":           "",
+			"docs/readme.txt": "",
+			"etc/passwd":      "",
+		}},
+	}
+
+	for _, test := range tests {
+		server := newArchiveServer(t, test.data)
+		archiveURL := server.URL + "/" + test.name
+		h := NewHandler(lib.DefaultConfig(), zap.NewNop()).WithCanonicalPaths(true)
+
+		rec := postJSON(h.List(), "/api/list", ListRequest{URL: archiveURL}, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", test.name, rec.Code, rec.Body.String())
+		}
+		var resp ListResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		if len(resp.Files) != len(test.expected) {
+			t.Errorf("%s: expected %d entries, got %+v", test.name, len(test.expected), resp.Files)
+		}
+
+		for _, file := range resp.Files {
+			raw, ok := test.expected[file.Path]
+			if !ok {
+				t.Errorf("%s: unexpected path %q", test.name, file.Path)
+				continue
+			}
+			if file.RawPath != raw {
+				t.Errorf("%s: %q has rawPath %q, expected %q", test.name, file.Path, file.RawPath, raw)
+			}
+			if file.IsDir {
+				continue
+			}
+
+			// Every file is extracted by rawPath if it has one, else by path
+			member := file.Path
+			if file.RawPath != "" {
+				member = file.RawPath
+			}
+			rec := postJSON(h.Extract(), "/api/extract", ExtractRequest{URL: archiveURL, File: member}, nil)
+			if rec.Code != http.StatusOK || rec.Body.String() != "text" {
+				t.Errorf("%s: extracting %q returned %d: %s", test.name, member, rec.Code, rec.Body.String())
+			}
+		}
+	}
+
+	// Without the option the stored names are listed
+	server := newArchiveServer(t, tarBuf.Bytes())
+	rec := postJSON(NewHandler(lib.DefaultConfig(), zap.NewNop()).List(), "/api/list", ListRequest{URL: server.URL + "/test.tar"}, nil)
+	var resp ListResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if len(resp.Files) == 0 || resp.Files[0].Path != "./docs" {
+		t.Errorf("expected the stored names without canonical paths, got %+v", resp.Files)
+	}
+}
@@ -2,11 +2,14 @@ package handlers
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"net"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
@@ -25,6 +28,64 @@ func Chain(middlewares ...Middleware) Middleware {
 	}
 }
 
+// ChainConfig holds the built-in middleware composed by BuildChain. Nil
+// fields are left out of the chain.
+type ChainConfig struct {
+	IPWhitelist   *IPWhitelistMiddleware
+	CORS          *CORSMiddleware
+	RateLimiter   *RateLimiter
+	MaxConcurrent int // 0 = no concurrency limit
+	Auth          *EnhancedAuthMiddleware
+
+	// Concurrent requests allowed per client IP (0 = no per-IP limit)
+	MaxConcurrentPerIP int
+
+	// Proxies whose forwarded headers name the client for the per-IP limit
+	// (nil = always the connection address)
+	TrustedProxies *TrustedProxies
+
+	// Creates request IDs for requests without one (nil = NewRequestID)
+	RequestIDGenerator func() string
+}
+
+// BuildChain composes the middleware wrapping every API route, followed by
+// extra, so servers embedding these handlers can add their own, e.g.
+// tracing or another authentication scheme.
+//
+// The order matters: recovery comes first so it also catches panics in
+// later middleware, then logging and the request ID so rejected requests
+// are logged too. The IP whitelist, CORS, rate and concurrency limits
+// reject requests before authentication runs, and extra middleware runs
+// last, after authentication, right before the handler.
+func BuildChain(config ChainConfig, logger *zap.Logger, extra ...Middleware) Middleware {
+	middlewares := []Middleware{
+		RecoveryMiddleware(logger),
+		LoggingMiddleware(logger),
+		RequestIDMiddlewareWithGenerator(config.RequestIDGenerator),
+	}
+	if config.IPWhitelist != nil {
+		middlewares = append(middlewares, config.IPWhitelist.Handler())
+	}
+	if config.CORS != nil {
+		middlewares = append(middlewares, config.CORS.Handler())
+	}
+	if config.RateLimiter != nil {
+		middlewares = append(middlewares, config.RateLimiter.Handler())
+	}
+	// Per-IP first, so requests over one client's share don't take
+	// global slots from others
+	if config.MaxConcurrentPerIP > 0 {
+		middlewares = append(middlewares, PerIPConcurrencyLimitMiddleware(config.MaxConcurrentPerIP, config.TrustedProxies, logger))
+	}
+	if config.MaxConcurrent > 0 {
+		middlewares = append(middlewares, ConcurrencyLimitMiddleware(config.MaxConcurrent, logger))
+	}
+	if config.Auth != nil {
+		middlewares = append(middlewares, config.Auth.Handler())
+	}
+	return Chain(append(middlewares, extra...)...)
+}
+
 // AuthMiddleware provides API key authentication
 type AuthMiddleware struct {
 	enabled   bool
@@ -293,6 +354,8 @@ func LoggingMiddleware(logger *zap.Logger) Middleware {
 				zap.String("remote_addr", r.RemoteAddr),
 				zap.Int("status", wrapped.statusCode),
 				zap.Duration("duration", duration),
+				// Set by RequestIDMiddleware, which runs after this one
+				zap.String("request_id", w.Header().Get("X-Request-ID")),
 			)
 		})
 	}
@@ -304,6 +367,11 @@ func RecoveryMiddleware(logger *zap.Logger) Middleware {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			defer func() {
 				if err := recover(); err != nil {
+					// Handlers abort a response that has already started this way
+					if err == http.ErrAbortHandler {
+						panic(err)
+					}
+
 					logger.Error("panic recovered",
 						zap.Any("error", err),
 						zap.String("path", r.URL.Path),
@@ -344,6 +412,49 @@ func ConcurrencyLimitMiddleware(maxConcurrent int, logger *zap.Logger) Middlewar
 	}
 }
 
+// PerIPConcurrencyLimitMiddleware limits concurrent requests per client
+// IP, so one client can't take every slot of ConcurrencyLimitMiddleware.
+// A request counts until its handler returns. Clients are told apart by
+// proxies.ClientIP, so forwarded headers only count when they come from a
+// trusted proxy; a nil proxies uses the connection address alone.
+func PerIPConcurrencyLimitMiddleware(maxPerIP int, proxies *TrustedProxies, logger *zap.Logger) Middleware {
+	var mu sync.Mutex
+	active := make(map[string]int)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			clientIP := proxies.ClientIP(r)
+
+			mu.Lock()
+			if active[clientIP] >= maxPerIP {
+				mu.Unlock()
+				logger.Warn("max concurrent requests per IP reached",
+					zap.String("ip", clientIP),
+					zap.String("path", r.URL.Path),
+				)
+				respondJSON(w, http.StatusTooManyRequests, ErrorResponse{
+					Error: "Too many concurrent requests from this IP",
+					Code:  "TOO_MANY_CONCURRENT_REQUESTS",
+				})
+				return
+			}
+			active[clientIP]++
+			mu.Unlock()
+
+			defer func() {
+				mu.Lock()
+				// Drop idle IPs so the map doesn't grow with every client seen
+				active[clientIP]--
+				if active[clientIP] == 0 {
+					delete(active, clientIP)
+				}
+				mu.Unlock()
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 // responseWriter wraps http.ResponseWriter to capture status code
 type responseWriter struct {
 	http.ResponseWriter
@@ -355,6 +466,11 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap lets http.ResponseController reach the underlying connection
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 // getClientIP extracts the real client IP address
 func getClientIP(r *http.Request) string {
 	// Check X-Forwarded-For header
@@ -380,6 +496,84 @@ func getClientIP(r *http.Request) string {
 	return ip
 }
 
+// TrustedProxies holds the reverse proxies allowed to name the client of a
+// request in X-Forwarded-For or X-Real-IP. Anyone else could put any
+// address there, so their requests are identified by the connection.
+type TrustedProxies struct {
+	ips   map[string]bool
+	cidrs []*net.IPNet
+}
+
+// NewTrustedProxies parses proxies, given as single IPs or CIDR ranges
+func NewTrustedProxies(proxies []string) (*TrustedProxies, error) {
+	tp := &TrustedProxies{ips: make(map[string]bool)}
+	for _, entry := range proxies {
+		entry = strings.TrimSpace(entry)
+		if strings.Contains(entry, "/") {
+			_, ipNet, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+			}
+			tp.cidrs = append(tp.cidrs, ipNet)
+			continue
+		}
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+		}
+		tp.ips[ip.String()] = true
+	}
+	return tp, nil
+}
+
+// isTrusted reports whether ip is one of the proxies
+func (tp *TrustedProxies) isTrusted(ip string) bool {
+	if tp == nil {
+		return false
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	if tp.ips[parsed.String()] {
+		return true
+	}
+	for _, ipNet := range tp.cidrs {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the client address of r. That's the connection address
+// unless it belongs to a trusted proxy; then X-Forwarded-For is read from
+// the right, skipping trusted proxies, since only the entries they appended
+// can be believed, and X-Real-IP is used when that header is missing.
+func (tp *TrustedProxies) ClientIP(r *http.Request) string {
+	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteIP = r.RemoteAddr
+	}
+	if !tp.isTrusted(remoteIP) {
+		return remoteIP
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if hop != "" && !tp.isTrusted(hop) {
+				return hop
+			}
+		}
+	}
+	if xri := strings.TrimSpace(r.Header.Get("X-Real-IP")); xri != "" {
+		return xri
+	}
+	return remoteIP
+}
+
 func min(a, b float64) float64 {
 	if a < b {
 		return a
@@ -395,14 +589,104 @@ const (
 	RequestIDKey ContextKey = "request_id"
 )
 
-// RequestIDMiddleware adds a unique request ID to each request
+// RequestIDMiddleware adds a unique request ID to each request. An ID
+// sent by the client in X-Request-ID is reused, or else the trace ID of a
+// W3C traceparent header, so the request can be followed across services.
 func RequestIDMiddleware() Middleware {
+	return RequestIDMiddlewareWithGenerator(NewRequestID)
+}
+
+// RequestIDMiddlewareWithGenerator is RequestIDMiddleware with generate
+// creating the IDs of requests that don't bring their own
+func RequestIDMiddlewareWithGenerator(generate func() string) Middleware {
+	if generate == nil {
+		generate = NewRequestID
+	}
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			requestID := fmt.Sprintf("%d", time.Now().UnixNano())
+			requestID := inboundRequestID(r)
+			if requestID == "" {
+				requestID = generate()
+			}
 			ctx := context.WithValue(r.Context(), RequestIDKey, requestID)
 			w.Header().Set("X-Request-ID", requestID)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
+
+// requestIDCounter numbers the IDs created by NewRequestID
+var requestIDCounter uint64
+
+// NewRequestID returns a request ID unique within the process: a counter,
+// so IDs sort in creation order, followed by a random suffix that keeps
+// them unique across restarts and instances and hard to guess.
+func NewRequestID() string {
+	n := atomic.AddUint64(&requestIDCounter, 1)
+	var suffix [8]byte
+	rand.Read(suffix[:])
+	return fmt.Sprintf("%012x-%s", n, hex.EncodeToString(suffix[:]))
+}
+
+// maxRequestIDLength bounds request IDs taken from clients
+const maxRequestIDLength = 128
+
+// inboundRequestID returns the request ID sent by the client, if usable
+func inboundRequestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); isValidRequestID(id) {
+		return id
+	}
+	return traceIDFromTraceparent(r.Header.Get("traceparent"))
+}
+
+// isValidRequestID accepts printable ASCII without spaces, so a client
+// can't inject anything into logs or response headers
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7E {
+			return false
+		}
+	}
+	return true
+}
+
+// traceIDFromTraceparent returns the trace ID of a W3C traceparent value
+// ("version-traceid-parentid-flags"), or "" if the value is invalid
+func traceIDFromTraceparent(value string) string {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 {
+		return ""
+	}
+	traceID := parts[1]
+	if strings.Trim(traceID, "0") == "" {
+		return ""
+	}
+	for i := 0; i < len(traceID); i++ {
+		c := traceID[i]
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return ""
+		}
+	}
+	return traceID
+}
+
+// RequestIDFromContext returns the request ID set by RequestIDMiddleware
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(RequestIDKey).(string)
+	return requestID
+}
+
+// LibraryLogFunc returns a lib.Config LogFunc writing the library's debug
+// messages to logger, tagged with the request ID of the operation
+func LibraryLogFunc(logger *zap.Logger) func(ctx context.Context, message string) {
+	return func(ctx context.Context, message string) {
+		fields := []zap.Field{zap.String("message", message)}
+		if requestID := RequestIDFromContext(ctx); requestID != "" {
+			fields = append(fields, zap.String("request_id", requestID))
+		}
+		logger.Info("library", fields...)
+	}
+}
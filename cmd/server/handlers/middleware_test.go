@@ -0,0 +1,333 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/NORMAL-EX/stream-7z/internal/testarchive"
+	"github.com/NORMAL-EX/stream-7z/lib"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestBuildChainRunsExtraAfterAuth(t *testing.T) {
+	logger := zap.NewNop()
+	var reached int
+	extra := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			reached++
+			if r.Header.Get("X-Panic") != "" {
+				panic("extra middleware failed")
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	chain := BuildChain(ChainConfig{
+		MaxConcurrent: 1,
+		Auth:          NewEnhancedAuthMiddleware(true, "X-API-Key", []string{"secret"}, logger),
+	}, logger, extra)
+	handler := chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	serve := func(headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/info", nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := serve(nil); rec.Code != http.StatusUnauthorized || reached != 0 {
+		t.Errorf("expected auth to reject before extra middleware, got %d (reached %d)", rec.Code, reached)
+	}
+
+	rec := serve(map[string]string{"X-API-Key": "secret"})
+	if rec.Code != http.StatusNoContent || reached != 1 {
+		t.Errorf("expected 204 through extra middleware, got %d (reached %d)", rec.Code, reached)
+	}
+	if rec.Header().Get("X-Request-ID") == "" {
+		t.Error("expected a request ID from the built-in chain")
+	}
+
+	// Recovery wraps the whole chain, extra middleware included
+	if rec := serve(map[string]string{"X-API-Key": "secret", "X-Panic": "1"}); rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected a recovered 500, got %d", rec.Code)
+	}
+}
+
+func TestRequestIDReachesLibraryLogs(t *testing.T) {
+	data := testarchive.Tar(t, testarchive.Files("a.txt")...)
+	// Without Accept-Ranges on HEAD the library logs a warning
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+
+	core, logs := observer.New(zap.InfoLevel)
+	logger := zap.New(core)
+	config := lib.DefaultConfig().WithDebug(true).WithLogFunc(LibraryLogFunc(logger))
+	h := NewHandler(config, logger)
+	handler := Chain(LoggingMiddleware(logger), RequestIDMiddleware())(h.Info())
+
+	tests := []struct {
+		name     string
+		header   string
+		value    string
+		expected string
+	}{
+		{"generated", "", "", ""},
+		{"X-Request-ID", "X-Request-ID", "client-id-42", "client-id-42"},
+		{"traceparent", "traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "4bf92f3577b34da6a3ce929d0e0e4736"},
+		{"invalid X-Request-ID", "X-Request-ID", "has space", ""},
+	}
+
+	for _, test := range tests {
+		logs.TakeAll()
+
+		payload, _ := json.Marshal(InfoRequest{URL: server.URL + "/test.tar"})
+		req := httptest.NewRequest(http.MethodPost, "/api/info", bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		if test.header != "" {
+			req.Header.Set(test.header, test.value)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", test.name, rec.Code, rec.Body.String())
+		}
+		requestID := rec.Header().Get("X-Request-ID")
+		if requestID == "" || (test.expected != "" && requestID != test.expected) {
+			t.Errorf("%s: X-Request-ID = %q, expected %q", test.name, requestID, test.expected)
+		}
+		if test.expected == "" && requestID == test.value {
+			t.Errorf("%s: expected the invalid ID to be replaced", test.name)
+		}
+
+		library := logs.FilterMessage("library").AllUntimed()
+		if len(library) == 0 {
+			t.Fatalf("%s: expected library log lines", test.name)
+		}
+		for _, entry := range library {
+			if got := entry.ContextMap()["request_id"]; got != requestID {
+				t.Errorf("%s: library log %q has request_id %v, expected %s", test.name, entry.ContextMap()["message"], got, requestID)
+			}
+		}
+		access := logs.FilterMessage("request").AllUntimed()
+		if len(access) != 1 || access[0].ContextMap()["request_id"] != requestID {
+			t.Errorf("%s: expected the access log to carry request_id %s", test.name, requestID)
+		}
+	}
+}
+
+func TestNewRequestIDUnique(t *testing.T) {
+	const workers, perWorker = 16, 2000
+
+	ids := make(chan string, workers*perWorker)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perWorker; j++ {
+				ids <- NewRequestID()
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[string]bool, workers*perWorker)
+	for id := range ids {
+		if seen[id] {
+			t.Fatalf("duplicate request ID %s", id)
+		}
+		if !isValidRequestID(id) {
+			t.Fatalf("generated request ID %q would be rejected inbound", id)
+		}
+		seen[id] = true
+	}
+
+	// IDs sort in creation order
+	if first, second := NewRequestID(), NewRequestID(); first >= second {
+		t.Errorf("expected %s to sort before %s", first, second)
+	}
+}
+
+func TestBuildChainRequestIDGenerator(t *testing.T) {
+	chain := BuildChain(ChainConfig{
+		RequestIDGenerator: func() string { return "fixed-id" },
+	}, zap.NewNop())
+	handler := chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := RequestIDFromContext(r.Context()); got != "fixed-id" {
+			t.Errorf("request ID in context = %q, expected fixed-id", got)
+		}
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if got := rec.Header().Get("X-Request-ID"); got != "fixed-id" {
+		t.Errorf("X-Request-ID = %q, expected fixed-id", got)
+	}
+}
+
+func TestBuildChainPerIPConcurrencyLimit(t *testing.T) {
+	proxies, err := NewTrustedProxies([]string{"203.0.113.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := BuildChain(ChainConfig{
+		MaxConcurrent:      10,
+		MaxConcurrentPerIP: 2,
+		TrustedProxies:     proxies,
+	}, zap.NewNop())
+
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+	handler := chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	serve := func(remoteAddr string, forwardedFor ...string) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/info", nil)
+		req.RemoteAddr = remoteAddr
+		for _, ip := range forwardedFor {
+			req.Header.Add("X-Forwarded-For", ip)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Fill both slots of one IP, then send more from it concurrently. It
+	// isn't a trusted proxy, so naming other clients in X-Forwarded-For or
+	// X-Real-IP doesn't get it more slots.
+	var wg sync.WaitGroup
+	codes := make(chan int, 8)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes <- serve("192.0.2.1:" + strconv.Itoa(40000+i))
+		}(i)
+	}
+	for i := 0; i < 2; i++ {
+		<-started
+	}
+	var rejected sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		rejected.Add(1)
+		go func(i int) {
+			defer rejected.Done()
+			spoofed := "10.0.0." + strconv.Itoa(i+1)
+			codes <- serve("192.0.2.1:"+strconv.Itoa(41000+i), spoofed)
+		}(i)
+	}
+	rejected.Wait()
+
+	// Another IP still gets through while the first is at its limit
+	other := make(chan int, 1)
+	go func() { other <- serve("198.51.100.7:5000") }()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a request from another IP to reach the handler")
+	}
+
+	// A trusted proxy's requests count against the client it forwards for
+	forwarded := make(chan int, 1)
+	go func() { forwarded <- serve("203.0.113.5:6000", "198.51.100.7, 192.0.2.1", "203.0.113.9") }()
+	if code := <-forwarded; code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 for a proxied request from the limited IP, got %d", code)
+	}
+	go func() { forwarded <- serve("203.0.113.5:6001", "192.0.2.1, 198.51.100.8") }()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a proxied request from another client to reach the handler")
+	}
+
+	close(release)
+	wg.Wait()
+	if code := <-other; code != http.StatusNoContent {
+		t.Errorf("expected 204 for the other IP, got %d", code)
+	}
+	if code := <-forwarded; code != http.StatusNoContent {
+		t.Errorf("expected 204 for the other proxied client, got %d", code)
+	}
+	close(codes)
+	counts := map[int]int{}
+	for code := range codes {
+		counts[code]++
+	}
+	if counts[http.StatusNoContent] != 2 || counts[http.StatusTooManyRequests] != 6 {
+		t.Errorf("expected 2 requests served and 6 rejected with 429, got %v", counts)
+	}
+
+	// Finished requests free their slots
+	if code := serve("192.0.2.1:42000"); code != http.StatusNoContent {
+		t.Errorf("expected 204 once the IP's requests finished, got %d", code)
+	}
+}
+
+func TestTrustedProxiesClientIP(t *testing.T) {
+	proxies, err := NewTrustedProxies([]string{"10.0.0.1", "172.16.0.0/12"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		proxies    *TrustedProxies
+		remoteAddr string
+		xff        string
+		xri        string
+		want       string
+	}{
+		{"no proxies", nil, "192.0.2.1:1234", "198.51.100.1", "198.51.100.2", "192.0.2.1"},
+		{"untrusted peer", proxies, "192.0.2.1:1234", "198.51.100.1", "", "192.0.2.1"},
+		{"trusted peer", proxies, "10.0.0.1:1234", "198.51.100.1", "", "198.51.100.1"},
+		{"spoofed entries before the proxy's", proxies, "10.0.0.1:1234", "1.2.3.4, 198.51.100.1", "", "198.51.100.1"},
+		{"chain of trusted proxies", proxies, "10.0.0.1:1234", "198.51.100.1, 172.16.3.4", "", "198.51.100.1"},
+		{"X-Real-IP from a trusted peer", proxies, "172.20.0.1:1234", "", "198.51.100.3", "198.51.100.3"},
+		{"trusted peer without headers", proxies, "10.0.0.1:1234", "", "", "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			if tt.xri != "" {
+				req.Header.Set("X-Real-IP", tt.xri)
+			}
+			if got := tt.proxies.ClientIP(req); got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := NewTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("expected an error for an invalid CIDR")
+	}
+	if _, err := NewTrustedProxies([]string{"proxy.local"}); err == nil {
+		t.Error("expected an error for an entry that isn't an IP")
+	}
+}
@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/NORMAL-EX/stream-7z/lib"
+	"go.uber.org/zap"
+)
+
+// OperationRegistry tracks the long-running operations in flight (extract,
+// download, hash, extract-to), so an operator can list them and cancel a
+// runaway one without restarting the server
+type OperationRegistry struct {
+	mu  sync.Mutex
+	ops map[*Operation]struct{}
+}
+
+// NewOperationRegistry creates an empty operation registry
+func NewOperationRegistry() *OperationRegistry {
+	return &OperationRegistry{ops: make(map[*Operation]struct{})}
+}
+
+// Operation is one tracked operation
+type Operation struct {
+	RequestID string
+	Kind      string // Endpoint name, e.g. "extract"
+	URL       string // Without the payload of a data: URL
+	Started   time.Time
+
+	bytes    int64 // Written to the client or sink, updated atomically
+	cancel   context.CancelFunc
+	registry *OperationRegistry
+}
+
+// Start registers an operation for r and returns r with a context that
+// Cancel aborts. Finish must be called once the operation is over.
+func (reg *OperationRegistry) Start(r *http.Request, kind, url string) (*http.Request, *Operation) {
+	ctx, cancel := context.WithCancel(r.Context())
+	op := &Operation{
+		RequestID: RequestIDFromContext(ctx),
+		Kind:      kind,
+		URL:       lib.DisplayURL(url),
+		Started:   time.Now(),
+		cancel:    cancel,
+		registry:  reg,
+	}
+
+	reg.mu.Lock()
+	reg.ops[op] = struct{}{}
+	reg.mu.Unlock()
+
+	return r.WithContext(ctx), op
+}
+
+// Finish unregisters the operation and releases its context
+func (op *Operation) Finish() {
+	op.registry.mu.Lock()
+	delete(op.registry.ops, op)
+	op.registry.mu.Unlock()
+	op.cancel()
+}
+
+// Bytes returns the number of bytes the operation has written so far
+func (op *Operation) Bytes() int64 {
+	return atomic.LoadInt64(&op.bytes)
+}
+
+// Writer returns w counting the bytes written into the operation
+func (op *Operation) Writer(w io.Writer) io.Writer {
+	return &operationWriter{w: w, op: op}
+}
+
+type operationWriter struct {
+	w  io.Writer
+	op *Operation
+}
+
+func (ow *operationWriter) Write(p []byte) (int, error) {
+	n, err := ow.w.Write(p)
+	atomic.AddInt64(&ow.op.bytes, int64(n))
+	return n, err
+}
+
+// List returns the operations in flight, oldest first
+func (reg *OperationRegistry) List() []*Operation {
+	reg.mu.Lock()
+	ops := make([]*Operation, 0, len(reg.ops))
+	for op := range reg.ops {
+		ops = append(ops, op)
+	}
+	reg.mu.Unlock()
+
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].Started.Before(ops[j].Started)
+	})
+	return ops
+}
+
+// Cancel cancels the operations with the given request ID and returns how
+// many there were. Client-supplied request IDs need not be unique, so
+// this may be more than one.
+func (reg *OperationRegistry) Cancel(requestID string) int {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	canceled := 0
+	for op := range reg.ops {
+		if op.RequestID == requestID {
+			op.cancel()
+			canceled++
+		}
+	}
+	return canceled
+}
+
+// ListOperations handles GET /api/admin/operations requests
+func (h *Handler) ListOperations() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			respondError(w, http.StatusMethodNotAllowed, "Method not allowed, use GET", "METHOD_NOT_ALLOWED")
+			return
+		}
+
+		ops := h.operations.List()
+		response := OperationsResponse{Operations: make([]OperationResponse, 0, len(ops))}
+		for _, op := range ops {
+			response.Operations = append(response.Operations, OperationResponse{
+				RequestID:        op.RequestID,
+				Kind:             op.Kind,
+				URL:              op.URL,
+				StartedAt:        op.Started.Format(time.RFC3339),
+				BytesTransferred: op.Bytes(),
+			})
+		}
+		respondJSON(w, http.StatusOK, response)
+	}
+}
+
+// CancelOperation handles POST /api/admin/operations/cancel requests
+func (h *Handler) CancelOperation() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req CancelOperationRequest
+		if err := parseJSONRequest(w, r, &req); err != nil {
+			return
+		}
+
+		if req.RequestID == "" {
+			respondError(w, http.StatusBadRequest, "requestId is required", "MISSING_REQUEST_ID")
+			return
+		}
+
+		canceled := h.operations.Cancel(req.RequestID)
+		if canceled == 0 {
+			respondError(w, http.StatusNotFound, "No operation in flight with this request ID", "OPERATION_NOT_FOUND")
+			return
+		}
+
+		h.logger.Warn("operation canceled by admin",
+			zap.String("request_id", req.RequestID),
+			zap.Int("canceled", canceled),
+			zap.String("remote_addr", r.RemoteAddr),
+		)
+
+		respondJSON(w, http.StatusOK, CancelOperationResponse{
+			RequestID: req.RequestID,
+			Canceled:  canceled,
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/NORMAL-EX/stream-7z/internal/testarchive"
+	"github.com/NORMAL-EX/stream-7z/lib"
+	"go.uber.org/zap"
+)
+
+func TestCancelOperationAbortsExtraction(t *testing.T) {
+	data := testarchive.Tar(t, testarchive.Files("a.txt")...)
+	// Range requests hang until the client goes away, like a wedged origin
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			return
+		}
+		<-r.Context().Done()
+	}))
+	t.Cleanup(origin.Close)
+
+	h := NewHandler(lib.DefaultConfig().WithWholeDownloadThreshold(0), zap.NewNop())
+	extract := RequestIDMiddleware()(h.Extract())
+
+	payload, _ := json.Marshal(ExtractRequest{URL: origin.URL + "/test.tar", File: "a.txt"})
+	req := httptest.NewRequest(http.MethodPost, "/api/extract", bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Request-ID", "runaway-1")
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rec := httptest.NewRecorder()
+		extract.ServeHTTP(rec, req)
+		done <- rec
+	}()
+
+	// Wait for the extraction to show up in the listing
+	var listed OperationsResponse
+	deadline := time.Now().Add(5 * time.Second)
+	for len(listed.Operations) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("extraction never appeared in the operation listing")
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		rec := httptest.NewRecorder()
+		h.ListOperations().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/admin/operations", nil))
+		listed = OperationsResponse{}
+		json.NewDecoder(rec.Body).Decode(&listed)
+	}
+	op := listed.Operations[0]
+	if op.RequestID != "runaway-1" || op.Kind != "extract" || op.URL != origin.URL+"/test.tar" {
+		t.Errorf("unexpected operation %+v", op)
+	}
+
+	rec := postJSON(h.CancelOperation(), "/api/admin/operations/cancel", CancelOperationRequest{RequestID: "runaway-1"}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 from cancel, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	select {
+	case rec := <-done:
+		if rec.Code == http.StatusOK {
+			t.Error("expected the canceled extraction to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("extraction kept running after it was canceled")
+	}
+
+	if ops := h.operations.List(); len(ops) != 0 {
+		t.Errorf("expected the finished operation to be unregistered, got %d", len(ops))
+	}
+	if rec := postJSON(h.CancelOperation(), "/api/admin/operations/cancel", CancelOperationRequest{RequestID: "runaway-1"}, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a finished operation, got %d", rec.Code)
+	}
+}
+
+func TestOperationRegistry(t *testing.T) {
+	server := newArchiveServer(t, testarchive.Tar(t, testarchive.Files("a.txt")...))
+	registry := NewOperationRegistry()
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop()).WithOperationRegistry(registry)
+
+	rec := postJSON(h.Extract(), "/api/extract", ExtractRequest{URL: server.URL + "/test.tar", File: "a.txt"}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if ops := registry.List(); len(ops) != 0 {
+		t.Errorf("expected no operations left after the request, got %d", len(ops))
+	}
+
+	r, op := registry.Start(httptest.NewRequest(http.MethodPost, "/", nil), "hash", "http://example.com/a.zip")
+	defer op.Finish()
+	op.Writer(&bytes.Buffer{}).Write([]byte("12345"))
+	if op.Bytes() != 5 {
+		t.Errorf("expected 5 bytes counted, got %d", op.Bytes())
+	}
+	if registry.Cancel(op.RequestID) != 1 || r.Context().Err() == nil {
+		t.Error("expected Cancel to cancel the operation's context")
+	}
+
+	// An inline archive isn't kept in the listing
+	_, inline := registry.Start(httptest.NewRequest(http.MethodPost, "/", nil), "hash", "data:application/zip;base64,UEsDBBQ=")
+	defer inline.Finish()
+	if inline.URL != "data:application/zip;base64,<8 bytes>" {
+		t.Errorf("expected the data: URL payload to be left out, got %q", inline.URL)
+	}
+}
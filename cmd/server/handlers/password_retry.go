@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NORMAL-EX/stream-7z/lib"
+)
+
+// PasswordRetryPool keeps an archive whose /api/info request ended asking
+// for a password open for a short time, so the client's retry with the
+// password reuses it: the HEAD request, format detection and the ranges
+// read so far aren't repeated, only the password is checked. The archive
+// caches its directory per password, so the retry never sees a listing
+// read with another password. A parked archive keeps its slot in the
+// ArchiveLimiter until it is reused or expires, so at most maxParked
+// archives are parked at once.
+type PasswordRetryPool struct {
+	ttl       time.Duration
+	maxParked int // 0 = no limit
+
+	// Header carrying the API key; archives parked for one client are
+	// never reused by another
+	apiKeyHeader string
+
+	mu     sync.Mutex
+	parked map[string]*parkedArchive
+}
+
+// parkedArchive is an open archive waiting for a retry
+type parkedArchive struct {
+	archive *lib.Archive
+	release func() // Frees the archive's limiter slot
+	timer   *time.Timer
+}
+
+// NewPasswordRetryPool creates a pool keeping at most maxParked archives
+// (0 = no limit) for ttl
+func NewPasswordRetryPool(ttl time.Duration, maxParked int) *PasswordRetryPool {
+	return &PasswordRetryPool{
+		ttl:       ttl,
+		maxParked: maxParked,
+		parked:    make(map[string]*parkedArchive),
+	}
+}
+
+// WithAPIKeyHeader scopes parked archives to the API key sent in the
+// named header, so one client's retry never reuses an archive another
+// client opened.
+func (p *PasswordRetryPool) WithAPIKeyHeader(name string) *PasswordRetryPool {
+	p.apiKeyHeader = name
+	return p
+}
+
+// park keeps archive for a retry under key, closing it and calling
+// release once ttl passes without one. An archive parked earlier under
+// the same key is closed. It returns false, leaving archive to the
+// caller, when the pool is full.
+func (p *PasswordRetryPool) park(key string, archive *lib.Archive, release func()) bool {
+	parked := &parkedArchive{archive: archive, release: release}
+
+	p.mu.Lock()
+	previous := p.parked[key]
+	if previous == nil && p.maxParked > 0 && len(p.parked) >= p.maxParked {
+		p.mu.Unlock()
+		return false
+	}
+	p.parked[key] = parked
+	// Whoever stops the timer owns the archive; if it fires first, the
+	// archive is closed here
+	parked.timer = time.AfterFunc(p.ttl, func() {
+		p.mu.Lock()
+		if p.parked[key] == parked {
+			delete(p.parked, key)
+		}
+		p.mu.Unlock()
+		parked.close()
+	})
+	p.mu.Unlock()
+
+	if previous != nil && previous.timer.Stop() {
+		previous.close()
+	}
+	return true
+}
+
+// take removes and returns the archive parked under key, if any. The
+// caller must close it and call release.
+func (p *PasswordRetryPool) take(key string) (*lib.Archive, func(), bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	parked, ok := p.parked[key]
+	if !ok || !parked.timer.Stop() {
+		return nil, nil, false
+	}
+	delete(p.parked, key)
+	return parked.archive, parked.release, true
+}
+
+// Close closes every parked archive
+func (p *PasswordRetryPool) Close() {
+	p.mu.Lock()
+	parked := p.parked
+	p.parked = make(map[string]*parkedArchive)
+	p.mu.Unlock()
+
+	for _, entry := range parked {
+		if entry.timer.Stop() {
+			entry.close()
+		}
+	}
+}
+
+// close closes the archive and frees its slot
+func (pa *parkedArchive) close() {
+	pa.archive.Close()
+	pa.release()
+}
+
+// retryKey identifies the archive a request opens: the client's API key,
+// the URL and the headers forwarded to the origin, so a retry only reuses
+// an archive the same client fetched with the same credentials
+func (h *Handler) retryKey(r *http.Request, archiveURL string) string {
+	forwarded := h.forwardedHeaders(r)
+	names := make([]string, 0, len(forwarded))
+	for name := range forwarded {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var key strings.Builder
+	if name := h.passwordRetries.apiKeyHeader; name != "" {
+		key.WriteString(r.Header.Get(name) + "\x00")
+	}
+	key.WriteString(archiveURL)
+	for _, name := range names {
+		key.WriteString("\x00" + name + "\x00" + forwarded[name])
+	}
+	return key.String()
+}
@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/NORMAL-EX/stream-7z/internal/testarchive"
+	"github.com/NORMAL-EX/stream-7z/lib"
+	"github.com/yeka/zip"
+	"go.uber.org/zap"
+)
+
+func TestInfoPasswordRetryReusesArchive(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	fw, err := zw.Encrypt("secret.txt", "pass", zip.AES256Encryption)
+	if err != nil {
+		t.Fatalf("failed to create encrypted zip entry: %v", err)
+	}
+	fw.Write([]byte("secret content"))
+	if err := zw.Close(); err != nil {
+		t.Fatalf("failed to close zip writer: %v", err)
+	}
+	data := buf.Bytes()
+
+	var heads int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			atomic.AddInt64(&heads, 1)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+
+	pool := NewPasswordRetryPool(time.Minute, 0).WithAPIKeyHeader("X-API-Key")
+	t.Cleanup(pool.Close)
+	limiter := NewArchiveLimiter(1, 0)
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop()).
+		WithArchiveLimiter(limiter).
+		WithPasswordRetryPool(pool)
+
+	info := func(password string, expectedStatus int) *InfoResponse {
+		t.Helper()
+		rec := postJSON(h.Info(), "/api/info", InfoRequest{URL: server.URL + "/secret.zip", Password: password}, nil)
+		if rec.Code != expectedStatus {
+			t.Fatalf("expected %d with password %q, got %d: %s", expectedStatus, password, rec.Code, rec.Body.String())
+		}
+		var resp InfoResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return &resp
+	}
+
+	if resp := info("", http.StatusOK); !resp.RequiresPassword {
+		t.Fatal("expected the archive to require a password")
+	}
+	if n := limiter.OpenCount(); n != 1 {
+		t.Errorf("expected the parked archive to keep its slot, %d open", n)
+	}
+
+	// A wrong password is parked again for the next attempt
+	info("wrong", http.StatusUnauthorized)
+	if resp := info("pass", http.StatusOK); resp.RequiresPassword {
+		t.Error("expected the correct password to be accepted")
+	}
+	if n := atomic.LoadInt64(&heads); n != 1 {
+		t.Errorf("expected the retries to reuse the archive, sent %d HEAD requests", n)
+	}
+	if n := limiter.OpenCount(); n != 0 {
+		t.Errorf("expected the archive to be closed after a successful retry, %d open", n)
+	}
+
+	// Nothing is parked once the password was accepted
+	info("pass", http.StatusOK)
+	if n := atomic.LoadInt64(&heads); n != 2 {
+		t.Errorf("expected a new request to reopen the archive, sent %d HEAD requests", n)
+	}
+}
+
+func TestPasswordRetryPoolExpires(t *testing.T) {
+	server := newArchiveServer(t, testarchive.Tar(t, testarchive.Files("a.txt")...))
+	archive, err := lib.NewArchive(server.URL+"/test.tar", nil)
+	if err != nil {
+		t.Fatalf("NewArchive failed: %v", err)
+	}
+
+	released := make(chan struct{})
+	pool := NewPasswordRetryPool(10*time.Millisecond, 0)
+	pool.park("key", archive, func() { close(released) })
+
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Fatal("expected the parked archive to be released after the ttl")
+	}
+	if _, _, ok := pool.take("key"); ok {
+		t.Error("expected an expired archive not to be reused")
+	}
+}
+
+func TestPasswordRetryKeyIncludesAPIKey(t *testing.T) {
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop()).
+		WithPasswordRetryPool(NewPasswordRetryPool(time.Minute, 0).WithAPIKeyHeader("X-API-Key"))
+
+	request := func(apiKey string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/api/info", nil)
+		r.Header.Set("X-API-Key", apiKey)
+		return r
+	}
+	const url = "http://origin/secret.zip"
+	if h.retryKey(request("alice"), url) == h.retryKey(request("bob"), url) {
+		t.Error("expected clients with different API keys to get different retry keys")
+	}
+	if h.retryKey(request("alice"), url) != h.retryKey(request("alice"), url) {
+		t.Error("expected the same client to get the same retry key")
+	}
+}
+
+func TestPasswordRetryPoolFull(t *testing.T) {
+	server := newArchiveServer(t, testarchive.Tar(t, testarchive.Files("a.txt")...))
+	open := func() *lib.Archive {
+		archive, err := lib.NewArchive(server.URL+"/test.tar", nil)
+		if err != nil {
+			t.Fatalf("NewArchive failed: %v", err)
+		}
+		return archive
+	}
+
+	pool := NewPasswordRetryPool(time.Minute, 1)
+	t.Cleanup(pool.Close)
+
+	if !pool.park("first", open(), func() {}) {
+		t.Fatal("expected the first archive to be parked")
+	}
+	second := open()
+	if pool.park("second", second, func() {}) {
+		t.Fatal("expected a full pool to refuse another archive")
+	}
+	second.Close()
+
+	// Parking again under the same key replaces the archive
+	if !pool.park("first", open(), func() {}) {
+		t.Error("expected an archive to replace the one parked under its key")
+	}
+	if _, _, ok := pool.take("second"); ok {
+		t.Error("expected the refused archive not to be parked")
+	}
+}
+
+func TestInfoPasswordRetryNotReusedAcrossAPIKeys(t *testing.T) {
+	data := testarchive.Zip(t, testarchive.Entry{Name: "secret.txt", Content: "secret content", Method: zip.Deflate, Password: "pass"})
+
+	var heads int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			atomic.AddInt64(&heads, 1)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+
+	pool := NewPasswordRetryPool(time.Minute, 0).WithAPIKeyHeader("X-API-Key")
+	t.Cleanup(pool.Close)
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop()).WithPasswordRetryPool(pool)
+
+	info := func(apiKey, password string) {
+		t.Helper()
+		req := InfoRequest{URL: server.URL + "/secret.zip", Password: password}
+		if rec := postJSON(h.Info(), "/api/info", req, http.Header{"X-API-Key": {apiKey}}); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+	}
+
+	info("alice", "")
+	info("bob", "pass")
+	if n := atomic.LoadInt64(&heads); n != 2 {
+		t.Errorf("expected another client's retry to open the archive itself, sent %d HEAD requests", n)
+	}
+	info("alice", "pass")
+	if n := atomic.LoadInt64(&heads); n != 2 {
+		t.Errorf("expected the client's own retry to reuse its archive, sent %d HEAD requests", n)
+	}
+}
@@ -0,0 +1,226 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/NORMAL-EX/stream-7z/lib/utils"
+	"go.uber.org/zap"
+)
+
+// Sink is a destination that extracted files are written to on the server
+// side instead of being streamed back to the client, e.g. an uploader for
+// a storage bucket.
+type Sink interface {
+	// Create opens the destination object called name. size is the
+	// uncompressed size of the member, or -1 if it isn't known; some
+	// formats only report it as a hint. If ctx is canceled before the
+	// writer is closed, the write failed and Close must discard it.
+	Create(ctx context.Context, name string, size int64) (io.WriteCloser, error)
+}
+
+// ErrSinkFull is returned when writing a file would take the sink's
+// temporary files over their size limit
+var ErrSinkFull = errors.New("sink temporary space limit reached")
+
+// DirectorySink writes extracted files below a local directory, such as
+// a mounted bucket or a directory watched by an upload agent
+type DirectorySink struct {
+	root string
+
+	// Bytes the temporary files of writes in progress may hold together
+	// (0 = no limit), and the bytes reserved by them so far
+	maxTempBytes int64
+	tempBytes    int64
+}
+
+// NewDirectorySink creates a sink writing below root
+func NewDirectorySink(root string) *DirectorySink {
+	return &DirectorySink{root: root}
+}
+
+// WithMaxTempBytes limits the disk space used by files still being
+// written. A write whose known size doesn't fit is refused up front, and
+// one that grows past the limit fails, with ErrSinkFull (0 = no limit).
+func (s *DirectorySink) WithMaxTempBytes(max int64) *DirectorySink {
+	s.maxTempBytes = max
+	return s
+}
+
+// reserve claims n bytes of temporary space, reporting whether they fit
+func (s *DirectorySink) reserve(n int64) bool {
+	total := atomic.AddInt64(&s.tempBytes, n)
+	if s.maxTempBytes > 0 && total > s.maxTempBytes {
+		atomic.AddInt64(&s.tempBytes, -n)
+		return false
+	}
+	return true
+}
+
+// release returns n bytes of temporary space
+func (s *DirectorySink) release(n int64) {
+	atomic.AddInt64(&s.tempBytes, -n)
+}
+
+// TempBytes returns the bytes reserved by writes in progress
+func (s *DirectorySink) TempBytes() int64 {
+	return atomic.LoadInt64(&s.tempBytes)
+}
+
+// sinkTempDir is the directory below the root that files being written
+// are kept in. Targets inside it are refused, so CleanTemp never removes
+// a finished file.
+const sinkTempDir = ".stream-7z-tmp"
+
+// ErrReservedTarget is returned for targets inside the sink's temporary
+// directory
+var ErrReservedTarget = errors.New("target is inside the sink's temporary directory")
+
+// CleanTemp removes temporary files left by writes that never finished,
+// e.g. because the server was killed. It must not run while files are
+// being written. It returns the number of files removed.
+func (s *DirectorySink) CleanTemp() (int, error) {
+	entries, err := os.ReadDir(filepath.Join(s.root, sinkTempDir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.root, sinkTempDir, entry.Name())); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// Create creates name below the root directory. The file is written to
+// the temporary directory and only appears at its final path once it is
+// complete.
+func (s *DirectorySink) Create(ctx context.Context, name string, size int64) (io.WriteCloser, error) {
+	target, err := utils.SafeJoin(s.root, name)
+	if err != nil {
+		return nil, err
+	}
+	if first, _, _ := strings.Cut(utils.NormalizePath(name), "/"); first == sinkTempDir {
+		return nil, ErrReservedTarget
+	}
+	tempDir := filepath.Join(s.root, sinkTempDir)
+	for _, dir := range []string{filepath.Dir(target), tempDir} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create directory: %w", err)
+		}
+	}
+
+	reserved := size
+	if reserved < 0 {
+		reserved = 0
+	}
+	if !s.reserve(reserved) {
+		return nil, fmt.Errorf("%w: %d bytes needed", ErrSinkFull, size)
+	}
+
+	file, err := os.CreateTemp(tempDir, filepath.Base(target)+".*.tmp")
+	if err != nil {
+		s.release(reserved)
+		return nil, fmt.Errorf("failed to create file: %w", err)
+	}
+
+	return &directorySinkFile{ctx: ctx, sink: s, file: file, target: target, reserved: reserved}, nil
+}
+
+// directorySinkFile is a file being written by DirectorySink
+type directorySinkFile struct {
+	ctx      context.Context
+	sink     *DirectorySink
+	file     *os.File
+	target   string
+	reserved int64 // Temporary space claimed, grown when the size hint was low
+	written  int64
+}
+
+func (f *directorySinkFile) Write(p []byte) (int, error) {
+	if extra := f.written + int64(len(p)) - f.reserved; extra > 0 {
+		if !f.sink.reserve(extra) {
+			return 0, ErrSinkFull
+		}
+		f.reserved += extra
+	}
+	n, err := f.file.Write(p)
+	f.written += int64(n)
+	return n, err
+}
+
+// Close moves the file into place, or removes it if the write was canceled
+func (f *directorySinkFile) Close() error {
+	defer f.sink.release(f.reserved)
+
+	err := f.file.Close()
+	if err == nil {
+		err = f.ctx.Err()
+	}
+	if err == nil {
+		err = os.Rename(f.file.Name(), f.target)
+	}
+	if err != nil {
+		os.Remove(f.file.Name())
+	}
+	return err
+}
+
+// ScopeMiddleware restricts an endpoint to a subset of the API keys
+type ScopeMiddleware struct {
+	headerKey string
+	apiKeys   map[string]bool
+	logger    *zap.Logger
+}
+
+// NewScopeMiddleware creates a middleware allowing only the given API keys.
+// An empty list allows every key accepted by the auth middleware.
+func NewScopeMiddleware(headerKey string, apiKeys []string, logger *zap.Logger) *ScopeMiddleware {
+	apiKeysMap := make(map[string]bool)
+	for _, key := range apiKeys {
+		if key != "" {
+			apiKeysMap[key] = true
+		}
+	}
+
+	return &ScopeMiddleware{
+		headerKey: headerKey,
+		apiKeys:   apiKeysMap,
+		logger:    logger,
+	}
+}
+
+// Handler returns the middleware handler
+func (sm *ScopeMiddleware) Handler() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(sm.apiKeys) > 0 && !sm.apiKeys[r.Header.Get(sm.headerKey)] {
+				sm.logger.Warn("API key not allowed for endpoint",
+					zap.String("remote_addr", r.RemoteAddr),
+					zap.String("path", r.URL.Path),
+				)
+				respondError(w, http.StatusForbidden, "Forbidden: API key is not allowed to use this endpoint", "INSUFFICIENT_SCOPE")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
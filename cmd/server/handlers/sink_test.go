@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/NORMAL-EX/stream-7z/internal/testarchive"
+	"github.com/NORMAL-EX/stream-7z/lib"
+	"github.com/NORMAL-EX/stream-7z/lib/utils"
+	"github.com/yeka/zip"
+	"go.uber.org/zap"
+)
+
+// sinkFiles lists the regular files below root, relative to it
+func sinkFiles(t *testing.T, root string) []string {
+	t.Helper()
+
+	var files []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			rel, _ := filepath.Rel(root, path)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to walk %s: %v", root, err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestDirectorySinkCreate(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "sink")
+	sink := NewDirectorySink(root)
+	ctx := context.Background()
+
+	for _, name := range []string{"../escape.txt", "docs/../../escape.txt", "/../escape.txt"} {
+		if _, err := sink.Create(ctx, name, 4); !errors.Is(err, utils.ErrPathTraversal) {
+			t.Errorf("%s: expected ErrPathTraversal, got %v", name, err)
+		}
+	}
+	if _, err := sink.Create(ctx, sinkTempDir+"/a.txt", 4); !errors.Is(err, ErrReservedTarget) {
+		t.Errorf("expected ErrReservedTarget inside the temporary directory, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(parent, "escape.txt")); err == nil {
+		t.Error("expected nothing to be written outside the root")
+	}
+
+	// The file only appears at its path once it is closed
+	w, err := sink.Create(ctx, "docs/a.txt", 5)
+	if err != nil {
+		t.Fatalf("failed to create docs/a.txt: %v", err)
+	}
+	w.Write([]byte("hello"))
+	if files := sinkFiles(t, root); len(files) != 1 || !strings.HasPrefix(files[0], sinkTempDir+"/a.txt.") {
+		t.Errorf("expected only a temporary file while writing, got %v", files)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close docs/a.txt: %v", err)
+	}
+	if files := sinkFiles(t, root); len(files) != 1 || files[0] != "docs/a.txt" {
+		t.Errorf("expected docs/a.txt alone after closing, got %v", files)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "docs", "a.txt")); string(data) != "hello" {
+		t.Errorf("expected hello, got %q", data)
+	}
+
+	// A write canceled before Close leaves nothing behind
+	canceled, cancel := context.WithCancel(ctx)
+	w, err = sink.Create(canceled, "b.txt", -1)
+	if err != nil {
+		t.Fatalf("failed to create b.txt: %v", err)
+	}
+	w.Write([]byte("partial"))
+	cancel()
+	if err := w.Close(); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected Close to report the cancellation, got %v", err)
+	}
+	if files := sinkFiles(t, root); len(files) != 1 || files[0] != "docs/a.txt" {
+		t.Errorf("expected the canceled write to be removed, got %v", files)
+	}
+}
+
+func TestDirectorySinkTempLimit(t *testing.T) {
+	sink := NewDirectorySink(t.TempDir()).WithMaxTempBytes(10)
+	ctx := context.Background()
+
+	first, err := sink.Create(ctx, "a.txt", 8)
+	if err != nil {
+		t.Fatalf("failed to create a.txt: %v", err)
+	}
+	if _, err := sink.Create(ctx, "b.txt", 5); !errors.Is(err, ErrSinkFull) {
+		t.Fatalf("expected ErrSinkFull while a.txt holds the space, got %v", err)
+	}
+
+	// An unknown size is claimed as the data arrives
+	second, err := sink.Create(ctx, "c.txt", -1)
+	if err != nil {
+		t.Fatalf("failed to create c.txt: %v", err)
+	}
+	if _, err := second.Write([]byte("12")); err != nil {
+		t.Fatalf("expected a write within the limit to succeed, got %v", err)
+	}
+	if _, err := second.Write([]byte("345")); !errors.Is(err, ErrSinkFull) {
+		t.Errorf("expected a write past the limit to fail, got %v", err)
+	}
+	second.Close()
+
+	first.Write([]byte("12345678"))
+	if err := first.Close(); err != nil {
+		t.Fatalf("failed to close a.txt: %v", err)
+	}
+	if n := sink.TempBytes(); n != 0 {
+		t.Errorf("expected all space released after closing, %d bytes still held", n)
+	}
+	if _, err := sink.Create(ctx, "b.txt", 5); err != nil {
+		t.Errorf("expected space to be available again, got %v", err)
+	}
+}
+
+func TestDirectorySinkCleanTemp(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, sinkTempDir), 0o755)
+	os.MkdirAll(filepath.Join(root, "docs"), 0o755)
+	files := map[string]bool{
+		sinkTempDir + "/guide.pdf.123456.tmp": true, // Left by a killed write
+		sinkTempDir + "/a.txt.42.tmp":         true,
+		"docs/guide.pdf":                      false,
+		"notes.tmp":                           false,
+		".report.2024.tmp":                    false, // A user file named like a temporary one
+		"docs/.guide.pdf.123456.tmp":          false,
+	}
+	for name := range files {
+		os.WriteFile(filepath.Join(root, name), []byte("x"), 0o644)
+	}
+
+	removed, err := NewDirectorySink(root).CleanTemp()
+	if err != nil || removed != 2 {
+		t.Fatalf("expected 2 files removed, got %d: %v", removed, err)
+	}
+	for name, orphan := range files {
+		_, err := os.Stat(filepath.Join(root, name))
+		if exists := err == nil; exists == orphan {
+			t.Errorf("%s: expected removed=%v", name, orphan)
+		}
+	}
+
+	// A finished write of such a name survives a restart
+	sink := NewDirectorySink(root)
+	w, err := sink.Create(context.Background(), ".summary.7.tmp", 2)
+	if err != nil {
+		t.Fatalf("failed to create .summary.7.tmp: %v", err)
+	}
+	w.Write([]byte("ok"))
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close .summary.7.tmp: %v", err)
+	}
+	if removed, err := sink.CleanTemp(); err != nil || removed != 0 {
+		t.Errorf("expected nothing removed, got %d: %v", removed, err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, ".summary.7.tmp")); string(data) != "ok" {
+		t.Errorf("expected the finished file to survive, got %q", data)
+	}
+
+	if _, err := NewDirectorySink(filepath.Join(root, "missing")).CleanTemp(); err != nil {
+		t.Errorf("expected a missing root to be fine, got %v", err)
+	}
+}
+
+func TestExtractToSinkFull(t *testing.T) {
+	server := newArchiveServer(t, testarchive.Tar(t, testarchive.Files("a.txt")...))
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop()).
+		WithSink(NewDirectorySink(t.TempDir()).WithMaxTempBytes(4))
+
+	rec := postJSON(h.ExtractTo(), "/api/extract-to", ExtractToRequest{URL: server.URL + "/test.tar", File: "a.txt"}, nil)
+	if rec.Code != http.StatusInsufficientStorage {
+		t.Fatalf("expected 507, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestExtractTo(t *testing.T) {
+	// A deflated member damaged halfway fails after part of it was written
+	var text strings.Builder
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&text, "line %d of %d\n", i*i, i)
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	fw, _ := zw.Create("broken.txt")
+	fw.Write([]byte(text.String()))
+	if err := zw.Close(); err != nil {
+		t.Fatalf("failed to close zip writer: %v", err)
+	}
+	corrupt := buf.Bytes()
+	for i := len(corrupt) / 3; i < len(corrupt)/3+64; i++ {
+		corrupt[i] ^= 0xFF
+	}
+
+	tarServer := newArchiveServer(t, testarchive.Tar(t, testarchive.Files("a.txt")...))
+	zipServer := newArchiveServer(t, corrupt)
+	root := t.TempDir()
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop()).WithSink(NewDirectorySink(root))
+
+	rec := postJSON(h.ExtractTo(), "/api/extract-to", ExtractToRequest{URL: tarServer.URL + "/test.tar", File: "a.txt", Target: "out/a.txt"}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "out", "a.txt")); string(data) != "content of a.txt" {
+		t.Errorf("expected the member at its target, got %q", data)
+	}
+
+	rec = postJSON(h.ExtractTo(), "/api/extract-to", ExtractToRequest{URL: tarServer.URL + "/test.tar", File: "a.txt", Target: "../escape.txt"}, nil)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "INVALID_TARGET") {
+		t.Errorf("expected 400 INVALID_TARGET for a target outside the sink, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = postJSON(h.ExtractTo(), "/api/extract-to", ExtractToRequest{URL: zipServer.URL + "/test.zip", File: "broken.txt"}, nil)
+	if rec.Code != http.StatusBadGateway || !strings.Contains(rec.Body.String(), "SINK_ERROR") {
+		t.Errorf("expected 502 SINK_ERROR for a member failing to decompress, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if files := sinkFiles(t, root); len(files) != 1 || files[0] != "out/a.txt" {
+		t.Errorf("expected only out/a.txt in the sink, got %v", files)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(root), "escape.txt")); err == nil {
+		t.Error("expected nothing to be written outside the sink")
+	}
+}
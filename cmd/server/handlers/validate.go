@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/NORMAL-EX/stream-7z/lib"
+	"github.com/NORMAL-EX/stream-7z/lib/formats"
+	"github.com/NORMAL-EX/stream-7z/lib/rangehttp"
+	"github.com/NORMAL-EX/stream-7z/lib/utils"
+	"go.uber.org/zap"
+)
+
+// Validate handles POST /api/validate requests. It only sends the HEAD
+// request and detects the format, without reading the archive's
+// directory, so a client can check a URL before browsing it. A URL that
+// isn't a usable archive is a normal result with valid set to false and a
+// reason, not an error response.
+func (h *Handler) Validate() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ValidateRequest
+		if err := parseJSONRequest(w, r, &req); err != nil {
+			return
+		}
+
+		if req.URL == "" {
+			respondError(w, http.StatusBadRequest, "url is required", "MISSING_URL")
+			return
+		}
+
+		release, ok := h.acquireArchive(w, r)
+		if !ok {
+			return
+		}
+		defer release()
+
+		h.logger.Info("validating archive URL", zap.String("url", lib.DisplayURL(req.URL)))
+
+		archive, err := lib.NewArchiveWithContext(r.Context(), req.URL, h.requestConfig(r, 0))
+		if err != nil {
+			reason, message := validateFailure(err)
+			h.logger.Info("archive URL is not valid",
+				zap.String("url", lib.DisplayURL(req.URL)),
+				zap.String("reason", reason),
+				zap.Error(err),
+			)
+			respondJSON(w, http.StatusOK, ValidateResponse{
+				Reason: reason,
+				Error:  message,
+			})
+			return
+		}
+		defer archive.Close()
+
+		response := ValidateResponse{
+			Valid:         true,
+			Format:        archive.Format(),
+			Size:          archive.Size(),
+			SupportsRange: archive.SupportsRange(),
+		}
+		// Formats that can only tell by reading their directory leave
+		// requiresPassword out; /api/info answers it
+		if required, known, err := archive.RequiresPassword(); err == nil && known {
+			response.RequiresPassword = &required
+		}
+
+		h.logger.Info("validated archive URL",
+			zap.String("url", lib.DisplayURL(req.URL)),
+			zap.String("format", response.Format),
+			zap.Int64("size", response.Size),
+		)
+
+		respondJSON(w, http.StatusOK, response)
+	}
+}
+
+// validateFailure returns the reason and message /api/validate reports
+// for a URL that couldn't be opened as an archive
+func validateFailure(err error) (string, string) {
+	var statusErr *rangehttp.StatusError
+	switch {
+	case errors.As(err, &statusErr) && (statusErr.StatusCode == http.StatusNotFound || statusErr.StatusCode == http.StatusGone):
+		return "NOT_FOUND", "The URL does not exist"
+	case errors.Is(err, utils.ErrNotAnArchive):
+		return "NOT_AN_ARCHIVE", "The URL returned a web page, not an archive file"
+	case errors.Is(err, formats.ErrEncryptedContainer):
+		return "ENCRYPTED_CONTAINER", "The file is encrypted as a whole; decrypt it before opening"
+	case errors.Is(err, utils.ErrUnsupportedFormat):
+		return "UNSUPPORTED_FORMAT", "Unsupported archive format"
+	case errors.Is(err, utils.ErrRangeNotSupported):
+		return "RANGE_NOT_SUPPORTED", "The server does not support range requests and the archive is too large to download"
+	default:
+		return "URL_ERROR", "Failed to access URL"
+	}
+}
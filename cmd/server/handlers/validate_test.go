@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/NORMAL-EX/stream-7z/internal/testarchive"
+	"github.com/NORMAL-EX/stream-7z/lib"
+	"github.com/yeka/zip"
+	"go.uber.org/zap"
+)
+
+func TestValidate(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	fw, err := zw.Encrypt("secret.txt", "pass", zip.AES256Encryption)
+	if err != nil {
+		t.Fatalf("failed to create encrypted zip entry: %v", err)
+	}
+	fw.Write([]byte("secret content"))
+	if err := zw.Close(); err != nil {
+		t.Fatalf("failed to close zip writer: %v", err)
+	}
+	encryptedZip := buf.Bytes()
+	tarData := testarchive.Tar(t, testarchive.Files("a.txt", "b.txt")...)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/secret.zip":
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(encryptedZip))
+		case "/plain.tar":
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(tarData))
+		case "/login":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader([]byte("<!DOCTYPE html><html><body>Sign in</body></html>")))
+		case "/data.bin":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(bytes.Repeat([]byte{0x42}, 4096)))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	h := NewHandler(lib.DefaultConfig(), zap.NewNop())
+	yes, no := true, false
+
+	tests := []struct {
+		name     string
+		path     string
+		expected ValidateResponse
+	}{
+		{"encrypted zip", "/secret.zip", ValidateResponse{Valid: true, Format: "zip", Size: int64(len(encryptedZip)), SupportsRange: true, RequiresPassword: &yes}},
+		{"tar", "/plain.tar", ValidateResponse{Valid: true, Format: "tar", Size: int64(len(tarData)), SupportsRange: true, RequiresPassword: &no}},
+		{"not found", "/missing.zip", ValidateResponse{Reason: "NOT_FOUND"}},
+		{"web page", "/login", ValidateResponse{Reason: "NOT_AN_ARCHIVE"}},
+		{"unsupported", "/data.bin", ValidateResponse{Reason: "UNSUPPORTED_FORMAT"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := postJSON(h.Validate(), "/api/validate", ValidateRequest{URL: server.URL + tt.path}, nil)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+			}
+
+			var resp ValidateResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+			if !tt.expected.Valid && resp.Error == "" {
+				t.Error("expected a message for an invalid URL")
+			}
+			resp.Error = ""
+			if resp.Valid != tt.expected.Valid || resp.Format != tt.expected.Format || resp.Size != tt.expected.Size ||
+				resp.SupportsRange != tt.expected.SupportsRange || resp.Reason != tt.expected.Reason {
+				t.Errorf("expected %+v, got %+v", tt.expected, resp)
+			}
+			if (resp.RequiresPassword == nil) != (tt.expected.RequiresPassword == nil) ||
+				(resp.RequiresPassword != nil && *resp.RequiresPassword != *tt.expected.RequiresPassword) {
+				t.Errorf("expected requiresPassword %v, got %v", tt.expected.RequiresPassword, resp.RequiresPassword)
+			}
+		})
+	}
+
+	rec := postJSON(h.Validate(), "/api/validate", ValidateRequest{}, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without a URL, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// newLogger builds the server logger from the logging settings. A
+// non-empty levelFlag (the -log-level flag) overrides settings.Level.
+func newLogger(levelFlag string, settings LoggingSettings) (*zap.Logger, error) {
+	levelName := settings.Level
+	if levelFlag != "" {
+		levelName = levelFlag
+	}
+	level, err := zapcore.ParseLevel(levelName)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %w", levelName, err)
+	}
+
+	config := zap.NewProductionConfig()
+	config.Level = zap.NewAtomicLevelAt(level)
+	config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	config.EncoderConfig.TimeKey = "time"
+	switch settings.Format {
+	case "", "json":
+	case "console":
+		config.Encoding = "console"
+	default:
+		return nil, fmt.Errorf("invalid log format %q", settings.Format)
+	}
+
+	return config.Build()
+}
+
+// libraryLogFunc returns a lib.Config LogFunc writing the library's debug
+// messages to logger at debug level, or at info level when library.debug
+// asks for them regardless of the log level
+func libraryLogFunc(logger *zap.Logger, verbose bool) func(ctx context.Context, message string) {
+	logger = logger.With(zap.String("component", "lib"))
+	return func(ctx context.Context, message string) {
+		if verbose {
+			logger.Info(message)
+			return
+		}
+		logger.Debug(message)
+	}
+}
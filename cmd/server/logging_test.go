@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func TestNewLoggerLevel(t *testing.T) {
+	tests := []struct {
+		name      string
+		levelFlag string
+		settings  LoggingSettings
+		enabled   zapcore.Level
+		disabled  zapcore.Level
+	}{
+		{"config level", "", LoggingSettings{Level: "warn", Format: "json"}, zapcore.WarnLevel, zapcore.InfoLevel},
+		{"flag overrides config", "warn", LoggingSettings{Level: "debug", Format: "json"}, zapcore.WarnLevel, zapcore.InfoLevel},
+		{"console format", "error", LoggingSettings{Level: "debug", Format: "console"}, zapcore.ErrorLevel, zapcore.WarnLevel},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, err := newLogger(tt.levelFlag, tt.settings)
+			if err != nil {
+				t.Fatalf("newLogger failed: %v", err)
+			}
+			if !logger.Core().Enabled(tt.enabled) {
+				t.Errorf("expected %s to be logged", tt.enabled)
+			}
+			if logger.Core().Enabled(tt.disabled) {
+				t.Errorf("expected %s not to be logged", tt.disabled)
+			}
+		})
+	}
+
+	if _, err := newLogger("loud", LoggingSettings{Level: "info", Format: "json"}); err == nil {
+		t.Error("expected an invalid level flag to be rejected")
+	}
+	if _, err := newLogger("", LoggingSettings{Level: "info", Format: "xml"}); err == nil {
+		t.Error("expected an invalid format to be rejected")
+	}
+}
@@ -20,11 +20,16 @@ func main() {
 	// Parse command line flags
 	configPath := flag.String("config", "", "Path to config file")
 	port := flag.Int("port", 0, "Server port (overrides config)")
+	logLevel := flag.String("log-level", "", "Log level: debug, info, warn or error (overrides config)")
 	flag.Parse()
 
-	// Initialize logger
-	logger := initLogger()
-	defer logger.Sync()
+	// Initialize logger; it is rebuilt from the logging settings once they are loaded
+	logger, err := newLogger(*logLevel, LoggingSettings{Level: "info", Format: "json"})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize logger: %v\n", err)
+		os.Exit(2)
+	}
+	defer func() { logger.Sync() }()
 
 	logger.Info("Starting Stream-7z HTTP API Server (Enhanced Edition)")
 
@@ -34,6 +39,13 @@ func main() {
 		logger.Fatal("Failed to load config", zap.Error(err))
 	}
 
+	configured, err := newLogger(*logLevel, config.Logging)
+	if err != nil {
+		logger.Fatal("Failed to initialize logger", zap.Error(err))
+	}
+	logger.Sync()
+	logger = configured
+
 	// Override port if specified
 	if *port > 0 {
 		config.Server.Port = *port
@@ -47,16 +59,84 @@ func main() {
 		zap.Bool("cors_enabled", config.Server.CORS.Enabled),
 		zap.Bool("rate_limit_enabled", config.Server.RateLimit.Enabled),
 		zap.Int("max_concurrent", config.Server.MaxConcurrent),
+		zap.Int("max_concurrent_per_ip", config.Server.MaxConcurrentPerIP),
+		zap.Int("max_open_archives", config.Server.Archives.MaxOpen),
+		zap.Bool("sink_enabled", config.Server.Sink.Enabled),
+		zap.Bool("idempotency_enabled", config.Server.Idempotency.Enabled),
+		zap.Bool("admin_enabled", config.Server.Admin.Enabled),
 	)
 
 	// Create library config
 	libConfig := lib.DefaultConfig().
 		WithMaxFileSize(config.Library.MaxFileSize).
 		WithTimeout(config.Library.Timeout).
-		WithDebug(config.Library.Debug)
+		WithDebug(config.Library.Debug || logger.Core().Enabled(zapcore.DebugLevel)).
+		WithLogFunc(libraryLogFunc(logger, config.Library.Debug)).
+		WithLogFunc(handlers.LibraryLogFunc(logger)).
+		WithDNSServer(config.Library.DNSServer).
+		WithDialTimeout(config.Library.DialTimeout).
+		WithResponseHeaderTimeout(config.Library.ResponseHeaderTimeout).
+		WithHeadRetries(config.Library.HeadRetries, config.Library.HeadRetryDelay).
+		WithRangeRetries(config.Library.RangeRetries, config.Library.RangeRetryDelay).
+		WithRetryBudget(config.Library.RetryBudget).
+		WithExtractRetries(config.Library.ExtractRetries).
+		WithTruncateOnShrink(config.Library.TruncateOnShrink).
+		WithMaxDataURLSize(config.Library.MaxDataURLSize).
+		WithMaxFallbackBytes(config.Library.MaxFallbackBytes).
+		WithMaxMemoryBuffer(config.Library.MaxMemoryBuffer).
+		WithSpillDir(config.Library.SpillDir).
+		WithMaxSpillBytes(config.Library.MaxSpillBytes)
+	if config.Library.SpillDir != "" {
+		if removed, err := lib.CleanSpillDir(config.Library.SpillDir); err != nil {
+			logger.Warn("failed to clean up spill directory", zap.Error(err))
+		} else if removed > 0 {
+			logger.Info("removed spill files left by an earlier run", zap.Int("files", removed))
+		}
+	}
+	if config.Library.NegativeCacheTTL > 0 {
+		libConfig.WithOpenErrorCache(lib.NewOpenErrorCache(config.Library.NegativeCacheTTL))
+	}
+	if config.Library.MinimalHeaders {
+		libConfig.WithMinimalHeaders(true)
+	}
+	if config.Library.UserAgent != "" {
+		libConfig.WithUserAgent(config.Library.UserAgent)
+	}
+	if config.Library.SharedCacheSize > 0 {
+		libConfig.WithSharedCache(lib.NewSharedCache(config.Library.SharedCacheSize, 0))
+	}
 
 	// Create handler
-	h := handlers.NewHandler(libConfig, logger)
+	h := handlers.NewHandler(libConfig, logger).
+		WithArchiveLimiter(handlers.NewArchiveLimiter(
+			config.Server.Archives.MaxOpen,
+			config.Server.Archives.WaitTimeout,
+		)).
+		WithRangeBudget(handlers.RangeBudget{
+			Info: config.Server.RangeBudget.Info,
+			List: config.Server.RangeBudget.List,
+		}).
+		WithExtractIdleTimeout(config.Server.Timeout.ExtractIdle).
+		WithExtractGzip(config.Server.GzipExtract).
+		WithCursorSecret([]byte(config.Server.ListCursorSecret)).
+		WithCanonicalPaths(config.Server.CanonicalPaths).
+		WithForwardHeaders(config.Server.ForwardHeaders, config.Server.Auth.HeaderKey, config.Server.Admin.HeaderKey)
+	if config.Server.Archives.PasswordRetryTTL > 0 {
+		retries := handlers.NewPasswordRetryPool(config.Server.Archives.PasswordRetryTTL, config.Server.Archives.PasswordRetryMax).
+			WithAPIKeyHeader(config.Server.Auth.HeaderKey)
+		defer retries.Close()
+		h.WithPasswordRetryPool(retries)
+	}
+	if config.Server.Sink.Enabled {
+		sink := handlers.NewDirectorySink(config.Server.Sink.Directory).
+			WithMaxTempBytes(config.Server.Sink.MaxSpillBytes)
+		if removed, err := sink.CleanTemp(); err != nil {
+			logger.Warn("failed to clean up sink temporary files", zap.Error(err))
+		} else if removed > 0 {
+			logger.Info("removed sink temporary files left by an earlier run", zap.Int("files", removed))
+		}
+		h.WithSink(sink)
+	}
 
 	// Create rate limiter
 	rateLimiter := handlers.NewRateLimiter(
@@ -74,6 +154,12 @@ func main() {
 		logger,
 	)
 
+	// Forwarded headers name the client only when sent by these proxies
+	trustedProxies, err := handlers.NewTrustedProxies(config.Server.TrustedProxies)
+	if err != nil {
+		logger.Fatal("Invalid trusted proxies", zap.Error(err))
+	}
+
 	// Create enhanced auth middleware with multiple API keys
 	enhancedAuth := handlers.NewEnhancedAuthMiddleware(
 		config.Server.Auth.Enabled,
@@ -83,16 +169,16 @@ func main() {
 	)
 
 	// Setup middleware chain
-	middleware := handlers.Chain(
-		handlers.RecoveryMiddleware(logger),
-		handlers.LoggingMiddleware(logger),
-		handlers.RequestIDMiddleware(),
-		ipWhitelist.Handler(), // Enhanced: IP whitelist comes first for security
-		handlers.NewCORSMiddleware(config.Server.CORS.Enabled, config.Server.CORS.Origins).Handler(),
-		rateLimiter.Handler(),
-		handlers.ConcurrencyLimitMiddleware(config.Server.MaxConcurrent, logger),
-		enhancedAuth.Handler(), // Enhanced: support multiple API keys
-	)
+	middleware := handlers.BuildChain(handlers.ChainConfig{
+		IPWhitelist:   ipWhitelist, // Enhanced: IP whitelist comes first for security
+		CORS:          handlers.NewCORSMiddleware(config.Server.CORS.Enabled, config.Server.CORS.Origins),
+		RateLimiter:   rateLimiter,
+		MaxConcurrent: config.Server.MaxConcurrent,
+		Auth:          enhancedAuth, // Enhanced: support multiple API keys
+
+		MaxConcurrentPerIP: config.Server.MaxConcurrentPerIP,
+		TrustedProxies:     trustedProxies,
+	}, logger)
 
 	// Setup routes
 	mux := http.NewServeMux()
@@ -118,8 +204,50 @@ func main() {
 
 	// API routes (with full middleware chain)
 	mux.Handle("/api/info", middleware(h.Info()))
+	mux.Handle("/api/check-password", middleware(h.CheckPassword()))
+	mux.Handle("/api/validate", middleware(h.Validate()))
 	mux.Handle("/api/list", middleware(h.List()))
+	mux.Handle("/api/browse", middleware(h.Browse()))
 	mux.Handle("/api/extract", middleware(h.Extract()))
+	mux.Handle("/api/download", middleware(h.Download()))
+	mux.Handle("/api/diff", middleware(h.Diff()))
+
+	// Retried or concurrent identical requests share one origin fetch
+	idempotent := handlers.Chain()
+	if config.Server.Idempotency.Enabled {
+		idempotent = handlers.NewIdempotencyMiddleware(config.Server.Idempotency.TTL, logger).
+			WithAPIKeyHeader(config.Server.Auth.HeaderKey).
+			WithVaryHeaders(config.Server.ForwardHeaders).
+			Handler()
+	}
+	mux.Handle("/api/hash", middleware(idempotent(h.Hash())))
+
+	// Write-through extraction is opt-in and may be limited to some API keys
+	if config.Server.Sink.Enabled {
+		sinkScope := handlers.NewScopeMiddleware(
+			config.Server.Auth.HeaderKey,
+			config.Server.Sink.APIKeys,
+			logger,
+		)
+		mux.Handle("/api/extract-to", middleware(sinkScope.Handler()(idempotent(h.ExtractTo()))))
+	}
+
+	// Admin endpoints take the admin key instead of an API key
+	if config.Server.Admin.Enabled {
+		adminChain := handlers.Chain(
+			handlers.RecoveryMiddleware(logger),
+			handlers.LoggingMiddleware(logger),
+			handlers.RequestIDMiddleware(),
+			ipWhitelist.Handler(),
+			handlers.NewEnhancedAuthMiddleware(true, config.Server.Admin.HeaderKey, []string{config.Server.Admin.Key}, logger).Handler(),
+		)
+		mux.Handle("/api/admin/operations", adminChain(h.ListOperations()))
+		mux.Handle("/api/admin/operations/cancel", adminChain(h.CancelOperation()))
+		// Exposes archive internals, so only while debugging
+		if config.Library.Debug {
+			mux.Handle("/api/admin/debug-info", adminChain(h.DebugInfo()))
+		}
+	}
 
 	// Create server
 	server := &http.Server{
@@ -159,20 +287,6 @@ func main() {
 	logger.Info("Server stopped")
 }
 
-// initLogger initializes the logger
-func initLogger() *zap.Logger {
-	config := zap.NewProductionConfig()
-	config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
-	config.EncoderConfig.TimeKey = "time"
-
-	logger, err := config.Build()
-	if err != nil {
-		panic(fmt.Sprintf("Failed to initialize logger: %v", err))
-	}
-
-	return logger
-}
-
 // printStartupBanner prints startup information
 func printStartupBanner(config *ServerConfig) {
 	banner := `
@@ -198,8 +312,18 @@ API Endpoints:
   • GET  /health             - Health check
   • GET  /api/docs           - API documentation
   • POST /api/info           - Get archive metadata
+  • POST /api/check-password - Verify an archive password
+  • POST /api/validate       - Check a URL is a supported archive
   • POST /api/list           - List files in archive
+  • POST /api/browse         - Info, listing page and preview in one call
   • POST /api/extract        - Extract file from archive
+  • POST /api/download       - Download members as a new ZIP
+  • POST /api/diff           - Compare the files of two archives
+  • POST /api/hash           - Hash file in archive (md5/sha1/sha256)
+  • POST /api/extract-to     - Extract file to the sink (if enabled)
+  • GET  /api/admin/operations        - List operations in flight (if enabled)
+  • POST /api/admin/operations/cancel - Cancel an operation (if enabled)
+  • POST /api/admin/debug-info        - Archive structure for debugging (admin and debug mode)
 
 Server is ready to accept requests!
 Press Ctrl+C to stop the server.
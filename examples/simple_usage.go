@@ -7,7 +7,6 @@ import (
 	"os"
 
 	"github.com/NORMAL-EX/stream-7z/lib"
-	"github.com/NORMAL-EX/stream-7z/lib/formats"
 )
 
 func main() {
@@ -75,7 +74,7 @@ func main() {
 		log.Fatalf("Failed to write file: %v", err)
 	}
 
-	fmt.Printf("Successfully extracted %s (%d bytes)\n", fileToExtract, written)
+	fmt.Printf("Successfully extracted %s (%d of %d bytes)\n", fileToExtract, written, size)
 
 	fmt.Println()
 
@@ -135,23 +134,22 @@ func main() {
 	encryptedURL := "https://example.com/encrypted.zip"
 	
 	// First, check if password is required
+	// ZIP lists encrypted entries without a password (err == nil), while
+	// other formats may return a password error along with the info
 	info, err = lib.QuickInfo(encryptedURL, "", nil)
-	if err != nil {
-		// Check if error is due to password requirement
-		if info != nil && info.RequiresPassword {
-			fmt.Println("Archive is encrypted, password required")
-			
-			// Try with password
-			correctPassword := "mypassword"
-			info, err = lib.QuickInfo(encryptedURL, correctPassword, nil)
-			if err != nil {
-				fmt.Printf("Password verification failed: %v\n", err)
-			} else {
-				fmt.Println("Password verified successfully")
-			}
+	if info != nil && info.RequiresPassword {
+		fmt.Println("Archive is encrypted, password required")
+
+		// Try with password
+		correctPassword := "mypassword"
+		info, err = lib.QuickInfo(encryptedURL, correctPassword, nil)
+		if err != nil {
+			fmt.Printf("Password verification failed: %v\n", err)
 		} else {
-			fmt.Printf("Error: %v\n", err)
+			fmt.Println("Password verified successfully")
 		}
+	} else if err != nil {
+		fmt.Printf("Error: %v\n", err)
 	} else {
 		fmt.Println("Archive is not encrypted")
 	}
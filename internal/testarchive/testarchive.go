@@ -0,0 +1,185 @@
+// Package testarchive builds the ZIP and TAR archives tests read
+package testarchive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"strings"
+	"testing"
+
+	"github.com/yeka/zip"
+)
+
+// Entry is a member of an archive built by Zip or Tar. Names ending in
+// "/" are directories.
+type Entry struct {
+	Name    string
+	Content string
+
+	// ZIP only: the compression method (zip.Store when zero), and the
+	// password encrypting the member with Encryption (AES-256 when zero)
+	Method     uint16
+	Password   string
+	Encryption zip.EncryptionMethod
+
+	// ZIP only: data already compressed with Method, written as it is,
+	// for methods the zip writer can't produce. CRC replaces the CRC-32
+	// of Content, and DescriptorCRC adds a data descriptor after the data
+	// holding it. An archive with such members is written by hand, so its
+	// other members must be stored and none can be encrypted.
+	Compressed    []byte
+	CRC           *uint32
+	DescriptorCRC *uint32
+}
+
+// Files returns deflated entries for names, each holding "content of "
+// followed by its name
+func Files(names ...string) []Entry {
+	entries := make([]Entry, len(names))
+	for i, name := range names {
+		entries[i] = Entry{Name: name, Method: zip.Deflate}
+		if !strings.HasSuffix(name, "/") {
+			entries[i].Content = "content of " + name
+		}
+	}
+	return entries
+}
+
+// Pairs returns deflated entries for name/content pairs, in order
+func Pairs(files ...string) []Entry {
+	var entries []Entry
+	for i := 0; i+1 < len(files); i += 2 {
+		entries = append(entries, Entry{Name: files[i], Content: files[i+1], Method: zip.Deflate})
+	}
+	return entries
+}
+
+// Zip creates a ZIP archive holding entries in order
+func Zip(t testing.TB, entries ...Entry) []byte {
+	t.Helper()
+
+	for _, e := range entries {
+		if e.Compressed != nil {
+			return rawZip(t, entries)
+		}
+	}
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, e := range entries {
+		fh := &zip.FileHeader{Name: e.Name, Method: e.Method}
+		if e.Password != "" {
+			fh.SetPassword(e.Password)
+			if e.Encryption == 0 {
+				e.Encryption = zip.AES256Encryption
+			}
+			fh.SetEncryptionMethod(e.Encryption)
+		}
+		fw, err := w.CreateHeader(fh)
+		if err != nil {
+			t.Fatalf("failed to create %s: %v", e.Name, err)
+		}
+		if _, err := fw.Write([]byte(e.Content)); err != nil {
+			t.Fatalf("failed to write %s: %v", e.Name, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close zip writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// rawZip writes the ZIP structures of entries by hand
+func rawZip(t testing.TB, entries []Entry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	le := func(w *bytes.Buffer, values ...interface{}) {
+		for _, v := range values {
+			binary.Write(w, binary.LittleEndian, v)
+		}
+	}
+
+	var dir bytes.Buffer
+	for _, e := range entries {
+		data := e.Compressed
+		if data == nil {
+			if e.Method != zip.Store {
+				t.Fatalf("%s: only stored members can be written with precompressed ones", e.Name)
+			}
+			data = []byte(e.Content)
+		}
+		if e.Password != "" {
+			t.Fatalf("%s: encrypted members can't be written with precompressed ones", e.Name)
+		}
+		crc := crc32.ChecksumIEEE([]byte(e.Content))
+		if e.CRC != nil {
+			crc = *e.CRC
+		}
+		var flags uint16
+		if e.DescriptorCRC != nil {
+			flags = 0x8
+		}
+
+		offset := buf.Len()
+		le(&buf, uint32(0x04034b50), uint16(20), flags, e.Method, uint32(0),
+			crc, uint32(len(data)), uint32(len(e.Content)), uint16(len(e.Name)), uint16(0))
+		buf.WriteString(e.Name)
+		buf.Write(data)
+		if e.DescriptorCRC != nil {
+			le(&buf, uint32(0x08074b50), *e.DescriptorCRC, uint32(len(data)), uint32(len(e.Content)))
+		}
+
+		le(&dir, uint32(0x02014b50), uint16(20), uint16(20), flags, e.Method, uint32(0),
+			crc, uint32(len(data)), uint32(len(e.Content)), uint16(len(e.Name)),
+			uint16(0), uint16(0), uint16(0), uint16(0), uint32(0), uint32(offset))
+		dir.WriteString(e.Name)
+	}
+
+	dirOffset := buf.Len()
+	buf.Write(dir.Bytes())
+	le(&buf, uint32(0x06054b50), uint16(0), uint16(0), uint16(len(entries)), uint16(len(entries)),
+		uint32(dir.Len()), uint32(dirOffset), uint16(0))
+	return buf.Bytes()
+}
+
+// Tar creates an uncompressed TAR archive holding entries in order
+func Tar(t testing.TB, entries ...Entry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.Name, Mode: 0o644, Typeflag: tar.TypeReg, Size: int64(len(e.Content))}
+		if strings.HasSuffix(e.Name, "/") {
+			header.Typeflag = tar.TypeDir
+			header.Mode = 0o755
+		}
+		if err := w.WriteHeader(header); err != nil {
+			t.Fatalf("failed to write %s: %v", e.Name, err)
+		}
+		if _, err := w.Write([]byte(e.Content)); err != nil {
+			t.Fatalf("failed to write %s: %v", e.Name, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close tar writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// Gzip compresses data, e.g. a TAR archive into a .tar.gz
+func Gzip(t testing.TB, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close gzip writer: %v", err)
+	}
+	return buf.Bytes()
+}
@@ -1,16 +1,23 @@
 package lib
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"net/http"
 	"net/url"
 	"path"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/NORMAL-EX/stream-7z/lib/formats"
 	"github.com/NORMAL-EX/stream-7z/lib/rangehttp"
+	"github.com/NORMAL-EX/stream-7z/lib/tracing"
 	"github.com/NORMAL-EX/stream-7z/lib/utils"
 )
 
@@ -18,151 +25,1383 @@ import (
 type Archive struct {
 	config     *Config
 	url        string
-	size       int64
-	reader     *rangehttp.RangeReader
-	format     formats.Format
 	ctx        context.Context
 	cancel     context.CancelFunc
 	httpClient *rangehttp.Client
+	stream     *forwardReader // Source of archives opened with NewStreamingArchive
+
+	// Replaced by Reopen; operations take it once with source()
+	sourceMu sync.RWMutex
+	src      *archiveSource
+
+	indexMu  sync.Mutex
+	dirIndex *directoryIndex
+	root     *rootListing // Cached ListRoot result of formats without a central directory
+
+	passwordMu sync.Mutex
+	password   string // Remembered by Unlock, cleared on Close
+
+	readersMu   sync.Mutex
+	openReaders map[*extractReader]struct{} // Extract readers not closed yet
+
+	cursor extractCursor // Position for in-order extraction (SequentialExtraction)
+}
+
+// archiveSource is the remote file an Archive reads. Reopen swaps in a new
+// one while other calls may be running, so each call reads the fields of
+// a single source and never mixes those of the old and the new file.
+type archiveSource struct {
+	size      int64
+	offset    int64  // Where the archive starts within the remote file
+	validator string // ETag or Last-Modified reported when opened
+	ranges    bool   // Whether the server honors Range requests
+	reader    *rangehttp.RangeReader
+	volumes   []*rangehttp.RangeReader // Earlier volumes of a split archive, before reader's
+	data      io.ReaderAt              // reader shifted to offset, or the volumes joined, used by the format
+	format    formats.Format
+}
+
+// source returns the file the archive currently reads
+func (a *Archive) source() *archiveSource {
+	a.sourceMu.RLock()
+	defer a.sourceMu.RUnlock()
+	return a.src
 }
 
 // NewArchive creates a new Archive instance from a URL
 func NewArchive(archiveURL string, config *Config) (*Archive, error) {
+	return newArchive(context.Background(), archiveURL, config)
+}
+
+// newArchive opens the archive with a context derived from parent, which
+// every later request of the archive uses
+func newArchive(parent context.Context, archiveURL string, config *Config) (archive *Archive, err error) {
 	if config == nil {
 		config = DefaultConfig()
 	}
 
+	if config.OpenErrorCache != nil {
+		if cached := config.OpenErrorCache.lookup(archiveURL); cached != nil {
+			config.debugf(parent, "Opening %s failed recently, returning the cached error\n", DisplayURL(archiveURL))
+			return nil, cached
+		}
+	}
+
+	tracer := config.tracer()
+	spanCtx, span := tracer.Start(parent, "archive.Open")
+	span = config.observeSpan("archive.Open", span)
+
+	// Create context with timeout from config
+	// If timeout is negative, no timeout is set (unlimited)
+	var ctx context.Context
+	var cancel context.CancelFunc
+
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			// A failure caused by the deadline or the caller says nothing about the URL
+			// (ctx itself has been canceled on the way out)
+			if config.OpenErrorCache != nil && parent.Err() == nil && (ctx == nil || ctx.Err() != context.DeadlineExceeded) {
+				config.OpenErrorCache.store(archiveURL, err)
+			}
+		} else {
+			span.SetAttributes(
+				tracing.String("archive.format", archive.Format()),
+				tracing.Int64("archive.size", archive.Size()),
+			)
+		}
+		span.End()
+	}()
+
 	// Validate URL
 	parsedURL, err := url.Parse(archiveURL)
 	if err != nil {
-		return nil, utils.WrapError(utils.ErrInvalidURL, "invalid URL: %s", archiveURL)
+		return nil, utils.WrapError(utils.ErrInvalidURL, "invalid URL: %s", DisplayURL(archiveURL))
 	}
 
+	if parsedURL.Scheme == "data" {
+		return openDataURL(parent, archiveURL, config)
+	}
 	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
 		return nil, utils.WrapError(utils.ErrInvalidURL, "only HTTP/HTTPS URLs are supported")
 	}
+	span.SetAttributes(tracing.String("url.host", parsedURL.Host))
+
+	client, err := config.httpClient()
+	if err != nil {
+		return nil, utils.WrapError(err, "invalid HTTP client configuration")
+	}
+	if config.TLSConfig != nil && config.TLSConfig.InsecureSkipVerify {
+		config.debugf(spanCtx, "Warning: TLS certificate verification is disabled\n")
+	}
 
 	// Create HTTP client
 	httpClient := rangehttp.NewClient(
-		config.HTTPClient,
+		client,
 		config.Headers,
 		config.UserAgent,
 		config.Timeout,
 	)
+	httpClient.SetAccept(config.Accept)
+	httpClient.SetMinimalHeaders(config.MinimalHeaders)
+	httpClient.SetTracer(tracer)
+	httpClient.SetSigner(config.Signer)
+	httpClient.SetFallbackLimit(config.MaxFallbackBytes)
 
-	// Create context with timeout from config
-	// If timeout is negative, no timeout is set (unlimited)
-	var ctx context.Context
-	var cancel context.CancelFunc
-	
 	if config.Timeout < 0 {
 		// Negative timeout means no timeout limit
-		ctx, cancel = context.WithCancel(context.Background())
+		ctx, cancel = context.WithCancel(parent)
 	} else {
 		timeout := config.Timeout
 		if timeout == 0 {
 			timeout = 120 * time.Second // Default 120 seconds
 		}
-		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+		ctx, cancel = context.WithTimeout(parent, timeout)
 	}
 
-	// Get file size and check Range support
-	size, supportsRange, err := httpClient.HeadRequest(ctx, archiveURL)
+	// The HEAD request is reported under the open span, with the same deadline
+	headCtx, headCancel := spanCtx, context.CancelFunc(func() {})
+	if deadline, ok := ctx.Deadline(); ok {
+		headCtx, headCancel = context.WithDeadline(spanCtx, deadline)
+	}
+	defer headCancel()
+
+	src, err := openSource(ctx, headCtx, httpClient, archiveURL, config)
 	if err != nil {
 		cancel()
+		return nil, err
+	}
+
+	archive = &Archive{
+		config:     config,
+		url:        archiveURL,
+		src:        src,
+		ctx:        ctx,
+		cancel:     cancel,
+		httpClient: httpClient,
+	}
+
+	if config.EagerIndex && hasCentralDirectory(src.format) {
+		archive.warmIndex(ctx)
+	}
+
+	return archive, nil
+}
+
+// openSource sends the HEAD request for the file at archiveURL, detects
+// its format and returns it as the source of an archive. Every request of
+// the source uses ctx, except the HEAD request, which uses headCtx.
+func openSource(ctx, headCtx context.Context, httpClient *rangehttp.Client, archiveURL string, config *Config) (*archiveSource, error) {
+	// Get file size and check Range support
+	headInfo, err := headArchive(headCtx, httpClient, archiveURL, config)
+	if err != nil {
 		return nil, utils.WrapError(err, "failed to get file information")
 	}
+	size, supportsRange := headInfo.Size, headInfo.SupportsRange
+
+	if err := checkContentType(headInfo.ContentType, config.ExpectedContentTypes); err != nil {
+		return nil, err
+	}
+	if isWebPageContentType(headInfo.ContentType) {
+		config.debugf(ctx, "Warning: Server returned Content-Type %q, the URL may not point to an archive\n", headInfo.ContentType)
+	}
 
-	if !supportsRange && config.Debug {
-		fmt.Printf("Warning: Server does not support Range requests, performance may be degraded\n")
+	if !supportsRange {
+		config.debugf(ctx, "Warning: Server does not support Range requests, performance may be degraded\n")
 	}
 
 	// Check max file size
 	if config.MaxFileSize > 0 && size > config.MaxFileSize {
-		cancel()
 		return nil, fmt.Errorf("file size %d exceeds maximum allowed size %d", size, config.MaxFileSize)
 	}
 
+	if size == 0 {
+		return nil, utils.WrapError(utils.ErrUnsupportedFormat, "file is empty")
+	}
+
+	if config.Offset < 0 || (config.Offset > 0 && config.Offset >= size) {
+		return nil, fmt.Errorf("offset %d is outside the file (size %d)", config.Offset, size)
+	}
+
 	// Create range reader
 	rangeReader, err := rangehttp.NewRangeReader(ctx, httpClient, archiveURL, size)
 	if err != nil {
-		cancel()
 		return nil, utils.WrapError(err, "failed to create range reader")
 	}
+	rangeReader.SetFetchSizes(config.fetchSizes())
+	rangeReader.SetMaxRequests(config.MaxRangeRequests)
+	rangeReader.SetRetries(config.RangeRetries, config.RangeRetryDelay, config.RetryBudget)
+	rangeReader.SetTruncateOnShrink(config.TruncateOnShrink)
+	rangeReader.SetObserver(config.readObserver())
+	config.useSharedCache(rangeReader, archiveURL, headInfo)
+
+	if err := config.preload(ctx, rangeReader, size, supportsRange); err != nil {
+		rangeReader.Close()
+		return nil, utils.WrapError(err, "failed to download archive")
+	}
 
-	// Detect format
+	parsedURL, _ := url.Parse(archiveURL)
 	ext := strings.ToLower(path.Ext(parsedURL.Path))
-	format, err := formats.DetectFormat(ctx, rangeReader, size, ext)
+	var split *splitZip
+	if ext == ".zip" && config.Offset == 0 && !config.TrustExtension {
+		if split, err = openSplitZip(ctx, httpClient, archiveURL, rangeReader, size, config); err != nil {
+			rangeReader.Close()
+			return nil, err
+		}
+	}
+
+	// Detect format; the last volume of a split ZIP doesn't start with a
+	// ZIP header
+	var format formats.Format
+	var offset int64
+	if split != nil {
+		format = formats.NewZipFormat()
+	} else {
+		format, offset, err = detectFormat(ctx, rangeReader, size, config.Offset, ext, headInfo.ContentType, config.TrustExtension)
+	}
 	if err != nil {
-		rangeReader.Close()
-		cancel()
+		defer rangeReader.Close()
+		switch {
+		case rangeReader.BudgetExceeded():
+			return nil, utils.WrapError(utils.ErrRangeBudgetExceeded, "unable to detect archive format")
+		case rangeReader.RetryBudgetExceeded():
+			return nil, utils.WrapError(utils.ErrRetryBudgetExceeded, "unable to detect archive format")
+		case httpClient.FallbackExceeded():
+			return nil, utils.WrapError(utils.ErrRangeNotSupported, "unable to detect archive format")
+		case looksLikeWebPage(headInfo.ContentType, rangeReader):
+			return nil, utils.WrapError(utils.ErrNotAnArchive, "unable to detect archive format")
+		case errors.Is(err, formats.ErrEncryptedContainer):
+			return nil, utils.WrapError(err, "unable to open archive")
+		}
 		return nil, utils.WrapError(utils.ErrUnsupportedFormat, "unable to detect archive format")
 	}
 
-	return &Archive{
-		config:     config,
-		url:        archiveURL,
-		size:       size,
-		reader:     rangeReader,
-		format:     format,
-		ctx:        ctx,
-		cancel:     cancel,
-		httpClient: httpClient,
-	}, nil
+	src := &archiveSource{
+		size:      size - offset,
+		offset:    offset,
+		validator: headInfo.Validator(),
+		ranges:    supportsRange,
+		reader:    rangeReader,
+		data:      payloadReader(rangeReader, offset, size),
+		format:    format,
+	}
+	if split != nil {
+		src.volumes = split.volumes
+		src.data, src.size = split.data, split.size
+	}
+	return src, nil
+}
+
+// headArchive sends the HEAD request that opens an archive, retrying
+// transient failures as configured by HeadRetries. When HEAD reports no
+// size, e.g. Content-Length is missing, a one-byte range GET asks again.
+func headArchive(ctx context.Context, client *rangehttp.Client, archiveURL string, config *Config) (*rangehttp.HeadInfo, error) {
+	delay := config.HeadRetryDelay
+	for attempt := 0; ; attempt++ {
+		info, err := client.Head(ctx, archiveURL)
+		// Some servers answer HEAD with Content-Length: 0 rather than the
+		// real size, so an empty file is confirmed with a range request
+		if err == nil && info.Size <= 0 {
+			config.debugf(ctx, "HEAD reported size %d, probing with a range request\n", info.Size)
+			info, err = client.ProbeRange(ctx, archiveURL)
+			if err == nil && info.Size < 0 {
+				if config.AssumedSize <= 0 {
+					return nil, utils.ErrUnknownSize
+				}
+				config.debugf(ctx, "No size reported, assuming %d bytes\n", config.AssumedSize)
+				info.Size = config.AssumedSize
+			}
+		}
+		if err == nil || attempt >= config.HeadRetries || !rangehttp.IsTransient(ctx, err) {
+			return info, err
+		}
+
+		config.debugf(ctx, "HEAD request failed (attempt %d), retrying in %v: %v\n", attempt+1, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		}
+		delay *= 2
+	}
+}
+
+// detectFormat detects the format of the archive starting at offset. With
+// no offset, a self-extracting executable is recognized and the embedded
+// archive detected instead; the returned offset then points at it.
+// With trustExtension a known extension picks the format without reading.
+// When ext isn't a known one, an archive contentType picks the format
+// tried first; the data still has to match it.
+func detectFormat(ctx context.Context, reader io.ReaderAt, size, offset int64, ext, contentType string, trustExtension bool) (formats.Format, int64, error) {
+	if trustExtension {
+		if format, ok := formats.FormatForExtension(ext); ok {
+			return format, offset, nil
+		}
+	}
+	if _, ok := formats.FormatForExtension(ext); !ok {
+		if typeExt, ok := contentTypeExtension(contentType); ok {
+			ext = typeExt
+		}
+	}
+
+	if offset > 0 {
+		format, err := formats.DetectFormat(ctx, payloadReader(reader, offset, size), size-offset, ext)
+		if err != nil {
+			return nil, 0, err
+		}
+		return format, offset, nil
+	}
+
+	format, err := formats.DetectFormat(ctx, reader, size, ext)
+	if err == nil {
+		return format, 0, nil
+	}
+
+	offset, ok := formats.FindSFXPayload(ctx, reader, size)
+	if !ok {
+		if tool, encrypted := formats.DetectEncryptedContainer(reader, size); encrypted {
+			return nil, 0, &formats.FormatError{
+				Message: "file was encrypted with " + tool,
+				Cause:   formats.ErrEncryptedContainer,
+			}
+		}
+		return nil, 0, err
+	}
+
+	format, err = formats.DetectFormat(ctx, payloadReader(reader, offset, size), size-offset, "")
+	if err != nil {
+		return nil, 0, err
+	}
+	return format, offset, nil
+}
+
+// contentTypeExtensions maps archive media types to an extension of the
+// format usually served with them
+var contentTypeExtensions = map[string]string{
+	"application/zip":              ".zip",
+	"application/x-zip":            ".zip",
+	"application/x-zip-compressed": ".zip",
+	"application/x-7z-compressed":  ".7z",
+	"application/vnd.rar":          ".rar",
+	"application/x-rar":            ".rar",
+	"application/x-rar-compressed": ".rar",
+	"application/x-tar":            ".tar",
+	"application/x-gtar":           ".tar",
+	"application/gzip":             ".tgz",
+	"application/x-gzip":           ".tgz",
+	"application/x-bzip2":          ".tbz2",
+	"application/x-xz":             ".txz",
+}
+
+// contentTypeExtension returns the extension of the format contentType
+// names, if it is an archive media type
+func contentTypeExtension(contentType string) (string, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", false
+	}
+	ext, ok := contentTypeExtensions[mediaType]
+	return ext, ok
+}
+
+// payloadReader returns reader shifted so the archive starts at offset 0
+func payloadReader(reader io.ReaderAt, offset, size int64) io.ReaderAt {
+	if offset == 0 {
+		return reader
+	}
+	return io.NewSectionReader(reader, offset, size-offset)
+}
+
+// looksLikeWebPage reports whether the remote file is an HTML/JSON response
+// (e.g. a login or error page served with 200) rather than archive data
+func looksLikeWebPage(contentType string, reader io.ReaderAt) bool {
+	if isWebPageContentType(contentType) {
+		return true
+	}
+
+	head := make([]byte, 512)
+	n, err := reader.ReadAt(head, 0)
+	if n == 0 && err != nil {
+		return false
+	}
+	head = bytes.TrimLeft(head[:n], "\xef\xbb\xbf \t\r\n")
+	if len(head) == 0 {
+		return false
+	}
+
+	switch head[0] {
+	case '{', '[':
+		return true
+	case '<':
+		sniffed := http.DetectContentType(head)
+		return strings.HasPrefix(sniffed, "text/html") || strings.HasPrefix(sniffed, "text/xml")
+	}
+	return false
+}
+
+// isWebPageContentType reports whether contentType is one used for web pages or API responses
+func isWebPageContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case "text/html", "application/xhtml+xml", "application/json":
+		return true
+	}
+	return false
+}
+
+// checkContentType validates contentType against the expected list.
+// Entries may be exact media types or wildcards like "application/*".
+// An empty list or a missing Content-Type header is always accepted.
+func checkContentType(contentType string, expected []string) error {
+	if len(expected) == 0 || contentType == "" {
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(contentType))
+	}
+
+	for _, e := range expected {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == mediaType || e == "*/*" {
+			return nil
+		}
+		if strings.HasSuffix(e, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(e, "*")) {
+			return nil
+		}
+	}
+
+	if isWebPageContentType(contentType) {
+		return utils.WrapError(utils.ErrNotAnArchive, "server returned Content-Type %q", contentType)
+	}
+	return utils.WrapError(utils.ErrUnexpectedContentType, "server returned Content-Type %q, expected one of %v", contentType, expected)
 }
 
 // GetInfo returns metadata about the archive
-func (a *Archive) GetInfo(password string) (*formats.ArchiveInfo, error) {
-	return a.format.GetInfo(a.ctx, a.reader, a.size, password)
+// For ZIP and 7z the parsed directory is cached for the archive's lifetime,
+// so later GetInfo/ListFiles calls don't re-read it
+func (a *Archive) GetInfo(password string) (info *formats.ArchiveInfo, err error) {
+	span := a.startSpan("archive.GetInfo")
+	defer func() {
+		err = a.checkBudget(err)
+		if info != nil {
+			markUnsafePaths(info.Files)
+		}
+		endSpan(span, err)
+	}()
+
+	password = a.resolvePassword(password)
+	info, err = a.info(password)
+	if err != nil || a.config.PathNormalizer == nil {
+		return info, err
+	}
+	normalized := *info
+	normalized.Files = a.normalizeEntries(info.Files)
+	return &normalized, nil
+}
+
+// info returns the archive information with the paths as stored
+func (a *Archive) info(password string) (*formats.ArchiveInfo, error) {
+	if a.indexed() {
+		return a.index(a.ctx, password)
+	}
+	src := a.source()
+	return src.format.GetInfo(a.ctx, src.data, src.size, password)
+}
+
+// normalizePath passes name through the PathNormalizer, if any
+func (a *Archive) normalizePath(name string) string {
+	if a.config.PathNormalizer == nil {
+		return name
+	}
+	return a.config.PathNormalizer(name)
+}
+
+// normalizeEntries returns a copy of entries with their paths passed
+// through the PathNormalizer, or entries itself without one
+func (a *Archive) normalizeEntries(entries []formats.FileEntry) []formats.FileEntry {
+	if a.config.PathNormalizer == nil {
+		return entries
+	}
+	normalized := make([]formats.FileEntry, len(entries))
+	for i, entry := range entries {
+		entry.Path = a.config.PathNormalizer(entry.Path)
+		normalized[i] = entry
+	}
+	return normalized
+}
+
+// startSpan starts a span for an operation on the archive. Its parent is
+// the context the archive was opened with.
+func (a *Archive) startSpan(name string, attrs ...tracing.Attribute) tracing.Span {
+	attrs = append([]tracing.Attribute{tracing.String("archive.format", a.Format())}, attrs...)
+	_, span := a.config.tracer().Start(a.ctx, name, attrs...)
+	return a.config.observeSpan(name, span)
+}
+
+// endSpan records err, if any, and ends span
+func endSpan(span tracing.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
 }
 
 // ListFiles returns a list of files in the archive
 // If innerPath is empty, returns root level files
 // If innerPath is specified, returns files within that directory
-func (a *Archive) ListFiles(innerPath string, password string) ([]formats.FileEntry, error) {
-	return a.format.ListFiles(a.ctx, a.reader, a.size, innerPath, password)
+func (a *Archive) ListFiles(innerPath string, password string) (files []formats.FileEntry, err error) {
+	span := a.startSpan("archive.ListFiles", tracing.String("archive.inner_path", innerPath))
+	defer func() {
+		err = a.checkBudget(err)
+		markUnsafePaths(files)
+		span.SetAttributes(tracing.Int64("archive.entries", int64(len(files))))
+		endSpan(span, err)
+	}()
+
+	password = a.resolvePassword(password)
+	if a.config.CaseInsensitivePaths || a.config.PathNormalizer != nil {
+		info, err := a.info(password)
+		if err != nil {
+			return nil, err
+		}
+		files, innerPath := a.normalizeEntries(info.Files), a.normalizePath(innerPath)
+		if a.config.CaseInsensitivePaths {
+			return formats.FilterEntriesFold(files, innerPath), nil
+		}
+		return formats.FilterEntries(files, innerPath), nil
+	}
+	if a.indexed() {
+		// Errors aren't cached; let the format report them the ListFiles way
+		if info, err := a.index(a.ctx, password); err == nil {
+			return formats.FilterEntries(info.Files, innerPath), nil
+		}
+	}
+	src := a.source()
+	return src.format.ListFiles(a.ctx, src.data, src.size, innerPath, password)
+}
+
+// markUnsafePaths sets UnsafePath on the entries
+func markUnsafePaths(files []formats.FileEntry) {
+	for i := range files {
+		files[i].UnsafePath = utils.IsUnsafePath(files[i].Path)
+	}
+}
+
+// ListFilesDepth returns the entries up to maxDepth levels below
+// innerPath, so with a directory as innerPath it reaches past the direct
+// children ListFiles returns. It lets a UI list the top of a large archive
+// and load deeper levels on demand. A maxDepth of 0 means no limit, which
+// lists like ListFiles.
+func (a *Archive) ListFilesDepth(innerPath string, password string, maxDepth int) ([]formats.FileEntry, error) {
+	if maxDepth <= 0 {
+		return a.ListFiles(innerPath, password)
+	}
+
+	// ListFiles("") is the only recursive listing; the subtree is
+	// selected from it
+	files, err := a.ListFiles("", password)
+	if err != nil {
+		return nil, err
+	}
+	innerPath = a.normalizePath(innerPath)
+	if a.config.CaseInsensitivePaths {
+		return formats.FilterTreeFold(files, innerPath, maxDepth), nil
+	}
+	return formats.FilterTree(files, innerPath, maxDepth), nil
+}
+
+// ListRoot returns the entries at the top level of the archive, like
+// ListFiles("/"). It is meant for a quick peek at an archive: ZIP and 7z
+// answer it from the cached directory, and other formats scan once and
+// cache the result, so repeated calls don't touch the network.
+func (a *Archive) ListRoot(password string) ([]formats.FileEntry, error) {
+	password = a.resolvePassword(password)
+	if a.indexed() {
+		return a.ListFiles("/", password)
+	}
+
+	if files, ok := a.cachedRoot(password); ok {
+		return files, nil
+	}
+	files, err := a.ListFiles("/", password)
+	if err != nil {
+		return nil, err
+	}
+	a.storeRoot(password, files)
+	return files, nil
+}
+
+// Walk calls fn for each entry ListFiles would return for innerPath.
+// Formats that support it (TAR) report entries as they are read, so a
+// huge listing never has to be held in memory. Walking stops at the first
+// error returned by fn, which Walk returns.
+func (a *Archive) Walk(innerPath string, password string, fn func(formats.FileEntry) error) error {
+	password = a.resolvePassword(password)
+	src := a.source()
+	if walker, ok := src.format.(formats.Walker); ok && !a.indexed() && !a.config.CaseInsensitivePaths {
+		innerPath = a.normalizePath(innerPath)
+		err := walker.Walk(a.ctx, src.data, src.size, password, func(entry formats.FileEntry) error {
+			entry.Path = a.normalizePath(entry.Path)
+			if !formats.MatchesInnerPath(entry.Path, innerPath) {
+				return nil
+			}
+			entry.UnsafePath = utils.IsUnsafePath(entry.Path)
+			return fn(entry)
+		})
+		return a.checkBudget(err)
+	}
+
+	files, err := a.ListFiles(innerPath, password)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := fn(file); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // ExtractFile extracts a single file from the archive
-// Returns a reader for the file content
+// Returns a reader for the file content and its size, -1 if unknown
+// Errors, including ones hit while reading the content, are *utils.ExtractError
+// Read errors wrap a *rangehttp.TransferError when fetching the archive's
+// bytes failed, which is resumed up to Config.ExtractRetries times, and a
+// *utils.DecompressionError when the bytes fail to decompress
+// The span of the extraction ends when the returned reader is closed.
 func (a *Archive) ExtractFile(filePath string, password string) (io.ReadCloser, int64, error) {
+	return a.extractFile(filePath, password, false)
+}
+
+// extractFile is ExtractFile, reading through the extraction cursor when
+// sequential is set even if SequentialExtraction isn't
+func (a *Archive) extractFile(filePath string, password string, sequential bool) (io.ReadCloser, int64, error) {
+	span := a.startSpan("archive.ExtractFile", tracing.String("archive.member", filePath))
+
 	// Validate path
 	if !utils.IsValidPath(filePath) {
-		return nil, 0, utils.ErrPathTraversal
+		err := &utils.ExtractError{Path: filePath, Cause: utils.ErrPathTraversal}
+		endSpan(span, err)
+		return nil, 0, err
 	}
 
-	return a.format.ExtractFile(a.ctx, a.reader, a.size, filePath, password)
+	er, err := a.trackReader(filePath)
+	if err != nil {
+		endSpan(span, err)
+		return nil, 0, err
+	}
+	er.span = span
+
+	password = a.resolvePassword(password)
+	src := a.source()
+	memberPath := filePath
+	reader, size, err := a.extractMember(src, memberPath, password, sequential)
+	if errors.Is(err, formats.ErrFileNotFound) && a.mayBeStoredOtherwise(filePath) {
+		// The exact lookup failed; retry with the stored name
+		if storedPath, ok := a.findStoredPath(filePath, password); ok {
+			memberPath = storedPath
+			reader, size, err = a.extractMember(src, memberPath, password, sequential)
+		}
+	}
+	if err != nil {
+		if reader != nil {
+			// Don't rely on formats to return no reader with an error
+			reader.Close()
+		}
+		a.untrackReader(er)
+		err = &utils.ExtractError{Path: filePath, Cause: a.checkBudget(err)}
+		endSpan(span, err)
+		return nil, 0, err
+	}
+
+	span.SetAttributes(tracing.Int64("archive.member_size", size))
+	er.ReadCloser = reader
+	if !sequential && !a.config.SequentialExtraction && a.stream == nil {
+		// Members read by the format itself can be opened again, from
+		// the same file even if the archive was reopened meanwhile
+		er.retries = a.config.ExtractRetries
+		er.maxReread = maxResumeReread
+		er.reopen = func(offset, maxReread int64) (io.ReadCloser, error) {
+			return a.reopenMember(src, memberPath, password, offset, maxReread)
+		}
+	}
+	return er, size, nil
+}
+
+// maxResumeReread caps the content a resumed member may decompress again
+// to get back to where reading failed
+const maxResumeReread = 64 << 20
+
+// reopenMember opens memberPath of src again, positioned offset bytes into
+// its content. Members stored without compression are read from that
+// offset in the archive, without verifying their checksum; others are
+// extracted from the start and the first offset bytes skipped, which fails
+// if offset exceeds maxReread.
+func (a *Archive) reopenMember(src *archiveSource, memberPath string, password string, offset, maxReread int64) (io.ReadCloser, error) {
+	if raw, ok := src.format.(formats.RawExtractor); ok {
+		reader, _, method, err := raw.ExtractRaw(a.ctx, src.data, src.size, memberPath, password)
+		if err == nil {
+			if seeker, ok := reader.(io.Seeker); ok && method == "Store" {
+				if _, err := seeker.Seek(offset, io.SeekStart); err == nil {
+					return reader, nil
+				}
+			}
+			reader.Close()
+		}
+	}
+
+	if offset > maxReread {
+		return nil, fmt.Errorf("resuming would decompress %d bytes again, more than %d", offset, maxReread)
+	}
+	reader, _, err := src.format.ExtractFile(a.ctx, src.data, src.size, memberPath, password)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, reader, offset); err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+// extractMember opens filePath of src with the format, through the
+// extraction cursor when sequential or SequentialExtraction is set or the
+// archive is a stream
+func (a *Archive) extractMember(src *archiveSource, filePath string, password string, sequential bool) (io.ReadCloser, int64, error) {
+	if sequential || a.config.SequentialExtraction || a.stream != nil {
+		reader, size, err := a.extractWithCursor(filePath, password)
+		if err != errCursorUnavailable {
+			return reader, size, err
+		}
+	}
+	return src.format.ExtractFile(a.ctx, src.data, src.size, filePath, password)
+}
+
+// ExtractRaw returns the compressed bytes of a member as stored in the
+// archive, their size and the compression method (e.g. "Deflate"),
+// without decompressing them. Only ZIP entries stored or compressed with
+// Deflate are supported; other formats and methods fail with
+// formats.ErrNotSupported. Errors are *utils.ExtractError.
+func (a *Archive) ExtractRaw(filePath string, password string) (io.ReadCloser, int64, string, error) {
+	if !utils.IsValidPath(filePath) {
+		return nil, 0, "", &utils.ExtractError{Path: filePath, Cause: utils.ErrPathTraversal}
+	}
+
+	src := a.source()
+	raw, ok := src.format.(formats.RawExtractor)
+	if !ok {
+		return nil, 0, "", &utils.ExtractError{Path: filePath, Cause: utils.WrapError(formats.ErrNotSupported, "raw data of %s members", src.format.Name())}
+	}
+
+	reader, size, method, err := raw.ExtractRaw(a.ctx, src.data, src.size, filePath, a.resolvePassword(password))
+	if err != nil {
+		return nil, 0, "", &utils.ExtractError{Path: filePath, Cause: a.checkBudget(err)}
+	}
+	return reader, size, method, nil
+}
+
+// DebugInfo returns low-level structural details of the archive, e.g. the
+// record offsets of a ZIP, for diagnosing archives that won't list or
+// extract. Formats that don't implement formats.DebugInfoProvider fail
+// with formats.ErrNotSupported.
+func (a *Archive) DebugInfo(password string) (map[string]interface{}, error) {
+	src := a.source()
+	provider, ok := src.format.(formats.DebugInfoProvider)
+	if !ok {
+		return nil, utils.WrapError(formats.ErrNotSupported, "debug info of %s archives", src.format.Name())
+	}
+
+	info, err := provider.DebugInfo(a.ctx, src.data, src.size, a.resolvePassword(password))
+	if err != nil {
+		return nil, a.checkBudget(err)
+	}
+	info["format"] = src.format.Name()
+	info["size"] = src.size
+	info["offset"] = src.offset
+	return info, nil
+}
+
+// ExtractFileTo extracts a single file from the archive into w and
+// returns the number of bytes written. Read failures are
+// *utils.ExtractError; errors from w are returned unchanged.
+func (a *Archive) ExtractFileTo(filePath string, password string, w io.Writer) (int64, error) {
+	return a.ExtractFileToWithBuffer(filePath, password, w, nil)
+}
+
+// ExtractFileToWithBuffer is like ExtractFileTo but copies through buf
+// instead of allocating a buffer, so a server extracting many small files
+// can reuse buffers across requests, e.g. from a sync.Pool. buf is not
+// used if w implements io.ReaderFrom or the member's reader implements
+// io.WriterTo; a nil or empty buf allocates one as ExtractFileTo does.
+func (a *Archive) ExtractFileToWithBuffer(filePath string, password string, w io.Writer, buf []byte) (int64, error) {
+	reader, _, err := a.ExtractFile(filePath, password)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	if len(buf) == 0 {
+		buf = nil
+	}
+	return io.CopyBuffer(w, reader, buf)
+}
+
+// ExtractAll extracts every file of the archive, in archive order, to
+// writers the caller provides. For each member that isn't a directory dest
+// is called with its entry and the content is copied into the returned
+// writer, which is then closed; a nil writer skips the member. Members
+// that fail to extract or to be written, including dest's own errors, are
+// passed to onError: returning nil goes on with the next member, anything
+// else stops ExtractAll with that error. A nil onError stops at the first
+// failure. Extraction errors are *utils.ExtractError. Entries with
+// UnsafePath set are still passed to dest, which should check it before
+// using the name as a file path.
+//
+// Members are read like SequentialExtraction does, so a TAR or other
+// stream-only format is decompressed once rather than once per member.
+func (a *Archive) ExtractAll(password string, dest func(entry formats.FileEntry) (io.WriteCloser, error), onError func(entry formats.FileEntry, err error) error) error {
+	files, err := a.ListFiles("", password)
+	if err != nil {
+		return err
+	}
+
+	// With a PathNormalizer ListFiles renamed the stored entries in
+	// order; read members by their stored name rather than looking each
+	// normalized one up again
+	var stored []formats.FileEntry
+	if a.config.PathNormalizer != nil {
+		info, err := a.info(a.resolvePassword(password))
+		if err != nil {
+			return err
+		}
+		stored = info.Files
+	}
+
+	for i, entry := range files {
+		if entry.IsDir {
+			continue
+		}
+		if err := a.ctx.Err(); err != nil {
+			return err
+		}
+
+		storedPath := entry.Path
+		if stored != nil {
+			storedPath = stored[i].Path
+		}
+		if err := a.extractEntry(entry, storedPath, password, dest); err != nil {
+			if onError == nil {
+				return err
+			}
+			if err := onError(entry, err); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// extractEntry copies one member of ExtractAll, stored as storedPath,
+// into the writer dest returns for it. The member is opened first, so
+// dest isn't asked for a writer for a member that can't be read.
+func (a *Archive) extractEntry(entry formats.FileEntry, storedPath string, password string, dest func(entry formats.FileEntry) (io.WriteCloser, error)) error {
+	reader, _, err := a.extractFile(storedPath, password, true)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	w, err := dest(entry)
+	if err != nil || w == nil {
+		return err
+	}
+	_, err = io.Copy(w, reader)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// mayBeStoredOtherwise reports whether a member not found as filePath
+// may be stored under a name findStoredPath matches. Names with non-ASCII
+// characters are always looked up again, since macOS stores them in NFD
+// while users type NFC.
+func (a *Archive) mayBeStoredOtherwise(filePath string) bool {
+	if a.config.CaseInsensitivePaths || a.config.PathNormalizer != nil {
+		return true
+	}
+	for i := 0; i < len(filePath); i++ {
+		if filePath[i] >= utf8.RuneSelf {
+			return true
+		}
+	}
+	return false
+}
+
+// findStoredPath returns the stored path of the entry matching filePath
+// once both went through the PathNormalizer, if it differs from filePath.
+// Names equal in Unicode NFC match too (e.g. "café" typed composed and
+// stored decomposed), and with CaseInsensitivePaths names differing in
+// case. An exact match is preferred, then a Unicode-equivalent one, then
+// the first entry in archive order.
+func (a *Archive) findStoredPath(filePath string, password string) (string, bool) {
+	info, err := a.info(password)
+	if err != nil {
+		return "", false
+	}
+
+	const (
+		noMatch = iota
+		foldMatch
+		unicodeMatch
+	)
+	name := utils.NormalizePath(a.normalizePath(filePath))
+	composed := utils.NFC(name)
+	match, rank := "", noMatch
+	for _, entry := range info.Files {
+		entryPath := utils.NormalizePath(a.normalizePath(entry.Path))
+		if entryPath == name {
+			match, rank = entry.Path, unicodeMatch
+			break
+		}
+		entryComposed := utils.NFC(entryPath)
+		if rank < unicodeMatch && entryComposed == composed {
+			match, rank = entry.Path, unicodeMatch
+		} else if rank < foldMatch && a.config.CaseInsensitivePaths && strings.EqualFold(entryComposed, composed) {
+			match, rank = entry.Path, foldMatch
+		}
+	}
+	if rank == noMatch || match == filePath {
+		return "", false
+	}
+	return match, true
+}
+
+// CachedEntry returns the directory entry of filePath for formats that
+// keep their directory in one place (ZIP, 7z) and for streaming archives,
+// where it is read once and cached. For other formats finding an entry
+// means scanning the archive, so ok is false. Paths are compared after
+// going through the PathNormalizer, and match when equal in Unicode NFC
+// if no entry matches exactly.
+func (a *Archive) CachedEntry(filePath string, password string) (formats.FileEntry, bool) {
+	if !a.indexed() {
+		return formats.FileEntry{}, false
+	}
+	info, err := a.index(a.ctx, a.resolvePassword(password))
+	if err != nil {
+		return formats.FileEntry{}, false
+	}
+	name := utils.NormalizePath(a.normalizePath(filePath))
+	composed := utils.NFC(name)
+	var match formats.FileEntry
+	found := false
+	for _, entry := range info.Files {
+		entryPath := utils.NormalizePath(a.normalizePath(entry.Path))
+		if entryPath == name {
+			return entry, true
+		}
+		if !found && utils.NFC(entryPath) == composed {
+			match, found = entry, true
+		}
+	}
+	return match, found
+}
+
+// trackReader registers a new extract reader, enforcing MaxOpenReaders
+func (a *Archive) trackReader(filePath string) (*extractReader, error) {
+	a.readersMu.Lock()
+	defer a.readersMu.Unlock()
+
+	if a.config.MaxOpenReaders > 0 && len(a.openReaders) >= a.config.MaxOpenReaders {
+		return nil, &utils.ExtractError{Path: filePath, Cause: utils.ErrTooManyReaders}
+	}
+
+	er := &extractReader{path: filePath, archive: a}
+	if a.openReaders == nil {
+		a.openReaders = make(map[*extractReader]struct{})
+	}
+	a.openReaders[er] = struct{}{}
+	return er, nil
+}
+
+// untrackReader forgets an extract reader once it is closed
+func (a *Archive) untrackReader(er *extractReader) {
+	a.readersMu.Lock()
+	delete(a.openReaders, er)
+	a.readersMu.Unlock()
+}
+
+// OpenReaders returns the number of extract readers that haven't been closed
+func (a *Archive) OpenReaders() int {
+	a.readersMu.Lock()
+	defer a.readersMu.Unlock()
+	return len(a.openReaders)
+}
+
+// extractReader reports read failures as *utils.ExtractError and lets the
+// archive track readers that are still open
+type extractReader struct {
+	io.ReadCloser
+	path      string
+	archive   *Archive
+	span      tracing.Span
+	read      int64
+	readErr   error
+	closeOnce sync.Once
+
+	// Opens the member again at an offset to resume after a transfer
+	// error, up to retries times (nil = the member can only be read once),
+	// decompressing at most maxReread bytes again to get there
+	reopen    func(offset, maxReread int64) (io.ReadCloser, error)
+	retries   int
+	maxReread int64
+}
+
+func (er *extractReader) Read(p []byte) (int, error) {
+	n, err := er.ReadCloser.Read(p)
+	er.read += int64(n)
+	if err != nil && err != io.EOF {
+		if er.resume(err) {
+			if n > 0 {
+				return n, nil
+			}
+			return er.Read(p)
+		}
+		err = &utils.ExtractError{Path: er.path, Cause: er.archive.classifyReadError(err)}
+		er.readErr = err
+	}
+	return n, err
+}
+
+// resume replaces the reader that failed with err by the member opened
+// again, past the bytes already read, if err is a transient transfer error
+// and retries are left
+func (er *extractReader) resume(err error) bool {
+	if er.reopen == nil || er.retries <= 0 || !rangehttp.IsTransferError(err) ||
+		!rangehttp.IsTransient(er.archive.ctx, err) {
+		return false
+	}
+	er.retries--
+	er.archive.config.debugf(er.archive.ctx, "Resuming %s at byte %d after: %v\n", er.path, er.read, err)
+
+	reader, reopenErr := er.reopen(er.read, er.maxReread)
+	if reopenErr != nil {
+		er.archive.config.debugf(er.archive.ctx, "Failed to resume %s: %v\n", er.path, reopenErr)
+		return false
+	}
+	er.ReadCloser.Close()
+	er.ReadCloser = reader
+	return true
+}
+
+// classifyReadError returns err, hit while reading member data, as a
+// *utils.DecompressionError unless reading the archive's bytes failed,
+// the read was canceled, or the password was wrong
+func (a *Archive) classifyReadError(err error) error {
+	if rangehttp.IsTransferError(err) || a.ctx.Err() != nil ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, utils.ErrStreamRewind) || errors.Is(err, utils.ErrRetryBudgetExceeded) ||
+		errors.Is(err, formats.ErrPasswordIncorrect) || errors.Is(err, formats.ErrPasswordRequired) ||
+		utils.IsPasswordError(err) {
+		return err
+	}
+	return &utils.DecompressionError{Cause: err}
+}
+
+func (er *extractReader) Close() error {
+	var err error
+	er.closeOnce.Do(func() {
+		err = er.ReadCloser.Close()
+		er.archive.untrackReader(er)
+		er.span.SetAttributes(tracing.Int64("archive.bytes_read", er.read))
+		endSpan(er.span, er.readErr)
+	})
+	return err
+}
+
+// Unlock verifies password and remembers it for this archive, so later
+// GetInfo/ListFiles/ExtractFile calls can pass an empty password.
+// The password is only kept in memory and is cleared on Close.
+func (a *Archive) Unlock(password string) error {
+	if _, err := a.GetInfo(password); err != nil {
+		return err
+	}
+
+	a.passwordMu.Lock()
+	a.password = password
+	a.passwordMu.Unlock()
+	return nil
+}
+
+// PasswordStatus is the outcome of VerifyPassword
+type PasswordStatus int
+
+const (
+	// PasswordNotRequired means the archive has no encrypted content
+	PasswordNotRequired PasswordStatus = iota
+	// PasswordCorrect means the password decrypts the archive
+	PasswordCorrect
+	// PasswordIncorrect means the password is wrong or missing
+	PasswordIncorrect
+)
+
+// CheckPassword reports whether password opens the archive. Archives
+// without encrypted content accept any password; use VerifyPassword to
+// tell them apart from a correct password.
+func (a *Archive) CheckPassword(password string) (bool, error) {
+	status, err := a.VerifyPassword(password)
+	if err != nil {
+		return false, err
+	}
+	return status != PasswordIncorrect, nil
+}
+
+// VerifyPassword checks password with the least work the format allows.
+// ZIP only opens the first encrypted entry, so this is much cheaper than
+// GetInfo for a "prompt, verify, then browse" flow. Other formats fall
+// back to reading the archive info. Unlike Unlock, the password is not
+// remembered, and a password remembered by Unlock is not used.
+func (a *Archive) VerifyPassword(password string) (PasswordStatus, error) {
+	src := a.source()
+	if checker, ok := src.format.(formats.PasswordChecker); ok {
+		encrypted, valid, err := checker.CheckPassword(a.ctx, src.data, src.size, password)
+		switch {
+		case err != nil:
+			return PasswordIncorrect, err
+		case !encrypted:
+			return PasswordNotRequired, nil
+		case !valid:
+			return PasswordIncorrect, nil
+		}
+		return PasswordCorrect, nil
+	}
+
+	info, err := src.format.GetInfo(a.ctx, src.data, src.size, "")
+	if err != nil && !errors.Is(err, formats.ErrPasswordRequired) {
+		return PasswordIncorrect, err
+	}
+	if err == nil && !info.IsEncrypted {
+		return PasswordNotRequired, nil
+	}
+	if password == "" {
+		return PasswordIncorrect, nil
+	}
+
+	_, err = src.format.GetInfo(a.ctx, src.data, src.size, password)
+	if errors.Is(err, formats.ErrPasswordIncorrect) || errors.Is(err, formats.ErrPasswordRequired) {
+		return PasswordIncorrect, nil
+	}
+	if err != nil {
+		return PasswordIncorrect, err
+	}
+	return PasswordCorrect, nil
+}
+
+// RequiresPassword reports whether extracting from the archive needs a
+// password, for formats that can tell without building the listing (see
+// formats.PasswordChecker). known is false for the others, whose GetInfo
+// has to be asked instead.
+func (a *Archive) RequiresPassword() (required bool, known bool, err error) {
+	src := a.source()
+	checker, ok := src.format.(formats.PasswordChecker)
+	if !ok {
+		return false, false, nil
+	}
+	encrypted, _, err := checker.CheckPassword(a.ctx, src.data, src.size, "")
+	if err != nil {
+		return false, false, a.checkBudget(err)
+	}
+	return encrypted, true, nil
+}
+
+// resolvePassword returns password, or the one remembered by Unlock if it's empty
+func (a *Archive) resolvePassword(password string) string {
+	if password != "" {
+		return password
+	}
+
+	a.passwordMu.Lock()
+	defer a.passwordMu.Unlock()
+	return a.password
+}
+
+// Reopen re-reads the archive's size and format from the server and drops
+// the cached directory, e.g. after the remote file has been replaced. It
+// is safe to call while other calls are running: each call reads either
+// the previous file or the new one, and readers of the previous file may
+// fail once it's closed, but never mix the two.
+func (a *Archive) Reopen() error {
+	if a.stream != nil {
+		return utils.WrapError(formats.ErrNotSupported, "a streaming archive can't be reopened")
+	}
+	if a.httpClient == nil {
+		// Opened from a data: URL, the bytes can't have changed
+		a.invalidateIndex()
+		a.cursor.close()
+		return nil
+	}
+
+	src, err := openSource(a.ctx, a.ctx, a.httpClient, a.url, a.config)
+	if err != nil {
+		return err
+	}
+
+	a.sourceMu.Lock()
+	old := a.src
+	a.src = src
+	a.sourceMu.Unlock()
+	// Reads still using the old file fail from here on
+	old.closeReaders()
+	a.invalidateIndex()
+	a.cursor.close()
+
+	return nil
 }
 
 // Close closes the archive and releases resources
 func (a *Archive) Close() error {
-	if a.reader != nil {
-		a.reader.Close()
+	a.readersMu.Lock()
+	if len(a.openReaders) > 0 {
+		paths := make([]string, 0, len(a.openReaders))
+		for er := range a.openReaders {
+			paths = append(paths, er.path)
+		}
+		a.config.debugf(a.ctx, "Warning: archive closed with %d extract reader(s) still open (missing Close?): %s\n",
+			len(paths), strings.Join(paths, ", "))
 	}
+	a.readersMu.Unlock()
+
+	a.passwordMu.Lock()
+	a.password = ""
+	a.passwordMu.Unlock()
+
+	a.cursor.close()
+	a.source().closeReaders()
 	if a.cancel != nil {
 		a.cancel()
 	}
 	return nil
 }
 
+// rangeReaders returns the readers of the source's volumes, the one for
+// the URL last
+func (s *archiveSource) rangeReaders() []*rangehttp.RangeReader {
+	if s.reader == nil {
+		return nil
+	}
+	return append(append([]*rangehttp.RangeReader(nil), s.volumes...), s.reader)
+}
+
+// closeReaders closes the range readers of every volume
+func (s *archiveSource) closeReaders() {
+	for _, reader := range s.rangeReaders() {
+		reader.Close()
+	}
+}
+
 // URL returns the archive URL
 func (a *Archive) URL() string {
 	return a.url
 }
 
 // Size returns the archive size in bytes
+// For archives embedded in a larger file this excludes the bytes before Offset
 func (a *Archive) Size() int64 {
-	return a.size
+	return a.source().size
+}
+
+// Offset returns where the archive starts within the remote file
+// (non-zero e.g. for self-extracting executables)
+func (a *Archive) Offset() int64 {
+	return a.source().offset
+}
+
+// Validator returns the ETag the server reported for the archive when it
+// was opened, or Last-Modified if there was no ETag, so a caller can tell
+// whether a later request sees the same file. It is empty if the server
+// sent neither and for archives not fetched over HTTP.
+func (a *Archive) Validator() string {
+	return a.source().validator
+}
+
+// SupportsRange reports whether the server said it honors Range
+// requests. Without them every read downloads the file from the start,
+// up to MaxFallbackBytes.
+func (a *Archive) SupportsRange() bool {
+	return a.source().ranges
+}
+
+// Stats counts the range requests an archive has sent. Reopen starts
+// counting anew.
+type Stats struct {
+	RangeRequests int64
+	BytesFetched  int64
+	CachedReads   int64 // Reads answered from memory without a request
+	Retries       int64 // Range requests sent again after a transient failure
+}
+
+// Stats returns the range requests sent for the archive so far
+func (a *Archive) Stats() Stats {
+	// Read from a stream there are no readers, and no requests
+	var stats Stats
+	for _, reader := range a.source().rangeReaders() {
+		stats.RangeRequests += reader.Requests()
+		stats.BytesFetched += reader.BytesFetched()
+		stats.CachedReads += reader.CachedReads()
+		stats.Retries += reader.Retries()
+	}
+	return stats
+}
+
+// checkBudget makes err match utils.ErrRangeBudgetExceeded when the
+// archive ran out of range requests, or utils.ErrRangeNotSupported when
+// it hit the fallback limit. Format parsers don't always pass the read
+// error through, and would report e.g. a corrupted archive instead.
+func (a *Archive) checkBudget(err error) error {
+	if err == nil || errors.Is(err, utils.ErrRangeBudgetExceeded) || errors.Is(err, utils.ErrRangeNotSupported) ||
+		errors.Is(err, utils.ErrRetryBudgetExceeded) {
+		return err
+	}
+	for _, reader := range a.source().rangeReaders() {
+		if reader.BudgetExceeded() {
+			return utils.WrapError(utils.ErrRangeBudgetExceeded, "%v", err)
+		}
+		if reader.RetryBudgetExceeded() {
+			return utils.WrapError(utils.ErrRetryBudgetExceeded, "%v", err)
+		}
+	}
+	if a.httpClient != nil && a.httpClient.FallbackExceeded() {
+		return utils.WrapError(utils.ErrRangeNotSupported, "%v", err)
+	}
+	return err
 }
 
 // Format returns the detected archive format name
 func (a *Archive) Format() string {
-	if a.format != nil {
-		return a.format.Name()
+	if format := a.source().format; format != nil {
+		return format.Name()
 	}
 	return "unknown"
 }
 
+// ExactSizes reports whether the sizes returned by ExtractFile always
+// match the extracted content. When false, a size is only a hint and
+// callers shouldn't promise it to their own clients, e.g. as Content-Length.
+func (a *Archive) ExactSizes() bool {
+	if reporter, ok := a.source().format.(formats.SizeReporter); ok {
+		return reporter.ExactSizes()
+	}
+	return true
+}
+
 // QuickInfo is a convenience function that creates an Archive, gets info, and closes it
 func QuickInfo(archiveURL string, password string, config *Config) (*formats.ArchiveInfo, error) {
 	archive, err := NewArchive(archiveURL, config)
@@ -185,6 +1424,51 @@ func QuickList(archiveURL string, innerPath string, password string, config *Con
 	return archive.ListFiles(innerPath, password)
 }
 
+// OperationStats describes what a one-shot operation cost upstream. The
+// HEAD request opening the archive is not counted as a range request.
+type OperationStats struct {
+	Elapsed time.Duration // From opening the archive to the result
+	Stats
+}
+
+// QuickInfoWithStats is QuickInfo that also reports the operation's cost,
+// e.g. for logging. Stats are returned even when the operation fails.
+func QuickInfoWithStats(archiveURL string, password string, config *Config) (*formats.ArchiveInfo, OperationStats, error) {
+	start := time.Now()
+	archive, err := NewArchive(archiveURL, config)
+	if err != nil {
+		return nil, OperationStats{Elapsed: time.Since(start)}, err
+	}
+	defer archive.Close()
+
+	info, err := archive.GetInfo(password)
+	return info, OperationStats{Elapsed: time.Since(start), Stats: archive.Stats()}, err
+}
+
+// QuickListWithStats is QuickList that also reports the operation's cost
+func QuickListWithStats(archiveURL string, innerPath string, password string, config *Config) ([]formats.FileEntry, OperationStats, error) {
+	start := time.Now()
+	archive, err := NewArchive(archiveURL, config)
+	if err != nil {
+		return nil, OperationStats{Elapsed: time.Since(start)}, err
+	}
+	defer archive.Close()
+
+	files, err := archive.ListFiles(innerPath, password)
+	return files, OperationStats{Elapsed: time.Since(start), Stats: archive.Stats()}, err
+}
+
+// QuickWalk is a convenience function that creates an Archive, walks its entries, and closes it
+func QuickWalk(archiveURL string, innerPath string, password string, config *Config, fn func(formats.FileEntry) error) error {
+	archive, err := NewArchive(archiveURL, config)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	return archive.Walk(innerPath, password, fn)
+}
+
 // QuickExtract is a convenience function that creates an Archive, extracts a file, and closes the archive
 // Note: The returned ReadCloser must still be closed by the caller
 func QuickExtract(archiveURL string, filePath string, password string, config *Config) (io.ReadCloser, int64, error) {
@@ -206,48 +1490,33 @@ func QuickExtract(archiveURL string, filePath string, password string, config *C
 	}, size, nil
 }
 
-// archiveReader wraps a file reader and ensures the archive is closed
+// archiveReader wraps a file reader and ensures the archive is closed.
+// The archive is closed even if closing the file reader fails.
 type archiveReader struct {
 	io.ReadCloser
-	archive *Archive
-	closed  bool
+	archive   *Archive
+	closeOnce sync.Once
 }
 
 func (ar *archiveReader) Close() error {
-	if ar.closed {
-		return nil
-	}
-	ar.closed = true
-
-	// Close the file reader first
-	err1 := ar.ReadCloser.Close()
-
-	// Then close the archive
-	err2 := ar.archive.Close()
+	var err error
+	ar.closeOnce.Do(func() {
+		// Close the file reader first
+		err = ar.ReadCloser.Close()
 
-	if err1 != nil {
-		return err1
-	}
-	return err2
+		// Then close the archive
+		if archiveErr := ar.archive.Close(); err == nil {
+			err = archiveErr
+		}
+	})
+	return err
 }
 
-// WithContext creates a new Archive with a custom context
+// NewArchiveWithContext creates a new Archive whose requests are bound to
+// ctx: canceling it aborts them, and its trace context is the parent of
+// the archive's spans
 func NewArchiveWithContext(ctx context.Context, archiveURL string, config *Config) (*Archive, error) {
-	archive, err := NewArchive(archiveURL, config)
-	if err != nil {
-		return nil, err
-	}
-
-	// Don't cancel the old context - RangeReader is still using it!
-	// Instead, create a child context from the provided context
-	oldCancel := archive.cancel
-	archive.ctx, archive.cancel = context.WithCancel(ctx)
-	
-	// Keep the old context alive by not calling oldCancel immediately
-	// It will be cleaned up when the archive is closed
-	_ = oldCancel
-
-	return archive, nil
+	return newArchive(ctx, archiveURL, config)
 }
 
 // WithTimeout creates a new Archive with a timeout
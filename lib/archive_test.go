@@ -0,0 +1,1905 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/flate"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/NORMAL-EX/stream-7z/internal/testarchive"
+	"github.com/NORMAL-EX/stream-7z/lib/formats"
+	"github.com/NORMAL-EX/stream-7z/lib/rangehttp"
+	"github.com/NORMAL-EX/stream-7z/lib/tracing"
+	"github.com/NORMAL-EX/stream-7z/lib/utils"
+	"github.com/yeka/zip"
+)
+
+// newFileServer serves data with Range support under any path
+func newFileServer(t testing.TB, data []byte, contentType string) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestNewArchiveRejectsWebPage(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		contentType string
+	}{
+		{"html content type", "<!DOCTYPE html><html><body>Not Found</body></html>", "text/html; charset=utf-8"},
+		{"sniffed html", "\n  <html><head><title>Login</title></head></html>", "application/octet-stream"},
+		{"sniffed json", `{"error": "access denied"}`, "binary/octet-stream"},
+	}
+
+	for _, test := range tests {
+		server := newFileServer(t, []byte(test.body), test.contentType)
+
+		_, err := NewArchive(server.URL+"/archive.zip", nil)
+		if !errors.Is(err, utils.ErrNotAnArchive) {
+			t.Errorf("%s: expected ErrNotAnArchive, got %v", test.name, err)
+		}
+	}
+}
+
+func TestNewArchiveUnknownBinaryIsUnsupported(t *testing.T) {
+	server := newFileServer(t, bytes.Repeat([]byte{0x00, 0x01, 0x02, 0x03}, 256), "application/octet-stream")
+
+	_, err := NewArchive(server.URL+"/archive.bin", nil)
+	if !errors.Is(err, utils.ErrUnsupportedFormat) {
+		t.Errorf("expected ErrUnsupportedFormat, got %v", err)
+	}
+}
+
+func TestNewArchiveEncryptedContainer(t *testing.T) {
+	data := append([]byte("Salted__"), bytes.Repeat([]byte{0x5A, 0xC3}, 512)...)
+	server := newFileServer(t, data, "application/octet-stream")
+
+	_, err := NewArchive(server.URL+"/backup.tar.gz", nil)
+	if !errors.Is(err, formats.ErrEncryptedContainer) {
+		t.Errorf("expected ErrEncryptedContainer, got %v", err)
+	}
+}
+
+func TestNewArchiveRetriesTransientHeadFailure(t *testing.T) {
+	data := testarchive.Zip(t, testarchive.Pairs("hello.txt", "hello")...)
+	var heads int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead && atomic.AddInt32(&heads, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+
+	archive, err := NewArchive(server.URL+"/archive.zip", DefaultConfig().WithHeadRetries(1, time.Millisecond))
+	if err != nil {
+		t.Fatalf("expected the retry to succeed, got %v", err)
+	}
+	archive.Close()
+	if n := atomic.LoadInt32(&heads); n != 2 {
+		t.Errorf("expected 2 HEAD requests, got %d", n)
+	}
+
+	// Without retries the first failure is final
+	atomic.StoreInt32(&heads, 0)
+	if _, err := NewArchive(server.URL+"/archive.zip", DefaultConfig().WithHeadRetries(0, 0)); err == nil {
+		t.Error("expected NewArchive to fail without retries")
+	}
+}
+
+func TestNewArchiveSizeFromRangeRequest(t *testing.T) {
+	data := testarchive.Zip(t, testarchive.Pairs("hello.txt", "hello")...)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodHead:
+			// No Content-Length, so HEAD tells nothing about the size
+			w.WriteHeader(http.StatusOK)
+		case r.Header.Get("Range") == "":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	archive, err := NewArchive(server.URL+"/archive.zip", nil)
+	if err != nil {
+		t.Fatalf("NewArchive failed: %v", err)
+	}
+	defer archive.Close()
+
+	if archive.Size() != int64(len(data)) {
+		t.Errorf("expected size %d, got %d", len(data), archive.Size())
+	}
+	files, err := archive.ListFiles("", "")
+	if err != nil || len(files) != 1 {
+		t.Errorf("expected 1 file, got %v (%v)", files, err)
+	}
+}
+
+func TestNewArchiveUnknownSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Neither HEAD nor a range request reports the size
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.Header().Set("Content-Range", "bytes 0-0/*")
+		w.WriteHeader(http.StatusPartialContent)
+	}))
+	t.Cleanup(server.Close)
+
+	if _, err := NewArchive(server.URL+"/archive.zip", nil); !errors.Is(err, utils.ErrUnknownSize) {
+		t.Errorf("expected ErrUnknownSize, got %v", err)
+	}
+}
+
+func TestNewArchiveZeroContentLength(t *testing.T) {
+	data := testarchive.Zip(t, testarchive.Pairs("hello.txt", "hello")...)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			// A server that doesn't know the size of HEAD responses
+			w.Header().Set("Content-Length", "0")
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+
+	archive, err := NewArchive(server.URL+"/archive.zip", nil)
+	if err != nil {
+		t.Fatalf("NewArchive failed: %v", err)
+	}
+	defer archive.Close()
+
+	if archive.Size() != int64(len(data)) {
+		t.Errorf("expected size %d from the range request, got %d", len(data), archive.Size())
+	}
+}
+
+func TestNewArchiveEmptyFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(nil))
+	}))
+	t.Cleanup(server.Close)
+
+	if _, err := NewArchive(server.URL+"/archive.zip", nil); !errors.Is(err, utils.ErrUnsupportedFormat) {
+		t.Errorf("expected ErrUnsupportedFormat for an empty file, got %v", err)
+	}
+}
+
+// chunkedWriter hides the total size in Content-Range and drops
+// Content-Length, so responses are sent chunked
+type chunkedWriter struct {
+	http.ResponseWriter
+}
+
+func (w chunkedWriter) WriteHeader(status int) {
+	if contentRange := w.Header().Get("Content-Range"); contentRange != "" {
+		rangePart, _, _ := strings.Cut(contentRange, "/")
+		w.Header().Set("Content-Range", rangePart+"/*")
+	}
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func TestNewArchiveAssumedSize(t *testing.T) {
+	data := testarchive.Zip(t, testarchive.Pairs("hello.txt", "hello")...)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		http.ServeContent(chunkedWriter{w}, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+
+	if _, err := NewArchive(server.URL+"/archive.zip", nil); !errors.Is(err, utils.ErrUnknownSize) {
+		t.Fatalf("expected ErrUnknownSize without an assumed size, got %v", err)
+	}
+
+	config := DefaultConfig().WithAssumedSize(int64(len(data)))
+	archive, err := NewArchive(server.URL+"/archive.zip", config)
+	if err != nil {
+		t.Fatalf("NewArchive failed: %v", err)
+	}
+	defer archive.Close()
+
+	if archive.Size() != int64(len(data)) {
+		t.Errorf("expected the assumed size %d, got %d", len(data), archive.Size())
+	}
+	files, err := archive.ListFiles("", "")
+	if err != nil || len(files) != 1 {
+		t.Errorf("expected 1 file, got %v (%v)", files, err)
+	}
+}
+
+func TestNewArchiveTrustExtension(t *testing.T) {
+	data := testarchive.Zip(t, testarchive.Pairs("hello.txt", "hello")...)
+	var gets int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			atomic.AddInt32(&gets, 1)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+
+	config := DefaultConfig().WithWholeDownloadThreshold(0).WithTrustExtension(true)
+	archive, err := NewArchive(server.URL+"/archive.zip", config)
+	if err != nil {
+		t.Fatalf("NewArchive failed: %v", err)
+	}
+	defer archive.Close()
+
+	if n := atomic.LoadInt32(&gets); n != 0 {
+		t.Errorf("expected no detection reads, got %d", n)
+	}
+	if archive.Format() != "zip" {
+		t.Errorf("expected zip, got %s", archive.Format())
+	}
+
+	// An unknown extension is still detected from the content
+	other, err := NewArchive(server.URL+"/download", config)
+	if err != nil {
+		t.Fatalf("NewArchive without extension failed: %v", err)
+	}
+	defer other.Close()
+	if n := atomic.LoadInt32(&gets); other.Format() != "zip" || n == 0 {
+		t.Errorf("expected content detection, got format %s after %d reads", other.Format(), n)
+	}
+}
+
+func TestNewArchiveSendsAcceptHeader(t *testing.T) {
+	data := testarchive.Zip(t, testarchive.Pairs("hello.txt", "hello")...)
+	accepts := make(chan string, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case accepts <- r.Header.Get("Accept"):
+		default:
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	archive, err := NewArchive(server.URL+"/archive.zip", DefaultConfig().WithAccept("application/zip"))
+	if err != nil {
+		t.Fatalf("NewArchive failed: %v", err)
+	}
+	archive.Close()
+
+	if accept := <-accepts; accept != "application/zip" {
+		t.Errorf("expected Accept 'application/zip', got %q", accept)
+	}
+}
+
+func TestNewArchiveExpectedContentTypes(t *testing.T) {
+	data := testarchive.Zip(t, testarchive.Pairs("hello.txt", "hello")...)
+
+	tests := []struct {
+		name        string
+		contentType string
+		expected    []string
+		wantErr     error
+	}{
+		{"lenient by default", "binary/octet-stream", nil, nil},
+		{"exact match", "application/zip", []string{"application/zip"}, nil},
+		{"wildcard match", "application/octet-stream", []string{"application/*"}, nil},
+		{"missing content type", "", []string{"application/zip"}, nil},
+		{"mismatch", "image/png", []string{"application/zip"}, utils.ErrUnexpectedContentType},
+		{"html mismatch", "text/html; charset=utf-8", []string{"application/zip"}, utils.ErrNotAnArchive},
+	}
+
+	for _, test := range tests {
+		server := newFileServer(t, data, test.contentType)
+		if test.contentType == "" {
+			// http.ServeContent sniffs a type when none is set, so serve it bare
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header()["Content-Type"] = nil
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+			}))
+			defer server.Close()
+		}
+
+		archive, err := NewArchive(server.URL+"/archive.zip", DefaultConfig().WithExpectedContentTypes(test.expected))
+		if test.wantErr == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+				continue
+			}
+			archive.Close()
+		} else if !errors.Is(err, test.wantErr) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.wantErr, err)
+		}
+	}
+}
+
+func TestArchiveUnlock(t *testing.T) {
+	server := newFileServer(t, testarchive.Zip(t, testarchive.Entry{Name: "secret.txt", Content: "secret content", Method: zip.Deflate, Password: "pass"}), "application/zip")
+
+	archive, err := NewArchive(server.URL+"/archive.zip", nil)
+	if err != nil {
+		t.Fatalf("NewArchive failed: %v", err)
+	}
+	defer archive.Close()
+
+	if err := archive.Unlock("wrong"); !errors.Is(err, formats.ErrPasswordIncorrect) {
+		t.Fatalf("expected ErrPasswordIncorrect, got %v", err)
+	}
+	if _, _, err := archive.ExtractFile("secret.txt", ""); !errors.Is(err, formats.ErrPasswordRequired) {
+		t.Fatalf("expected ErrPasswordRequired before unlocking, got %v", err)
+	}
+
+	if err := archive.Unlock("pass"); err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+
+	reader, _, err := archive.ExtractFile("secret.txt", "")
+	if err != nil {
+		t.Fatalf("ExtractFile after Unlock failed: %v", err)
+	}
+	content, _ := io.ReadAll(reader)
+	reader.Close()
+	if string(content) != "secret content" {
+		t.Errorf("unexpected content %q", content)
+	}
+
+	archive.Close()
+	if archive.resolvePassword("") != "" {
+		t.Error("expected Close to forget the password")
+	}
+}
+
+func TestArchiveVerifyPassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		password string
+		want     PasswordStatus
+	}{
+		{"not encrypted", testarchive.Zip(t, testarchive.Pairs("hello.txt", "hello")...), "anything", PasswordNotRequired},
+		{"correct", testarchive.Zip(t, testarchive.Entry{Name: "secret.txt", Content: "secret content", Method: zip.Deflate, Password: "pass"}), "pass", PasswordCorrect},
+		{"incorrect", testarchive.Zip(t, testarchive.Entry{Name: "secret.txt", Content: "secret content", Method: zip.Deflate, Password: "pass"}), "wrong", PasswordIncorrect},
+		{"missing", testarchive.Zip(t, testarchive.Entry{Name: "secret.txt", Content: "secret content", Method: zip.Deflate, Password: "pass"}), "", PasswordIncorrect},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFileServer(t, tt.data, "application/zip")
+			archive, err := NewArchive(server.URL+"/archive.zip", nil)
+			if err != nil {
+				t.Fatalf("NewArchive failed: %v", err)
+			}
+			defer archive.Close()
+
+			status, err := archive.VerifyPassword(tt.password)
+			if err != nil {
+				t.Fatalf("VerifyPassword failed: %v", err)
+			}
+			if status != tt.want {
+				t.Errorf("expected status %d, got %d", tt.want, status)
+			}
+
+			ok, err := archive.CheckPassword(tt.password)
+			if err != nil {
+				t.Fatalf("CheckPassword failed: %v", err)
+			}
+			if ok != (tt.want != PasswordIncorrect) {
+				t.Errorf("expected CheckPassword %v, got %v", tt.want != PasswordIncorrect, ok)
+			}
+		})
+	}
+}
+
+func TestNewArchiveSelfExtracting(t *testing.T) {
+	stub := append([]byte("MZ"), bytes.Repeat([]byte{0x90}, 2048)...)
+	data := append(stub, testarchive.Zip(t, testarchive.Pairs("hello.txt", "hello")...)...)
+	server := newFileServer(t, data, "application/x-msdownload")
+
+	archive, err := NewArchive(server.URL+"/setup.exe", nil)
+	if err != nil {
+		t.Fatalf("NewArchive failed: %v", err)
+	}
+	defer archive.Close()
+
+	if archive.Format() != "zip" {
+		t.Errorf("expected zip payload, got %s", archive.Format())
+	}
+	if archive.Offset() != int64(len(stub)) {
+		t.Errorf("expected offset %d, got %d", len(stub), archive.Offset())
+	}
+
+	reader, _, err := archive.ExtractFile("hello.txt", "")
+	if err != nil {
+		t.Fatalf("ExtractFile failed: %v", err)
+	}
+	content, _ := io.ReadAll(reader)
+	reader.Close()
+	if string(content) != "hello" {
+		t.Errorf("unexpected content %q", content)
+	}
+}
+
+func TestNewArchiveWithOffset(t *testing.T) {
+	junk := bytes.Repeat([]byte("junk"), 100)
+	data := append(append([]byte(nil), junk...), testarchive.Zip(t, testarchive.Pairs("hello.txt", "hello")...)...)
+	server := newFileServer(t, data, "application/octet-stream")
+
+	if _, err := NewArchive(server.URL+"/data.bin", nil); !errors.Is(err, utils.ErrUnsupportedFormat) {
+		t.Fatalf("expected ErrUnsupportedFormat without offset, got %v", err)
+	}
+
+	archive, err := NewArchive(server.URL+"/data.bin", DefaultConfig().WithOffset(int64(len(junk))))
+	if err != nil {
+		t.Fatalf("NewArchive with offset failed: %v", err)
+	}
+	defer archive.Close()
+
+	if archive.Size() != int64(len(data)-len(junk)) {
+		t.Errorf("expected size %d, got %d", len(data)-len(junk), archive.Size())
+	}
+
+	files, err := archive.ListFiles("", "")
+	if err != nil {
+		t.Fatalf("ListFiles failed: %v", err)
+	}
+	if len(files) != 1 || files[0].Path != "hello.txt" {
+		t.Errorf("unexpected listing %+v", files)
+	}
+
+	if _, err := NewArchive(server.URL+"/data.bin", DefaultConfig().WithOffset(int64(len(data)))); err == nil {
+		t.Error("expected an error for an offset past the end of the file")
+	}
+}
+
+func TestExtractFileReturnsExtractError(t *testing.T) {
+	server := newFileServer(t, testarchive.Zip(t, testarchive.Entry{Name: "secret.txt", Content: "secret content", Method: zip.Deflate, Password: "pass"}), "application/zip")
+
+	archive, err := NewArchive(server.URL+"/archive.zip", nil)
+	if err != nil {
+		t.Fatalf("NewArchive failed: %v", err)
+	}
+	defer archive.Close()
+
+	tests := []struct {
+		path     string
+		password string
+		cause    error
+	}{
+		{"missing.txt", "", formats.ErrFileNotFound},
+		{"secret.txt", "", formats.ErrPasswordRequired},
+		{"../etc/passwd", "", utils.ErrPathTraversal},
+	}
+
+	for _, test := range tests {
+		_, _, err := archive.ExtractFile(test.path, test.password)
+
+		var extractErr *utils.ExtractError
+		if !errors.As(err, &extractErr) {
+			t.Errorf("%s: expected *utils.ExtractError, got %T (%v)", test.path, err, err)
+			continue
+		}
+		if extractErr.Path != test.path {
+			t.Errorf("%s: error reports path %q", test.path, extractErr.Path)
+		}
+		if !errors.Is(err, test.cause) {
+			t.Errorf("%s: expected cause %v, got %v", test.path, test.cause, extractErr.Cause)
+		}
+	}
+}
+
+func TestArchiveWarnsAboutLeakedReaders(t *testing.T) {
+	var output bytes.Buffer
+	debugOutput = &output
+	defer func() { debugOutput = os.Stdout }()
+
+	server := newFileServer(t, testarchive.Zip(t, testarchive.Pairs("hello.txt", "hello")...), "application/zip")
+	archive, err := NewArchive(server.URL+"/archive.zip", DefaultConfig().WithDebug(true))
+	if err != nil {
+		t.Fatalf("NewArchive failed: %v", err)
+	}
+
+	if _, _, err := archive.ExtractFile("hello.txt", ""); err != nil {
+		t.Fatalf("ExtractFile failed: %v", err)
+	}
+	if archive.OpenReaders() != 1 {
+		t.Errorf("expected 1 open reader, got %d", archive.OpenReaders())
+	}
+
+	archive.Close()
+
+	if !strings.Contains(output.String(), "still open") || !strings.Contains(output.String(), "hello.txt") {
+		t.Errorf("expected a leak warning naming hello.txt, got %q", output.String())
+	}
+}
+
+func TestArchiveMaxOpenReaders(t *testing.T) {
+	server := newFileServer(t, testarchive.Zip(t, testarchive.Pairs("hello.txt", "hello")...), "application/zip")
+	archive, err := NewArchive(server.URL+"/archive.zip", DefaultConfig().WithMaxOpenReaders(1))
+	if err != nil {
+		t.Fatalf("NewArchive failed: %v", err)
+	}
+	defer archive.Close()
+
+	first, _, err := archive.ExtractFile("hello.txt", "")
+	if err != nil {
+		t.Fatalf("ExtractFile failed: %v", err)
+	}
+
+	if _, _, err := archive.ExtractFile("hello.txt", ""); !errors.Is(err, utils.ErrTooManyReaders) {
+		t.Errorf("expected ErrTooManyReaders, got %v", err)
+	}
+
+	first.Close()
+	first.Close() // Closing twice must not free a second slot
+
+	second, _, err := archive.ExtractFile("hello.txt", "")
+	if err != nil {
+		t.Fatalf("ExtractFile after Close failed: %v", err)
+	}
+	second.Close()
+
+	if archive.OpenReaders() != 0 {
+		t.Errorf("expected no open readers, got %d", archive.OpenReaders())
+	}
+}
+
+// countingReadCloser counts Close calls, optionally failing reads after
+// the first chunk and failing Close
+type countingReadCloser struct {
+	io.Reader
+	readErr  error
+	closeErr error
+	closes   int32
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	if err == io.EOF && c.readErr != nil {
+		err = c.readErr
+	}
+	return n, err
+}
+
+func (c *countingReadCloser) Close() error {
+	atomic.AddInt32(&c.closes, 1)
+	return c.closeErr
+}
+
+// leakyFormat hands out a fixed reader and error from ExtractFile
+type leakyFormat struct {
+	formats.Format
+	reader *countingReadCloser
+	err    error
+}
+
+func (f *leakyFormat) ExtractFile(ctx context.Context, reader io.ReaderAt, size int64, filePath string, password string) (io.ReadCloser, int64, error) {
+	return f.reader, 5, f.err
+}
+
+func TestExtractClosesReaderOnError(t *testing.T) {
+	server := newFileServer(t, testarchive.Zip(t, testarchive.Pairs("hello.txt", "hello")...), "application/zip")
+	archive, err := NewArchive(server.URL+"/archive.zip", nil)
+	if err != nil {
+		t.Fatalf("NewArchive failed: %v", err)
+	}
+	defer archive.Close()
+	zipFormat := archive.src.format
+
+	// A format failing after it opened the member
+	opened := &countingReadCloser{Reader: strings.NewReader("hello")}
+	archive.src.format = &leakyFormat{Format: zipFormat, reader: opened, err: errors.New("checksum failed")}
+	if _, _, err := archive.ExtractFile("hello.txt", ""); err == nil {
+		t.Fatal("expected ExtractFile to fail")
+	}
+	if opened.closes != 1 {
+		t.Errorf("expected the reader to be closed once, got %d", opened.closes)
+	}
+
+	// Extraction failing partway through the content
+	partial := &countingReadCloser{Reader: strings.NewReader("hel"), readErr: io.ErrUnexpectedEOF}
+	archive.src.format = &leakyFormat{Format: zipFormat, reader: partial}
+	if _, err := archive.ExtractFileTo("hello.txt", "", io.Discard); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected the read error, got %v", err)
+	}
+	if partial.closes != 1 {
+		t.Errorf("expected the reader to be closed once, got %d", partial.closes)
+	}
+
+	if archive.OpenReaders() != 0 {
+		t.Errorf("expected no open readers, got %d", archive.OpenReaders())
+	}
+}
+
+func TestExtractResumesAfterTransferError(t *testing.T) {
+	content := make([]byte, 64*1024)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	fw, err := w.CreateHeader(&zip.FileHeader{Name: "data.bin", Method: zip.Store})
+	if err != nil {
+		t.Fatalf("failed to create zip entry: %v", err)
+	}
+	fw.Write(content)
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close zip writer: %v", err)
+	}
+	data := buf.Bytes()
+
+	// Once armed, the first request for the second half of the member fails
+	failed := int32(1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start int64
+		fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start)
+		if start >= 32*1024 && start < int64(len(content)) && atomic.CompareAndSwapInt32(&failed, 0, 1) {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+
+	extract := func(retries int) ([]byte, error) {
+		t.Helper()
+		atomic.StoreInt32(&failed, 1)
+		config := DefaultConfig().WithWholeDownloadThreshold(0).WithFetchSizes(4096, 4096).
+			WithRangeRetries(0, 0).WithExtractRetries(retries)
+		archive, err := NewArchive(server.URL+"/archive.zip", config)
+		if err != nil {
+			t.Fatalf("NewArchive failed: %v", err)
+		}
+		defer archive.Close()
+		reader, _, err := archive.ExtractFile("data.bin", "")
+		if err != nil {
+			t.Fatalf("ExtractFile failed: %v", err)
+		}
+		defer reader.Close()
+		atomic.StoreInt32(&failed, 0)
+		return io.ReadAll(reader)
+	}
+
+	got, err := extract(1)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("expected the member to be read in full after resuming, got %d bytes (%v)", len(got), err)
+	}
+	if atomic.LoadInt32(&failed) != 1 {
+		t.Fatal("expected a request to fail")
+	}
+
+	got, err = extract(0)
+	var extractErr *utils.ExtractError
+	if !errors.As(err, &extractErr) || !rangehttp.IsTransferError(err) || utils.IsDecompressionError(err) {
+		t.Fatalf("expected a transfer error without retries, got %v", err)
+	}
+	if len(got) < 32*1024-4096 || !bytes.Equal(got, content[:len(got)]) {
+		t.Errorf("expected the data before the failure, got %d bytes", len(got))
+	}
+}
+
+// extractCountingFormat counts the members a ZIP format extracts
+type extractCountingFormat struct {
+	*formats.ZipFormat
+	extracts int32
+}
+
+func (f *extractCountingFormat) ExtractFile(ctx context.Context, reader io.ReaderAt, size int64, filePath string, password string) (io.ReadCloser, int64, error) {
+	atomic.AddInt32(&f.extracts, 1)
+	return f.ZipFormat.ExtractFile(ctx, reader, size, filePath, password)
+}
+
+func TestExtractResumeRereadCost(t *testing.T) {
+	// Random bytes don't compress, so the data is spread evenly either way
+	content := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(content)
+
+	for _, test := range []struct {
+		name      string
+		method    uint16
+		maxReread int64
+		resumed   bool
+		extracts  int32
+	}{
+		// Read on from the failed offset, without extracting again
+		{"stored", zip.Store, 0, true, 1},
+		// Decompressed again from the start
+		{"deflated", zip.Deflate, maxResumeReread, true, 2},
+		// Not resumed when that means decompressing too much again
+		{"deflated past the cap", zip.Deflate, 16 * 1024, false, 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := zip.NewWriter(&buf)
+			fw, err := w.CreateHeader(&zip.FileHeader{Name: "data.bin", Method: test.method})
+			if err != nil {
+				t.Fatalf("failed to create zip entry: %v", err)
+			}
+			fw.Write(content)
+			if err := w.Close(); err != nil {
+				t.Fatalf("failed to close zip writer: %v", err)
+			}
+			data := buf.Bytes()
+
+			// Once armed, the first request for the second half of the member fails
+			failed := int32(1)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var start int64
+				fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start)
+				if start >= 32*1024 && start < int64(len(content)) && atomic.CompareAndSwapInt32(&failed, 0, 1) {
+					http.Error(w, "unavailable", http.StatusServiceUnavailable)
+					return
+				}
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+			}))
+			t.Cleanup(server.Close)
+
+			config := DefaultConfig().WithWholeDownloadThreshold(0).WithFetchSizes(4096, 4096).
+				WithRangeRetries(0, 0).WithExtractRetries(1)
+			archive, err := NewArchive(server.URL+"/archive.zip", config)
+			if err != nil {
+				t.Fatalf("NewArchive failed: %v", err)
+			}
+			defer archive.Close()
+			format := &extractCountingFormat{ZipFormat: archive.src.format.(*formats.ZipFormat)}
+			archive.src.format = format
+
+			reader, _, err := archive.ExtractFile("data.bin", "")
+			if err != nil {
+				t.Fatalf("ExtractFile failed: %v", err)
+			}
+			defer reader.Close()
+			reader.(*extractReader).maxReread = test.maxReread
+			atomic.StoreInt32(&failed, 0)
+			got, err := io.ReadAll(reader)
+
+			if atomic.LoadInt32(&failed) != 1 {
+				t.Fatal("expected a request to fail")
+			}
+			if test.resumed && (err != nil || !bytes.Equal(got, content)) {
+				t.Errorf("expected the member to be read in full after resuming, got %d bytes (%v)", len(got), err)
+			}
+			if !test.resumed && !rangehttp.IsTransferError(err) {
+				t.Errorf("expected the transfer error, got %v", err)
+			}
+			if n := atomic.LoadInt32(&format.extracts); n != test.extracts {
+				t.Errorf("expected %d extractions, got %d", test.extracts, n)
+			}
+		})
+	}
+}
+
+func TestExtractFailsCorruptDataWithoutRetrying(t *testing.T) {
+	var text strings.Builder
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&text, "line %d of %d\n", i*i, i)
+	}
+	data := testarchive.Zip(t, testarchive.Pairs("text.txt", text.String())...)
+	// Damage the middle of the Deflate stream, between the local header
+	// and the central directory
+	corrupt := append([]byte(nil), data...)
+	for i := len(data) / 3; i < len(data)/3+64; i++ {
+		corrupt[i] ^= 0xFF
+	}
+	server, gets := newCountingServer(t, corrupt)
+
+	extract := func(retries int) (int64, error) {
+		t.Helper()
+		archive, err := NewArchive(server.URL+"/archive.zip", DefaultConfig().WithWholeDownloadThreshold(0).WithExtractRetries(retries))
+		if err != nil {
+			t.Fatalf("NewArchive failed: %v", err)
+		}
+		defer archive.Close()
+		before := atomic.LoadInt64(gets)
+		_, err = archive.ExtractFileTo("text.txt", "", io.Discard)
+		return atomic.LoadInt64(gets) - before, err
+	}
+
+	requests, err := extract(0)
+	if !utils.IsDecompressionError(err) || rangehttp.IsTransferError(err) {
+		t.Fatalf("expected a decompression error, got %v", err)
+	}
+	var extractErr *utils.ExtractError
+	if !errors.As(err, &extractErr) || extractErr.Path != "text.txt" {
+		t.Errorf("expected an ExtractError naming the member, got %v", err)
+	}
+
+	// Retries are left, but the member isn't read again
+	if retried, err := extract(3); !utils.IsDecompressionError(err) || retried != requests {
+		t.Errorf("expected %d requests and a decompression error, got %d (%v)", requests, retried, err)
+	}
+}
+
+func TestReopenDuringExtraction(t *testing.T) {
+	files := []string{"a.txt", strings.Repeat("a", 4096), "b.txt", strings.Repeat("b", 4096)}
+	server := newFileServer(t, testarchive.Zip(t, testarchive.Pairs(files...)...), "application/zip")
+
+	archive, err := NewArchive(server.URL+"/archive.zip", DefaultConfig())
+	if err != nil {
+		t.Fatalf("NewArchive failed: %v", err)
+	}
+	defer archive.Close()
+
+	// Run with -race: extractions, listings and the archive's accessors
+	// run while Reopen swaps the file they read
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name, expected := files[i%2*2], files[i%2*2+1]
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				archive.ListFiles("", "")
+				archive.Size()
+				archive.Format()
+				reader, _, err := archive.ExtractFile(name, "")
+				if err != nil {
+					continue // The file was reopened underneath
+				}
+				content, err := io.ReadAll(reader)
+				reader.Close()
+				if err == nil && string(content) != expected {
+					t.Errorf("extracted %d bytes of %s that don't match", len(content), name)
+				}
+			}
+		}(i)
+	}
+	for i := 0; i < 20; i++ {
+		if err := archive.Reopen(); err != nil {
+			t.Errorf("Reopen failed: %v", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	reader, _, err := archive.ExtractFile("a.txt", "")
+	if err != nil {
+		t.Fatalf("ExtractFile after Reopen failed: %v", err)
+	}
+	defer reader.Close()
+	if content, _ := io.ReadAll(reader); string(content) != files[1] {
+		t.Errorf("expected the content of a.txt after Reopen, got %d bytes", len(content))
+	}
+}
+
+func TestReopenReportsErrorsLikeOpen(t *testing.T) {
+	page := []byte("<!DOCTYPE html><html><body>Please sign in</body></html>")
+	var replaced int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data := testarchive.Zip(t, testarchive.Pairs("hello.txt", "hello")...)
+		if atomic.LoadInt32(&replaced) == 1 {
+			// The link now leads to a login page
+			w.Header().Set("Content-Type", "text/html")
+			data = page
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+
+	archive, err := NewArchive(server.URL+"/archive.zip", nil)
+	if err != nil {
+		t.Fatalf("NewArchive failed: %v", err)
+	}
+	defer archive.Close()
+
+	atomic.StoreInt32(&replaced, 1)
+	_, openErr := NewArchive(server.URL+"/archive.zip", nil)
+	if !errors.Is(openErr, utils.ErrNotAnArchive) {
+		t.Fatalf("expected NewArchive to fail with ErrNotAnArchive, got %v", openErr)
+	}
+	if err := archive.Reopen(); !errors.Is(err, utils.ErrNotAnArchive) || err.Error() != openErr.Error() {
+		t.Errorf("expected Reopen to fail like NewArchive (%v), got %v", openErr, err)
+	}
+}
+
+func TestQuickExtractClosesArchiveWhenReaderCloseFails(t *testing.T) {
+	server := newFileServer(t, testarchive.Zip(t, testarchive.Pairs("hello.txt", "hello")...), "application/zip")
+	archive, err := NewArchive(server.URL+"/archive.zip", nil)
+	if err != nil {
+		t.Fatalf("NewArchive failed: %v", err)
+	}
+
+	closeErr := errors.New("close failed")
+	inner := &countingReadCloser{Reader: strings.NewReader("hello"), closeErr: closeErr}
+	reader := &archiveReader{ReadCloser: inner, archive: archive}
+
+	if err := reader.Close(); err != closeErr {
+		t.Errorf("expected the reader's close error, got %v", err)
+	}
+	if archive.ctx.Err() == nil {
+		t.Error("expected the archive to be closed despite the reader's close error")
+	}
+
+	reader.Close()
+	if inner.closes != 1 {
+		t.Errorf("expected the reader to be closed once, got %d", inner.closes)
+	}
+}
+
+func TestArchiveExtractRaw(t *testing.T) {
+	content := strings.Repeat("compressible content ", 100)
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, method := range []uint16{zip.Store, zip.Deflate} {
+		fw, _ := w.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("m%d.txt", method), Method: method})
+		fw.Write([]byte(content))
+	}
+	w.Close()
+	server := newFileServer(t, buf.Bytes(), "application/zip")
+
+	archive, err := NewArchive(server.URL+"/archive.zip", nil)
+	if err != nil {
+		t.Fatalf("NewArchive failed: %v", err)
+	}
+	defer archive.Close()
+
+	reader, size, method, err := archive.ExtractRaw("m0.txt", "")
+	if err != nil {
+		t.Fatalf("ExtractRaw of a stored entry failed: %v", err)
+	}
+	raw, _ := io.ReadAll(reader)
+	reader.Close()
+	if method != "Store" || size != int64(len(content)) || string(raw) != content {
+		t.Errorf("unexpected stored raw data: method %s, size %d", method, size)
+	}
+
+	reader, size, method, err = archive.ExtractRaw("m8.txt", "")
+	if err != nil {
+		t.Fatalf("ExtractRaw of a deflated entry failed: %v", err)
+	}
+	raw, _ = io.ReadAll(reader)
+	reader.Close()
+	if method != "Deflate" || size != int64(len(raw)) || size >= int64(len(content)) {
+		t.Errorf("unexpected deflated raw data: method %s, size %d, read %d", method, size, len(raw))
+	}
+	inflated, err := io.ReadAll(flate.NewReader(bytes.NewReader(raw)))
+	if err != nil || string(inflated) != content {
+		t.Errorf("raw data doesn't inflate to the content: %v", err)
+	}
+
+	if _, _, _, err := archive.ExtractRaw("missing.txt", ""); !errors.Is(err, formats.ErrFileNotFound) {
+		t.Errorf("expected ErrFileNotFound, got %v", err)
+	}
+
+	encrypted := newFileServer(t, testarchive.Zip(t, testarchive.Entry{Name: "secret.txt", Content: "secret", Method: zip.Deflate, Password: "pass"}), "application/zip")
+	archive, err = NewArchive(encrypted.URL+"/archive.zip", nil)
+	if err != nil {
+		t.Fatalf("NewArchive failed: %v", err)
+	}
+	defer archive.Close()
+	if _, _, _, err := archive.ExtractRaw("secret.txt", "pass"); !errors.Is(err, formats.ErrNotSupported) {
+		t.Errorf("expected ErrNotSupported for an encrypted entry, got %v", err)
+	}
+}
+
+func TestArchiveFlagsUnsafePaths(t *testing.T) {
+	data := testarchive.Zip(t, testarchive.Pairs("ok.txt", "ok", "/etc/cron.d/evil", "absolute", "../../x", "traversal")...)
+	server := newFileServer(t, data, "application/zip")
+
+	archive, err := NewArchive(server.URL+"/archive.zip", nil)
+	if err != nil {
+		t.Fatalf("NewArchive failed: %v", err)
+	}
+	defer archive.Close()
+
+	expected := map[string]bool{"ok.txt": false, "/etc/cron.d/evil": true, "../../x": true}
+	info, err := archive.GetInfo("")
+	if err != nil {
+		t.Fatalf("GetInfo failed: %v", err)
+	}
+	files, err := archive.ListFiles("", "")
+	if err != nil {
+		t.Fatalf("ListFiles failed: %v", err)
+	}
+	for _, listing := range [][]formats.FileEntry{info.Files, files} {
+		if len(listing) != len(expected) {
+			t.Fatalf("expected %d entries, got %+v", len(expected), listing)
+		}
+		for _, entry := range listing {
+			if entry.UnsafePath != expected[entry.Path] {
+				t.Errorf("%q: UnsafePath = %v", entry.Path, entry.UnsafePath)
+			}
+		}
+	}
+
+	// The bytes of an absolute entry can still be fetched
+	var out bytes.Buffer
+	if _, err := archive.ExtractFileTo("/etc/cron.d/evil", "", &out); err != nil || out.String() != "absolute" {
+		t.Errorf("expected the absolute entry to extract, got %q: %v", out.String(), err)
+	}
+}
+
+func TestListFilesDepthBelowInnerPath(t *testing.T) {
+	data := testarchive.Zip(t, testarchive.Pairs(
+		"readme.txt", "top",
+		"docs/", "",
+		"docs/a.txt", "a",
+		"docs/sub/", "",
+		"docs/sub/b.txt", "b",
+		"docs/sub/deep/c.txt", "c",
+	)...)
+	server := newFileServer(t, data, "application/zip")
+
+	tests := []struct {
+		config    *Config
+		innerPath string
+		maxDepth  int
+		expected  []string
+	}{
+		{DefaultConfig(), "", 1, []string{"readme.txt", "docs/"}},
+		{DefaultConfig(), "docs", 1, []string{"docs/a.txt", "docs/sub/"}},
+		{DefaultConfig(), "docs", 2, []string{"docs/a.txt", "docs/sub/", "docs/sub/b.txt"}},
+		{DefaultConfig(), "/docs/", 3, []string{"docs/a.txt", "docs/sub/", "docs/sub/b.txt", "docs/sub/deep/c.txt"}},
+		{DefaultConfig(), "docs/sub", 5, []string{"docs/sub/b.txt", "docs/sub/deep/c.txt"}},
+		{DefaultConfig(), "docs", 0, []string{"docs/a.txt", "docs/sub/"}}, // Like ListFiles
+		{DefaultConfig().WithCaseInsensitivePaths(true), "DOCS", 2, []string{"docs/a.txt", "docs/sub/", "docs/sub/b.txt"}},
+	}
+	for _, test := range tests {
+		archive, err := NewArchive(server.URL+"/archive.zip", test.config)
+		if err != nil {
+			t.Fatalf("NewArchive failed: %v", err)
+		}
+		files, err := archive.ListFilesDepth(test.innerPath, "", test.maxDepth)
+		archive.Close()
+		if err != nil {
+			t.Errorf("ListFilesDepth(%q, %d) failed: %v", test.innerPath, test.maxDepth, err)
+			continue
+		}
+		var paths []string
+		for _, file := range files {
+			paths = append(paths, file.Path)
+		}
+		if !reflect.DeepEqual(paths, test.expected) {
+			t.Errorf("ListFilesDepth(%q, %d) = %v, expected %v", test.innerPath, test.maxDepth, paths, test.expected)
+		}
+	}
+}
+
+func TestCaseInsensitivePaths(t *testing.T) {
+	data := testarchive.Zip(t, testarchive.Pairs(
+		"Readme.txt", "mixed",
+		"readme.txt", "lower",
+		"Docs/Guide.md", "guide",
+	)...)
+	server := newFileServer(t, data, "application/zip")
+
+	archive, err := NewArchive(server.URL+"/archive.zip", DefaultConfig())
+	if err != nil {
+		t.Fatalf("NewArchive failed: %v", err)
+	}
+	if _, _, err := archive.ExtractFile("README.TXT", ""); !errors.Is(err, formats.ErrFileNotFound) {
+		t.Errorf("expected ErrFileNotFound without the option, got %v", err)
+	}
+	archive.Close()
+
+	archive, err = NewArchive(server.URL+"/archive.zip", DefaultConfig().WithCaseInsensitivePaths(true))
+	if err != nil {
+		t.Fatalf("NewArchive failed: %v", err)
+	}
+	defer archive.Close()
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"readme.txt", "lower"},    // Exact match wins over the earlier entry
+		{"Readme.txt", "mixed"},    // Exact match
+		{"README.TXT", "mixed"},    // Ambiguous, first entry in archive order
+		{"docs/guide.md", "guide"}, // Directory case differs too
+	}
+	for _, test := range tests {
+		reader, _, err := archive.ExtractFile(test.path, "")
+		if err != nil {
+			t.Errorf("ExtractFile(%q) failed: %v", test.path, err)
+			continue
+		}
+		content, _ := io.ReadAll(reader)
+		reader.Close()
+		if string(content) != test.expected {
+			t.Errorf("ExtractFile(%q) = %q, expected %q", test.path, content, test.expected)
+		}
+	}
+
+	files, err := archive.ListFiles("docs", "")
+	if err != nil {
+		t.Fatalf("ListFiles failed: %v", err)
+	}
+	if len(files) != 1 || files[0].Path != "Docs/Guide.md" {
+		t.Errorf("expected the stored path Docs/Guide.md, got %+v", files)
+	}
+}
+
+func TestPathNormalizer(t *testing.T) {
+	// Names as macOS stores them, decomposed: "e" + U+0301
+	nfdFile, nfdDir := "cafe\u0301.txt", "Re\u0301sume\u0301/notes.txt"
+	nfcFile, nfcDir := "caf\u00e9.txt", "R\u00e9sum\u00e9/notes.txt"
+	data := testarchive.Zip(t, testarchive.Pairs(
+		nfdFile, "coffee",
+		nfdDir, "notes",
+	)...)
+	server := newFileServer(t, data, "application/zip")
+
+	archive, err := NewArchive(server.URL+"/archive.zip", DefaultConfig())
+	if err != nil {
+		t.Fatalf("NewArchive failed: %v", err)
+	}
+	if files, err := archive.ListFiles("", ""); err != nil || len(files) != 2 || files[0].Path != nfdFile {
+		t.Errorf("expected the stored paths without a normalizer, got %+v, %v", files, err)
+	}
+	archive.Close()
+
+	for _, normalizer := range []struct {
+		name      string
+		normalize func(string) string
+		listed    []string
+	}{
+		{"NFC", utils.NFC, []string{nfcFile, nfcDir}},
+		{"NFD", utils.NFD, []string{nfdFile, nfdDir}},
+	} {
+		t.Run(normalizer.name, func(t *testing.T) {
+			archive, err := NewArchive(server.URL+"/archive.zip", DefaultConfig().WithPathNormalizer(normalizer.normalize))
+			if err != nil {
+				t.Fatalf("NewArchive failed: %v", err)
+			}
+			defer archive.Close()
+
+			files, err := archive.ListFiles("", "")
+			if err != nil {
+				t.Fatalf("ListFiles failed: %v", err)
+			}
+			if len(files) != 2 || files[0].Path != normalizer.listed[0] || files[1].Path != normalizer.listed[1] {
+				t.Errorf("expected paths %q, got %+v", normalizer.listed, files)
+			}
+			if files, err := archive.ListFiles("R\u00e9sum\u00e9", ""); err != nil || len(files) != 1 {
+				t.Errorf("expected the directory typed in NFC to list 1 entry, got %+v, %v", files, err)
+			}
+
+			// Both forms of the name are normalized before comparing
+			for path, expected := range map[string]string{nfcFile: "coffee", nfdFile: "coffee", nfcDir: "notes"} {
+				reader, _, err := archive.ExtractFile(path, "")
+				if err != nil {
+					t.Errorf("ExtractFile(%q) failed: %v", path, err)
+					continue
+				}
+				content, _ := io.ReadAll(reader)
+				reader.Close()
+				if string(content) != expected {
+					t.Errorf("ExtractFile(%q) = %q, expected %q", path, content, expected)
+				}
+			}
+
+			extracted := make(map[string]*memFile)
+			err = archive.ExtractAll("", func(entry formats.FileEntry) (io.WriteCloser, error) {
+				extracted[entry.Path] = &memFile{}
+				return extracted[entry.Path], nil
+			}, nil)
+			if err != nil {
+				t.Fatalf("ExtractAll failed: %v", err)
+			}
+			if f := extracted[normalizer.listed[0]]; f == nil || f.String() != "coffee" {
+				t.Errorf("expected ExtractAll to write %q under its normalized name", normalizer.listed[0])
+			}
+		})
+	}
+}
+
+func TestExtractUnicodeEquivalentPaths(t *testing.T) {
+	// macOS stores "café.txt" decomposed ("e" + U+0301); users type it
+	// composed. A name stored in both forms is matched exactly.
+	nfd, nfc := "cafe\u0301.txt", "caf\u00e9.txt"
+
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for _, name := range []string{nfd, "Ame\u0301lie/nfd.txt", "both/" + nfd, "both/" + nfc} {
+		w.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(name))})
+		w.Write([]byte(name))
+	}
+	w.Close()
+
+	archives := map[string]struct {
+		data  []byte
+		ctype string
+	}{
+		"archive.zip": {testarchive.Zip(t, testarchive.Pairs(nfd, nfd, "Ame\u0301lie/nfd.txt", "Ame\u0301lie/nfd.txt", "both/"+nfd, "both/"+nfd, "both/"+nfc, "both/"+nfc)...), "application/zip"},
+		"archive.tar": {buf.Bytes(), "application/x-tar"},
+	}
+	for name, a := range archives {
+		t.Run(name, func(t *testing.T) {
+			server := newFileServer(t, a.data, a.ctype)
+			archive, err := NewArchive(server.URL+"/"+name, DefaultConfig())
+			if err != nil {
+				t.Fatalf("NewArchive failed: %v", err)
+			}
+			defer archive.Close()
+
+			for path, expected := range map[string]string{
+				nfc:                   nfd,
+				nfd:                   nfd,
+				"Am\u00e9lie/nfd.txt": "Ame\u0301lie/nfd.txt",
+				"both/" + nfc:         "both/" + nfc,
+				"both/" + nfd:         "both/" + nfd,
+			} {
+				reader, _, err := archive.ExtractFile(path, "")
+				if err != nil {
+					t.Errorf("ExtractFile(%q) failed: %v", path, err)
+					continue
+				}
+				content, _ := io.ReadAll(reader)
+				reader.Close()
+				if string(content) != expected {
+					t.Errorf("ExtractFile(%q) read %q, expected %q", path, content, expected)
+				}
+			}
+
+			if _, _, err := archive.ExtractFile("caf\u00e8.txt", ""); !errors.Is(err, formats.ErrFileNotFound) {
+				t.Errorf("expected a different accent not to match, got %v", err)
+			}
+		})
+	}
+
+	server := newFileServer(t, archives["archive.zip"].data, "application/zip")
+	archive, err := NewArchive(server.URL+"/archive.zip", DefaultConfig())
+	if err != nil {
+		t.Fatalf("NewArchive failed: %v", err)
+	}
+	defer archive.Close()
+	if entry, ok := archive.CachedEntry(nfc, ""); !ok || entry.Path != nfd {
+		t.Errorf("expected CachedEntry to find the NFD entry, got %+v, %v", entry, ok)
+	}
+}
+
+// recordingTracer keeps the spans started through it
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	name   string
+	parent *recordedSpan
+	attrs  map[string]interface{}
+	err    error
+	ended  bool
+}
+
+type spanKey struct{}
+
+func (t *recordingTracer) Start(ctx context.Context, name string, attrs ...tracing.Attribute) (context.Context, tracing.Span) {
+	span := &recordedSpan{name: name, attrs: make(map[string]interface{})}
+	span.parent, _ = ctx.Value(spanKey{}).(*recordedSpan)
+	span.SetAttributes(attrs...)
+
+	t.mu.Lock()
+	t.spans = append(t.spans, span)
+	t.mu.Unlock()
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func (t *recordingTracer) find(name string) []*recordedSpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var found []*recordedSpan
+	for _, span := range t.spans {
+		if span.name == name {
+			found = append(found, span)
+		}
+	}
+	return found
+}
+
+func (s *recordedSpan) SetAttributes(attrs ...tracing.Attribute) {
+	for _, attr := range attrs {
+		s.attrs[attr.Key] = attr.Value
+	}
+}
+
+func (s *recordedSpan) RecordError(err error) { s.err = err }
+func (s *recordedSpan) End()                  { s.ended = true }
+
+func TestArchiveTracing(t *testing.T) {
+	server := newFileServer(t, testarchive.Zip(t, testarchive.Pairs("hello.txt", "hello")...), "application/zip")
+	tracer := &recordingTracer{}
+	config := DefaultConfig().WithWholeDownloadThreshold(0).WithTracer(tracer)
+
+	ctx, request := tracer.Start(context.Background(), "request")
+	archive, err := NewArchiveWithContext(ctx, server.URL+"/test.zip", config)
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	defer archive.Close()
+
+	if _, err := archive.ListFiles("", ""); err != nil {
+		t.Fatalf("ListFiles failed: %v", err)
+	}
+	reader, _, err := archive.ExtractFile("hello.txt", "")
+	if err != nil {
+		t.Fatalf("ExtractFile failed: %v", err)
+	}
+	io.ReadAll(reader)
+	reader.Close()
+	if _, _, err := archive.ExtractFile("missing.txt", ""); err == nil {
+		t.Fatal("expected missing file to fail")
+	}
+
+	open := tracer.find("archive.Open")
+	if len(open) != 1 || !open[0].ended || open[0].parent != request {
+		t.Fatalf("expected one ended archive.Open span under the request, got %+v", open)
+	}
+	if host := strings.TrimPrefix(server.URL, "http://"); open[0].attrs["url.host"] != host {
+		t.Errorf("url.host = %v, expected %s", open[0].attrs["url.host"], host)
+	}
+	if open[0].attrs["archive.format"] != "zip" {
+		t.Errorf("archive.format = %v, expected zip", open[0].attrs["archive.format"])
+	}
+
+	head := tracer.find("rangehttp.Head")
+	if len(head) == 0 || head[0].parent != open[0] {
+		t.Errorf("expected the HEAD request under archive.Open")
+	}
+
+	ranges := tracer.find("rangehttp.RangeRequest")
+	if len(ranges) == 0 {
+		t.Fatal("expected range request spans")
+	}
+	for _, span := range ranges {
+		if !span.ended || span.parent != request {
+			t.Errorf("expected ended range span under the request, got %+v", span)
+		}
+		if n, _ := span.attrs["bytes.fetched"].(int64); n <= 0 {
+			t.Errorf("expected bytes.fetched to be recorded, got %v", span.attrs["bytes.fetched"])
+		}
+	}
+
+	extracts := tracer.find("archive.ExtractFile")
+	if len(extracts) != 2 {
+		t.Fatalf("expected 2 archive.ExtractFile spans, got %d", len(extracts))
+	}
+	if extracts[0].attrs["archive.member"] != "hello.txt" || extracts[0].attrs["archive.bytes_read"] != int64(5) || extracts[0].err != nil {
+		t.Errorf("unexpected span for hello.txt: %+v", extracts[0])
+	}
+	if !extracts[1].ended || extracts[1].err == nil {
+		t.Errorf("expected the failed extraction to end with its error, got %+v", extracts[1])
+	}
+
+	if list := tracer.find("archive.ListFiles"); len(list) != 1 || list[0].attrs["archive.entries"] != int64(1) {
+		t.Errorf("unexpected archive.ListFiles spans: %+v", list)
+	}
+}
+
+func TestMaxRangeRequests(t *testing.T) {
+	// Every TAR header is a separate read, so many small members make a
+	// listing cost many range requests
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for i := 0; i < 100; i++ {
+		content := bytes.Repeat([]byte{'x'}, 4096)
+		w.WriteHeader(&tar.Header{Name: fmt.Sprintf("f%03d.txt", i), Mode: 0o644, Size: int64(len(content))})
+		w.Write(content)
+	}
+	w.Close()
+	server := newFileServer(t, buf.Bytes(), "application/x-tar")
+
+	config := DefaultConfig().WithWholeDownloadThreshold(0).WithFetchSizes(0, 0)
+
+	archive, err := NewArchive(server.URL+"/many.tar", config.Clone().WithMaxRangeRequests(10))
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	defer archive.Close()
+	if _, err := archive.ListFiles("", ""); !errors.Is(err, utils.ErrRangeBudgetExceeded) {
+		t.Fatalf("expected ErrRangeBudgetExceeded, got %v", err)
+	}
+	if stats := archive.Stats(); stats.RangeRequests != 10 {
+		t.Errorf("expected the reader to stop at 10 range requests, got %d", stats.RangeRequests)
+	}
+
+	archive, err = NewArchive(server.URL+"/many.tar", config)
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	defer archive.Close()
+	files, err := archive.ListFiles("", "")
+	if err != nil || len(files) != 100 {
+		t.Fatalf("expected 100 entries without a limit, got %d: %v", len(files), err)
+	}
+	if stats := archive.Stats(); stats.RangeRequests <= 10 || stats.BytesFetched == 0 {
+		t.Errorf("unexpected stats without a limit: %+v", stats)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for i := 0; i < 100; i++ {
+		content := bytes.Repeat([]byte{'x'}, 4096)
+		w.WriteHeader(&tar.Header{Name: fmt.Sprintf("f%03d.txt", i), Mode: 0o644, Size: int64(len(content))})
+		w.Write(content)
+	}
+	w.Close()
+	data := buf.Bytes()
+
+	var gets, failEvery int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			n := atomic.AddInt64(&gets, 1)
+			if every := atomic.LoadInt64(&failEvery); every > 0 && n%every == 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+
+	config := DefaultConfig().WithWholeDownloadThreshold(0).WithFetchSizes(0, 0).
+		WithRangeRetries(3, time.Millisecond).
+		WithRetryBudget(5)
+
+	t.Run("flaky origin", func(t *testing.T) {
+		archive, err := NewArchive(server.URL+"/many.tar", config)
+		if err != nil {
+			t.Fatalf("failed to open archive: %v", err)
+		}
+		defer archive.Close()
+
+		atomic.StoreInt64(&failEvery, 40)
+		defer atomic.StoreInt64(&failEvery, 0)
+		files, err := archive.ListFiles("", "")
+		if err != nil || len(files) != 100 {
+			t.Fatalf("expected the retries to complete the listing, got %d entries: %v", len(files), err)
+		}
+		if stats := archive.Stats(); stats.Retries == 0 || stats.Retries > 5 {
+			t.Errorf("expected 1 to 5 retries, got %d", stats.Retries)
+		}
+	})
+
+	t.Run("origin down", func(t *testing.T) {
+		// A budget below one request's retries cuts them short
+		archive, err := NewArchive(server.URL+"/many.tar", config.Clone().WithRetryBudget(2))
+		if err != nil {
+			t.Fatalf("failed to open archive: %v", err)
+		}
+		defer archive.Close()
+
+		atomic.StoreInt64(&failEvery, 1)
+		defer atomic.StoreInt64(&failEvery, 0)
+		before := atomic.LoadInt64(&gets)
+		if _, err := archive.ListFiles("", ""); !errors.Is(err, utils.ErrRetryBudgetExceeded) {
+			t.Fatalf("expected ErrRetryBudgetExceeded, got %v", err)
+		}
+		if n := atomic.LoadInt64(&gets) - before; n != 3 {
+			t.Errorf("expected the request and 2 retries, sent %d", n)
+		}
+
+		// Once the budget is spent, reads fail without contacting the origin
+		before = atomic.LoadInt64(&gets)
+		if _, err := archive.ListFiles("", ""); !errors.Is(err, utils.ErrRetryBudgetExceeded) {
+			t.Errorf("expected later calls to fail with ErrRetryBudgetExceeded, got %v", err)
+		}
+		if n := atomic.LoadInt64(&gets) - before; n != 0 {
+			t.Errorf("expected no more requests, sent %d", n)
+		}
+	})
+}
+
+func TestMaxFallbackBytes(t *testing.T) {
+	var files []string
+	for i := 0; i < 50; i++ {
+		files = append(files, fmt.Sprintf("f%02d.txt", i), strings.Repeat(fmt.Sprintf("line %d\n", i), 2000))
+	}
+	data := testarchive.Zip(t, testarchive.Pairs(files...)...)
+
+	// The origin ignores Range and sends the whole file every time
+	var served, gets int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodHead {
+			return
+		}
+		atomic.AddInt64(&gets, 1)
+		n, _ := w.Write(data)
+		atomic.AddInt64(&served, int64(n))
+	}))
+	t.Cleanup(server.Close)
+	size := int64(len(data))
+
+	// Within the limit the archive is downloaded once and read from memory
+	config := DefaultConfig().WithWholeDownloadThreshold(0).WithFetchSizes(0, 0)
+	archive, err := NewArchive(server.URL+"/a.zip", config.Clone().WithMaxFallbackBytes(size))
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	defer archive.Close()
+	for i := 0; i < 50; i += 10 {
+		var out bytes.Buffer
+		if _, err := archive.ExtractFileTo(fmt.Sprintf("f%02d.txt", i), "", &out); err != nil {
+			t.Fatalf("failed to extract f%02d.txt: %v", i, err)
+		}
+	}
+	if atomic.LoadInt64(&gets) != 1 || atomic.LoadInt64(&served) != size {
+		t.Errorf("expected one download of %d bytes, got %d requests sending %d bytes", size, gets, served)
+	}
+
+	// Beyond the limit reads fail instead of downloading the file repeatedly
+	atomic.StoreInt64(&gets, 0)
+	atomic.StoreInt64(&served, 0)
+	archive, err = NewArchive(server.URL+"/a.zip", config.Clone().WithMaxFallbackBytes(size/2))
+	if err == nil {
+		defer archive.Close()
+		_, err = archive.ListFiles("", "")
+	}
+	if !errors.Is(err, utils.ErrRangeNotSupported) {
+		t.Fatalf("expected ErrRangeNotSupported, got %v", err)
+	}
+	// Detection reads the header, and the first read past the limit is
+	// refused; nothing is downloaded after that
+	if n := atomic.LoadInt64(&gets); n > 2 {
+		t.Errorf("expected at most 2 requests, got %d", n)
+	}
+	if n := atomic.LoadInt64(&served); n > 2*size {
+		t.Errorf("expected at most %d bytes sent, got %d", 2*size, n)
+	}
+}
+
+func TestMinimalHeaders(t *testing.T) {
+	data := testarchive.Zip(t, testarchive.Pairs("hello.txt", "hello")...)
+
+	var mu sync.Mutex
+	var seen []http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.Header.Clone())
+		mu.Unlock()
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+
+	open := func(config *Config) []http.Header {
+		t.Helper()
+		mu.Lock()
+		seen = nil
+		mu.Unlock()
+
+		archive, err := NewArchive(server.URL+"/a.zip", config)
+		if err != nil {
+			t.Fatalf("NewArchive failed: %v", err)
+		}
+		defer archive.Close()
+		if _, err := archive.GetInfo(""); err != nil {
+			t.Fatalf("GetInfo failed: %v", err)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if len(seen) == 0 {
+			t.Fatal("expected requests to the origin")
+		}
+		return seen
+	}
+
+	for _, header := range open(DefaultConfig()) {
+		if header.Get("User-Agent") != DefaultUserAgent || header.Get("Accept") != "*/*" || header.Get("Accept-Encoding") != "identity" {
+			t.Errorf("expected the default headers, got %v", header)
+		}
+	}
+
+	for _, header := range open(DefaultConfig().WithMinimalHeaders(true)) {
+		for name := range header {
+			if name != "Range" {
+				t.Errorf("expected only Range, got %s: %q", name, header.Get(name))
+			}
+		}
+	}
+
+	config := DefaultConfig().WithMinimalHeaders(true).WithUserAgent("custom/1.0").WithHeader("Authorization", "Bearer t")
+	for _, header := range open(config) {
+		if header.Get("User-Agent") != "custom/1.0" || header.Get("Authorization") != "Bearer t" || header.Get("Accept-Encoding") != "" {
+			t.Errorf("expected only the configured headers, got %v", header)
+		}
+	}
+
+	restored := DefaultConfig().WithMinimalHeaders(true).WithMinimalHeaders(false)
+	if restored.UserAgent != DefaultUserAgent || restored.Accept != "*/*" {
+		t.Errorf("expected disabling minimal headers to restore the defaults, got %q/%q", restored.UserAgent, restored.Accept)
+	}
+}
+
+func TestQuickInfoWithStats(t *testing.T) {
+	data := testarchive.Zip(t, testarchive.Pairs("a.txt", "alpha", "b.txt", "beta")...)
+	server := newFileServer(t, data, "")
+
+	// Range reads: every request is counted
+	config := DefaultConfig().WithWholeDownloadThreshold(0).WithFetchSizes(0, 0)
+	info, stats, err := QuickInfoWithStats(server.URL+"/a.zip", "", config)
+	if err != nil {
+		t.Fatalf("QuickInfoWithStats failed: %v", err)
+	}
+	if info.TotalFiles != 2 {
+		t.Errorf("expected 2 files, got %d", info.TotalFiles)
+	}
+	if stats.Elapsed <= 0 || stats.RangeRequests == 0 || stats.BytesFetched == 0 {
+		t.Errorf("expected populated stats, got %+v", stats)
+	}
+
+	// Preloaded: one request, the rest served from memory
+	files, stats, err := QuickListWithStats(server.URL+"/a.zip", "", "", DefaultConfig())
+	if err != nil || len(files) != 2 {
+		t.Fatalf("expected 2 files, got %d (%v)", len(files), err)
+	}
+	if stats.RangeRequests != 1 || stats.BytesFetched != int64(len(data)) || stats.CachedReads == 0 {
+		t.Errorf("expected one request and cached reads, got %+v", stats)
+	}
+
+	_, stats, err = QuickInfoWithStats("ftp://example.com/a.zip", "", config)
+	if err == nil || stats.Elapsed <= 0 {
+		t.Errorf("expected an error with elapsed time, got %v, %+v", err, stats)
+	}
+}
+
+func TestMaxMemoryBuffer(t *testing.T) {
+	data := testarchive.Zip(t, testarchive.Pairs("a.txt", strings.Repeat("alpha", 100), "b.txt", "beta")...)
+	server, gets := newCountingServer(t, data)
+	limit := int64(len(data) / 2)
+
+	t.Run("spill", func(t *testing.T) {
+		dir := t.TempDir()
+		atomic.StoreInt64(gets, 0)
+		config := DefaultConfig().WithMaxMemoryBuffer(limit).WithSpillDir(dir)
+		archive, err := NewArchive(server.URL+"/archive.zip", config)
+		if err != nil {
+			t.Fatalf("NewArchive failed: %v", err)
+		}
+
+		if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+			t.Fatalf("expected the archive to be downloaded to the spill directory, found %d files", len(entries))
+		}
+		reader, _, err := archive.ExtractFile("a.txt", "")
+		if err != nil {
+			t.Fatalf("ExtractFile failed: %v", err)
+		}
+		content, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil || string(content) != strings.Repeat("alpha", 100) {
+			t.Errorf("unexpected content from the spilled file (%v)", err)
+		}
+		if n := atomic.LoadInt64(gets); n != 1 {
+			t.Errorf("expected a single download, got %d requests", n)
+		}
+
+		archive.Close()
+		if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+			t.Errorf("expected Close to remove the spilled file, found %d files", len(entries))
+		}
+	})
+
+	t.Run("range requests", func(t *testing.T) {
+		atomic.StoreInt64(gets, 0)
+		config := DefaultConfig().WithMaxMemoryBuffer(limit).WithFetchSizes(0, 0)
+		archive, err := NewArchive(server.URL+"/archive.zip", config)
+		if err != nil {
+			t.Fatalf("NewArchive failed: %v", err)
+		}
+		defer archive.Close()
+
+		if files, err := archive.ListFiles("", ""); err != nil || len(files) != 2 {
+			t.Fatalf("expected 2 files, got %d (%v)", len(files), err)
+		}
+		if stats := archive.Stats(); stats.RangeRequests < 2 {
+			t.Errorf("expected the archive to be read with range requests, got %+v", stats)
+		}
+	})
+
+	t.Run("spill limit", func(t *testing.T) {
+		dir := t.TempDir()
+		config := DefaultConfig().WithMaxMemoryBuffer(limit).WithSpillDir(dir).
+			WithMaxSpillBytes(int64(len(data))+1).WithFetchSizes(0, 0)
+		first, err := NewArchive(server.URL+"/archive.zip", config)
+		if err != nil {
+			t.Fatalf("NewArchive failed: %v", err)
+		}
+		defer first.Close()
+
+		// The first archive holds the space, so the second reads by range
+		second, err := NewArchive(server.URL+"/archive.zip", config)
+		if err != nil {
+			t.Fatalf("NewArchive failed: %v", err)
+		}
+		defer second.Close()
+		if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+			t.Errorf("expected only the first archive to be spilled, found %d files", len(entries))
+		}
+		if files, err := second.ListFiles("", ""); err != nil || len(files) != 2 {
+			t.Fatalf("expected 2 files, got %d (%v)", len(files), err)
+		}
+		if stats := second.Stats(); stats.RangeRequests < 2 {
+			t.Errorf("expected the second archive to be read with range requests, got %+v", stats)
+		}
+	})
+}
+
+func TestCleanSpillDir(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]bool{
+		"stream-7z-spill-123456": true, // Left by a killed process
+		"stream-7z-spill-":       false,
+		"stream-7z-server":       false,
+		"notes.txt":              false,
+	}
+	for name := range files {
+		os.WriteFile(filepath.Join(dir, name), []byte("x"), 0o644)
+	}
+
+	removed, err := CleanSpillDir(dir)
+	if err != nil || removed != 1 {
+		t.Fatalf("expected 1 file removed, got %d: %v", removed, err)
+	}
+	for name, orphan := range files {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if exists := err == nil; exists == orphan {
+			t.Errorf("%s: expected removed=%v", name, orphan)
+		}
+	}
+
+	if _, err := CleanSpillDir(filepath.Join(dir, "missing")); err != nil {
+		t.Errorf("expected a missing directory to be fine, got %v", err)
+	}
+}
+
+// countingReaderAt counts the ReadAt calls made on it
+type countingReaderAt struct {
+	r     io.ReaderAt
+	reads int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	c.reads++
+	return c.r.ReadAt(p, off)
+}
+
+func TestDetectFormatFromContentType(t *testing.T) {
+	zipData := testarchive.Zip(t, testarchive.Pairs("hello.txt", "hello")...)
+
+	// An archive Content-Type picks the format tried first
+	reader := &countingReaderAt{r: bytes.NewReader(zipData)}
+	format, _, err := detectFormat(context.Background(), reader, int64(len(zipData)), 0, "", "application/zip", false)
+	if err != nil || format.Name() != "zip" {
+		t.Fatalf("expected zip, got %v (%v)", format, err)
+	}
+	if reader.reads != 1 {
+		t.Errorf("expected a single detection read, got %d", reader.reads)
+	}
+
+	// The content decides when the type is wrong
+	tarData, _ := buildTestTarGz(t, 1, 16)
+	format, _, err = detectFormat(context.Background(), bytes.NewReader(tarData), int64(len(tarData)), 0, "", "application/zip", false)
+	if err != nil || format.Name() != "tar" {
+		t.Errorf("expected the data to win over the Content-Type, got %v (%v)", format, err)
+	}
+
+	// A URL without an extension
+	server := newFileServer(t, zipData, "application/zip")
+	archive, err := NewArchive(server.URL+"/download?id=123", nil)
+	if err != nil {
+		t.Fatalf("NewArchive failed: %v", err)
+	}
+	defer archive.Close()
+	if archive.Format() != "zip" {
+		t.Errorf("expected zip, got %s", archive.Format())
+	}
+}
+
+func TestAWSCredentialsSignRequests(t *testing.T) {
+	data := testarchive.Zip(t, testarchive.Pairs("hello.txt", "hello")...)
+	authorization := regexp.MustCompile(`^AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/\d{8}/eu-west-1/s3/aws4_request, ` +
+		`SignedHeaders=host(;range)?;x-amz-content-sha256;x-amz-date, Signature=[0-9a-f]{64}$`)
+
+	var mu sync.Mutex
+	var unsigned []string
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		auth := r.Header.Get("Authorization")
+		if !authorization.MatchString(auth) || r.Header.Get("X-Amz-Date") == "" ||
+			(r.Header.Get("Range") != "" && !strings.Contains(auth, ";range;")) {
+			unsigned = append(unsigned, fmt.Sprintf("%s %s: %q", r.Method, r.Header.Get("Range"), auth))
+		}
+		mu.Unlock()
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+
+	config := DefaultConfig().WithAWSCredentials("AKIDEXAMPLE", "secret", "eu-west-1")
+	archive, err := NewArchive(server.URL+"/bucket/test.zip", config)
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	defer archive.Close()
+	var out bytes.Buffer
+	if _, err := archive.ExtractFileTo("hello.txt", "", &out); err != nil {
+		t.Fatalf("failed to extract: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if requests < 2 {
+		t.Errorf("expected HEAD and range requests, got %d requests", requests)
+	}
+	for _, request := range unsigned {
+		t.Errorf("request not signed as expected: %s", request)
+	}
+}
+
+// discardWriter drops what is written to it without implementing
+// io.ReaderFrom, so copies into it go through a buffer
+type discardWriter struct{}
+
+func (discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+
+func BenchmarkExtractFileTo(b *testing.B) {
+	content := strings.Repeat("small file content\n", 200)
+	server := newFileServer(b, testarchive.Zip(b, testarchive.Pairs("small.txt", content)...), "application/zip")
+	archive, err := NewArchive(server.URL+"/small.zip", nil)
+	if err != nil {
+		b.Fatalf("failed to open archive: %v", err)
+	}
+	defer archive.Close()
+
+	b.Run("Alloc", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := archive.ExtractFileTo("small.txt", "", discardWriter{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Pooled", func(b *testing.B) {
+		pool := sync.Pool{New: func() interface{} {
+			buf := make([]byte, 32*1024)
+			return &buf
+		}}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf := pool.Get().(*[]byte)
+			if _, err := archive.ExtractFileToWithBuffer("small.txt", "", discardWriter{}, *buf); err != nil {
+				b.Fatal(err)
+			}
+			pool.Put(buf)
+		}
+	})
+}
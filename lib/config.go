@@ -1,8 +1,21 @@
 package lib
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"os"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/NORMAL-EX/stream-7z/lib/rangehttp"
+	"github.com/NORMAL-EX/stream-7z/lib/sigv4"
+	"github.com/NORMAL-EX/stream-7z/lib/tracing"
 )
 
 // Config holds configuration for the archive library
@@ -10,42 +23,274 @@ type Config struct {
 	// HTTP client configuration
 	HTTPClient *http.Client
 
-	// Timeout for HTTP requests
+	// Timeout for a whole archive operation, from opening the archive to
+	// the last byte extracted. Use DialTimeout and ResponseHeaderTimeout to
+	// fail fast on an unreachable origin while allowing long extractions.
 	Timeout time.Duration
 
+	// Resolver used to look up archive hosts (nil = system resolver).
+	// Takes precedence over DNSServer.
+	Resolver HostResolver
+
+	// DNS server ("host:port") to query instead of the system resolver
+	DNSServer string
+
+	// Timeout for establishing a connection (0 = no dial timeout beyond Timeout)
+	DialTimeout time.Duration
+
+	// Timeout for the response headers after a request was sent, which
+	// detects a connection the origin accepted but never answers
+	// (0 = the transport's setting)
+	ResponseHeaderTimeout time.Duration
+
+	// Happy-eyeballs delay before falling back to the other IP family
+	// (0 = Go's default of 300ms, negative disables the fallback race)
+	FallbackDelay time.Duration
+
+	// Extra attempts at the HEAD request that opens an archive when it
+	// fails with a network error or a 5xx/429 status (0 = no retries).
+	// The delay before the first retry is HeadRetryDelay, doubling after
+	// each further attempt.
+	HeadRetries    int
+	HeadRetryDelay time.Duration
+
+	// Extra attempts at a range request that fails the same way (0 = no
+	// retries), with the delay starting at RangeRetryDelay and doubling.
+	// RetryBudget caps the retries of all range requests of an archive
+	// together (0 = no cap), so a listing whose reads all hit an outage
+	// doesn't multiply into hundreds of retries: once the budget is spent
+	// the archive's reads fail at once with utils.ErrRetryBudgetExceeded.
+	// The server opens an archive per API call, so there the budget
+	// applies to one GetInfo, ListFiles or ExtractFile.
+	RangeRetries    int
+	RangeRetryDelay time.Duration
+	RetryBudget     int
+
+	// How often ExtractFile resumes reading a member after a transient
+	// transfer error its range retries didn't recover from (0 = never).
+	// A member stored without compression is read again from where it
+	// failed. Any other member is decompressed again from its start and
+	// the bytes already returned are discarded, so a resume costs as much
+	// as the content read so far; past 64 MiB the read fails instead.
+	// Data that fails to decompress is never read again; reads fail at
+	// once with a *utils.DecompressionError.
+	ExtractRetries int
+
 	// Custom headers to include in requests
 	Headers map[string]string
 
 	// User agent string
 	UserAgent string
 
+	// Accept header sent with every request (empty = don't send one)
+	Accept string
+
+	// Send only Range, Host and the headers configured here (Headers,
+	// UserAgent, Accept), leaving out Accept-Encoding and Go's own
+	// User-Agent. By default requests carry:
+	//
+	//	Range: bytes=<start>-<end>   (not on HEAD)
+	//	Accept-Encoding: identity
+	//	Accept: */*
+	//	User-Agent: Stream-7z/1.0
+	//
+	// plus Headers. The library never adds anything else, e.g. headers
+	// of an incoming request it serves.
+	MinimalHeaders bool
+
+	// Signs every request after its headers are set, e.g. with AWS
+	// Signature Version 4 for private S3 objects (nil = no signing). The
+	// signer may add headers of its own, like Authorization.
+	Signer rangehttp.RequestSigner
+
+	// Content types the archive URL may be served with (e.g. "application/zip",
+	// "application/*"). Empty accepts any type; a response without a
+	// Content-Type header is always accepted.
+	ExpectedContentTypes []string
+
+	// Byte offset of the archive within the remote file (0 = start of file).
+	// Used for archives embedded in other files or concatenated after other data.
+	Offset int64
+
+	// Size to assume for a file when neither the HEAD request nor a range
+	// request reports one, e.g. a server answering with a chunked body and
+	// no Content-Range total (0 = fail with utils.ErrUnknownSize)
+	AssumedSize int64
+
+	// When a range request is answered with 416 because the file became
+	// shorter since it was opened, e.g. truncated or replaced, read up to
+	// its new end instead of failing with utils.ErrArchiveChanged. Meant
+	// for files opened with AssumedSize, where the size was only a guess.
+	TruncateOnShrink bool
+
 	// Maximum file size to process (in bytes, 0 = unlimited)
 	MaxFileSize int64
 
+	// Maximum decoded size of an archive passed inline as a data: URL
+	// (0 = data: URLs are rejected)
+	MaxDataURLSize int64
+
 	// Buffer size for reading
 	BufferSize int
 
+	// Adaptive range request sizing: after a random read each request
+	// fetches at least MinFetchSize bytes, doubling up to MaxFetchSize while
+	// reads stay sequential. MinFetchSize 0 requests exactly what is read.
+	MinFetchSize int64
+	MaxFetchSize int64
+
+	// Archives up to this size are downloaded with a single request and
+	// read from memory (0 = always use range requests)
+	WholeDownloadThreshold int64
+
+	// Most bytes a single operation of an archive buffers in memory
+	// (0 = no limit). It is honored by:
+	//
+	//   - whole downloads (WholeDownloadThreshold, and servers without
+	//     Range support): a larger archive is written to a temporary file
+	//     in SpillDir, or read with range requests when SpillDir is empty
+	//   - read-ahead: MinFetchSize and MaxFetchSize are capped to it
+	//   - data: URLs: larger payloads are rejected
+	//
+	// Memory the decompressors keep while extracting (e.g. the dictionary
+	// of an LZMA stream in a 7z archive) is set by the archive and not
+	// counted, and neither are the buffers callers pass to Read.
+	MaxMemoryBuffer int64
+
+	// Directory for the temporary files holding archives that exceed
+	// MaxMemoryBuffer (empty = don't spill to disk). Each file is removed
+	// when its Archive is closed.
+	SpillDir string
+
+	// Most bytes the temporary files in SpillDir may hold together, across
+	// all archives (0 = no limit). An archive that doesn't fit is read with
+	// range requests instead.
+	MaxSpillBytes int64
+
+	// Read the archive directory in the background as soon as the archive
+	// is opened, so the first GetInfo/ListFiles call is served from memory
+	EagerIndex bool
+
+	// Maximum number of extract readers an Archive may have open at once (0 = unlimited)
+	MaxOpenReaders int
+
+	// Match member paths and listing directories case-insensitively.
+	// An exact-case match is preferred when several entries match.
+	CaseInsensitivePaths bool
+
+	// PathNormalizer rewrites member paths before they are listed or
+	// compared, e.g. utils.NFC so names stored decomposed by macOS are
+	// listed in the composed form users type. Members are still read by
+	// their stored name. Nil keeps paths as stored.
+	PathNormalizer func(string) string
+
+	// Keep the decompressor position between extractions from one Archive
+	// for formats that are read sequentially (TAR). Members must then be
+	// extracted in archive order to benefit: going back to an earlier
+	// member restarts decompression from the beginning, and a member is
+	// extracted the normal way while another one read this way is open.
+	SequentialExtraction bool
+
+	// Pick the format from the URL's extension without reading any data,
+	// saving the detection round trip when extensions can be trusted.
+	// Unknown extensions are still detected from the content. Split ZIP
+	// archives are only recognized by reading, so they can't be opened.
+	TrustExtension bool
+
+	// Maximum number of range requests an archive may send (0 = no limit).
+	// Reads needing more fail with utils.ErrRangeBudgetExceeded, which
+	// bounds the requests a crafted, heavily fragmented archive can cause.
+	MaxRangeRequests int
+
+	// Maximum bytes to accept from a server that ignores Range requests
+	// and sends the whole file each time (0 = no limit). Every read then
+	// downloads and discards everything before its offset, so reads
+	// beyond the limit fail with utils.ErrRangeNotSupported rather than
+	// silently transferring the file over and over. Archives up to this
+	// size are downloaded in one request when the server doesn't
+	// advertise Range support.
+	MaxFallbackBytes int64
+
+	// Remembers URLs that recently failed to open, e.g. with 404 or as
+	// an unsupported format, and fails them again without a request
+	// (nil = no caching). Share one cache between configs to share failures.
+	OpenErrorCache *OpenErrorCache
+
+	// Keeps the ranges fetched for a file so archives opened for the same
+	// URL and ETag reuse them instead of sending the requests again
+	// (nil = each archive fetches on its own). Share one cache between
+	// configs to share ranges.
+	SharedCache *SharedCache
+
+	// Receives spans for archive operations and range requests
+	// (nil = no tracing). See the tracing package for adapting a tracer.
+	Tracer tracing.Tracer
+
+	// Receives measurements of range requests and archive operations
+	// (nil = none), e.g. to export them as Prometheus metrics
+	Metrics MetricsRecorder
+
 	// Enable debug logging
 	Debug bool
+
+	// Receives the debug messages instead of stdout when Debug is enabled.
+	// ctx is the context of the operation that logged, e.g. the one passed
+	// to NewArchiveWithContext, so a server can add its request ID.
+	LogFunc func(ctx context.Context, message string)
+
+	// TLS settings for HTTPS archives (nil = the transport's own settings)
+	TLSConfig *tls.Config
+
+	// Disable HTTP/2 and use HTTP/1.1 connections only. With HTTP/2,
+	// parallel range reads are multiplexed over a single connection.
+	DisableHTTP2 bool
+
+	// HTTP client with the dial and TLS settings applied, built on first use
+	// and shared by all archives opened with this config
+	transportMu     sync.Mutex
+	transportClient *http.Client
+
+	// Invalid certificates passed to WithRootCAs and WithClientCert, kept
+	// until the same helper succeeds
+	rootCAsErr    error
+	clientCertErr error
 }
 
+// DefaultUserAgent is the User-Agent DefaultConfig sends
+const DefaultUserAgent = "Stream-7z/1.0"
+
 // DefaultConfig returns a configuration with sensible defaults
 func DefaultConfig() *Config {
 	return &Config{
+		// No client-wide timeout: it would cut off long extractions.
+		// Stalled connections are caught by the transport instead.
 		HTTPClient: &http.Client{
-			Timeout: 30 * time.Second,
 			Transport: &http.Transport{
-				MaxIdleConns:        100,
-				MaxIdleConnsPerHost: 10,
-				IdleConnTimeout:     90 * time.Second,
+				MaxIdleConns:          100,
+				MaxIdleConnsPerHost:   10,
+				IdleConnTimeout:       90 * time.Second,
+				ResponseHeaderTimeout: 30 * time.Second,
+				ForceAttemptHTTP2:     true,
 			},
 		},
-		Timeout:     30 * time.Second,
-		Headers:     make(map[string]string),
-		UserAgent:   "Stream-7z/1.0",
-		MaxFileSize: 0, // 0 = 无限制
-		BufferSize:  32 * 1024,          // 32KB buffer
-		Debug:       false,
+		Timeout:                30 * time.Second,
+		HeadRetries:            2,
+		HeadRetryDelay:         250 * time.Millisecond,
+		RangeRetries:           2,
+		RangeRetryDelay:        250 * time.Millisecond,
+		RetryBudget:            10,
+		ExtractRetries:         1,
+		Headers:                make(map[string]string),
+		UserAgent:              DefaultUserAgent,
+		Accept:                 "*/*",
+		MinFetchSize:           32 * 1024,        // 32KB
+		MaxFetchSize:           1024 * 1024,      // 1MB
+		WholeDownloadThreshold: 1024 * 1024,      // 1MB
+		MaxFileSize:            0,                // 0 = 无限制
+		MaxDataURLSize:         1024 * 1024,      // 1MB
+		MaxFallbackBytes:       64 * 1024 * 1024, // 64MB
+		BufferSize:             32 * 1024,        // 32KB buffer
+		Debug:                  false,
 	}
 }
 
@@ -56,20 +301,68 @@ func (c *Config) Clone() *Config {
 		headers[k] = v
 	}
 
+	var expectedTypes []string
+	if c.ExpectedContentTypes != nil {
+		expectedTypes = append([]string(nil), c.ExpectedContentTypes...)
+	}
+
 	return &Config{
-		HTTPClient:  c.HTTPClient,
-		Timeout:     c.Timeout,
-		Headers:     headers,
-		UserAgent:   c.UserAgent,
-		MaxFileSize: c.MaxFileSize,
-		BufferSize:  c.BufferSize,
-		Debug:       c.Debug,
+		HTTPClient:             c.HTTPClient,
+		Timeout:                c.Timeout,
+		Resolver:               c.Resolver,
+		DNSServer:              c.DNSServer,
+		DialTimeout:            c.DialTimeout,
+		ResponseHeaderTimeout:  c.ResponseHeaderTimeout,
+		FallbackDelay:          c.FallbackDelay,
+		HeadRetries:            c.HeadRetries,
+		HeadRetryDelay:         c.HeadRetryDelay,
+		RangeRetries:           c.RangeRetries,
+		RangeRetryDelay:        c.RangeRetryDelay,
+		RetryBudget:            c.RetryBudget,
+		ExtractRetries:         c.ExtractRetries,
+		TLSConfig:              c.TLSConfig.Clone(),
+		DisableHTTP2:           c.DisableHTTP2,
+		rootCAsErr:             c.rootCAsErr,
+		clientCertErr:          c.clientCertErr,
+		Headers:                headers,
+		UserAgent:              c.UserAgent,
+		Accept:                 c.Accept,
+		MinimalHeaders:         c.MinimalHeaders,
+		ExpectedContentTypes:   expectedTypes,
+		Offset:                 c.Offset,
+		AssumedSize:            c.AssumedSize,
+		TruncateOnShrink:       c.TruncateOnShrink,
+		MaxFileSize:            c.MaxFileSize,
+		MaxDataURLSize:         c.MaxDataURLSize,
+		BufferSize:             c.BufferSize,
+		MinFetchSize:           c.MinFetchSize,
+		MaxFetchSize:           c.MaxFetchSize,
+		WholeDownloadThreshold: c.WholeDownloadThreshold,
+		MaxMemoryBuffer:        c.MaxMemoryBuffer,
+		SpillDir:               c.SpillDir,
+		MaxSpillBytes:          c.MaxSpillBytes,
+		EagerIndex:             c.EagerIndex,
+		MaxOpenReaders:         c.MaxOpenReaders,
+		CaseInsensitivePaths:   c.CaseInsensitivePaths,
+		PathNormalizer:         c.PathNormalizer,
+		SequentialExtraction:   c.SequentialExtraction,
+		TrustExtension:         c.TrustExtension,
+		MaxRangeRequests:       c.MaxRangeRequests,
+		MaxFallbackBytes:       c.MaxFallbackBytes,
+		OpenErrorCache:         c.OpenErrorCache,
+		SharedCache:            c.SharedCache,
+		Tracer:                 c.Tracer,
+		Signer:                 c.Signer,
+		Metrics:                c.Metrics,
+		Debug:                  c.Debug,
+		LogFunc:                c.LogFunc,
 	}
 }
 
 // WithHTTPClient sets a custom HTTP client
 func (c *Config) WithHTTPClient(client *http.Client) *Config {
 	c.HTTPClient = client
+	c.resetTransport()
 	return c
 }
 
@@ -79,6 +372,130 @@ func (c *Config) WithTimeout(timeout time.Duration) *Config {
 	return c
 }
 
+// WithResolver sets a custom resolver for archive hosts
+func (c *Config) WithResolver(resolver HostResolver) *Config {
+	c.Resolver = resolver
+	c.resetTransport()
+	return c
+}
+
+// WithDNSServer sets the DNS server ("host:port") used to resolve archive hosts
+func (c *Config) WithDNSServer(server string) *Config {
+	c.DNSServer = server
+	c.resetTransport()
+	return c
+}
+
+// WithDialTimeout sets the timeout for establishing connections
+func (c *Config) WithDialTimeout(timeout time.Duration) *Config {
+	c.DialTimeout = timeout
+	c.resetTransport()
+	return c
+}
+
+// WithResponseHeaderTimeout sets how long to wait for response headers
+// before giving up on a connection
+func (c *Config) WithResponseHeaderTimeout(timeout time.Duration) *Config {
+	c.ResponseHeaderTimeout = timeout
+	c.resetTransport()
+	return c
+}
+
+// WithFallbackDelay sets the happy-eyeballs fallback delay between IP families
+func (c *Config) WithFallbackDelay(delay time.Duration) *Config {
+	c.FallbackDelay = delay
+	c.resetTransport()
+	return c
+}
+
+// WithHeadRetries sets how often the HEAD request opening an archive is
+// retried after a transient failure, and the delay before the first retry
+func (c *Config) WithHeadRetries(retries int, delay time.Duration) *Config {
+	c.HeadRetries = retries
+	c.HeadRetryDelay = delay
+	return c
+}
+
+// WithRangeRetries sets how often a range request is retried after a
+// transient failure, and the delay before the first retry
+func (c *Config) WithRangeRetries(retries int, delay time.Duration) *Config {
+	c.RangeRetries = retries
+	c.RangeRetryDelay = delay
+	return c
+}
+
+// WithRetryBudget caps the range request retries of an archive together
+func (c *Config) WithRetryBudget(budget int) *Config {
+	c.RetryBudget = budget
+	return c
+}
+
+// WithExtractRetries sets how often reading a member is resumed after a
+// transient transfer error
+func (c *Config) WithExtractRetries(retries int) *Config {
+	c.ExtractRetries = retries
+	return c
+}
+
+// WithTLSConfig sets the TLS configuration used for HTTPS archives
+func (c *Config) WithTLSConfig(tlsConfig *tls.Config) *Config {
+	c.TLSConfig = tlsConfig
+	c.resetTransport()
+	return c
+}
+
+// WithHTTP2 enables or disables HTTP/2 (enabled by default)
+func (c *Config) WithHTTP2(enabled bool) *Config {
+	c.DisableHTTP2 = !enabled
+	c.resetTransport()
+	return c
+}
+
+// WithInsecureSkipVerify disables (or re-enables) TLS certificate verification
+func (c *Config) WithInsecureSkipVerify(skip bool) *Config {
+	c.ensureTLSConfig().InsecureSkipVerify = skip
+	c.resetTransport()
+	return c
+}
+
+// WithRootCAs trusts the PEM-encoded CA certificates instead of the system roots.
+// Invalid PEM makes NewArchive fail until WithRootCAs is called with valid PEM.
+func (c *Config) WithRootCAs(certPEM []byte) *Config {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(certPEM) {
+		c.rootCAsErr = fmt.Errorf("no valid CA certificates found in PEM data")
+		return c
+	}
+	c.rootCAsErr = nil
+	c.ensureTLSConfig().RootCAs = pool
+	c.resetTransport()
+	return c
+}
+
+// WithClientCert presents the PEM-encoded certificate and key to servers
+// that require client authentication. An invalid pair makes NewArchive fail
+// until WithClientCert is called with a valid one.
+func (c *Config) WithClientCert(certPEM, keyPEM []byte) *Config {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		c.clientCertErr = fmt.Errorf("invalid client certificate: %w", err)
+		return c
+	}
+	c.clientCertErr = nil
+	tlsConfig := c.ensureTLSConfig()
+	tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+	c.resetTransport()
+	return c
+}
+
+// ensureTLSConfig returns the TLS config, creating an empty one if needed
+func (c *Config) ensureTLSConfig() *tls.Config {
+	if c.TLSConfig == nil {
+		c.TLSConfig = &tls.Config{}
+	}
+	return c.TLSConfig
+}
+
 // WithHeaders sets custom headers
 func (c *Config) WithHeaders(headers map[string]string) *Config {
 	c.Headers = headers
@@ -94,20 +511,288 @@ func (c *Config) WithHeader(key, value string) *Config {
 	return c
 }
 
+// WithRequestSigner sets the signer every request is passed to before it
+// is sent
+func (c *Config) WithRequestSigner(signer rangehttp.RequestSigner) *Config {
+	c.Signer = signer
+	return c
+}
+
+// WithAWSCredentials signs every HEAD and range request with AWS
+// Signature Version 4, so private S3 objects are read with plain
+// https://bucket.s3.region.amazonaws.com/key URLs instead of pre-signed
+// ones. GCS accepts the same signatures for HMAC keys with region "auto".
+// See the sigv4 package for session tokens.
+func (c *Config) WithAWSCredentials(accessKey, secretKey, region string) *Config {
+	return c.WithRequestSigner(sigv4.NewSigner(accessKey, secretKey, region))
+}
+
 // WithUserAgent sets the user agent
 func (c *Config) WithUserAgent(ua string) *Config {
 	c.UserAgent = ua
 	return c
 }
 
+// WithMinimalHeaders enables or disables sending only the strictly
+// necessary headers. Enabling it clears UserAgent and Accept, so no
+// User-Agent or Accept is sent unless set again afterwards; disabling it
+// restores the defaults.
+func (c *Config) WithMinimalHeaders(minimal bool) *Config {
+	c.MinimalHeaders = minimal
+	if minimal {
+		c.UserAgent = ""
+		c.Accept = ""
+	} else {
+		c.UserAgent = DefaultUserAgent
+		c.Accept = rangehttp.DefaultAccept
+	}
+	return c
+}
+
+// WithAccept sets the Accept header sent with every request
+func (c *Config) WithAccept(accept string) *Config {
+	c.Accept = accept
+	return c
+}
+
+// WithExpectedContentTypes restricts the Content-Type the archive may be served with
+func (c *Config) WithExpectedContentTypes(types []string) *Config {
+	c.ExpectedContentTypes = types
+	return c
+}
+
+// WithOffset sets the byte offset at which the archive starts within the remote file
+func (c *Config) WithOffset(offset int64) *Config {
+	c.Offset = offset
+	return c
+}
+
+// WithAssumedSize sets the file size used when the server doesn't report one
+func (c *Config) WithAssumedSize(size int64) *Config {
+	c.AssumedSize = size
+	return c
+}
+
+// WithTruncateOnShrink makes reads of a file that became shorter on the
+// server stop at its new end instead of failing
+func (c *Config) WithTruncateOnShrink(truncate bool) *Config {
+	c.TruncateOnShrink = truncate
+	return c
+}
+
 // WithMaxFileSize sets the maximum file size
 func (c *Config) WithMaxFileSize(size int64) *Config {
 	c.MaxFileSize = size
 	return c
 }
 
+// WithMaxDataURLSize sets the maximum decoded size of data: URL archives
+// (0 disables data: URLs)
+func (c *Config) WithMaxDataURLSize(size int64) *Config {
+	c.MaxDataURLSize = size
+	return c
+}
+
+// WithEagerIndex enables or disables reading the directory in the background on open
+func (c *Config) WithEagerIndex(eager bool) *Config {
+	c.EagerIndex = eager
+	return c
+}
+
+// WithFetchSizes sets the adaptive range request sizes (min 0 disables read-ahead)
+func (c *Config) WithFetchSizes(min, max int64) *Config {
+	c.MinFetchSize = min
+	c.MaxFetchSize = max
+	return c
+}
+
+// WithWholeDownloadThreshold sets the size up to which archives are downloaded in one request
+func (c *Config) WithWholeDownloadThreshold(size int64) *Config {
+	c.WholeDownloadThreshold = size
+	return c
+}
+
+// WithMaxMemoryBuffer caps the bytes a single operation buffers in memory
+// (see MaxMemoryBuffer)
+func (c *Config) WithMaxMemoryBuffer(size int64) *Config {
+	c.MaxMemoryBuffer = size
+	return c
+}
+
+// WithSpillDir sets the directory archives exceeding MaxMemoryBuffer are
+// downloaded to
+func (c *Config) WithSpillDir(dir string) *Config {
+	c.SpillDir = dir
+	return c
+}
+
+// WithMaxSpillBytes caps the bytes the temporary files in SpillDir hold
+// together (see MaxSpillBytes)
+func (c *Config) WithMaxSpillBytes(max int64) *Config {
+	c.MaxSpillBytes = max
+	return c
+}
+
+// CleanSpillDir removes the temporary files a killed process left in dir,
+// the SpillDir of its archives. It must not run while archives spilling
+// to dir are open. It returns the number of files removed.
+func CleanSpillDir(dir string) (int, error) {
+	return rangehttp.CleanSpillDir(dir)
+}
+
+// WithMaxOpenReaders caps how many extract readers an Archive may have open at once
+func (c *Config) WithMaxOpenReaders(max int) *Config {
+	c.MaxOpenReaders = max
+	return c
+}
+
+// WithCaseInsensitivePaths enables case-insensitive matching of member paths
+func (c *Config) WithCaseInsensitivePaths(enabled bool) *Config {
+	c.CaseInsensitivePaths = enabled
+	return c
+}
+
+// WithPathNormalizer sets the function member paths are rewritten with in
+// listings and when looking up a member to extract (nil to disable)
+func (c *Config) WithPathNormalizer(normalize func(string) string) *Config {
+	c.PathNormalizer = normalize
+	return c
+}
+
+// WithSequentialExtraction keeps the decompressor position between
+// in-order extractions of TAR members
+func (c *Config) WithSequentialExtraction(enabled bool) *Config {
+	c.SequentialExtraction = enabled
+	return c
+}
+
+// WithTrustExtension picks the format from the URL's extension instead of
+// reading the archive's leading bytes
+func (c *Config) WithTrustExtension(trust bool) *Config {
+	c.TrustExtension = trust
+	return c
+}
+
+// shouldPreload reports whether an archive of size bytes is downloaded
+// in one request when opened. Servers without Range support would send
+// the whole file for every read anyway.
+func (c *Config) shouldPreload(size int64, supportsRange bool) bool {
+	if size <= 0 {
+		return false
+	}
+	return size <= c.WholeDownloadThreshold || (!supportsRange && size <= c.MaxFallbackBytes)
+}
+
+// fetchSizes returns the read-ahead sizes, capped to MaxMemoryBuffer
+func (c *Config) fetchSizes() (int64, int64) {
+	min, max := c.MinFetchSize, c.MaxFetchSize
+	if c.MaxMemoryBuffer > 0 {
+		if min > c.MaxMemoryBuffer {
+			min = c.MaxMemoryBuffer
+		}
+		if max > c.MaxMemoryBuffer {
+			max = c.MaxMemoryBuffer
+		}
+	}
+	return min, max
+}
+
+// preload downloads the whole archive when shouldPreload says so, to
+// memory or, beyond MaxMemoryBuffer, to a temporary file in SpillDir
+func (c *Config) preload(ctx context.Context, reader *rangehttp.RangeReader, size int64, supportsRange bool) error {
+	if !c.shouldPreload(size, supportsRange) {
+		return nil
+	}
+	if c.MaxMemoryBuffer > 0 && size > c.MaxMemoryBuffer {
+		if c.SpillDir == "" {
+			c.debugf(ctx, "Archive exceeds the memory buffer limit, reading it with range requests\n")
+			return nil
+		}
+		err := reader.PreloadToFile(c.SpillDir, c.MaxSpillBytes)
+		if errors.Is(err, rangehttp.ErrSpillFull) {
+			c.debugf(ctx, "Spill directory is full, reading the archive with range requests\n")
+			return nil
+		}
+		return err
+	}
+	return reader.Preload()
+}
+
+// WithMaxFallbackBytes limits the bytes accepted from servers without
+// Range support
+func (c *Config) WithMaxFallbackBytes(max int64) *Config {
+	c.MaxFallbackBytes = max
+	return c
+}
+
+// WithMaxRangeRequests limits the range requests an archive may send
+func (c *Config) WithMaxRangeRequests(max int) *Config {
+	c.MaxRangeRequests = max
+	return c
+}
+
+// WithOpenErrorCache sets the cache of recent failures to open an archive
+func (c *Config) WithOpenErrorCache(cache *OpenErrorCache) *Config {
+	c.OpenErrorCache = cache
+	return c
+}
+
+// WithSharedCache sets the cache of fetched ranges shared between archives
+func (c *Config) WithSharedCache(cache *SharedCache) *Config {
+	c.SharedCache = cache
+	return c
+}
+
+// WithTracer sets the tracer archive operations report spans to
+func (c *Config) WithTracer(tracer tracing.Tracer) *Config {
+	c.Tracer = tracer
+	return c
+}
+
+// tracer returns the configured tracer or a no-op one
+func (c *Config) tracer() tracing.Tracer {
+	if c.Tracer == nil {
+		return tracing.Noop()
+	}
+	return c.Tracer
+}
+
+// WithMetricsRecorder sets the recorder for range request and operation metrics
+func (c *Config) WithMetricsRecorder(recorder MetricsRecorder) *Config {
+	c.Metrics = recorder
+	return c
+}
+
 // WithDebug enables or disables debug logging
 func (c *Config) WithDebug(debug bool) *Config {
 	c.Debug = debug
 	return c
 }
+
+// WithLogFunc sends debug messages to fn instead of stdout
+func (c *Config) WithLogFunc(fn func(ctx context.Context, message string)) *Config {
+	c.LogFunc = fn
+	return c
+}
+
+// debugOutput receives debug warnings
+var debugOutput io.Writer = os.Stdout
+
+// debugf prints a debug message when debug logging is enabled
+func (c *Config) debugf(ctx context.Context, format string, args ...interface{}) {
+	if !c.Debug {
+		return
+	}
+	if c.LogFunc != nil {
+		c.LogFunc(ctx, strings.TrimSuffix(fmt.Sprintf(format, args...), "\n"))
+		return
+	}
+	fmt.Fprintf(debugOutput, format, args...)
+}
+
+// resetTransport drops the cached client so changed transport settings take effect
+func (c *Config) resetTransport() {
+	c.transportMu.Lock()
+	c.transportClient = nil
+	c.transportMu.Unlock()
+}
@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"net/http"
 	"testing"
 	"time"
 )
@@ -24,8 +25,8 @@ func TestDefaultConfig(t *testing.T) {
 		t.Errorf("Expected UserAgent 'Stream-7z/1.0', got '%s'", config.UserAgent)
 	}
 
-	if config.MaxFileSize != 500*1024*1024 {
-		t.Errorf("Expected MaxFileSize 500MB, got %d", config.MaxFileSize)
+	if config.MaxFileSize != 0 {
+		t.Errorf("Expected MaxFileSize 0 (unlimited), got %d", config.MaxFileSize)
 	}
 
 	if config.BufferSize != 32*1024 {
@@ -105,3 +106,80 @@ func TestConfigHeaders(t *testing.T) {
 		t.Error("Headers not set correctly")
 	}
 }
+
+func TestConfigContentTypes(t *testing.T) {
+	config := DefaultConfig()
+
+	if config.Accept != "*/*" {
+		t.Errorf("Expected default Accept '*/*', got '%s'", config.Accept)
+	}
+	if len(config.ExpectedContentTypes) != 0 {
+		t.Error("Expected no content type restriction by default")
+	}
+
+	config.WithAccept("application/zip").
+		WithExpectedContentTypes([]string{"application/zip", "application/octet-stream"})
+
+	clone := config.Clone()
+	clone.ExpectedContentTypes[0] = "text/plain"
+
+	if config.ExpectedContentTypes[0] != "application/zip" {
+		t.Error("Modifying clone's expected content types affected original")
+	}
+	if clone.Accept != "application/zip" {
+		t.Error("Accept not properly cloned")
+	}
+}
+
+func TestConfigProfiles(t *testing.T) {
+	tests := []struct {
+		profile       Profile
+		minFetch      int64
+		maxFetch      int64
+		threshold     int64
+		bufferSize    int
+		eagerIndex    bool
+		idlePerHost   int
+		idleConns     int
+		idleConnAfter time.Duration
+	}{
+		{ProfileLowMemory, 16 * 1024, 128 * 1024, 0, 8 * 1024, false, 2, 16, 30 * time.Second},
+		{ProfileBalanced, 32 * 1024, 1024 * 1024, 1024 * 1024, 32 * 1024, false, 10, 100, 90 * time.Second},
+		{ProfileLowLatency, 256 * 1024, 8 * 1024 * 1024, 16 * 1024 * 1024, 256 * 1024, true, 32, 100, 120 * time.Second},
+	}
+
+	for _, tt := range tests {
+		original := DefaultConfig()
+		config := original.Clone().WithProfile(tt.profile)
+
+		if config.MinFetchSize != tt.minFetch || config.MaxFetchSize != tt.maxFetch {
+			t.Errorf("%s: expected fetch sizes %d-%d, got %d-%d", tt.profile, tt.minFetch, tt.maxFetch, config.MinFetchSize, config.MaxFetchSize)
+		}
+		if config.WholeDownloadThreshold != tt.threshold {
+			t.Errorf("%s: expected whole download threshold %d, got %d", tt.profile, tt.threshold, config.WholeDownloadThreshold)
+		}
+		if config.BufferSize != tt.bufferSize {
+			t.Errorf("%s: expected buffer size %d, got %d", tt.profile, tt.bufferSize, config.BufferSize)
+		}
+		if config.EagerIndex != tt.eagerIndex {
+			t.Errorf("%s: expected eager index %v, got %v", tt.profile, tt.eagerIndex, config.EagerIndex)
+		}
+
+		transport := config.HTTPClient.Transport.(*http.Transport)
+		if transport.MaxIdleConnsPerHost != tt.idlePerHost || transport.MaxIdleConns != tt.idleConns || transport.IdleConnTimeout != tt.idleConnAfter {
+			t.Errorf("%s: unexpected pool settings %d/%d/%v", tt.profile, transport.MaxIdleConns, transport.MaxIdleConnsPerHost, transport.IdleConnTimeout)
+		}
+		// The shared client of the original config is left alone
+		if original.HTTPClient.Transport.(*http.Transport).MaxIdleConnsPerHost != 10 {
+			t.Errorf("%s: profile changed the original config's transport", tt.profile)
+		}
+	}
+
+	// Balanced matches the defaults
+	defaults := DefaultConfig()
+	balanced := DefaultConfig().WithProfile(ProfileBalanced)
+	if balanced.MinFetchSize != defaults.MinFetchSize || balanced.MaxFetchSize != defaults.MaxFetchSize ||
+		balanced.WholeDownloadThreshold != defaults.WholeDownloadThreshold || balanced.BufferSize != defaults.BufferSize {
+		t.Error("expected the balanced profile to match DefaultConfig")
+	}
+}
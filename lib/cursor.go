@@ -0,0 +1,100 @@
+package lib
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/NORMAL-EX/stream-7z/lib/formats"
+)
+
+// errCursorUnavailable means the member has to be extracted without the cursor
+var errCursorUnavailable = errors.New("extraction cursor unavailable")
+
+// extractCursor holds the archive's position for in-order extraction
+type extractCursor struct {
+	mu       sync.Mutex
+	cursor   formats.Cursor
+	password string
+	busy     bool // A member read from cursor is still open
+}
+
+// extractWithCursor extracts filePath through the archive's cursor,
+// continuing from the previously extracted member. If filePath lies
+// before the current position the pass starts over. It returns
+// errCursorUnavailable when the format has no cursor or a member read
+// from it is still open.
+func (a *Archive) extractWithCursor(filePath string, password string) (io.ReadCloser, int64, error) {
+	src := a.source()
+	seq, ok := src.format.(formats.SequentialExtractor)
+	if !ok {
+		return nil, 0, errCursorUnavailable
+	}
+
+	c := &a.cursor
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.busy {
+		return nil, 0, errCursorUnavailable
+	}
+
+	if c.cursor != nil && c.password == password {
+		reader, size, err := c.cursor.Next(filePath)
+		if err == nil {
+			return c.open(reader), size, nil
+		}
+		// Already past the member, or the stream broke; start over
+	}
+	c.reset()
+
+	cursor, err := seq.NewCursor(a.ctx, src.data, src.size, password)
+	if err != nil {
+		return nil, 0, err
+	}
+	c.cursor, c.password = cursor, password
+
+	reader, size, err := cursor.Next(filePath)
+	if err != nil {
+		c.reset()
+		return nil, 0, err
+	}
+	return c.open(reader), size, nil
+}
+
+// open marks the cursor busy until the returned member reader is closed
+func (c *extractCursor) open(reader io.Reader) io.ReadCloser {
+	c.busy = true
+	return &cursorMember{Reader: reader, cursor: c}
+}
+
+// reset drops the current pass; the caller holds c.mu
+func (c *extractCursor) reset() {
+	if c.cursor != nil {
+		c.cursor.Close()
+		c.cursor = nil
+	}
+}
+
+// close drops the current pass
+func (c *extractCursor) close() {
+	c.mu.Lock()
+	c.reset()
+	c.mu.Unlock()
+}
+
+// cursorMember is the content of one member read through the cursor
+type cursorMember struct {
+	io.Reader
+	cursor    *extractCursor
+	closeOnce sync.Once
+}
+
+func (m *cursorMember) Close() error {
+	m.closeOnce.Do(func() {
+		m.cursor.mu.Lock()
+		m.cursor.busy = false
+		m.cursor.mu.Unlock()
+	})
+	return nil
+}
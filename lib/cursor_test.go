@@ -0,0 +1,209 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync/atomic"
+	"testing"
+
+	"github.com/NORMAL-EX/stream-7z/internal/testarchive"
+	"github.com/NORMAL-EX/stream-7z/lib/formats"
+)
+
+// buildTestTarGz creates a tar.gz archive of n incompressible members
+// named file0.bin, file1.bin, ...
+func buildTestTarGz(t *testing.T, n int, memberSize int) ([]byte, [][]byte) {
+	t.Helper()
+
+	rng := rand.New(rand.NewSource(1))
+	contents := make([][]byte, n)
+	entries := make([]testarchive.Entry, n)
+	for i := range contents {
+		contents[i] = make([]byte, memberSize)
+		rng.Read(contents[i])
+		entries[i] = testarchive.Entry{Name: fmt.Sprintf("file%d.bin", i), Content: string(contents[i])}
+	}
+	return testarchive.Gzip(t, testarchive.Tar(t, entries...)), contents
+}
+
+// extractAll extracts the named members in order and checks their content
+func extractAll(t *testing.T, archive *Archive, contents [][]byte, order []int) {
+	t.Helper()
+
+	for _, i := range order {
+		reader, _, err := archive.ExtractFile(fmt.Sprintf("file%d.bin", i), "")
+		if err != nil {
+			t.Fatalf("ExtractFile(file%d.bin) failed: %v", i, err)
+		}
+		content, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatalf("reading file%d.bin failed: %v", i, err)
+		}
+		if !bytes.Equal(content, contents[i]) {
+			t.Fatalf("file%d.bin content mismatch", i)
+		}
+	}
+}
+
+func TestSequentialExtractionReusesDecompressor(t *testing.T) {
+	data, contents := buildTestTarGz(t, 5, 16<<10)
+	order := []int{0, 1, 2, 3, 4}
+
+	gets := func(sequential bool) int64 {
+		server, counter := newCountingServer(t, data)
+		config := DefaultConfig().
+			WithFetchSizes(0, 0).
+			WithWholeDownloadThreshold(0).
+			WithSequentialExtraction(sequential)
+
+		archive, err := NewArchive(server.URL+"/archive.tar.gz", config)
+		if err != nil {
+			t.Fatalf("NewArchive failed: %v", err)
+		}
+		defer archive.Close()
+
+		before := atomic.LoadInt64(counter)
+		extractAll(t, archive, contents, order)
+		return atomic.LoadInt64(counter) - before
+	}
+
+	restarting := gets(false)
+	sequential := gets(true)
+	if sequential*2 >= restarting {
+		t.Errorf("expected in-order extraction to need far fewer requests, got %d with the cursor vs %d without", sequential, restarting)
+	}
+}
+
+func TestSequentialExtractionOutOfOrder(t *testing.T) {
+	data, contents := buildTestTarGz(t, 4, 1<<10)
+	server := newFileServer(t, data, "application/gzip")
+
+	archive, err := NewArchive(server.URL+"/archive.tar.gz", DefaultConfig().WithSequentialExtraction(true))
+	if err != nil {
+		t.Fatalf("NewArchive failed: %v", err)
+	}
+	defer archive.Close()
+
+	// Going back restarts the pass; the content must still be right
+	extractAll(t, archive, contents, []int{2, 3, 0, 1, 1})
+
+	// A second member opened while the first is still being read
+	// bypasses the cursor
+	first, _, err := archive.ExtractFile("file1.bin", "")
+	if err != nil {
+		t.Fatalf("ExtractFile failed: %v", err)
+	}
+	defer first.Close()
+	extractAll(t, archive, contents, []int{3})
+
+	content, _ := io.ReadAll(first)
+	if !bytes.Equal(content, contents[1]) {
+		t.Error("first member was corrupted by the concurrent extraction")
+	}
+}
+
+// memFile is an in-memory ExtractAll destination
+type memFile struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (f *memFile) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestExtractAll(t *testing.T) {
+	data, contents := buildTestTarGz(t, 10, 16<<10)
+	server, counter := newCountingServer(t, data)
+	config := DefaultConfig().WithFetchSizes(0, 0).WithWholeDownloadThreshold(0)
+
+	open := func() *Archive {
+		archive, err := NewArchive(server.URL+"/archive.tar.gz", config)
+		if err != nil {
+			t.Fatalf("NewArchive failed: %v", err)
+		}
+		t.Cleanup(func() { archive.Close() })
+		return archive
+	}
+
+	t.Run("all members", func(t *testing.T) {
+		archive := open()
+		before := atomic.LoadInt64(counter)
+
+		files := make(map[string]*memFile)
+		err := archive.ExtractAll("", func(entry formats.FileEntry) (io.WriteCloser, error) {
+			files[entry.Path] = &memFile{}
+			return files[entry.Path], nil
+		}, nil)
+		if err != nil {
+			t.Fatalf("ExtractAll failed: %v", err)
+		}
+		extracted := atomic.LoadInt64(counter) - before
+
+		if len(files) != len(contents) {
+			t.Fatalf("expected %d files, got %d", len(contents), len(files))
+		}
+		for i, content := range contents {
+			f := files[fmt.Sprintf("file%d.bin", i)]
+			if f == nil || !bytes.Equal(f.Bytes(), content) || !f.closed {
+				t.Errorf("file%d.bin was not extracted and closed correctly", i)
+			}
+		}
+
+		// Besides the listing, members are read in one pass rather than
+		// by decompressing from the start for each one
+		before = atomic.LoadInt64(counter)
+		extractAll(t, open(), contents, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9})
+		if restarting := atomic.LoadInt64(counter) - before; extracted*2 >= restarting {
+			t.Errorf("expected ExtractAll to need far fewer requests, got %d vs %d member by member", extracted, restarting)
+		}
+	})
+
+	t.Run("failing member", func(t *testing.T) {
+		failing := errors.New("disk full")
+		dest := func(written *[]string) func(formats.FileEntry) (io.WriteCloser, error) {
+			return func(entry formats.FileEntry) (io.WriteCloser, error) {
+				switch entry.Path {
+				case "file1.bin":
+					return nil, failing
+				case "file3.bin":
+					return nil, nil // Skipped
+				}
+				*written = append(*written, entry.Path)
+				return &memFile{}, nil
+			}
+		}
+
+		var written, failed []string
+		err := open().ExtractAll("", dest(&written), func(entry formats.FileEntry, err error) error {
+			if !errors.Is(err, failing) {
+				t.Errorf("expected the destination's error, got %v", err)
+			}
+			failed = append(failed, entry.Path)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("expected the failure to be handled, got %v", err)
+		}
+		if len(failed) != 1 || failed[0] != "file1.bin" {
+			t.Errorf("expected file1.bin to fail, got %v", failed)
+		}
+		if len(written) != len(contents)-2 {
+			t.Errorf("expected the other members except the skipped one to be written, got %v", written)
+		}
+
+		// Without a handler the first failure stops extraction
+		written = nil
+		if err := open().ExtractAll("", dest(&written), nil); !errors.Is(err, failing) {
+			t.Errorf("expected the destination's error, got %v", err)
+		}
+		if len(written) != 1 {
+			t.Errorf("expected extraction to stop after file0.bin, got %v", written)
+		}
+	})
+}
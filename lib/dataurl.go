@@ -0,0 +1,137 @@
+package lib
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/NORMAL-EX/stream-7z/lib/formats"
+	"github.com/NORMAL-EX/stream-7z/lib/rangehttp"
+	"github.com/NORMAL-EX/stream-7z/lib/utils"
+)
+
+// openDataURL opens an archive passed inline as a data: URL, e.g.
+// "data:application/zip;base64,UEsDBBQ...". Its bytes are read from
+// memory, so the archive never makes a request.
+func openDataURL(parent context.Context, archiveURL string, config *Config) (*Archive, error) {
+	if config.MaxDataURLSize <= 0 {
+		return nil, utils.WrapError(utils.ErrInvalidURL, "data: URLs are not allowed")
+	}
+
+	maxSize := config.MaxDataURLSize
+	if config.MaxMemoryBuffer > 0 && config.MaxMemoryBuffer < maxSize {
+		// The decoded archive is held in memory for its whole lifetime
+		maxSize = config.MaxMemoryBuffer
+	}
+	data, err := decodeDataURL(archiveURL, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(len(data))
+
+	if config.MaxFileSize > 0 && size > config.MaxFileSize {
+		return nil, fmt.Errorf("file size %d exceeds maximum allowed size %d", size, config.MaxFileSize)
+	}
+	if config.Offset < 0 || (config.Offset > 0 && config.Offset >= size) {
+		return nil, fmt.Errorf("offset %d is outside the file (size %d)", config.Offset, size)
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	reader := rangehttp.NewMemoryReader(ctx, data)
+	reader.SetObserver(config.readObserver())
+
+	// The media type of the data: URL stands in for a Content-Type
+	header, _, _ := strings.Cut(archiveURL[len("data:"):], ",")
+	mediaType, _, _ := strings.Cut(header, ";")
+	format, offset, err := detectFormat(ctx, reader, size, config.Offset, "", mediaType, false)
+	if err != nil {
+		reader.Close()
+		cancel()
+		if errors.Is(err, formats.ErrEncryptedContainer) {
+			return nil, utils.WrapError(err, "unable to open archive")
+		}
+		return nil, utils.WrapError(utils.ErrUnsupportedFormat, "unable to detect archive format")
+	}
+
+	return &Archive{
+		config: config,
+		url:    archiveURL,
+		src: &archiveSource{
+			size:   size - offset,
+			offset: offset,
+			reader: reader,
+			data:   payloadReader(reader, offset, size),
+			format: format,
+		},
+		ctx:    ctx,
+		cancel: cancel,
+	}, nil
+}
+
+// isDataURL reports whether archiveURL has the data: scheme, in any case
+func isDataURL(archiveURL string) bool {
+	return len(archiveURL) >= len("data:") && strings.EqualFold(archiveURL[:len("data:")], "data:")
+}
+
+// maxDisplayedDataURLHeader caps the media type DisplayURL keeps
+const maxDisplayedDataURLHeader = 64
+
+// DisplayURL returns archiveURL as it may be logged or listed. The payload
+// of a data: URL is the archive itself, so only its media type and length
+// are kept, e.g. "data:application/zip;base64,<1024 bytes>".
+func DisplayURL(archiveURL string) string {
+	if !isDataURL(archiveURL) {
+		return archiveURL
+	}
+	header, payload, _ := strings.Cut(archiveURL, ",")
+	if len(header) > maxDisplayedDataURLHeader {
+		header = header[:maxDisplayedDataURLHeader] + "..."
+	}
+	return fmt.Sprintf("%s,<%d bytes>", header, len(payload))
+}
+
+// decodeDataURL returns the bytes of a data: URL, refusing payloads
+// larger than maxSize once decoded
+func decodeDataURL(dataURL string, maxSize int64) ([]byte, error) {
+	if !isDataURL(dataURL) {
+		return nil, utils.WrapError(utils.ErrInvalidURL, "malformed data: URL")
+	}
+	header, payload, ok := strings.Cut(dataURL[len("data:"):], ",")
+	if !ok {
+		return nil, utils.WrapError(utils.ErrInvalidURL, "malformed data: URL")
+	}
+
+	if !strings.HasSuffix(strings.ToLower(header), ";base64") {
+		// Each decoded byte takes at most 3 escaped characters, so check
+		// before unescaping that the payload can fit
+		if int64(len(payload)) > 3*maxSize {
+			return nil, fmt.Errorf("data: URL payload exceeds maximum allowed size %d", maxSize)
+		}
+		decoded, err := url.PathUnescape(payload)
+		if err != nil {
+			return nil, utils.WrapError(utils.ErrInvalidURL, "malformed data: URL")
+		}
+		if int64(len(decoded)) > maxSize {
+			return nil, fmt.Errorf("data: URL payload exceeds maximum allowed size %d", maxSize)
+		}
+		return []byte(decoded), nil
+	}
+
+	// Check before decoding, so an oversized payload is never allocated
+	if int64(base64.StdEncoding.DecodedLen(len(payload))) > maxSize+2 {
+		return nil, fmt.Errorf("data: URL payload exceeds maximum allowed size %d", maxSize)
+	}
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		if data, err = base64.RawStdEncoding.DecodeString(payload); err != nil {
+			return nil, utils.WrapError(utils.ErrInvalidURL, "invalid base64 in data: URL")
+		}
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("data: URL payload exceeds maximum allowed size %d", maxSize)
+	}
+	return data, nil
+}
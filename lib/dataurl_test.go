@@ -0,0 +1,93 @@
+package lib
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/NORMAL-EX/stream-7z/internal/testarchive"
+	"github.com/NORMAL-EX/stream-7z/lib/utils"
+)
+
+func TestNewArchiveDataURL(t *testing.T) {
+	data := testarchive.Zip(t, testarchive.Pairs("hello.txt", "hello")...)
+	dataURL := "data:application/zip;base64," + base64.StdEncoding.EncodeToString(data)
+
+	archive, err := NewArchive(dataURL, nil)
+	if err != nil {
+		t.Fatalf("NewArchive failed: %v", err)
+	}
+	defer archive.Close()
+
+	if archive.Format() != "zip" {
+		t.Errorf("expected zip, got %s", archive.Format())
+	}
+	reader, _, err := archive.ExtractFile("hello.txt", "")
+	if err != nil {
+		t.Fatalf("ExtractFile failed: %v", err)
+	}
+	content, _ := io.ReadAll(reader)
+	reader.Close()
+	if string(content) != "hello" {
+		t.Errorf("expected hello, got %q", content)
+	}
+	if err := archive.Reopen(); err != nil {
+		t.Errorf("Reopen failed: %v", err)
+	}
+	if stats := archive.Stats(); stats.RangeRequests != 0 {
+		t.Errorf("expected no range requests, got %d", stats.RangeRequests)
+	}
+
+	if _, err := NewArchive(dataURL, DefaultConfig().WithMaxDataURLSize(int64(len(data)-1))); err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Errorf("expected the size cap to reject the payload, got %v", err)
+	}
+	limited := DefaultConfig().WithMaxMemoryBuffer(int64(len(data) - 1))
+	if _, err := NewArchive(dataURL, limited); err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Errorf("expected the memory buffer limit to reject the payload, got %v", err)
+	}
+	if _, err := NewArchive(dataURL, DefaultConfig().WithMaxDataURLSize(0)); !errors.Is(err, utils.ErrInvalidURL) {
+		t.Errorf("expected data: URLs to be rejected when disabled, got %v", err)
+	}
+	if _, err := NewArchive("data:application/zip;base64,!!!", nil); !errors.Is(err, utils.ErrInvalidURL) {
+		t.Errorf("expected invalid base64 to be rejected, got %v", err)
+	}
+
+	// Scheme and parameters are case-insensitive
+	upper := "DATA:application/zip;BASE64," + base64.StdEncoding.EncodeToString(data)
+	if archive, err := NewArchive(upper, nil); err != nil {
+		t.Errorf("expected an upper-case data: URL to open, got %v", err)
+	} else {
+		archive.Close()
+	}
+}
+
+func TestDecodeDataURLChecksSizeFirst(t *testing.T) {
+	// Too long to fit even if every byte were escaped, so it is refused
+	// before the (invalid) escapes are decoded
+	payload := strings.Repeat("%ZZ", 11)
+	if _, err := decodeDataURL("data:application/zip,"+payload, 10); err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Errorf("expected the size cap to reject the escaped payload, got %v", err)
+	}
+	if _, err := decodeDataURL("data:application/zip,"+strings.Repeat("%41", 10), 10); err != nil {
+		t.Errorf("expected 10 escaped bytes to fit, got %v", err)
+	}
+}
+
+func TestDisplayURL(t *testing.T) {
+	tests := []struct {
+		url      string
+		expected string
+	}{
+		{"https://example.com/a.zip", "https://example.com/a.zip"},
+		{"data:application/zip;base64,UEsDBBQ=", "data:application/zip;base64,<8 bytes>"},
+		{"Data:,abc", "Data:,<3 bytes>"},
+		{"data:" + strings.Repeat("x", 100), "data:" + strings.Repeat("x", 59) + "...,<0 bytes>"},
+	}
+	for _, test := range tests {
+		if got := DisplayURL(test.url); got != test.expected {
+			t.Errorf("DisplayURL(%q) = %q, expected %q", test.url, got, test.expected)
+		}
+	}
+}
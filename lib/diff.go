@@ -0,0 +1,148 @@
+package lib
+
+import (
+	"sort"
+	"time"
+
+	"github.com/NORMAL-EX/stream-7z/lib/formats"
+	"github.com/NORMAL-EX/stream-7z/lib/utils"
+)
+
+// ChangeKind says how a file differs between two archives
+type ChangeKind string
+
+const (
+	ChangeAdded   ChangeKind = "added"   // Only in the new archive
+	ChangeRemoved ChangeKind = "removed" // Only in the old archive
+	ChangeChanged ChangeKind = "changed" // In both, with different contents
+)
+
+// FileChange is a file that differs between two archives. Old is nil for
+// added files and New is nil for removed ones.
+type FileChange struct {
+	Kind ChangeKind
+	Path string
+	Old  *formats.FileEntry
+	New  *formats.FileEntry
+}
+
+// DiffResult lists the files that differ between two archives
+type DiffResult struct {
+	Added     []FileChange
+	Removed   []FileChange
+	Changed   []FileChange
+	Unchanged int // Files found unchanged in both archives
+}
+
+// diffEntry is what WalkDiff remembers about a file of the old archive
+type diffEntry struct {
+	entry formats.FileEntry
+	seen  bool
+}
+
+// WalkDiff compares the files of two open archives and calls fn for every
+// file that was added, removed or changed from oldArchive to newArchive.
+// Directories are ignored. Files are compared by CRC-32 when both
+// archives record it, and by size and modification time otherwise.
+//
+// Only the old archive's listing is kept in memory; the new archive is
+// walked, so added and changed files are reported as they are read.
+// Removed files are reported last, sorted by path. Walking stops at the
+// first error returned by fn, which WalkDiff returns.
+func WalkDiff(oldArchive, newArchive *Archive, oldPassword, newPassword string, fn func(FileChange) error) (unchanged int, err error) {
+	old := make(map[string]*diffEntry)
+	err = oldArchive.Walk("", oldPassword, func(entry formats.FileEntry) error {
+		if !entry.IsDir {
+			old[utils.NormalizePath(entry.Path)] = &diffEntry{entry: entry}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, utils.WrapError(err, "failed to list old archive")
+	}
+
+	err = newArchive.Walk("", newPassword, func(entry formats.FileEntry) error {
+		if entry.IsDir {
+			return nil
+		}
+		path := utils.NormalizePath(entry.Path)
+		newEntry := entry
+
+		previous, ok := old[path]
+		if !ok {
+			return fn(FileChange{Kind: ChangeAdded, Path: path, New: &newEntry})
+		}
+		if previous.seen {
+			// Duplicate name in the new archive; the first one was compared
+			return nil
+		}
+		previous.seen = true
+
+		if sameContents(previous.entry, entry) {
+			unchanged++
+			return nil
+		}
+		return fn(FileChange{Kind: ChangeChanged, Path: path, Old: &previous.entry, New: &newEntry})
+	})
+	if err != nil {
+		return unchanged, utils.WrapError(err, "failed to list new archive")
+	}
+
+	removed := make([]string, 0)
+	for path, previous := range old {
+		if !previous.seen {
+			removed = append(removed, path)
+		}
+	}
+	sort.Strings(removed)
+	for _, path := range removed {
+		if err := fn(FileChange{Kind: ChangeRemoved, Path: path, Old: &old[path].entry}); err != nil {
+			return unchanged, err
+		}
+	}
+	return unchanged, nil
+}
+
+// sameContents reports whether two entries for the same path hold the
+// same data, as far as their metadata can tell
+func sameContents(a, b formats.FileEntry) bool {
+	if a.Size != b.Size {
+		return false
+	}
+	if a.CRC32 != 0 && b.CRC32 != 0 {
+		return a.CRC32 == b.CRC32
+	}
+	// Formats store times with different precision (ZIP uses 2 seconds)
+	return a.ModTime.Truncate(2 * time.Second).Equal(b.ModTime.Truncate(2 * time.Second))
+}
+
+// DiffArchives is a convenience function that opens two archives, compares
+// their files with WalkDiff and closes them
+func DiffArchives(urlA, urlB string, passwordA, passwordB string, config *Config) (DiffResult, error) {
+	var result DiffResult
+
+	oldArchive, err := NewArchive(urlA, config)
+	if err != nil {
+		return result, err
+	}
+	defer oldArchive.Close()
+
+	newArchive, err := NewArchive(urlB, config)
+	if err != nil {
+		return result, err
+	}
+	defer newArchive.Close()
+
+	result.Unchanged, err = WalkDiff(oldArchive, newArchive, passwordA, passwordB, func(change FileChange) error {
+		switch change.Kind {
+		case ChangeAdded:
+			result.Added = append(result.Added, change)
+		case ChangeRemoved:
+			result.Removed = append(result.Removed, change)
+		default:
+			result.Changed = append(result.Changed, change)
+		}
+		return nil
+	})
+	return result, err
+}
@@ -0,0 +1,46 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/NORMAL-EX/stream-7z/internal/testarchive"
+)
+
+func TestDiffArchives(t *testing.T) {
+	oldServer := newFileServer(t, testarchive.Zip(t, testarchive.Pairs(
+		"docs/", "",
+		"docs/a.txt", "alpha",
+		"b.txt", "bravo",
+		"c.txt", "charlie",
+		"gone.txt", "removed",
+	)...), "application/zip")
+	newServer := newFileServer(t, testarchive.Zip(t, testarchive.Pairs(
+		"docs/", "",
+		"docs/a.txt", "alpha",
+		"b.txt", "BRAVO",
+		"c.txt", "charlie",
+		"new.txt", "added",
+	)...), "application/zip")
+
+	result, err := DiffArchives(oldServer.URL+"/old.zip", newServer.URL+"/new.zip", "", "", DefaultConfig())
+	if err != nil {
+		t.Fatalf("failed to diff archives: %v", err)
+	}
+
+	if len(result.Changed) != 1 || result.Changed[0].Path != "b.txt" {
+		t.Fatalf("expected only b.txt to change, got %+v", result.Changed)
+	}
+	// Same size and time: only the CRC tells the versions apart
+	if change := result.Changed[0]; change.Old.CRC32 == change.New.CRC32 || change.Old.Size != change.New.Size {
+		t.Errorf("unexpected entries for the changed file: %+v %+v", change.Old, change.New)
+	}
+	if len(result.Added) != 1 || result.Added[0].Path != "new.txt" || result.Added[0].Old != nil {
+		t.Errorf("expected new.txt to be added, got %+v", result.Added)
+	}
+	if len(result.Removed) != 1 || result.Removed[0].Path != "gone.txt" || result.Removed[0].New != nil {
+		t.Errorf("expected gone.txt to be removed, got %+v", result.Removed)
+	}
+	if result.Unchanged != 2 {
+		t.Errorf("expected 2 unchanged files, got %d", result.Unchanged)
+	}
+}
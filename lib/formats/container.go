@@ -0,0 +1,86 @@
+package formats
+
+import (
+	"bytes"
+	"io"
+)
+
+// encryptedContainerSignatures maps the leading bytes of whole-file
+// encryption tools to their names
+var encryptedContainerSignatures = []struct {
+	magic []byte
+	name  string
+}{
+	{[]byte("Salted__"), "OpenSSL"},
+	{[]byte("age-encryption.org/v1\n"), "age"},
+	{[]byte("-----BEGIN AGE ENCRYPTED FILE-----"), "age"},
+	{[]byte("-----BEGIN PGP MESSAGE-----"), "GPG"},
+}
+
+// DetectEncryptedContainer reports whether the data is an archive that
+// was encrypted as a whole file, e.g. a .tar.gz.gpg or an `openssl enc`
+// output, and names the tool. Such a file is not an archive this package
+// can open, whatever its extension says, and no archive password helps.
+func DetectEncryptedContainer(reader io.ReaderAt, size int64) (string, bool) {
+	header := make([]byte, 64)
+	n, err := reader.ReadAt(header, 0)
+	if n == 0 && err != nil {
+		return "", false
+	}
+	header = header[:n]
+
+	for _, sig := range encryptedContainerSignatures {
+		if bytes.HasPrefix(header, sig.magic) {
+			return sig.name, true
+		}
+	}
+
+	if isOpenPGPMessage(header) {
+		return "GPG", true
+	}
+	return "", false
+}
+
+// isOpenPGPMessage checks for a binary OpenPGP message, which starts with
+// a public-key (tag 1) or symmetric-key (tag 3) encrypted session key
+// packet. The packet version is checked too, as a single tag byte would
+// match too much unrelated data.
+func isOpenPGPMessage(header []byte) bool {
+	if len(header) < 4 {
+		return false
+	}
+
+	tag := header[0]
+	var bodyStart int
+	switch {
+	case tag&0xC0 == 0x80:
+		// Old format: tag in bits 5-2, then a 1, 2 or 4 byte length
+		lengthType := tag & 0x03
+		if lengthType == 3 {
+			return false
+		}
+		tag = (tag >> 2) & 0x0F
+		bodyStart = 1 + 1<<lengthType
+	case tag&0xC0 == 0xC0:
+		// New format with a one-byte length
+		tag &= 0x3F
+		if header[1] >= 192 {
+			return false
+		}
+		bodyStart = 2
+	default:
+		return false
+	}
+
+	if bodyStart >= len(header) {
+		return false
+	}
+	version := header[bodyStart]
+	switch tag {
+	case 1:
+		return version == 3 || version == 6
+	case 3:
+		return version == 4 || version == 5 || version == 6
+	}
+	return false
+}
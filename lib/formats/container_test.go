@@ -0,0 +1,31 @@
+package formats
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDetectEncryptedContainer(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		expected string
+	}{
+		{"openssl", append([]byte("Salted__"), 1, 2, 3, 4, 5, 6, 7, 8), "OpenSSL"},
+		{"age", []byte("age-encryption.org/v1\n-> X25519 abc\n"), "age"},
+		{"armored gpg", []byte("-----BEGIN PGP MESSAGE-----\n\nhQEMA..."), "GPG"},
+		{"gpg public key", []byte{0x85, 0x01, 0x0C, 0x03, 0x12, 0x34}, "GPG"},
+		{"gpg symmetric", []byte{0x8C, 0x0D, 0x04, 0x09, 0x03, 0x08}, "GPG"},
+		{"gpg new format", []byte{0xC3, 0x0D, 0x04, 0x09, 0x03, 0x08}, "GPG"},
+		{"gzip", []byte{0x1F, 0x8B, 0x08, 0x00, 0x00, 0x00}, ""},
+		{"zip", []byte("PK\x03\x04\x14\x00\x00\x00"), ""},
+		{"unrelated tag byte", []byte{0x85, 0x01, 0x0C, 0x07, 0x00, 0x00}, ""},
+	}
+
+	for _, test := range tests {
+		name, ok := DetectEncryptedContainer(bytes.NewReader(test.data), int64(len(test.data)))
+		if name != test.expected || ok != (test.expected != "") {
+			t.Errorf("%s: got (%q, %v), expected %q", test.name, name, ok, test.expected)
+		}
+	}
+}
@@ -0,0 +1,450 @@
+package formats
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/NORMAL-EX/stream-7z/lib/utils"
+)
+
+// zipMethodDeflate64 is the ZIP method code of Deflate64 ("Enhanced
+// Deflate"), which Windows' built-in compression uses for large files
+const zipMethodDeflate64 = 9
+
+// Deflate64 is Deflate with a 64 KiB window: length code 285 takes 16
+// extra bits instead of meaning 258, and distance codes 30 and 31 reach
+// back up to 65536 bytes. Everything else, including the block types and
+// the fixed Huffman codes, is the same.
+const (
+	deflate64WindowSize = 1 << 16
+	deflate64WindowMask = deflate64WindowSize - 1
+
+	// Codes up to this length are decoded with a single table lookup
+	huffmanTableBits = 9
+	huffmanMaxBits   = 15
+)
+
+var (
+	deflate64LengthBase = [29]uint16{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31,
+		35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 3,
+	}
+	deflate64LengthExtra = [29]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2,
+		3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 16,
+	}
+	deflate64DistBase = [32]uint32{
+		1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193,
+		257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577, 32769, 49153,
+	}
+	deflate64DistExtra = [32]uint8{
+		0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6,
+		7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13, 14, 14,
+	}
+
+	// Order in which the code length code lengths are stored
+	codeLengthOrder = [19]uint8{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+)
+
+// huffman is a canonical Huffman code
+type huffman struct {
+	count  [huffmanMaxBits + 1]uint16 // Number of codes of each length
+	symbol []uint16                   // Symbols ordered by code
+	// Symbol<<4 | length for the codes up to huffmanTableBits long, indexed
+	// by their bits as read from the stream; 0 for longer codes
+	table [1 << huffmanTableBits]uint16
+}
+
+// init builds the code from the code length of each symbol (0 = unused)
+func (h *huffman) init(lengths []uint8) error {
+	h.count = [huffmanMaxBits + 1]uint16{}
+	for _, l := range lengths {
+		h.count[l]++
+	}
+	h.count[0] = 0
+
+	// An over-subscribed set of lengths isn't a prefix code
+	left := 1
+	for l := 1; l <= huffmanMaxBits; l++ {
+		left = left<<1 - int(h.count[l])
+		if left < 0 {
+			return utils.WrapError(utils.ErrArchiveCorrupted, "deflate64: invalid Huffman code")
+		}
+	}
+
+	var offsets [huffmanMaxBits + 2]uint16
+	for l := 1; l <= huffmanMaxBits; l++ {
+		offsets[l+1] = offsets[l] + h.count[l]
+	}
+	h.symbol = h.symbol[:0]
+	for range lengths {
+		h.symbol = append(h.symbol, 0)
+	}
+	for sym, l := range lengths {
+		if l != 0 {
+			h.symbol[offsets[l]] = uint16(sym)
+			offsets[l]++
+		}
+	}
+
+	h.table = [1 << huffmanTableBits]uint16{}
+	code, index := 0, 0
+	for l := 1; l <= huffmanTableBits; l++ {
+		for i := 0; i < int(h.count[l]); i++ {
+			// Codes are sent most significant bit first
+			reversed := 0
+			for b := 0; b < l; b++ {
+				reversed |= (code >> b & 1) << (l - 1 - b)
+			}
+			entry := h.symbol[index]<<4 | uint16(l)
+			for fill := reversed; fill < len(h.table); fill += 1 << l {
+				h.table[fill] = entry
+			}
+			code++
+			index++
+		}
+		code <<= 1
+	}
+	return nil
+}
+
+// deflate64Reader decompresses a Deflate64 stream
+type deflate64Reader struct {
+	r     *bufio.Reader
+	bits  uint64 // Bits read but not consumed, least significant first
+	nbits uint
+
+	window  [deflate64WindowSize]byte
+	written int64 // Total bytes produced so far
+
+	final     bool // Whether the current block is the last one
+	inBlock   bool // Whether a block is being decoded
+	stored    int  // Bytes left in a stored block, -1 in a compressed one
+	copyLen   int  // Bytes left of the match being copied
+	copyDist  int  // Distance of the match being copied
+	lit, dist huffman
+	fixed     bool  // Whether lit and dist hold the fixed codes
+	readErr   error // Error reading the compressed data
+	err       error
+}
+
+// newDeflate64Reader returns a reader decompressing the Deflate64 data
+// read from r; it matches the zip.Decompressor signature
+func newDeflate64Reader(r io.Reader) io.ReadCloser {
+	return &deflate64Reader{r: bufio.NewReader(r)}
+}
+
+func (d *deflate64Reader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) && d.err == nil {
+		switch {
+		case d.copyLen > 0:
+			for d.copyLen > 0 && n < len(p) {
+				b := d.window[(d.written-int64(d.copyDist))&deflate64WindowMask]
+				p[n] = b
+				d.put(b)
+				n++
+				d.copyLen--
+			}
+		case !d.inBlock:
+			if d.final {
+				d.err = io.EOF
+				break
+			}
+			d.err = d.readBlockHeader()
+		case d.stored > 0:
+			b, err := d.readStoredByte()
+			if err != nil {
+				d.err = err
+				break
+			}
+			p[n] = b
+			d.put(b)
+			n++
+			d.stored--
+		case d.stored == 0:
+			d.inBlock = false
+		default:
+			d.err = d.decodeSymbol(p, &n)
+		}
+	}
+	if n > 0 {
+		return n, nil
+	}
+	return 0, d.err
+}
+
+func (d *deflate64Reader) Close() error {
+	return nil
+}
+
+// put appends b to the window
+func (d *deflate64Reader) put(b byte) {
+	d.window[d.written&deflate64WindowMask] = b
+	d.written++
+}
+
+// decodeSymbol decodes a literal, which it writes to p[*n], a match,
+// which it leaves in copyLen and copyDist, or the end of the block
+func (d *deflate64Reader) decodeSymbol(p []byte, n *int) error {
+	sym, err := d.decode(&d.lit)
+	if err != nil {
+		return err
+	}
+	switch {
+	case sym < 256:
+		p[*n] = byte(sym)
+		d.put(byte(sym))
+		*n++
+		return nil
+	case sym == 256:
+		d.inBlock = false
+		return nil
+	case sym > 285:
+		return utils.WrapError(utils.ErrArchiveCorrupted, "deflate64: invalid length code %d", sym)
+	}
+
+	sym -= 257
+	extra, err := d.getBits(uint(deflate64LengthExtra[sym]))
+	if err != nil {
+		return err
+	}
+	length := int(deflate64LengthBase[sym]) + int(extra)
+
+	distSym, err := d.decode(&d.dist)
+	if err != nil {
+		return err
+	}
+	if distSym >= len(deflate64DistBase) {
+		return utils.WrapError(utils.ErrArchiveCorrupted, "deflate64: invalid distance code %d", distSym)
+	}
+	extra, err = d.getBits(uint(deflate64DistExtra[distSym]))
+	if err != nil {
+		return err
+	}
+	dist := int(deflate64DistBase[distSym]) + int(extra)
+	if int64(dist) > d.written {
+		return utils.WrapError(utils.ErrArchiveCorrupted, "deflate64: distance %d before the start of the data", dist)
+	}
+
+	d.copyLen = length
+	d.copyDist = dist
+	return nil
+}
+
+// readBlockHeader starts the next block
+func (d *deflate64Reader) readBlockHeader() error {
+	header, err := d.getBits(3)
+	if err != nil {
+		return err
+	}
+	d.final = header&1 == 1
+	d.inBlock = true
+	d.stored = -1
+
+	switch header >> 1 {
+	case 0:
+		// Stored blocks start at a byte boundary
+		d.bits >>= d.nbits % 8
+		d.nbits -= d.nbits % 8
+		lengths, err := d.getBits(32)
+		if err != nil {
+			return err
+		}
+		length, inverse := lengths&0xffff, lengths>>16
+		if length != ^inverse&0xffff {
+			return utils.WrapError(utils.ErrArchiveCorrupted, "deflate64: stored block length mismatch")
+		}
+		d.stored = int(length)
+		return nil
+	case 1:
+		return d.useFixedCodes()
+	case 2:
+		d.fixed = false
+		return d.readDynamicCodes()
+	default:
+		return utils.WrapError(utils.ErrArchiveCorrupted, "deflate64: invalid block type")
+	}
+}
+
+// useFixedCodes sets up the Huffman codes of a fixed block
+func (d *deflate64Reader) useFixedCodes() error {
+	if d.fixed {
+		return nil
+	}
+	var lengths [288 + 32]uint8
+	for i := 0; i < 288; i++ {
+		switch {
+		case i < 144:
+			lengths[i] = 8
+		case i < 256:
+			lengths[i] = 9
+		case i < 280:
+			lengths[i] = 7
+		default:
+			lengths[i] = 8
+		}
+	}
+	for i := 288; i < len(lengths); i++ {
+		lengths[i] = 5
+	}
+	if err := d.lit.init(lengths[:288]); err != nil {
+		return err
+	}
+	if err := d.dist.init(lengths[288:]); err != nil {
+		return err
+	}
+	d.fixed = true
+	return nil
+}
+
+// readDynamicCodes reads the Huffman codes of a dynamic block
+func (d *deflate64Reader) readDynamicCodes() error {
+	counts, err := d.getBits(14)
+	if err != nil {
+		return err
+	}
+	nlit := int(counts&0x1f) + 257
+	ndist := int(counts>>5&0x1f) + 1
+	nclen := int(counts>>10) + 4
+	if nlit > 286 {
+		return utils.WrapError(utils.ErrArchiveCorrupted, "deflate64: too many length codes")
+	}
+
+	var clen [19]uint8
+	for i := 0; i < nclen; i++ {
+		l, err := d.getBits(3)
+		if err != nil {
+			return err
+		}
+		clen[codeLengthOrder[i]] = uint8(l)
+	}
+	var codeLengths huffman
+	if err := codeLengths.init(clen[:]); err != nil {
+		return err
+	}
+
+	lengths := make([]uint8, nlit+ndist)
+	for i := 0; i < len(lengths); {
+		sym, err := d.decode(&codeLengths)
+		if err != nil {
+			return err
+		}
+		if sym < 16 {
+			lengths[i] = uint8(sym)
+			i++
+			continue
+		}
+
+		var repeat uint64
+		var value uint8
+		switch sym {
+		case 16:
+			if i == 0 {
+				return utils.WrapError(utils.ErrArchiveCorrupted, "deflate64: repeat with no previous length")
+			}
+			value = lengths[i-1]
+			repeat, err = d.getBits(2)
+			repeat += 3
+		case 17:
+			repeat, err = d.getBits(3)
+			repeat += 3
+		default:
+			repeat, err = d.getBits(7)
+			repeat += 11
+		}
+		if err != nil {
+			return err
+		}
+		if i+int(repeat) > len(lengths) {
+			return utils.WrapError(utils.ErrArchiveCorrupted, "deflate64: code lengths overflow")
+		}
+		for ; repeat > 0; repeat-- {
+			lengths[i] = value
+			i++
+		}
+	}
+	if lengths[256] == 0 {
+		return utils.WrapError(utils.ErrArchiveCorrupted, "deflate64: missing end of block code")
+	}
+
+	if err := d.lit.init(lengths[:nlit]); err != nil {
+		return err
+	}
+	return d.dist.init(lengths[nlit:])
+}
+
+// decode reads one symbol of h
+func (d *deflate64Reader) decode(h *huffman) (int, error) {
+	// Near the end of the stream fewer bits than a table index may be left
+	d.fill(huffmanTableBits)
+	if entry := h.table[d.bits&(1<<huffmanTableBits-1)]; entry != 0 && uint(entry&0xf) <= d.nbits {
+		d.consume(uint(entry & 0xf))
+		return int(entry >> 4), nil
+	}
+
+	// Longer codes are walked a bit at a time
+	code, first, index := 0, 0, 0
+	for l := 1; l <= huffmanMaxBits; l++ {
+		bit, err := d.getBits(1)
+		if err != nil {
+			return 0, err
+		}
+		code |= int(bit)
+		count := int(h.count[l])
+		if code-first < count {
+			return int(h.symbol[index+code-first]), nil
+		}
+		index += count
+		first = (first + count) << 1
+		code <<= 1
+	}
+	return 0, utils.WrapError(utils.ErrArchiveCorrupted, "deflate64: invalid Huffman code")
+}
+
+// fill reads bytes until n bits are buffered or the input ends
+func (d *deflate64Reader) fill(n uint) {
+	for d.nbits < n {
+		b, err := d.r.ReadByte()
+		if err != nil {
+			d.readErr = err
+			return
+		}
+		d.bits |= uint64(b) << d.nbits
+		d.nbits += 8
+	}
+}
+
+// getBits reads an n-bit value, n <= 32
+func (d *deflate64Reader) getBits(n uint) (uint64, error) {
+	d.fill(n)
+	if d.nbits < n {
+		if d.readErr != nil && d.readErr != io.EOF {
+			return 0, d.readErr
+		}
+		return 0, io.ErrUnexpectedEOF
+	}
+	v := d.bits & (1<<n - 1)
+	d.consume(n)
+	return v, nil
+}
+
+func (d *deflate64Reader) consume(n uint) {
+	d.bits >>= n
+	d.nbits -= n
+}
+
+// readStoredByte reads a byte of a stored block, taking the bytes already
+// buffered first
+func (d *deflate64Reader) readStoredByte() (byte, error) {
+	if d.nbits >= 8 {
+		b := byte(d.bits)
+		d.consume(8)
+		return b, nil
+	}
+	b, err := d.r.ReadByte()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return b, err
+}
@@ -0,0 +1,217 @@
+package formats
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/yeka/zip"
+
+	"github.com/NORMAL-EX/stream-7z/internal/testarchive"
+)
+
+func init() {
+	zip.RegisterCompressor(zipMethodDeflate64, func(w io.Writer) (io.WriteCloser, error) {
+		return &deflate64TestWriter{w: w}, nil
+	})
+}
+
+// deflate64TestWriter compresses what is written to it with
+// encodeDeflate64 when closed
+type deflate64TestWriter struct {
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+func (w *deflate64TestWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *deflate64TestWriter) Close() error {
+	_, err := w.w.Write(encodeDeflate64(w.buf.Bytes()))
+	return err
+}
+
+// bitWriter packs bits least significant first, like Deflate
+type bitWriter struct {
+	out   []byte
+	bits  uint64
+	nbits uint
+}
+
+func (b *bitWriter) write(v uint64, n uint) {
+	b.bits |= v << b.nbits
+	b.nbits += n
+	for b.nbits >= 8 {
+		b.out = append(b.out, byte(b.bits))
+		b.bits >>= 8
+		b.nbits -= 8
+	}
+}
+
+// writeCode writes a Huffman code, which is sent most significant bit first
+func (b *bitWriter) writeCode(code uint64, n uint) {
+	var reversed uint64
+	for i := uint(0); i < n; i++ {
+		reversed |= (code >> i & 1) << (n - 1 - i)
+	}
+	b.write(reversed, n)
+}
+
+func (b *bitWriter) flush() []byte {
+	if b.nbits > 0 {
+		b.write(0, 8-b.nbits)
+	}
+	return b.out
+}
+
+// writeFixedLiteral writes a literal/length symbol with the fixed code
+func (b *bitWriter) writeFixedLiteral(sym int) {
+	switch {
+	case sym < 144:
+		b.writeCode(uint64(0x30+sym), 8)
+	case sym < 256:
+		b.writeCode(uint64(0x190+sym-144), 9)
+	case sym < 280:
+		b.writeCode(uint64(sym-256), 7)
+	default:
+		b.writeCode(uint64(0xc0+sym-280), 8)
+	}
+}
+
+// encodeDeflate64 compresses data as a stored block holding its first
+// bytes followed by a fixed-code block, which reuses earlier data only at
+// distances 1 and 40000 but with matches as long as Deflate64 allows. That
+// is enough to exercise what Deflate64 adds to Deflate.
+func encodeDeflate64(data []byte) []byte {
+	var b bitWriter
+
+	stored := len(data)
+	if stored > 100 {
+		stored = 100
+	}
+	b.write(0, 3) // Not final, stored
+	b.flush()
+	b.write(uint64(stored), 16)
+	b.write(uint64(^uint16(stored)), 16)
+	b.out = append(b.out, data[:stored]...)
+
+	b.write(1|1<<1, 3) // Final, fixed codes
+	for i := stored; i < len(data); {
+		length, dist := 0, 0
+		for _, d := range []int{1, 40000} {
+			if d > i {
+				continue
+			}
+			l := 0
+			for i+l < len(data) && l < 65538 && data[i+l] == data[i+l-d] {
+				l++
+			}
+			if l > length {
+				length, dist = l, d
+			}
+		}
+		if length < 3 {
+			b.writeFixedLiteral(int(data[i]))
+			i++
+			continue
+		}
+
+		sym := 28
+		if length <= 258 {
+			for sym = 27; int(deflate64LengthBase[sym]) > length; sym-- {
+			}
+		}
+		b.writeFixedLiteral(257 + sym)
+		b.write(uint64(length-int(deflate64LengthBase[sym])), uint(deflate64LengthExtra[sym]))
+
+		dsym := 31
+		for int(deflate64DistBase[dsym]) > dist {
+			dsym--
+		}
+		b.writeCode(uint64(dsym), 5)
+		b.write(uint64(dist-int(deflate64DistBase[dsym])), uint(deflate64DistExtra[dsym]))
+		i += length
+	}
+	b.writeFixedLiteral(256)
+	return b.flush()
+}
+
+func TestDeflate64(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 40000)
+	rng.Read(random)
+
+	// A match 40000 bytes back, which needs distance code 30, and one
+	// longer than 258 bytes, which needs length code 285 with 16 extra bits
+	var data []byte
+	data = append(data, random...)
+	data = append(data, random[:1000]...)
+	data = append(data, bytes.Repeat([]byte("x"), 70000)...)
+
+	compressed := encodeDeflate64(data)
+	got, err := io.ReadAll(newDeflate64Reader(bytes.NewReader(compressed)))
+	if err != nil {
+		t.Fatalf("failed to decompress: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("decompressed %d bytes, which don't match the %d written", len(got), len(data))
+	}
+
+	// Deflate data without length-258 matches is also valid Deflate64,
+	// which covers dynamic Huffman blocks
+	words := []string{"alpha", "beta", "gamma", "delta", "epsilon", "zeta"}
+	var text strings.Builder
+	for i := 0; i < 20000; i++ {
+		text.WriteString(words[rng.Intn(len(words))] + " ")
+	}
+	var deflated bytes.Buffer
+	fw, _ := flate.NewWriter(&deflated, flate.BestCompression)
+	fw.Write([]byte(text.String()))
+	fw.Close()
+	got, err = io.ReadAll(newDeflate64Reader(&deflated))
+	if err != nil {
+		t.Fatalf("failed to decompress dynamic blocks: %v", err)
+	}
+	if string(got) != text.String() {
+		t.Error("decompressed dynamic blocks don't match")
+	}
+
+	// Truncated data fails instead of ending early
+	if _, err := io.ReadAll(newDeflate64Reader(bytes.NewReader(compressed[:len(compressed)/2]))); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected a truncated stream to fail with io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestZipExtractDeflate64(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	content := make([]byte, 50000)
+	rng.Read(content)
+	content = append(content, content[:5000]...)
+
+	reader := bytes.NewReader(testarchive.Zip(t, []testarchive.Entry{
+		{Name: "large.bin", Content: string(content), Method: zipMethodDeflate64},
+	}...))
+
+	rc, size, err := NewZipFormat().ExtractFile(context.Background(), reader, reader.Size(), "large.bin", "")
+	if err != nil {
+		t.Fatalf("ExtractFile failed: %v", err)
+	}
+	defer rc.Close()
+	if size != int64(len(content)) {
+		t.Errorf("expected size %d, got %d", len(content), size)
+	}
+
+	// Reading to the end also checks the CRC
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("failed to read the member: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Error("extracted bytes don't match the original")
+	}
+}
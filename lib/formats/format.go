@@ -2,8 +2,14 @@ package formats
 
 import (
 	"context"
+	"errors"
 	"io"
+	"sort"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/NORMAL-EX/stream-7z/lib/utils"
 )
 
 // FileEntry represents a file within an archive
@@ -13,6 +19,20 @@ type FileEntry struct {
 	CompressedSize int64     // Compressed size
 	ModTime        time.Time // Modification time
 	IsDir          bool      // Whether this is a directory
+	Method         string    // Compression method (e.g. "Store", "Deflate"), empty if unknown
+	IsEncrypted    bool      // Whether extracting this entry requires a password
+	CRC32          uint32    // CRC-32 of the contents, 0 if the format doesn't record it
+
+	// Extended attributes (e.g. "user.comment", "security.selinux") and
+	// the other PAX header records of the entry, keyed by name. Only TAR
+	// records them; nil when there are none.
+	Xattrs     map[string]string
+	PAXRecords map[string]string
+
+	// UnsafePath is set by the Archive listing methods for names that are
+	// absolute or climb out with "..", which would escape the target
+	// directory if written to disk as named
+	UnsafePath bool
 }
 
 // ArchiveInfo contains metadata about an archive
@@ -23,6 +43,283 @@ type ArchiveInfo struct {
 	TotalSize        int64       // Total uncompressed size
 	Files            []FileEntry // List of all files
 	Comment          string      // Archive comment (if any)
+
+	// TotalCompressedSize is the sum of the members' compressed sizes for
+	// formats recording them (ZIP, RAR), and the archive size for the
+	// others (TAR, 7z), whose members are compressed as one stream
+	TotalCompressedSize int64
+
+	// RandomAccess reports whether a single member can be extracted without
+	// decompressing the members stored before it. Solid reports whether
+	// members were compressed together, so extraction cost grows with the
+	// member's position in the archive.
+	RandomAccess bool
+	Solid        bool
+
+	// Metadata holds format-specific details about how the archive was built
+	// (e.g. entry count, solid flag). Keys the format can't report are absent.
+	Metadata map[string]string
+}
+
+// FilterEntries selects entries the way ListFiles does for innerPath:
+// "" returns every entry, "/" the root's direct children, and any other
+// path the direct children of that directory. Leading and trailing
+// slashes don't matter, so "docs", "docs/" and "/docs/" are the same.
+func FilterEntries(entries []FileEntry, innerPath string) []FileEntry {
+	if innerPath == "" {
+		return append([]FileEntry(nil), entries...)
+	}
+
+	files := make([]FileEntry, 0)
+	for _, entry := range entries {
+		if MatchesInnerPath(entry.Path, innerPath) {
+			files = append(files, entry)
+		}
+	}
+	return files
+}
+
+// MatchesInnerPath reports whether FilterEntries selects the entry at
+// entryPath for innerPath
+func MatchesInnerPath(entryPath, innerPath string) bool {
+	return matchesInnerPath(entryPath, innerPath, false)
+}
+
+// FilterEntriesFold is FilterEntries with innerPath compared
+// case-insensitively. If innerPath names a directory with the exact case,
+// only that directory's entries are returned.
+func FilterEntriesFold(entries []FileEntry, innerPath string) []FileEntry {
+	if files := FilterEntries(entries, innerPath); len(files) > 0 || innerPath == "" {
+		return files
+	}
+
+	files := make([]FileEntry, 0)
+	for _, entry := range entries {
+		if matchesInnerPath(entry.Path, innerPath, true) {
+			files = append(files, entry)
+		}
+	}
+	return files
+}
+
+// matchesInnerPath implements MatchesInnerPath, optionally ignoring case
+func matchesInnerPath(entryPath, innerPath string, fold bool) bool {
+	if innerPath == "" {
+		return true
+	}
+
+	prefix := utils.NormalizePath(innerPath)
+	if prefix == "." {
+		prefix = ""
+	} else {
+		prefix += "/"
+	}
+
+	normalizedName := utils.NormalizePath(entryPath)
+	if fold {
+		normalizedName = strings.ToLower(normalizedName)
+		prefix = strings.ToLower(prefix)
+	}
+	if !strings.HasPrefix(normalizedName, prefix) {
+		return false
+	}
+	relativePath := strings.TrimPrefix(normalizedName, prefix)
+	return relativePath != "" && relativePath != "." && !strings.Contains(relativePath, "/")
+}
+
+// EntryDepth returns how many levels below innerPath the entry at
+// entryPath is, so a direct child is at depth 1. innerPath is interpreted
+// as by FilterEntries, with "" and "/" both meaning the archive root.
+// Entries outside innerPath, and innerPath itself, are at depth 0.
+func EntryDepth(entryPath, innerPath string) int {
+	return entryDepth(entryPath, innerPath, false)
+}
+
+// entryDepth implements EntryDepth, optionally ignoring case
+func entryDepth(entryPath, innerPath string, fold bool) int {
+	prefix := utils.NormalizePath(innerPath)
+	if prefix == "." {
+		prefix = ""
+	} else {
+		prefix += "/"
+	}
+
+	normalizedName := utils.NormalizePath(entryPath)
+	if fold {
+		normalizedName = strings.ToLower(normalizedName)
+		prefix = strings.ToLower(prefix)
+	}
+	if normalizedName == "." || !strings.HasPrefix(normalizedName, prefix) {
+		return 0
+	}
+	relativePath := strings.TrimPrefix(normalizedName, prefix)
+	if relativePath == "" {
+		return 0
+	}
+	return strings.Count(relativePath, "/") + 1
+}
+
+// LimitDepth drops entries more than maxDepth levels below innerPath.
+// A maxDepth of 0 or less keeps every entry.
+func LimitDepth(entries []FileEntry, innerPath string, maxDepth int) []FileEntry {
+	if maxDepth <= 0 {
+		return entries
+	}
+
+	files := make([]FileEntry, 0, len(entries))
+	for _, entry := range entries {
+		if EntryDepth(entry.Path, innerPath) <= maxDepth {
+			files = append(files, entry)
+		}
+	}
+	return files
+}
+
+// FilterTree selects the entries up to maxDepth levels below innerPath,
+// reaching into subdirectories where FilterEntries stops at the direct
+// children. A maxDepth of 0 or less selects the whole subtree. innerPath
+// is interpreted as by FilterEntries, with "" and "/" both meaning the
+// archive root.
+func FilterTree(entries []FileEntry, innerPath string, maxDepth int) []FileEntry {
+	return filterTree(entries, innerPath, maxDepth, false)
+}
+
+// FilterTreeFold is FilterTree with innerPath compared
+// case-insensitively. If innerPath names a directory with the exact case,
+// only that directory's entries are returned.
+func FilterTreeFold(entries []FileEntry, innerPath string, maxDepth int) []FileEntry {
+	if files := FilterTree(entries, innerPath, maxDepth); len(files) > 0 {
+		return files
+	}
+	return filterTree(entries, innerPath, maxDepth, true)
+}
+
+// filterTree implements FilterTree, optionally ignoring case
+func filterTree(entries []FileEntry, innerPath string, maxDepth int, fold bool) []FileEntry {
+	files := make([]FileEntry, 0)
+	for _, entry := range entries {
+		depth := entryDepth(entry.Path, innerPath, fold)
+		if depth > 0 && (maxDepth <= 0 || depth <= maxDepth) {
+			files = append(files, entry)
+		}
+	}
+	return files
+}
+
+// HideEmptyDirs drops the directory entries with no file below them,
+// e.g. the chains of intermediate directories some tools store for every
+// level of a path. A directory only holding empty directories is dropped
+// as well. Only the given entries are considered, so apply it before
+// LimitDepth, or use HideEmptyDirsIn for a partial listing.
+func HideEmptyDirs(entries []FileEntry) []FileEntry {
+	return HideEmptyDirsIn(entries, entries)
+}
+
+// HideEmptyDirsIn is HideEmptyDirs for a partial listing, such as the
+// direct children of a directory: the directories of entries are looked
+// for files in all, which should hold every entry of the archive.
+func HideEmptyDirsIn(entries, all []FileEntry) []FileEntry {
+	nonEmpty := make(map[string]bool)
+	for _, entry := range all {
+		if entry.IsDir {
+			continue
+		}
+		dir := utils.NormalizePath(entry.Path)
+		for {
+			i := strings.LastIndex(dir, "/")
+			if i < 0 {
+				break
+			}
+			dir = dir[:i]
+			if nonEmpty[dir] {
+				break // Its parents are marked already
+			}
+			nonEmpty[dir] = true
+		}
+	}
+
+	files := make([]FileEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir && !nonEmpty[utils.NormalizePath(entry.Path)] {
+			continue
+		}
+		files = append(files, entry)
+	}
+	return files
+}
+
+// SortTree sorts entries the way a file browser shows a tree: each
+// directory is followed by what it contains, and the entries of one
+// directory are ordered directories first, then by name. Paths are
+// compared normalized, so members sort below their directory even if it
+// has no entry of its own. Sorting needs every entry at once, so use it on
+// bounded listings (e.g. after LimitDepth) of large archives.
+func SortTree(entries []FileEntry) {
+	segments := make([][]string, len(entries))
+	for i, entry := range entries {
+		segments[i] = strings.Split(utils.NormalizePath(entry.Path), "/")
+	}
+	sort.Stable(treeOrder{entries: entries, segments: segments})
+}
+
+// treeOrder implements sort.Interface for SortTree
+type treeOrder struct {
+	entries  []FileEntry
+	segments [][]string
+}
+
+func (t treeOrder) Len() int { return len(t.entries) }
+
+func (t treeOrder) Swap(i, j int) {
+	t.entries[i], t.entries[j] = t.entries[j], t.entries[i]
+	t.segments[i], t.segments[j] = t.segments[j], t.segments[i]
+}
+
+func (t treeOrder) Less(i, j int) bool {
+	a, b := t.segments[i], t.segments[j]
+	for k := 0; k < len(a) && k < len(b); k++ {
+		if a[k] == b[k] {
+			continue
+		}
+		// At the first level they differ, either side may be a directory
+		// holding the entry rather than the entry itself
+		aDir := k < len(a)-1 || t.entries[i].IsDir
+		bDir := k < len(b)-1 || t.entries[j].IsDir
+		if aDir != bDir {
+			return aDir
+		}
+		return a[k] < b[k]
+	}
+	// A directory comes before its contents
+	return len(a) < len(b)
+}
+
+// Walker is implemented by formats that can report entries while the
+// archive is being read, without collecting the whole listing first
+type Walker interface {
+	// Walk calls fn for every entry in archive order. It stops at the
+	// first error returned by fn and returns that error.
+	Walk(ctx context.Context, reader io.ReaderAt, size int64, password string, fn func(FileEntry) error) error
+}
+
+// SequentialExtractor is implemented by formats that can only reach a
+// member by decompressing everything stored before it. A cursor keeps that
+// position, so extracting members in archive order decompresses the
+// archive once instead of once per member.
+type SequentialExtractor interface {
+	// NewCursor starts a pass over the archive from its beginning
+	NewCursor(ctx context.Context, reader io.ReaderAt, size int64, password string) (Cursor, error)
+}
+
+// Cursor extracts members during one forward pass over an archive
+type Cursor interface {
+	// Next skips ahead to filePath and returns its content, which is only
+	// valid until the next call. ErrFileNotFound means filePath doesn't
+	// come after the current position.
+	Next(filePath string) (io.Reader, int64, error)
+
+	// Close releases the decompressor
+	Close() error
 }
 
 // Format defines the interface that all archive format handlers must implement
@@ -45,12 +342,57 @@ type Format interface {
 
 	// ExtractFile extracts a single file from the archive
 	// Returns a reader for the file content and the file size
+	// A size of -1 means the format doesn't know it
+	// On error no reader is returned and anything opened is released
 	ExtractFile(ctx context.Context, reader io.ReaderAt, size int64, filePath string, password string) (io.ReadCloser, int64, error)
 }
 
-// Registry holds all registered format handlers
+// SizeReporter is implemented by formats that can say whether the size
+// returned by ExtractFile is guaranteed to match the extracted content.
+// Formats that don't implement it are assumed to report exact sizes.
+type SizeReporter interface {
+	// ExactSizes reports whether member sizes always match the content
+	ExactSizes() bool
+}
+
+// RawExtractor is implemented by formats that can hand out the compressed
+// bytes of a member as stored, without decompressing them
+type RawExtractor interface {
+	// ExtractRaw returns a reader for the member's compressed data, its
+	// size and the compression method. It fails with ErrNotSupported for
+	// members whose data isn't a plain compressed stream. Readers that
+	// read straight from the archive implement io.Seeker.
+	ExtractRaw(ctx context.Context, reader io.ReaderAt, size int64, filePath string, password string) (io.ReadCloser, int64, string, error)
+}
+
+// PasswordChecker is implemented by formats that can verify a password
+// by opening a single encrypted entry, without building the listing
+type PasswordChecker interface {
+	// CheckPassword reports whether the archive has encrypted content and,
+	// if it does, whether password decrypts it
+	CheckPassword(ctx context.Context, reader io.ReaderAt, size int64, password string) (encrypted bool, valid bool, err error)
+}
+
+// DebugInfoProvider is implemented by formats that can describe their
+// low-level structure, for diagnosing archives that won't open
+type DebugInfoProvider interface {
+	// DebugInfo returns structural details such as record offsets and
+	// flags, keyed by name. Per-entry details stop after maxDebugEntries
+	// entries. It reads as little as possible, so it also works on
+	// archives GetInfo rejects.
+	DebugInfo(ctx context.Context, reader io.ReaderAt, size int64, password string) (map[string]interface{}, error)
+}
+
+// maxDebugEntries caps the entries a DebugInfo result describes one by one
+const maxDebugEntries = 1000
+
+// Registry holds all registered format handlers. It is safe for
+// concurrent use, so formats can be registered at runtime while archives
+// are being detected.
 type Registry struct {
+	mu      sync.RWMutex
 	formats map[string]Format
+	order   []string // Format names in registration order
 }
 
 // NewRegistry creates a new format registry
@@ -60,21 +402,54 @@ func NewRegistry() *Registry {
 	}
 }
 
-// Register adds a format handler to the registry
+// Register adds a format handler to the registry. A format registered
+// under the name of an earlier one replaces it in its place.
 func (r *Registry) Register(format Format) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.formats[format.Name()]; !ok {
+		r.order = append(r.order, format.Name())
+	}
 	r.formats[format.Name()] = format
 }
 
+// Unregister removes the format handler registered under name, if any
+func (r *Registry) Unregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.formats[name]; !ok {
+		return
+	}
+	delete(r.formats, name)
+	for i, n := range r.order {
+		if n == name {
+			r.order = append(r.order[:i:i], r.order[i+1:]...)
+			break
+		}
+	}
+}
+
 // Get retrieves a format handler by name
 func (r *Registry) Get(name string) (Format, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	f, ok := r.formats[name]
 	return f, ok
 }
 
-// DetectFormat attempts to detect the archive format
+// DetectFormat attempts to detect the archive format. Formats claiming
+// extension are tried first, then all of them, each in registration order,
+// so the same data is always detected the same way. The first bytes of the
+// file are read once and shared by all formats, and reads beyond them are
+// capped, so a file that isn't an archive costs a bounded number of reads.
+// Formats registered while it runs may not be tried.
 func (r *Registry) DetectFormat(ctx context.Context, reader io.ReaderAt, size int64, extension string) (Format, error) {
+	// Detect reads from the reader, so it runs without holding the lock
+	formats := r.GetAllFormats()
+	reader = newDetectReader(reader, size)
+
 	// First try by extension
-	for _, format := range r.formats {
+	for _, format := range formats {
 		for _, ext := range format.Extensions() {
 			if ext == extension {
 				detected, err := format.Detect(ctx, reader, size)
@@ -86,7 +461,7 @@ func (r *Registry) DetectFormat(ctx context.Context, reader io.ReaderAt, size in
 	}
 
 	// Try all formats
-	for _, format := range r.formats {
+	for _, format := range formats {
 		detected, err := format.Detect(ctx, reader, size)
 		if err == nil && detected {
 			return format, nil
@@ -96,15 +471,93 @@ func (r *Registry) DetectFormat(ctx context.Context, reader io.ReaderAt, size in
 	return nil, ErrFormatNotDetected
 }
 
-// GetAllFormats returns all registered formats
+// FormatForExtension returns the format handling extension without looking
+// at any data. It fails if no format, or more than one, claims extension.
+func (r *Registry) FormatForExtension(extension string) (Format, bool) {
+	var found Format
+	for _, format := range r.GetAllFormats() {
+		for _, ext := range format.Extensions() {
+			if ext != extension {
+				continue
+			}
+			if found != nil && found != format {
+				return nil, false
+			}
+			found = format
+		}
+	}
+	return found, found != nil
+}
+
+// GetAllFormats returns all registered formats in registration order
 func (r *Registry) GetAllFormats() []Format {
-	formats := make([]Format, 0, len(r.formats))
-	for _, f := range r.formats {
-		formats = append(formats, f)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	formats := make([]Format, 0, len(r.order))
+	for _, name := range r.order {
+		formats = append(formats, r.formats[name])
 	}
 	return formats
 }
 
+const (
+	// detectPrefixSize is how much of the file DetectFormat reads up
+	// front; every built-in format's signature lies within it
+	detectPrefixSize = 4096
+
+	// maxDetectReads caps the reads past the prefix during DetectFormat
+	maxDetectReads = 4
+)
+
+// errDetectReadsExhausted fails reads once maxDetectReads is reached
+var errDetectReadsExhausted = errors.New("detection read limit reached")
+
+// detectReader serves DetectFormat's reads from the file's prefix, read
+// once, and passes at most maxDetectReads others through
+type detectReader struct {
+	r      io.ReaderAt
+	size   int64
+	prefix []byte
+	err    error // Error reading the prefix
+	reads  int
+}
+
+func newDetectReader(r io.ReaderAt, size int64) *detectReader {
+	n := int64(detectPrefixSize)
+	if size < n {
+		n = size
+	}
+	d := &detectReader{r: r, size: size, prefix: make([]byte, n)}
+	read, err := r.ReadAt(d.prefix, 0)
+	d.prefix = d.prefix[:read]
+	if err != nil && !(err == io.EOF && int64(read) == n) {
+		d.err = err
+	}
+	return d
+}
+
+func (d *detectReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= 0 && off+int64(len(p)) <= int64(len(d.prefix)) {
+		return copy(p, d.prefix[off:]), nil
+	}
+	// The prefix holds the whole file, so the read runs past its end
+	if off >= 0 && int64(len(d.prefix)) == d.size {
+		if off >= d.size {
+			return 0, io.EOF
+		}
+		return copy(p, d.prefix[off:]), io.EOF
+	}
+	if off < int64(len(d.prefix)) && d.err != nil {
+		return 0, d.err
+	}
+
+	if d.reads >= maxDetectReads {
+		return 0, errDetectReadsExhausted
+	}
+	d.reads++
+	return d.r.ReadAt(p, off)
+}
+
 // Global registry instance
 var globalRegistry = NewRegistry()
 
@@ -113,6 +566,11 @@ func RegisterFormat(format Format) {
 	globalRegistry.Register(format)
 }
 
+// UnregisterFormat removes a format from the global registry
+func UnregisterFormat(name string) {
+	globalRegistry.Unregister(name)
+}
+
 // GetFormat retrieves a format from the global registry
 func GetFormat(name string) (Format, bool) {
 	return globalRegistry.Get(name)
@@ -123,6 +581,11 @@ func DetectFormat(ctx context.Context, reader io.ReaderAt, size int64, extension
 	return globalRegistry.DetectFormat(ctx, reader, size, extension)
 }
 
+// FormatForExtension looks up a format by extension in the global registry
+func FormatForExtension(extension string) (Format, bool) {
+	return globalRegistry.FormatForExtension(extension)
+}
+
 // Common errors
 var (
 	ErrFormatNotDetected = &FormatError{Message: "unable to detect archive format"}
@@ -130,6 +593,10 @@ var (
 	ErrPasswordRequired  = &FormatError{Message: "password required"}
 	ErrFileNotFound      = &FormatError{Message: "file not found in archive"}
 	ErrNotSupported      = &FormatError{Message: "operation not supported"}
+	ErrUnsupportedMethod = &FormatError{Message: "unsupported compression method"}
+
+	// ErrEncryptedContainer means the whole file is encrypted, see DetectEncryptedContainer
+	ErrEncryptedContainer = &FormatError{Message: "archive is encrypted as a whole file"}
 )
 
 // FormatError represents a format-specific error
@@ -148,3 +615,21 @@ func (e *FormatError) Error() string {
 func (e *FormatError) Unwrap() error {
 	return e.Cause
 }
+
+// UnsupportedMethodError reports a member compressed with a method that
+// can't be decompressed. It matches ErrUnsupportedMethod with errors.Is.
+type UnsupportedMethodError struct {
+	Method uint64 // Format-specific method ID, 0 if the format doesn't expose it
+	Name   string // Readable method name (e.g. "LZMA2"), empty if unknown
+}
+
+func (e *UnsupportedMethodError) Error() string {
+	if e.Name == "" {
+		return ErrUnsupportedMethod.Message
+	}
+	return ErrUnsupportedMethod.Message + " " + e.Name
+}
+
+func (e *UnsupportedMethodError) Unwrap() error {
+	return ErrUnsupportedMethod
+}
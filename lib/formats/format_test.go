@@ -0,0 +1,643 @@
+package formats
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yeka/zip"
+
+	"github.com/NORMAL-EX/stream-7z/internal/testarchive"
+)
+
+func TestMatchesInnerPath(t *testing.T) {
+	tests := []struct {
+		entry     string
+		innerPath string
+		expected  bool
+	}{
+		{"docs/a.txt", "", true},
+		{"docs/sub/b.txt", "", true},
+		{"readme.txt", "/", true},
+		{"docs/", "/", true},
+		{"docs/a.txt", "/", false},
+		{"docs/a.txt", "docs", true},
+		{"docs/a.txt", "docs/", true},
+		{"docs/a.txt", "/docs/", true},
+		{"./docs/a.txt", "docs/", true},
+		{"docs/sub/", "docs/", true},
+		{"docs/sub/b.txt", "docs/", false},
+		{"docs/", "docs/", false},
+		{"docsextra/a.txt", "docs", false},
+	}
+
+	for _, test := range tests {
+		result := MatchesInnerPath(test.entry, test.innerPath)
+		if result != test.expected {
+			t.Errorf("MatchesInnerPath(%q, %q) = %v, expected %v", test.entry, test.innerPath, result, test.expected)
+		}
+	}
+}
+
+func TestLimitDepth(t *testing.T) {
+	var entries []FileEntry
+	for _, p := range []string{"readme.txt", "docs/", "docs/a.txt", "docs/sub/", "docs/sub/b.txt", "docs/sub/deep/c.txt"} {
+		entries = append(entries, FileEntry{Path: p})
+	}
+
+	tests := []struct {
+		innerPath string
+		maxDepth  int
+		expected  []string
+	}{
+		{"", 1, []string{"readme.txt", "docs/"}},
+		{"", 2, []string{"readme.txt", "docs/", "docs/a.txt", "docs/sub/"}},
+		{"", 0, []string{"readme.txt", "docs/", "docs/a.txt", "docs/sub/", "docs/sub/b.txt", "docs/sub/deep/c.txt"}},
+		{"/docs/", 1, []string{"docs/a.txt", "docs/sub/"}},
+		{"docs", 2, []string{"docs/a.txt", "docs/sub/", "docs/sub/b.txt"}},
+	}
+
+	for _, test := range tests {
+		var paths []string
+		// LimitDepth only drops entries, so it needs the full listing
+		for _, entry := range LimitDepth(entries, test.innerPath, test.maxDepth) {
+			if EntryDepth(entry.Path, test.innerPath) > 0 {
+				paths = append(paths, entry.Path)
+			}
+		}
+		if !reflect.DeepEqual(paths, test.expected) {
+			t.Errorf("LimitDepth(%q, %d) = %v, expected %v", test.innerPath, test.maxDepth, paths, test.expected)
+		}
+	}
+}
+
+func TestFilterTree(t *testing.T) {
+	reader := bytes.NewReader(testarchive.Tar(t, testarchive.Files("readme.txt", "docs/", "docs/a.txt", "docs/sub/", "docs/sub/b.txt", "docs/sub/deep/c.txt", "Src/main.go")...))
+	entries, err := NewTarFormat().ListFiles(context.Background(), reader, reader.Size(), "", "")
+	if err != nil {
+		t.Fatalf("ListFiles failed: %v", err)
+	}
+
+	tests := []struct {
+		innerPath string
+		maxDepth  int
+		fold      bool
+		expected  []string
+	}{
+		{"", 1, false, []string{"readme.txt", "docs/"}},
+		{"/", 1, false, []string{"readme.txt", "docs/"}},
+		{"docs", 1, false, []string{"docs/a.txt", "docs/sub/"}},
+		{"/docs/", 2, false, []string{"docs/a.txt", "docs/sub/", "docs/sub/b.txt"}},
+		{"docs/sub", 0, false, []string{"docs/sub/b.txt", "docs/sub/deep/c.txt"}},
+		{"src", 1, false, nil},
+		{"src", 1, true, []string{"Src/main.go"}},
+		{"docs", 1, true, []string{"docs/a.txt", "docs/sub/"}},
+	}
+	for _, test := range tests {
+		filter := FilterTree
+		if test.fold {
+			filter = FilterTreeFold
+		}
+		var paths []string
+		for _, entry := range filter(entries, test.innerPath, test.maxDepth) {
+			paths = append(paths, entry.Path)
+		}
+		if !reflect.DeepEqual(paths, test.expected) {
+			t.Errorf("FilterTree(%q, %d, fold %v) = %v, expected %v", test.innerPath, test.maxDepth, test.fold, paths, test.expected)
+		}
+	}
+}
+
+func TestHideEmptyDirs(t *testing.T) {
+	paths := []string{
+		"empty/", "empty/a/", "empty/a/b/", "empty/a/b/c/", "empty/a/b/c/d/",
+		"deep/", "deep/a/", "deep/a/b/", "deep/a/b/c/", "deep/a/b/c/file.txt",
+		"mixed/", "mixed/notes.txt", "mixed/sub/", "mixed/sub/sub/",
+		"readme.txt",
+	}
+	reader := bytes.NewReader(testarchive.Tar(t, testarchive.Files(paths...)...))
+	files, err := NewTarFormat().ListFiles(context.Background(), reader, reader.Size(), "", "")
+	if err != nil {
+		t.Fatalf("ListFiles failed: %v", err)
+	}
+
+	var got []string
+	for _, entry := range HideEmptyDirs(files) {
+		got = append(got, entry.Path)
+	}
+	expected := []string{
+		"deep/", "deep/a/", "deep/a/b/", "deep/a/b/c/", "deep/a/b/c/file.txt",
+		"mixed/", "mixed/notes.txt",
+		"readme.txt",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("HideEmptyDirs = %v, expected %v", got, expected)
+	}
+
+	// The direct children of a directory hold none of the files below
+	// their subdirectories; those are looked for in the full listing
+	got = nil
+	for _, entry := range HideEmptyDirsIn(FilterEntries(files, "deep/a"), files) {
+		got = append(got, entry.Path)
+	}
+	if expected := []string{"deep/a/b/"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("HideEmptyDirsIn = %v, expected %v", got, expected)
+	}
+	got = nil
+	for _, entry := range HideEmptyDirsIn(FilterEntries(files, "mixed"), files) {
+		got = append(got, entry.Path)
+	}
+	if expected := []string{"mixed/notes.txt"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("HideEmptyDirsIn = %v, expected %v", got, expected)
+	}
+}
+
+func TestSortTree(t *testing.T) {
+	var entries []FileEntry
+	for _, p := range []string{"b.txt", "docs/z.md", "A.txt", "docs/", "src/main.go", "docs/api/", "a.txt", "docs/api/v1.md", "docs/a.md", "empty/"} {
+		entries = append(entries, FileEntry{Path: p, IsDir: strings.HasSuffix(p, "/")})
+	}
+
+	SortTree(entries)
+	var got []string
+	for _, entry := range entries {
+		got = append(got, entry.Path)
+	}
+	// src has no entry of its own but still sorts as a directory
+	expected := []string{
+		"docs/", "docs/api/", "docs/api/v1.md", "docs/a.md", "docs/z.md",
+		"empty/",
+		"src/main.go",
+		"A.txt", "a.txt", "b.txt",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("SortTree = %v, expected %v", got, expected)
+	}
+}
+
+func TestListFilesTrailingSlash(t *testing.T) {
+	paths := []string{"readme.txt", "docs/", "docs/a.txt", "docs/sub/", "docs/sub/b.txt"}
+
+	var zipEntries []testarchive.Entry
+	for _, p := range paths {
+		zipEntries = append(zipEntries, testarchive.Entry{Name: p, Method: zip.Store})
+	}
+
+	archives := []struct {
+		format Format
+		reader *bytes.Reader
+	}{
+		{NewZipFormat(), bytes.NewReader(testarchive.Zip(t, zipEntries...))},
+		{NewTarFormat(), bytes.NewReader(testarchive.Tar(t, testarchive.Files(paths...)...))},
+	}
+
+	for _, archive := range archives {
+		list := func(innerPath string) []string {
+			files, err := archive.format.ListFiles(context.Background(), archive.reader, archive.reader.Size(), innerPath, "")
+			if err != nil {
+				t.Fatalf("%s: ListFiles(%q) failed: %v", archive.format.Name(), innerPath, err)
+			}
+			names := make([]string, 0, len(files))
+			for _, f := range files {
+				names = append(names, f.Path)
+			}
+			return names
+		}
+
+		expected := []string{"docs/a.txt", "docs/sub/"}
+		for _, innerPath := range []string{"docs", "docs/", "/docs/"} {
+			if names := list(innerPath); !reflect.DeepEqual(names, expected) {
+				t.Errorf("%s: ListFiles(%q) = %v, expected %v", archive.format.Name(), innerPath, names, expected)
+			}
+		}
+
+		if names := list(""); len(names) != len(paths) {
+			t.Errorf("%s: ListFiles(\"\") = %v, expected all entries", archive.format.Name(), names)
+		}
+		if names := list("/"); !reflect.DeepEqual(names, []string{"readme.txt", "docs/"}) {
+			t.Errorf("%s: ListFiles(\"/\") = %v, expected the root entries", archive.format.Name(), names)
+		}
+	}
+}
+
+func TestTarGetInfoIgnoresPassword(t *testing.T) {
+	tarReader := bytes.NewReader(testarchive.Tar(t, testarchive.Files("a.txt")...))
+	info, err := NewTarFormat().GetInfo(context.Background(), tarReader, tarReader.Size(), "habit")
+	if err != nil {
+		t.Fatalf("expected GetInfo to ignore the password, got %v", err)
+	}
+	if info.TotalFiles != 1 || info.IsEncrypted {
+		t.Errorf("expected 1 unencrypted file, got %d (encrypted %v)", info.TotalFiles, info.IsEncrypted)
+	}
+}
+
+// lzmaSevenZip is a 7z archive compressed with LZMA holding something.txt
+// and two empty files (issue87.7z of github.com/bodgit/sevenzip)
+const lzmaSevenZip = "377abcaf271c00035156fc708200000000000000210000000000000073a5d6be" +
+	"00188c82b33a77a0000000813307ae0fe0ec726362d37a3c2975558c5c4d6182" +
+	"7a4ddc5282029d901aaa8f282a537873e5302b32cfe5b21fae507c1ad2fc0604" +
+	"a2c5f1be42b8d38737ad6a24f600fa7f46e43c257d7d967510fd48e7da6e5e64" +
+	"cf77c37df6b02d5045d0704959f531573fd9b515e8538a2dddd091bc7a3ac800" +
+	"000017060901097900070b01000123030101055d001000000c80a80a01520d5a" +
+	"9f0000"
+
+func TestSevenZipGetInfoMethod(t *testing.T) {
+	data, err := hex.DecodeString(lzmaSevenZip)
+	if err != nil {
+		t.Fatalf("failed to decode archive: %v", err)
+	}
+	info, err := NewSevenZipFormat().GetInfo(context.Background(), bytes.NewReader(data), int64(len(data)), "")
+	if err != nil {
+		t.Fatalf("GetInfo failed: %v", err)
+	}
+	if info.Metadata["method"] != "LZMA" {
+		t.Errorf("expected method LZMA, got %q (metadata %v)", info.Metadata["method"], info.Metadata)
+	}
+}
+
+func TestGetInfoAccessFlags(t *testing.T) {
+	ctx := context.Background()
+
+	zipReader := bytes.NewReader(testarchive.Zip(t, testarchive.Entry{Name: "a.txt", Content: "a", Method: zip.Deflate}))
+	info, err := NewZipFormat().GetInfo(ctx, zipReader, zipReader.Size(), "")
+	if err != nil {
+		t.Fatalf("zip GetInfo failed: %v", err)
+	}
+	if !info.RandomAccess || info.Solid {
+		t.Errorf("zip: expected random access and not solid, got %v/%v", info.RandomAccess, info.Solid)
+	}
+
+	tarReader := bytes.NewReader(testarchive.Tar(t, testarchive.Files("a.txt")...))
+	info, err = NewTarFormat().GetInfo(ctx, tarReader, tarReader.Size(), "")
+	if err != nil {
+		t.Fatalf("tar GetInfo failed: %v", err)
+	}
+	if info.RandomAccess || info.Solid {
+		t.Errorf("tar: expected streaming and not solid, got %v/%v", info.RandomAccess, info.Solid)
+	}
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	tarReader.Seek(0, io.SeekStart)
+	io.Copy(gw, tarReader)
+	gw.Close()
+	tgzReader := bytes.NewReader(gz.Bytes())
+	info, err = NewTarFormat().GetInfo(ctx, tgzReader, tgzReader.Size(), "")
+	if err != nil {
+		t.Fatalf("tar.gz GetInfo failed: %v", err)
+	}
+	if info.RandomAccess || !info.Solid {
+		t.Errorf("tar.gz: expected streaming and solid, got %v/%v", info.RandomAccess, info.Solid)
+	}
+}
+
+func TestTarExtendedHeaders(t *testing.T) {
+	longName := "very/" + strings.Repeat("deeply-nested-directory/", 8) + "file.txt"
+	gnuName := "gnu/" + strings.Repeat("long-name-", 15) + ".txt"
+	modTime := time.Date(2024, 3, 1, 12, 30, 45, 123456789, time.UTC)
+
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	w.WriteHeader(&tar.Header{
+		Name:     longName,
+		Mode:     0o644,
+		Size:     1,
+		ModTime:  modTime,
+		Format:   tar.FormatPAX,
+		Typeflag: tar.TypeReg,
+		PAXRecords: map[string]string{
+			"SCHILY.xattr.user.comment":     "keep me",
+			"SCHILY.xattr.security.selinux": "system_u:object_r:user_home_t:s0",
+			"GOLANG.pkg":                    "custom",
+		},
+	})
+	w.Write([]byte("a"))
+	w.WriteHeader(&tar.Header{Name: gnuName, Mode: 0o644, Size: 1, Format: tar.FormatGNU, Typeflag: tar.TypeReg})
+	w.Write([]byte("b"))
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close tar writer: %v", err)
+	}
+	reader := bytes.NewReader(buf.Bytes())
+
+	files, err := NewTarFormat().ListFiles(context.Background(), reader, reader.Size(), "", "")
+	if err != nil {
+		t.Fatalf("ListFiles failed: %v", err)
+	}
+	if len(files) != 2 || files[0].Path != longName || files[1].Path != gnuName {
+		t.Fatalf("expected the long names to be read in full, got %+v", files)
+	}
+
+	pax := files[0]
+	wantXattrs := map[string]string{
+		"user.comment":     "keep me",
+		"security.selinux": "system_u:object_r:user_home_t:s0",
+	}
+	if !reflect.DeepEqual(pax.Xattrs, wantXattrs) {
+		t.Errorf("expected xattrs %v, got %v", wantXattrs, pax.Xattrs)
+	}
+	if pax.PAXRecords["GOLANG.pkg"] != "custom" || pax.PAXRecords["path"] != longName {
+		t.Errorf("unexpected PAX records %v", pax.PAXRecords)
+	}
+	if !pax.ModTime.Equal(modTime) {
+		t.Errorf("expected sub-second mtime %v, got %v", modTime, pax.ModTime)
+	}
+	if files[1].Xattrs != nil || files[1].PAXRecords != nil {
+		t.Errorf("expected no PAX data for the GNU entry, got %+v", files[1])
+	}
+
+	// Walk reports the same entries
+	var walked []FileEntry
+	NewTarFormat().Walk(context.Background(), reader, reader.Size(), "", func(entry FileEntry) error {
+		walked = append(walked, entry)
+		return nil
+	})
+	if !reflect.DeepEqual(walked, files) {
+		t.Errorf("expected Walk to match ListFiles, got %+v", walked)
+	}
+}
+
+func TestEmptyArchives(t *testing.T) {
+	ctx := context.Background()
+
+	var zipBuf bytes.Buffer
+	zip.NewWriter(&zipBuf).Close()
+
+	var tarBuf bytes.Buffer
+	tar.NewWriter(&tarBuf).Close()
+	var tgz bytes.Buffer
+	gw := gzip.NewWriter(&tgz)
+	gw.Write(tarBuf.Bytes())
+	gw.Close()
+
+	// 7-Zip writes an empty archive as a bare signature header
+	sevenZip := make([]byte, sevenZipSignatureSize)
+	copy(sevenZip, []byte{'7', 'z', 0xBC, 0xAF, 0x27, 0x1C, 0, 4})
+	binary.LittleEndian.PutUint32(sevenZip[8:], crc32.ChecksumIEEE(sevenZip[12:]))
+
+	archives := []struct {
+		name   string
+		format string
+		data   []byte
+	}{
+		{"zip", "zip", zipBuf.Bytes()},
+		{"tar", "tar", tarBuf.Bytes()},
+		{"tar (10240-byte record)", "tar", make([]byte, tarRecordSize)},
+		{"tar.gz", "tar", tgz.Bytes()},
+		{"7z", "7z", sevenZip},
+	}
+
+	for _, archive := range archives {
+		reader := bytes.NewReader(archive.data)
+		size := reader.Size()
+
+		format, err := DetectFormat(ctx, reader, size, "")
+		if err != nil {
+			t.Errorf("%s: expected the empty archive to be detected, got %v", archive.name, err)
+			continue
+		}
+		if format.Name() != archive.format {
+			t.Errorf("%s: detected as %s", archive.name, format.Name())
+			continue
+		}
+
+		info, err := format.GetInfo(ctx, reader, size, "")
+		if err != nil {
+			t.Errorf("%s: GetInfo failed: %v", archive.name, err)
+		} else if info.TotalFiles != 0 || info.TotalSize != 0 {
+			t.Errorf("%s: expected no files, got %d (%d bytes)", archive.name, info.TotalFiles, info.TotalSize)
+		}
+
+		for _, innerPath := range []string{"", "/"} {
+			files, err := format.ListFiles(ctx, reader, size, innerPath, "")
+			if err != nil || len(files) != 0 {
+				t.Errorf("%s: ListFiles(%q) = %v, %v; expected no files", archive.name, innerPath, files, err)
+			}
+		}
+
+		if _, _, err := format.ExtractFile(ctx, reader, size, "a.txt", ""); err != ErrFileNotFound {
+			t.Errorf("%s: expected ErrFileNotFound, got %v", archive.name, err)
+		}
+	}
+}
+
+func TestDebugInfo(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("zip", func(t *testing.T) {
+		reader := bytes.NewReader(testarchive.Zip(t, []testarchive.Entry{
+			{Name: "a.txt", Content: "alpha", Method: zip.Deflate},
+			{Name: "b.txt", Content: "beta", Method: zip.Store},
+		}...))
+		info, err := (&ZipFormat{}).DebugInfo(ctx, reader, reader.Size(), "")
+		if err != nil {
+			t.Fatalf("DebugInfo failed: %v", err)
+		}
+
+		dirOffset := info["centralDirectoryOffset"].(uint64)
+		dirSize := info["centralDirectorySize"].(uint64)
+		if eocd := info["eocdOffset"].(int64); uint64(eocd) != dirOffset+dirSize || eocd != reader.Size()-22 {
+			t.Errorf("expected the EOCD to follow the central directory, got %d (directory %d+%d)", eocd, dirOffset, dirSize)
+		}
+		if n := info["entries"].(uint64); n != 2 {
+			t.Errorf("expected 2 entries, got %d", n)
+		}
+
+		files := info["files"].([]map[string]interface{})
+		if len(files) != 2 {
+			t.Fatalf("expected 2 files, got %d", len(files))
+		}
+		if files[0]["name"] != "a.txt" || files[0]["localHeaderOffset"].(uint64) != 0 || files[0]["method"] != "Deflate" {
+			t.Errorf("unexpected first entry %v", files[0])
+		}
+		if files[1]["localHeaderOffset"].(uint64) == 0 || files[1]["method"] != "Store" {
+			t.Errorf("unexpected second entry %v", files[1])
+		}
+		if _, ok := files[0]["flags"]; !ok {
+			t.Error("expected the entry flags to be reported")
+		}
+	})
+
+	t.Run("tar", func(t *testing.T) {
+		reader := bytes.NewReader(testarchive.Tar(t, testarchive.Files("a.txt", "dir/b.txt")...))
+		info, err := (&TarFormat{}).DebugInfo(ctx, reader, reader.Size(), "")
+		if err != nil {
+			t.Fatalf("DebugInfo failed: %v", err)
+		}
+
+		files := info["files"].([]map[string]interface{})
+		if len(files) != 2 {
+			t.Fatalf("expected 2 files, got %d", len(files))
+		}
+		if files[0]["headerOffset"].(int64) != 0 || files[0]["dataOffset"].(int64) != 512 {
+			t.Errorf("unexpected first entry %v", files[0])
+		}
+		if off := files[1]["headerOffset"].(int64); off == 0 || off%512 != 0 {
+			t.Errorf("expected the second header on a block boundary, got %d", off)
+		}
+		if _, ok := info["endOffset"]; !ok {
+			t.Error("expected the end of the archive to be reported")
+		}
+	})
+
+	t.Run("7z", func(t *testing.T) {
+		sevenZip := make([]byte, sevenZipSignatureSize)
+		copy(sevenZip, []byte{'7', 'z', 0xBC, 0xAF, 0x27, 0x1C, 0, 4})
+		binary.LittleEndian.PutUint32(sevenZip[8:], crc32.ChecksumIEEE(sevenZip[12:]))
+
+		reader := bytes.NewReader(sevenZip)
+		info, err := (&SevenZipFormat{}).DebugInfo(ctx, reader, reader.Size(), "")
+		if err != nil {
+			t.Fatalf("DebugInfo failed: %v", err)
+		}
+		if info["version"] != "0.4" || info["startHeaderCRCValid"] != true {
+			t.Errorf("unexpected signature header %v", info)
+		}
+		if _, ok := info["nextHeaderOffset"]; !ok {
+			t.Error("expected the next header offset to be reported")
+		}
+	})
+}
+
+// stubFormat is a format that detects every file when detects is set and
+// none otherwise
+type stubFormat struct {
+	name    string
+	detects bool
+}
+
+func (s stubFormat) Name() string         { return s.name }
+func (s stubFormat) Extensions() []string { return []string{"." + s.name} }
+
+func (s stubFormat) Detect(ctx context.Context, reader io.ReaderAt, size int64) (bool, error) {
+	return s.detects, nil
+}
+
+func (stubFormat) GetInfo(ctx context.Context, reader io.ReaderAt, size int64, password string) (*ArchiveInfo, error) {
+	return nil, ErrNotSupported
+}
+
+func (stubFormat) ListFiles(ctx context.Context, reader io.ReaderAt, size int64, innerPath string, password string) ([]FileEntry, error) {
+	return nil, ErrNotSupported
+}
+
+func (stubFormat) ExtractFile(ctx context.Context, reader io.ReaderAt, size int64, filePath string, password string) (io.ReadCloser, int64, error) {
+	return nil, 0, ErrNotSupported
+}
+
+// Run with -race to check the registry's locking
+func TestRegistryConcurrentRegistration(t *testing.T) {
+	registry := NewRegistry()
+	registry.Register(NewZipFormat())
+	registry.Register(NewTarFormat())
+
+	zipData := bytes.NewReader(testarchive.Zip(t, testarchive.Entry{Name: "a.txt", Content: "alpha"}))
+	tarData := bytes.NewReader(testarchive.Tar(t, testarchive.Files("a.txt")...))
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(2)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				registry.Register(stubFormat{name: fmt.Sprintf("stub%d-%d", g, i)})
+			}
+		}(g)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				if format, err := registry.DetectFormat(context.Background(), zipData, zipData.Size(), ".zip"); err != nil || format.Name() != "zip" {
+					t.Errorf("expected zip, got %v (%v)", format, err)
+					return
+				}
+				if format, err := registry.DetectFormat(context.Background(), tarData, tarData.Size(), ""); err != nil || format.Name() != "tar" {
+					t.Errorf("expected tar, got %v (%v)", format, err)
+					return
+				}
+				registry.FormatForExtension(".zip")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := len(registry.GetAllFormats()); n != 2+4*50 {
+		t.Errorf("expected %d formats, got %d", 2+4*50, n)
+	}
+	if _, ok := registry.Get("stub3-49"); !ok {
+		t.Error("expected a format registered at runtime to be found")
+	}
+}
+
+// countingReaderAt counts the ReadAt calls made on it
+type countingReaderAt struct {
+	r     io.ReaderAt
+	reads int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	c.reads++
+	return c.r.ReadAt(p, off)
+}
+
+func TestDetectFormatOrderAndReads(t *testing.T) {
+	ctx := context.Background()
+
+	// Of several matching formats the first registered wins, every time
+	registry := NewRegistry()
+	for _, name := range []string{"first", "second", "third"} {
+		registry.Register(stubFormat{name: name, detects: true})
+	}
+	registry.Register(stubFormat{name: "first", detects: true}) // Keeps its place
+	for i := 0; i < 20; i++ {
+		format, err := registry.DetectFormat(ctx, bytes.NewReader([]byte("data")), 4, "")
+		if err != nil || format.Name() != "first" {
+			t.Fatalf("expected first, got %v (%v)", format, err)
+		}
+	}
+	if format, _ := registry.DetectFormat(ctx, bytes.NewReader([]byte("data")), 4, ".third"); format.Name() != "third" {
+		t.Errorf("expected the format claiming the extension to be tried first, got %s", format.Name())
+	}
+
+	// Once removed a format is neither detected nor listed
+	registry.Unregister("first")
+	if format, _ := registry.DetectFormat(ctx, bytes.NewReader([]byte("data")), 4, ""); format.Name() != "second" {
+		t.Errorf("expected second after removing first, got %s", format.Name())
+	}
+	if _, ok := registry.Get("first"); ok || len(registry.GetAllFormats()) != 2 {
+		t.Errorf("expected first to be gone, got %d formats", len(registry.GetAllFormats()))
+	}
+
+	// A file that isn't an archive is read once, whatever its size
+	blob := bytes.Repeat([]byte("not an archive "), 1<<16)
+	for _, size := range []int{100, len(blob)} {
+		reader := &countingReaderAt{r: bytes.NewReader(blob[:size])}
+		if _, err := DetectFormat(ctx, reader, int64(size), ""); err != ErrFormatNotDetected {
+			t.Errorf("%d bytes: expected ErrFormatNotDetected, got %v", size, err)
+		}
+		if reader.reads != 1 {
+			t.Errorf("%d bytes: expected a single read, got %d", size, reader.reads)
+		}
+	}
+
+	// Reads past the prefix are capped
+	detect := newDetectReader(bytes.NewReader(blob), int64(len(blob)))
+	p := make([]byte, 10)
+	for i := 0; i < maxDetectReads; i++ {
+		if _, err := detect.ReadAt(p, int64(detectPrefixSize+i)); err != nil {
+			t.Fatalf("read %d failed: %v", i, err)
+		}
+	}
+	if _, err := detect.ReadAt(p, detectPrefixSize); err != errDetectReadsExhausted {
+		t.Errorf("expected the read limit to be reached, got %v", err)
+	}
+}
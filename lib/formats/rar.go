@@ -3,6 +3,7 @@ package formats
 import (
 	"context"
 	"io"
+	"strconv"
 	"strings"
 
 	"github.com/NORMAL-EX/stream-7z/lib/utils"
@@ -27,6 +28,12 @@ func (r *RarFormat) Extensions() []string {
 	return []string{".rar"}
 }
 
+// ExactSizes reports false: a RAR header may flag its unpacked size as
+// unknown, and multi-volume members can declare a size that doesn't match
+func (r *RarFormat) ExactSizes() bool {
+	return false
+}
+
 // Detect checks if the reader contains a RAR archive
 func (r *RarFormat) Detect(ctx context.Context, reader io.ReaderAt, size int64) (bool, error) {
 	// Check RAR magic numbers
@@ -75,8 +82,12 @@ func (r *RarFormat) GetInfo(ctx context.Context, reader io.ReaderAt, size int64,
 		TotalFiles:       0,
 		TotalSize:        0,
 		Files:            make([]FileEntry, 0),
+		Metadata:         make(map[string]string),
 	}
 
+	// rardecode doesn't expose the archive comment, so Comment stays empty
+	solid := false
+
 	for {
 		header, err := rarReader.Next()
 		if err == io.EOF {
@@ -95,8 +106,8 @@ func (r *RarFormat) GetInfo(ctx context.Context, reader io.ReaderAt, size int64,
 			return nil, utils.WrapError(err, "failed to read RAR header")
 		}
 
-		// Check if this file is encrypted (using HostOS as a proxy check since IsEncrypted field doesn't exist)
-		// RAR encryption is detected via errors, so we rely on the error handling above
+		// rardecode has no per-file encryption flag; encrypted headers surface as
+		// password errors above, so entries that parse are reported unencrypted
 		
 		entry := FileEntry{
 			Path:           header.Name,
@@ -108,12 +119,22 @@ func (r *RarFormat) GetInfo(ctx context.Context, reader io.ReaderAt, size int64,
 
 		info.Files = append(info.Files, entry)
 
+		if header.Solid {
+			solid = true
+		}
+
 		if !header.IsDir {
 			info.TotalFiles++
 			info.TotalSize += entry.Size
+			info.TotalCompressedSize += entry.CompressedSize
 		}
 	}
 
+	info.Metadata["solid"] = strconv.FormatBool(solid)
+	// Extraction always reads the archive sequentially from the start
+	info.Solid = solid
+	info.RandomAccess = false
+
 	if info.IsEncrypted && password == "" {
 		info.RequiresPassword = true
 		return info, ErrPasswordRequired
@@ -139,11 +160,6 @@ func (r *RarFormat) ListFiles(ctx context.Context, reader io.ReaderAt, size int6
 		return nil, utils.WrapError(err, "failed to open RAR archive")
 	}
 
-	innerPath = utils.NormalizePath(innerPath)
-	if innerPath != "" {
-		innerPath = innerPath + "/"
-	}
-
 	files := make([]FileEntry, 0)
 
 	for {
@@ -161,23 +177,8 @@ func (r *RarFormat) ListFiles(ctx context.Context, reader io.ReaderAt, size int6
 			return nil, utils.WrapError(err, "failed to read RAR header")
 		}
 
-		normalizedName := utils.NormalizePath(header.Name)
-
-		// Filter by inner path
-		if innerPath != "" {
-			if innerPath == "/" {
-				if strings.Contains(strings.TrimSuffix(normalizedName, "/"), "/") {
-					continue
-				}
-			} else {
-				if !strings.HasPrefix(normalizedName, innerPath) {
-					continue
-				}
-				relativePath := strings.TrimPrefix(normalizedName, innerPath)
-				if strings.Contains(strings.TrimSuffix(relativePath, "/"), "/") {
-					continue
-				}
-			}
+		if !MatchesInnerPath(header.Name, innerPath) {
+			continue
 		}
 
 		files = append(files, FileEntry{
@@ -229,6 +230,9 @@ func (r *RarFormat) ExtractFile(ctx context.Context, reader io.ReaderAt, size in
 		if utils.NormalizePath(header.Name) == filePath {
 			// RAR reader doesn't support seeking, so we need to read the entire file
 			// into memory or a temp file
+			if header.UnKnownSize {
+				return io.NopCloser(rarReader), -1, nil
+			}
 			return io.NopCloser(rarReader), header.UnPackedSize, nil
 		}
 	}
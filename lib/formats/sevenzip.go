@@ -2,7 +2,12 @@ package formats
 
 import (
 	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
 	"io"
+	"reflect"
+	"strconv"
 	"strings"
 
 	"github.com/NORMAL-EX/stream-7z/lib/utils"
@@ -44,16 +49,117 @@ func (s *SevenZipFormat) Detect(ctx context.Context, reader io.ReaderAt, size in
 	return false, nil
 }
 
+// sevenZipSignatureSize is the length of the 7z signature header
+const sevenZipSignatureSize = 32
+
+// openSevenZip opens a 7z archive. An empty archive, as written by 7-Zip,
+// is only a signature header pointing to no header at all, which the
+// decoder rejects; it is opened as a reader without files instead.
+func openSevenZip(reader io.ReaderAt, size int64, password string) (*sevenzip.Reader, error) {
+	if size == sevenZipSignatureSize {
+		header := make([]byte, sevenZipSignatureSize)
+		if _, err := reader.ReadAt(header, 0); err == nil && isEmptySevenZip(header) {
+			return &sevenzip.Reader{}, nil
+		}
+	}
+	if password != "" {
+		return sevenzip.NewReaderWithPassword(reader, size, password)
+	}
+	return sevenzip.NewReader(reader, size)
+}
+
+// isEmptySevenZip reports whether a signature header has a valid CRC and
+// no next header (offset, size and CRC all zero)
+func isEmptySevenZip(header []byte) bool {
+	if crc32.ChecksumIEEE(header[12:32]) != binary.LittleEndian.Uint32(header[8:12]) {
+		return false
+	}
+	for _, b := range header[12:32] {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// DebugInfo describes the 7z signature header, which locates the header
+// at the end of the archive, and how files are grouped into packed
+// streams. A header the decoder can't read, e.g. an encrypted one opened
+// without the password, is reported in openError instead of failing.
+func (s *SevenZipFormat) DebugInfo(ctx context.Context, reader io.ReaderAt, size int64, password string) (map[string]interface{}, error) {
+	header := make([]byte, sevenZipSignatureSize)
+	if _, err := reader.ReadAt(header, 0); err != nil {
+		return nil, utils.WrapError(err, "failed to read 7z signature header")
+	}
+
+	nextHeaderOffset := binary.LittleEndian.Uint64(header[12:])
+	info := map[string]interface{}{
+		"version":             strconv.Itoa(int(header[6])) + "." + strconv.Itoa(int(header[7])),
+		"startHeaderCRCValid": crc32.ChecksumIEEE(header[12:32]) == binary.LittleEndian.Uint32(header[8:12]),
+		// The offset is relative to the end of the signature header
+		"nextHeaderOffset": sevenZipSignatureSize + nextHeaderOffset,
+		"nextHeaderSize":   binary.LittleEndian.Uint64(header[20:]),
+		"nextHeaderCRC":    binary.LittleEndian.Uint32(header[28:]),
+	}
+
+	szReader, err := openSevenZip(reader, size, password)
+	if err != nil {
+		info["openError"] = err.Error()
+		return info, nil
+	}
+
+	// Files are grouped into packed streams (folders); a stream holding
+	// several files is a solid block
+	type streamLayout struct {
+		files int
+		size  uint64
+	}
+	layouts := make(map[int]*streamLayout)
+	var order []int
+	var files []map[string]interface{}
+	for _, file := range szReader.File {
+		if len(files) < maxDebugEntries {
+			files = append(files, map[string]interface{}{
+				"name":   file.Name,
+				"stream": file.Stream,
+				"size":   file.UncompressedSize,
+				"isDir":  file.FileInfo().IsDir(),
+			})
+		}
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		layout, ok := layouts[file.Stream]
+		if !ok {
+			layout = &streamLayout{}
+			layouts[file.Stream] = layout
+			order = append(order, file.Stream)
+		}
+		layout.files++
+		layout.size += file.UncompressedSize
+	}
+
+	streams := make([]map[string]interface{}, 0, len(order))
+	for _, stream := range order {
+		streams = append(streams, map[string]interface{}{
+			"stream": stream,
+			"files":  layouts[stream].files,
+			"size":   layouts[stream].size,
+		})
+	}
+	info["entries"] = len(szReader.File)
+	info["streams"] = streams
+	info["files"] = files
+	info["filesTruncated"] = len(files) < len(szReader.File)
+	return info, nil
+}
+
 // GetInfo retrieves metadata about the 7z archive
 func (s *SevenZipFormat) GetInfo(ctx context.Context, reader io.ReaderAt, size int64, password string) (*ArchiveInfo, error) {
 	var szReader *sevenzip.Reader
 	var err error
 
-	if password != "" {
-		szReader, err = sevenzip.NewReaderWithPassword(reader, size, password)
-	} else {
-		szReader, err = sevenzip.NewReader(reader, size)
-	}
+	szReader, err = openSevenZip(reader, size, password)
 
 	if err != nil {
 		// Check if error is due to password
@@ -77,8 +183,14 @@ func (s *SevenZipFormat) GetInfo(ctx context.Context, reader io.ReaderAt, size i
 		TotalFiles:       0,
 		TotalSize:        0,
 		Files:            make([]FileEntry, 0),
+		Metadata:         make(map[string]string),
+
+		TotalCompressedSize: size, // Entries have no compressed size of their own
 	}
 
+	// Files sharing a stream were compressed together (solid block)
+	streamFiles := make(map[int]int)
+
 	for _, file := range szReader.File {
 		// Check if file is encrypted
 		// Note: 7z library doesn't provide direct encrypted flag
@@ -96,12 +208,16 @@ func (s *SevenZipFormat) GetInfo(ctx context.Context, reader io.ReaderAt, size i
 			}
 		}
 
+		// Method is left empty: the decoder doesn't say which folder an
+		// empty file belongs to (the archive's method is in Metadata)
 		entry := FileEntry{
 			Path:           file.Name,
 			Size:           int64(file.UncompressedSize),
 			CompressedSize: 0, // 7z doesn't provide individual compressed size
 			ModTime:        file.Modified,
 			IsDir:          file.FileInfo().IsDir(),
+			IsEncrypted:    isEncrypted, // Best effort: only probed when no password is given
+			CRC32:          file.CRC32,
 		}
 
 		info.Files = append(info.Files, entry)
@@ -109,6 +225,7 @@ func (s *SevenZipFormat) GetInfo(ctx context.Context, reader io.ReaderAt, size i
 		if !entry.IsDir {
 			info.TotalFiles++
 			info.TotalSize += entry.Size
+			streamFiles[file.Stream]++
 		}
 
 		if isEncrypted {
@@ -116,6 +233,21 @@ func (s *SevenZipFormat) GetInfo(ctx context.Context, reader io.ReaderAt, size i
 		}
 	}
 
+	solid := false
+	for _, count := range streamFiles {
+		if count > 1 {
+			solid = true
+			break
+		}
+	}
+	info.Metadata["solid"] = strconv.FormatBool(solid)
+	info.Solid = solid
+	info.RandomAccess = !solid
+	info.Metadata["streams"] = strconv.Itoa(len(streamFiles))
+	if method := sevenZipMethod(szReader); method != "" {
+		info.Metadata["method"] = method
+	}
+
 	if info.IsEncrypted && password == "" {
 		return info, ErrPasswordRequired
 	}
@@ -128,11 +260,7 @@ func (s *SevenZipFormat) ListFiles(ctx context.Context, reader io.ReaderAt, size
 	var szReader *sevenzip.Reader
 	var err error
 
-	if password != "" {
-		szReader, err = sevenzip.NewReaderWithPassword(reader, size, password)
-	} else {
-		szReader, err = sevenzip.NewReader(reader, size)
-	}
+	szReader, err = openSevenZip(reader, size, password)
 
 	if err != nil {
 		if strings.Contains(err.Error(), "password") || strings.Contains(err.Error(), "encrypted") {
@@ -144,31 +272,11 @@ func (s *SevenZipFormat) ListFiles(ctx context.Context, reader io.ReaderAt, size
 		return nil, utils.WrapError(err, "failed to open 7z archive")
 	}
 
-	innerPath = utils.NormalizePath(innerPath)
-	if innerPath != "" {
-		innerPath = innerPath + "/"
-	}
-
 	files := make([]FileEntry, 0)
 
 	for _, file := range szReader.File {
-		normalizedName := utils.NormalizePath(file.Name)
-
-		// Filter by inner path
-		if innerPath != "" {
-			if innerPath == "/" {
-				if strings.Contains(strings.TrimSuffix(normalizedName, "/"), "/") {
-					continue
-				}
-			} else {
-				if !strings.HasPrefix(normalizedName, innerPath) {
-					continue
-				}
-				relativePath := strings.TrimPrefix(normalizedName, innerPath)
-				if strings.Contains(strings.TrimSuffix(relativePath, "/"), "/") {
-					continue
-				}
-			}
+		if !MatchesInnerPath(file.Name, innerPath) {
+			continue
 		}
 
 		files = append(files, FileEntry{
@@ -177,6 +285,7 @@ func (s *SevenZipFormat) ListFiles(ctx context.Context, reader io.ReaderAt, size
 			CompressedSize: 0,
 			ModTime:        file.Modified,
 			IsDir:          file.FileInfo().IsDir(),
+			CRC32:          file.CRC32,
 		})
 	}
 
@@ -188,11 +297,7 @@ func (s *SevenZipFormat) ExtractFile(ctx context.Context, reader io.ReaderAt, si
 	var szReader *sevenzip.Reader
 	var err error
 
-	if password != "" {
-		szReader, err = sevenzip.NewReaderWithPassword(reader, size, password)
-	} else {
-		szReader, err = sevenzip.NewReader(reader, size)
-	}
+	szReader, err = openSevenZip(reader, size, password)
 
 	if err != nil {
 		if strings.Contains(err.Error(), "password") || strings.Contains(err.Error(), "encrypted") {
@@ -216,6 +321,10 @@ func (s *SevenZipFormat) ExtractFile(ctx context.Context, reader io.ReaderAt, si
 					}
 					return nil, 0, ErrPasswordRequired
 				}
+				// The decoder doesn't say which of the folder's coders it lacks
+				if strings.Contains(err.Error(), "unsupported compression algorithm") {
+					return nil, 0, &UnsupportedMethodError{}
+				}
 				return nil, 0, utils.WrapError(err, "failed to open file")
 			}
 
@@ -226,6 +335,68 @@ func (s *SevenZipFormat) ExtractFile(ctx context.Context, reader io.ReaderAt, si
 	return nil, 0, ErrFileNotFound
 }
 
+// sevenZipCoderNames names the 7z coder IDs the decoder supports
+var sevenZipCoderNames = map[string]string{
+	"\x00":             "Copy",
+	"\x03":             "Delta",
+	"\x03\x01\x01":     "LZMA",
+	"\x03\x03\x01\x03": "BCJ",
+	"\x03\x03\x01\x1b": "BCJ2",
+	"\x03\x03\x02\x05": "PPC",
+	"\x03\x03\x05\x01": "ARM",
+	"\x03\x03\x08\x05": "SPARC",
+	"\x04\x01\x08":     "Deflate",
+	"\x04\x02\x02":     "BZip2",
+	"\x04\xf7\x11\x01": "Zstd",
+	"\x04\xf7\x11\x02": "Brotli",
+	"\x04\xf7\x11\x04": "LZ4",
+	"\x06\xf1\x07\x01": "7zAES",
+	"\x21":             "LZMA2",
+}
+
+// sevenZipMethod names the coders of the archive's first folder in the
+// order 7-Zip lists them, e.g. "LZMA2 BCJ", or returns "" when it has no
+// folders. The decoder keeps its folders unexported, so they are read
+// through reflection; a decoder laid out differently also yields "".
+func sevenZipMethod(szReader *sevenzip.Reader) string {
+	field := func(v reflect.Value, name string) reflect.Value {
+		for v.IsValid() && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}
+			}
+			v = v.Elem()
+		}
+		if !v.IsValid() || v.Kind() != reflect.Struct {
+			return reflect.Value{}
+		}
+		return v.FieldByName(name)
+	}
+
+	folders := field(field(reflect.ValueOf(szReader), "si"), "unpackInfo")
+	folders = field(folders, "folder")
+	if !folders.IsValid() || folders.Kind() != reflect.Slice || folders.Len() == 0 {
+		return ""
+	}
+	coders := field(folders.Index(0), "coder")
+	if !coders.IsValid() || coders.Kind() != reflect.Slice {
+		return ""
+	}
+
+	names := make([]string, 0, coders.Len())
+	for i := 0; i < coders.Len(); i++ {
+		id := field(coders.Index(i), "id")
+		if !id.IsValid() || id.Kind() != reflect.Slice || id.Type().Elem().Kind() != reflect.Uint8 {
+			return ""
+		}
+		name, ok := sevenZipCoderNames[string(id.Bytes())]
+		if !ok {
+			name = hex.EncodeToString(id.Bytes())
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, " ")
+}
+
 func init() {
 	RegisterFormat(NewSevenZipFormat())
 }
@@ -0,0 +1,196 @@
+package formats
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// sfxScanLimit bounds how far into an executable the embedded archive is
+// searched for when the PE overlay doesn't point at it
+const sfxScanLimit = 4 << 20
+
+// sfxChunkSize is the size of each read while scanning for a signature
+const sfxChunkSize = 256 << 10
+
+// sfxSignatures are the start-of-archive markers an SFX payload may begin with
+var sfxSignatures = [][]byte{
+	zipLocalSignature,
+	sevenZipSignature,
+	rarSignature,
+}
+
+var (
+	zipLocalSignature = []byte{'P', 'K', 0x03, 0x04}
+	sevenZipSignature = []byte{0x37, 0x7A, 0xBC, 0xAF, 0x27, 0x1C}
+	rarSignature      = []byte{'R', 'a', 'r', '!', 0x1A, 0x07} // RAR 4.x and 5.x
+)
+
+// FindSFXPayload locates the archive embedded in a self-extracting
+// executable (a PE stub with a ZIP, 7z or RAR archive appended).
+// It first checks the PE overlay, i.e. the data after the last section,
+// then scans the first few MB for an archive signature. The stub's code
+// or resources may hold a signature too, so a signature only counts if
+// the archive headers after it check out.
+func FindSFXPayload(ctx context.Context, reader io.ReaderAt, size int64) (int64, bool) {
+	header := make([]byte, 4096)
+	n, err := reader.ReadAt(header, 0)
+	if n < 2 && err != nil {
+		return 0, false
+	}
+	header = header[:n]
+
+	if !bytes.HasPrefix(header, []byte("MZ")) {
+		return 0, false
+	}
+
+	if overlay, ok := peOverlayOffset(header); ok && overlay < size {
+		if validSFXPayload(reader, overlay, size) {
+			return overlay, true
+		}
+	}
+
+	return scanSFXSignature(ctx, reader, size)
+}
+
+// peOverlayOffset returns the end of the last PE section, parsed from the
+// start of the file. ok is false if the headers don't fit in header.
+func peOverlayOffset(header []byte) (int64, bool) {
+	if len(header) < 0x40 {
+		return 0, false
+	}
+
+	peOffset := int64(binary.LittleEndian.Uint32(header[0x3C:]))
+	if peOffset+24 > int64(len(header)) || !bytes.Equal(header[peOffset:peOffset+4], []byte("PE\x00\x00")) {
+		return 0, false
+	}
+
+	coff := header[peOffset+4:]
+	numSections := int64(binary.LittleEndian.Uint16(coff[2:]))
+	optionalHeaderSize := int64(binary.LittleEndian.Uint16(coff[16:]))
+
+	sectionTable := peOffset + 24 + optionalHeaderSize
+	if numSections == 0 || sectionTable+numSections*40 > int64(len(header)) {
+		return 0, false
+	}
+
+	var end int64
+	for i := int64(0); i < numSections; i++ {
+		section := header[sectionTable+i*40:]
+		rawSize := int64(binary.LittleEndian.Uint32(section[16:]))
+		rawOffset := int64(binary.LittleEndian.Uint32(section[20:]))
+		if rawOffset+rawSize > end {
+			end = rawOffset + rawSize
+		}
+	}
+	return end, end > 0
+}
+
+// validSFXPayload reports whether an archive starts at offset: its
+// signature must be followed by headers that are consistent, which a
+// signature occurring by chance in the stub's bytes isn't
+func validSFXPayload(reader io.ReaderAt, offset, size int64) bool {
+	header := make([]byte, 32)
+	n, _ := reader.ReadAt(header, offset)
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, zipLocalSignature):
+		// The central directory's offsets are relative to the payload,
+		// so it only opens from where the archive really starts
+		_, err := openZipReader(io.NewSectionReader(reader, offset, size-offset), size-offset)
+		return err == nil
+	case bytes.HasPrefix(header, sevenZipSignature):
+		return len(header) == 32 && crc32.ChecksumIEEE(header[12:32]) == binary.LittleEndian.Uint32(header[8:12])
+	case bytes.HasPrefix(header, rarSignature):
+		return validRARHeader(reader, offset)
+	}
+	return false
+}
+
+// validRARHeader checks the CRC of the header following the RAR signature
+// at offset: the RAR 5 main archive header, or the RAR 4 archive header
+func validRARHeader(reader io.ReaderAt, offset int64) bool {
+	buf := make([]byte, 64)
+	n, _ := reader.ReadAt(buf, offset)
+	buf = buf[:n]
+	if len(buf) < 8 {
+		return false
+	}
+
+	if buf[6] == 0x01 && buf[7] == 0x00 {
+		// RAR 5: CRC32 of the header size vint and the header
+		block := buf[8:]
+		if len(block) < 5 {
+			return false
+		}
+		headerSize, sizeLen := binary.Uvarint(block[4:])
+		if sizeLen <= 0 || headerSize == 0 || 4+uint64(sizeLen)+headerSize > uint64(len(block)) {
+			return false
+		}
+		return crc32.ChecksumIEEE(block[4:4+uint64(sizeLen)+headerSize]) == binary.LittleEndian.Uint32(block)
+	}
+
+	if buf[6] == 0x00 {
+		// RAR 4: the archive header (type 0x73) after the 7-byte marker,
+		// with the low 16 bits of a CRC32 from its type field on
+		block := buf[7:]
+		if len(block) < 7 || block[2] != 0x73 {
+			return false
+		}
+		headerSize := int(binary.LittleEndian.Uint16(block[5:]))
+		if headerSize < 7 || headerSize > len(block) {
+			return false
+		}
+		return uint16(crc32.ChecksumIEEE(block[2:headerSize])) == binary.LittleEndian.Uint16(block)
+	}
+	return false
+}
+
+// scanSFXSignature returns the offset of the first archive signature within
+// the first sfxScanLimit bytes that validSFXPayload accepts
+func scanSFXSignature(ctx context.Context, reader io.ReaderAt, size int64) (int64, bool) {
+	limit := size
+	if limit > sfxScanLimit {
+		limit = sfxScanLimit
+	}
+
+	// Overlap chunks so a signature spanning a boundary isn't missed
+	const overlap = 8
+	buf := make([]byte, sfxChunkSize+overlap)
+
+	// Skip the MZ header itself
+	for offset := int64(2); offset < limit; offset += sfxChunkSize {
+		if ctx.Err() != nil {
+			return 0, false
+		}
+
+		n, err := reader.ReadAt(buf, offset)
+		if n == 0 {
+			if err != nil {
+				return 0, false
+			}
+			continue
+		}
+
+		// Signatures starting in the overlap are found again in the next chunk
+		for from := 0; from < n && from < sfxChunkSize; {
+			best := -1
+			for _, sig := range sfxSignatures {
+				if i := bytes.Index(buf[from:n], sig); i >= 0 && (best < 0 || from+i < best) {
+					best = from + i
+				}
+			}
+			if best < 0 || best >= sfxChunkSize || offset+int64(best) >= limit {
+				break
+			}
+			if validSFXPayload(reader, offset+int64(best), size) {
+				return offset + int64(best), true
+			}
+			from = best + 1
+		}
+	}
+	return 0, false
+}
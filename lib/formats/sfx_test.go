@@ -0,0 +1,129 @@
+package formats
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+
+	"github.com/yeka/zip"
+
+	"github.com/NORMAL-EX/stream-7z/internal/testarchive"
+)
+
+// buildPEStub creates a minimal PE image with one section ending at stubSize
+func buildPEStub(stubSize int) []byte {
+	stub := make([]byte, stubSize)
+	copy(stub, "MZ")
+	binary.LittleEndian.PutUint32(stub[0x3C:], 0x40)
+
+	copy(stub[0x40:], "PE\x00\x00")
+	coff := stub[0x44:]
+	binary.LittleEndian.PutUint16(coff[0:], 0x14C) // i386
+	binary.LittleEndian.PutUint16(coff[2:], 1)     // one section
+	binary.LittleEndian.PutUint16(coff[16:], 0)    // no optional header
+
+	section := stub[0x58:]
+	copy(section, ".text")
+	binary.LittleEndian.PutUint32(section[16:], uint32(stubSize-0x200)) // SizeOfRawData
+	binary.LittleEndian.PutUint32(section[20:], 0x200)                  // PointerToRawData
+
+	return stub
+}
+
+func TestFindSFXPayload(t *testing.T) {
+	payload := bytes.NewReader(testarchive.Zip(t, testarchive.Entry{Name: "setup.txt", Content: "installer", Method: zip.Deflate}))
+	zipData := make([]byte, payload.Size())
+	payload.ReadAt(zipData, 0)
+
+	// Junk after the MZ header that isn't a valid PE forces a signature scan
+	junk := append([]byte("MZ"), bytes.Repeat([]byte{0x90}, 3000)...)
+
+	tests := []struct {
+		name     string
+		stub     []byte
+		expected int64
+		found    bool
+	}{
+		{"pe overlay", buildPEStub(0x1000), 0x1000, true},
+		{"signature scan", junk, int64(len(junk)), true},
+		{"not an executable", bytes.Repeat([]byte{0x00}, 64), 0, false},
+	}
+
+	for _, test := range tests {
+		data := append(append([]byte(nil), test.stub...), zipData...)
+		offset, found := FindSFXPayload(context.Background(), bytes.NewReader(data), int64(len(data)))
+		if found != test.found || offset != test.expected {
+			t.Errorf("%s: got (%d, %v), expected (%d, %v)", test.name, offset, found, test.expected, test.found)
+		}
+	}
+}
+
+func TestFindSFXPayloadWithoutArchive(t *testing.T) {
+	data := buildPEStub(0x1000)
+
+	if _, found := FindSFXPayload(context.Background(), bytes.NewReader(data), int64(len(data))); found {
+		t.Error("expected no payload in a plain executable")
+	}
+}
+
+func TestFindSFXPayloadSkipsFakeSignatures(t *testing.T) {
+	payload := bytes.NewReader(testarchive.Zip(t, testarchive.Entry{Name: "setup.txt", Content: "installer", Method: zip.Deflate}))
+	zipData := make([]byte, payload.Size())
+	payload.ReadAt(zipData, 0)
+
+	// The stub's own bytes contain every signature, none of them
+	// followed by a valid archive
+	stub := append([]byte("MZ"), bytes.Repeat([]byte{0x90}, 500)...)
+	stub = append(stub, "PK\x03\x04\x14\x00\x00\x00\x08\x00"...)
+	stub = append(stub, bytes.Repeat([]byte{0x90}, 500)...)
+	stub = append(stub, "7z\xBC\xAF\x27\x1C\x00\x04"...)
+	stub = append(stub, bytes.Repeat([]byte{0x90}, 500)...)
+	stub = append(stub, "Rar!\x1A\x07\x01\x00"...)
+	stub = append(stub, bytes.Repeat([]byte{0x90}, 500)...)
+	data := append(stub, zipData...)
+
+	offset, found := FindSFXPayload(context.Background(), bytes.NewReader(data), int64(len(data)))
+	if !found || offset != int64(len(stub)) {
+		t.Errorf("got (%d, %v), expected the real archive at %d", offset, found, len(stub))
+	}
+
+	// A PE overlay pointing at a fake signature falls back to the scan
+	pe := buildPEStub(0x1000)
+	copy(pe[0x800:], "PK\x03\x04")
+	pe = append(pe, "PK\x03\x04 not a zip"...)
+	data = append(pe, zipData...)
+	offset, found = FindSFXPayload(context.Background(), bytes.NewReader(data), int64(len(data)))
+	if !found || offset != int64(len(pe)) {
+		t.Errorf("got (%d, %v), expected the real archive at %d", offset, found, len(pe))
+	}
+}
+
+func TestValidSFXPayload(t *testing.T) {
+	// 7z signature header: the start header CRC covers bytes 12 to 32
+	sevenZip := make([]byte, 32)
+	copy(sevenZip, sevenZipSignature)
+	binary.LittleEndian.PutUint64(sevenZip[12:], 1024)
+	binary.LittleEndian.PutUint32(sevenZip[8:], crc32.ChecksumIEEE(sevenZip[12:32]))
+
+	// RAR 5: signature, then the main archive header (type 1, no flags)
+	rar5 := append([]byte("Rar!\x1A\x07\x01\x00"), 0, 0, 0, 0, 3, 1, 0, 0)
+	binary.LittleEndian.PutUint32(rar5[8:], crc32.ChecksumIEEE(rar5[12:16]))
+
+	// RAR 4: marker block, then the 13-byte archive header (type 0x73)
+	rar4 := append([]byte("Rar!\x1A\x07\x00"), 0, 0, 0x73, 0, 0, 13, 0, 0, 0, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint16(rar4[7:], uint16(crc32.ChecksumIEEE(rar4[9:20])))
+
+	for name, header := range map[string][]byte{"7z": sevenZip, "rar5": rar5, "rar4": rar4} {
+		data := append(append([]byte(nil), header...), make([]byte, 64)...)
+		if !validSFXPayload(bytes.NewReader(data), 0, int64(len(data))) {
+			t.Errorf("%s: expected a valid header", name)
+		}
+
+		data[len(header)-1] ^= 0xFF
+		if validSFXPayload(bytes.NewReader(data), 0, int64(len(data))) {
+			t.Errorf("%s: expected a corrupted header to be rejected", name)
+		}
+	}
+}
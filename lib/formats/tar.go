@@ -12,7 +12,15 @@ import (
 	"github.com/ulikunitz/xz"
 )
 
-// TarFormat handles TAR archives (including tar.gz, tar.bz2, tar.xz)
+const (
+	// tarBlockSize is the size of a TAR header or data block
+	tarBlockSize = 512
+	// tarRecordSize is the default record size archives are padded to
+	tarRecordSize = 20 * tarBlockSize
+)
+
+// TarFormat handles TAR archives (including tar.gz, tar.bz2, tar.xz).
+// TAR has no encryption, so a password passed out of habit is ignored.
 type TarFormat struct{}
 
 // NewTarFormat creates a new TAR format handler
@@ -30,6 +38,12 @@ func (t *TarFormat) Extensions() []string {
 	return []string{".tar", ".tar.gz", ".tgz", ".tar.bz2", ".tbz2", ".tar.xz", ".txz"}
 }
 
+// ExactSizes reports true: archive/tar reads exactly header.Size bytes for
+// a member, expanding sparse files to their logical size
+func (t *TarFormat) ExactSizes() bool {
+	return true
+}
+
 // Detect checks if the reader contains a TAR archive
 func (t *TarFormat) Detect(ctx context.Context, reader io.ReaderAt, size int64) (bool, error) {
 	// Check various compression formats
@@ -62,7 +76,26 @@ func (t *TarFormat) Detect(ctx context.Context, reader io.ReaderAt, size int64)
 		}
 	}
 
-	return false, nil
+	return isEmptyTar(reader, size), nil
+}
+
+// isEmptyTar reports whether the file is an empty TAR archive: nothing but
+// the two zero end-of-archive blocks, padded to at most one default
+// 10240-byte record. It has no "ustar" magic to detect it by.
+func isEmptyTar(reader io.ReaderAt, size int64) bool {
+	if size < 2*tarBlockSize || size > tarRecordSize || size%tarBlockSize != 0 {
+		return false
+	}
+	data := make([]byte, size)
+	if _, err := reader.ReadAt(data, 0); err != nil {
+		return false
+	}
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
 }
 
 // detectCompression determines the compression type
@@ -107,13 +140,100 @@ func (t *TarFormat) wrapReader(reader io.Reader, compression string) (io.Reader,
 	}
 }
 
-// GetInfo retrieves metadata about the TAR archive
-func (t *TarFormat) GetInfo(ctx context.Context, reader io.ReaderAt, size int64, password string) (*ArchiveInfo, error) {
-	// TAR doesn't support encryption
-	if password != "" {
-		return nil, &FormatError{Message: "TAR format does not support encryption"}
+// DebugInfo describes the TAR's compression and where each entry's header
+// blocks and data start. For a compressed TAR the offsets are positions
+// in the decompressed stream.
+func (t *TarFormat) DebugInfo(ctx context.Context, reader io.ReaderAt, size int64, password string) (map[string]interface{}, error) {
+	compression, err := t.detectCompression(reader)
+	if err != nil {
+		return nil, err
 	}
 
+	sectionReader := io.NewSectionReader(reader, 0, size)
+	wrappedReader, err := t.wrapReader(sectionReader, compression)
+	if err != nil {
+		return nil, utils.WrapError(err, "failed to create decompressor")
+	}
+
+	// An uncompressed TAR is seekable, so skipped data isn't downloaded
+	var position func() int64
+	var tarReader *tar.Reader
+	if compression == "none" {
+		position = func() int64 {
+			pos, _ := sectionReader.Seek(0, io.SeekCurrent)
+			return pos
+		}
+		tarReader = tar.NewReader(sectionReader)
+	} else {
+		counter := &countingReader{r: wrappedReader}
+		position = func() int64 { return counter.n }
+		tarReader = tar.NewReader(counter)
+	}
+
+	info := map[string]interface{}{
+		"compression": compression,
+		"blockSize":   512,
+	}
+
+	var entries []map[string]interface{}
+	truncated := false
+	// Next skips the previous entry's data itself, so the reader's position
+	// before it isn't the next header's offset; it follows the padded data
+	var headerOffset int64
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			info["endOffset"] = position()
+			break
+		}
+		if err != nil {
+			info["files"] = entries
+			info["readError"] = err.Error()
+			info["readErrorOffset"] = headerOffset
+			return info, nil
+		}
+		if len(entries) == maxDebugEntries {
+			truncated = true
+			break
+		}
+		// Extended (PAX, GNU long name) headers sit between the two
+		dataOffset := position()
+		entries = append(entries, map[string]interface{}{
+			"name":         header.Name,
+			"type":         string(header.Typeflag),
+			"format":       header.Format.String(),
+			"headerOffset": headerOffset,
+			"dataOffset":   dataOffset,
+			"size":         header.Size,
+		})
+		headerOffset = dataOffset + (header.Size+511)/512*512
+	}
+
+	info["files"] = entries
+	info["filesTruncated"] = truncated
+	return info, nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// CheckPassword reports that the archive isn't encrypted, which TAR
+// archives never are, without reading them
+func (t *TarFormat) CheckPassword(ctx context.Context, reader io.ReaderAt, size int64, password string) (bool, bool, error) {
+	return false, true, nil
+}
+
+// GetInfo retrieves metadata about the TAR archive
+func (t *TarFormat) GetInfo(ctx context.Context, reader io.ReaderAt, size int64, password string) (*ArchiveInfo, error) {
 	compression, err := t.detectCompression(reader)
 	if err != nil {
 		return nil, err
@@ -133,6 +253,16 @@ func (t *TarFormat) GetInfo(ctx context.Context, reader io.ReaderAt, size int64,
 		TotalFiles:       0,
 		TotalSize:        0,
 		Files:            make([]FileEntry, 0),
+		// TAR records no compressed sizes; for .tar.gz and the like the
+		// archive size is what the members compressed to
+		TotalCompressedSize: size,
+		// Extraction scans the headers from the start; a compressed
+		// stream is one unit that has to be decompressed up to the member
+		RandomAccess: false,
+		Solid:        compression != "none",
+		Metadata: map[string]string{
+			"compression": compression,
+		},
 	}
 
 	for {
@@ -144,13 +274,7 @@ func (t *TarFormat) GetInfo(ctx context.Context, reader io.ReaderAt, size int64,
 			return nil, utils.WrapError(err, "failed to read TAR header")
 		}
 
-		entry := FileEntry{
-			Path:           header.Name,
-			Size:           header.Size,
-			CompressedSize: 0, // TAR doesn't store individual compressed sizes
-			ModTime:        header.ModTime,
-			IsDir:          header.Typeflag == tar.TypeDir,
-		}
+		entry := newTarEntry(header, compression)
 
 		info.Files = append(info.Files, entry)
 
@@ -165,10 +289,6 @@ func (t *TarFormat) GetInfo(ctx context.Context, reader io.ReaderAt, size int64,
 
 // ListFiles returns a list of files in the TAR archive
 func (t *TarFormat) ListFiles(ctx context.Context, reader io.ReaderAt, size int64, innerPath string, password string) ([]FileEntry, error) {
-	if password != "" {
-		return nil, &FormatError{Message: "TAR format does not support encryption"}
-	}
-
 	compression, err := t.detectCompression(reader)
 	if err != nil {
 		return nil, err
@@ -182,11 +302,6 @@ func (t *TarFormat) ListFiles(ctx context.Context, reader io.ReaderAt, size int6
 
 	tarReader := tar.NewReader(wrappedReader)
 
-	innerPath = utils.NormalizePath(innerPath)
-	if innerPath != "" {
-		innerPath = innerPath + "/"
-	}
-
 	files := make([]FileEntry, 0)
 
 	for {
@@ -198,43 +313,85 @@ func (t *TarFormat) ListFiles(ctx context.Context, reader io.ReaderAt, size int6
 			return nil, utils.WrapError(err, "failed to read TAR header")
 		}
 
-		normalizedName := utils.NormalizePath(header.Name)
-
-		// Filter by inner path
-		if innerPath != "" {
-			if innerPath == "/" {
-				if strings.Contains(strings.TrimSuffix(normalizedName, "/"), "/") {
-					continue
-				}
-			} else {
-				if !strings.HasPrefix(normalizedName, innerPath) {
-					continue
-				}
-				relativePath := strings.TrimPrefix(normalizedName, innerPath)
-				if strings.Contains(strings.TrimSuffix(relativePath, "/"), "/") {
-					continue
-				}
-			}
+		if !MatchesInnerPath(header.Name, innerPath) {
+			continue
 		}
 
-		files = append(files, FileEntry{
-			Path:           header.Name,
-			Size:           header.Size,
-			CompressedSize: 0,
-			ModTime:        header.ModTime,
-			IsDir:          header.Typeflag == tar.TypeDir,
-		})
+		files = append(files, newTarEntry(header, compression))
 	}
 
 	return files, nil
 }
 
-// ExtractFile extracts a single file from the TAR archive
-func (t *TarFormat) ExtractFile(ctx context.Context, reader io.ReaderAt, size int64, filePath string, password string) (io.ReadCloser, int64, error) {
-	if password != "" {
-		return nil, 0, &FormatError{Message: "TAR format does not support encryption"}
+// Walk streams the TAR headers, calling fn for each entry as it is read
+func (t *TarFormat) Walk(ctx context.Context, reader io.ReaderAt, size int64, password string, fn func(FileEntry) error) error {
+	compression, err := t.detectCompression(reader)
+	if err != nil {
+		return err
+	}
+
+	sectionReader := io.NewSectionReader(reader, 0, size)
+	wrappedReader, err := t.wrapReader(sectionReader, compression)
+	if err != nil {
+		return utils.WrapError(err, "failed to create decompressor")
 	}
 
+	tarReader := tar.NewReader(wrappedReader)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return utils.WrapError(err, "failed to read TAR header")
+		}
+
+		if err := fn(newTarEntry(header, compression)); err != nil {
+			return err
+		}
+	}
+}
+
+// paxXattrPrefix marks the PAX records that hold extended attributes
+const paxXattrPrefix = "SCHILY.xattr."
+
+// newTarEntry builds a FileEntry from a TAR header. Long names and
+// sub-second times from PAX and GNU headers are already applied to the
+// header by the reader; the remaining PAX records are kept, with extended
+// attributes split out into Xattrs.
+func newTarEntry(header *tar.Header, compression string) FileEntry {
+	entry := FileEntry{
+		Path:           header.Name,
+		Size:           header.Size,
+		CompressedSize: 0, // TAR doesn't store individual compressed sizes
+		ModTime:        header.ModTime,
+		IsDir:          header.Typeflag == tar.TypeDir,
+		Method:         compression, // Members share the stream's compression
+	}
+
+	for key, value := range header.PAXRecords {
+		if name := strings.TrimPrefix(key, paxXattrPrefix); name != key {
+			if entry.Xattrs == nil {
+				entry.Xattrs = make(map[string]string)
+			}
+			entry.Xattrs[name] = value
+			continue
+		}
+		if entry.PAXRecords == nil {
+			entry.PAXRecords = make(map[string]string)
+		}
+		entry.PAXRecords[key] = value
+	}
+	return entry
+}
+
+// ExtractFile extracts a single file from the TAR archive
+func (t *TarFormat) ExtractFile(ctx context.Context, reader io.ReaderAt, size int64, filePath string, password string) (io.ReadCloser, int64, error) {
 	compression, err := t.detectCompression(reader)
 	if err != nil {
 		return nil, 0, err
@@ -255,19 +412,91 @@ func (t *TarFormat) ExtractFile(ctx context.Context, reader io.ReaderAt, size in
 			break
 		}
 		if err != nil {
+			closeDecompressor(wrappedReader)
 			return nil, 0, utils.WrapError(err, "failed to read TAR header")
 		}
 
 		if utils.NormalizePath(header.Name) == filePath {
 			// TAR reader doesn't support seeking, so we return it as-is
 			// The caller must read it immediately
-			return io.NopCloser(tarReader), header.Size, nil
+			return &tarMember{Reader: tarReader, decompressor: wrappedReader}, header.Size, nil
 		}
 	}
 
+	closeDecompressor(wrappedReader)
 	return nil, 0, ErrFileNotFound
 }
 
+// tarMember is the content of one extracted member; closing it releases
+// the decompressor
+type tarMember struct {
+	io.Reader
+	decompressor io.Reader
+}
+
+func (m *tarMember) Close() error {
+	return closeDecompressor(m.decompressor)
+}
+
+// closeDecompressor releases r if it is a decompressor that needs closing
+func closeDecompressor(r io.Reader) error {
+	if closer, ok := r.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// tarCursor is one pass over a TAR stream
+type tarCursor struct {
+	ctx          context.Context
+	tarReader    *tar.Reader
+	decompressor io.Reader // Released by Close if it needs closing
+}
+
+// NewCursor starts a pass over the TAR stream for in-order extraction
+func (t *TarFormat) NewCursor(ctx context.Context, reader io.ReaderAt, size int64, password string) (Cursor, error) {
+	compression, err := t.detectCompression(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	sectionReader := io.NewSectionReader(reader, 0, size)
+	wrappedReader, err := t.wrapReader(sectionReader, compression)
+	if err != nil {
+		return nil, utils.WrapError(err, "failed to create decompressor")
+	}
+
+	return &tarCursor{ctx: ctx, tarReader: tar.NewReader(wrappedReader), decompressor: wrappedReader}, nil
+}
+
+// Next advances to filePath; the rest of the previous member is skipped
+func (c *tarCursor) Next(filePath string) (io.Reader, int64, error) {
+	filePath = utils.NormalizePath(filePath)
+
+	for {
+		if err := c.ctx.Err(); err != nil {
+			return nil, 0, err
+		}
+
+		header, err := c.tarReader.Next()
+		if err == io.EOF {
+			return nil, 0, ErrFileNotFound
+		}
+		if err != nil {
+			return nil, 0, utils.WrapError(err, "failed to read TAR header")
+		}
+
+		if utils.NormalizePath(header.Name) == filePath {
+			return c.tarReader, header.Size, nil
+		}
+	}
+}
+
+// Close releases the decompressor
+func (c *tarCursor) Close() error {
+	return closeDecompressor(c.decompressor)
+}
+
 func init() {
 	RegisterFormat(NewTarFormat())
 }
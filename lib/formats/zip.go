@@ -1,13 +1,21 @@
 package formats
 
 import (
+	"bufio"
 	"bytes"
+	"compress/bzip2"
 	"context"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
 	"io"
+	"strconv"
 	"strings"
 
 	"github.com/NORMAL-EX/stream-7z/lib/utils"
 	"github.com/saintfish/chardet"
+	"github.com/ulikunitz/xz/lzma"
 	"github.com/yeka/zip"
 	"golang.org/x/text/encoding"
 	"golang.org/x/text/encoding/charmap"
@@ -58,7 +66,7 @@ func (z *ZipFormat) Detect(ctx context.Context, reader io.ReaderAt, size int64)
 
 // GetInfo retrieves metadata about the ZIP archive
 func (z *ZipFormat) GetInfo(ctx context.Context, reader io.ReaderAt, size int64, password string) (*ArchiveInfo, error) {
-	zipReader, err := zip.NewReader(reader, size)
+	zipReader, err := openZipReader(reader, size)
 	if err != nil {
 		return nil, utils.WrapError(err, "failed to open ZIP archive")
 	}
@@ -70,163 +78,187 @@ func (z *ZipFormat) GetInfo(ctx context.Context, reader io.ReaderAt, size int64,
 		TotalSize:        0,
 		Files:            make([]FileEntry, 0),
 		Comment:          zipReader.Comment,
+		RandomAccess:     true, // Members are compressed independently
+		Metadata: map[string]string{
+			"entries": strconv.Itoa(len(zipReader.File)),
+		},
 	}
 
-	passwordVerified := false
-
+	// Encryption is flagged in the central directory, so no entry is opened
+	// unless there is a password to verify
 	for _, file := range zipReader.File {
-		fileName := decodeName(file.Name)
-
-		// Check if file is encrypted
-		if file.IsEncrypted() {
-			info.IsEncrypted = true
-			if !passwordVerified && password != "" {
-				// Verify password by trying to open the file
-				file.SetPassword(password)
-				rc, err := file.Open()
-				if err != nil {
-					if strings.Contains(err.Error(), "password") {
-						info.RequiresPassword = true
-						return info, ErrPasswordIncorrect
-					}
-					return nil, utils.WrapError(err, "failed to verify password")
-				}
-				rc.Close()
-				passwordVerified = true
-			} else if password == "" {
-				info.RequiresPassword = true
-			}
-		}
-
-		isDir := strings.HasSuffix(fileName, "/") || file.FileInfo().IsDir()
-
-		entry := FileEntry{
-			Path:           fileName,
-			Size:           int64(file.UncompressedSize64),
-			CompressedSize: int64(file.CompressedSize64),
-			ModTime:        file.FileInfo().ModTime(),
-			IsDir:          isDir,
-		}
+		entry := newZipEntry(file, decodeName(file.Name))
 
 		info.Files = append(info.Files, entry)
 
-		if !isDir {
+		if entry.IsEncrypted {
+			info.IsEncrypted = true
+		}
+		if !entry.IsDir {
 			info.TotalFiles++
 			info.TotalSize += entry.Size
+			info.TotalCompressedSize += entry.CompressedSize
 		}
 	}
 
-	// If archive is encrypted and password wasn't provided, indicate it's required
 	if info.IsEncrypted && password == "" {
 		info.RequiresPassword = true
-		return info, ErrPasswordRequired
+	}
+	if _, err := verifyZipPassword(reader, zipReader.File, password); err != nil {
+		if errors.Is(err, ErrPasswordIncorrect) {
+			info.RequiresPassword = true
+			return info, err
+		}
+		return nil, err
 	}
 
+	// The central directory isn't encrypted, so the listing succeeds without a
+	// password; RequiresPassword only signals that some entries need one to extract
 	return info, nil
 }
 
 // ListFiles returns a list of files in the ZIP archive
 func (z *ZipFormat) ListFiles(ctx context.Context, reader io.ReaderAt, size int64, innerPath string, password string) ([]FileEntry, error) {
-	zipReader, err := zip.NewReader(reader, size)
+	zipReader, err := openZipReader(reader, size)
 	if err != nil {
 		return nil, utils.WrapError(err, "failed to open ZIP archive")
 	}
 
-	// 关键修复: 在 NormalizePath 之前保存原始输入
-	// 空字符串 "" 表示列出所有文件（递归）
-	// "/" 表示列出根目录的直接子项（非递归）
-	originalInnerPath := innerPath
-	listAll := (originalInnerPath == "")
-	isRoot := (originalInnerPath == "/")
-	
-	innerPath = utils.NormalizePath(innerPath)
-	
-	// NormalizePath 会把 "" 和 "/" 都转换为 "."
-	// 需要根据原始输入来决定最终值
-	if innerPath == "." {
-		if listAll {
-			innerPath = ""
-		} else if isRoot {
-			innerPath = ""
-		} else {
-			innerPath = ""
-		}
-	}
-	
-	// 只有在指定了具体目录时才添加后缀 "/"
-	if innerPath != "" && !listAll && !isRoot {
-		innerPath = innerPath + "/"
-	}
-
 	files := make([]FileEntry, 0)
-	passwordVerified := false
+	matched := make([]*zip.File, 0)
 
 	for _, file := range zipReader.File {
 		fileName := decodeName(file.Name)
-		normalizedName := utils.NormalizePath(fileName)
-
-		// 根据不同情况进行过滤
-		if listAll {
-			// 列出所有文件，不做任何过滤
-		} else if isRoot {
-			// 根目录 - 只列出第一层的文件和目录
-			// normalizedName 已经移除了前导 "/"
-			// 例如: "file.txt" 或 "dir/file.txt"
-			// 我们只要第一层，即不包含 "/" 的，或者以 "/" 结尾的目录
-			if strings.Contains(strings.TrimSuffix(normalizedName, "/"), "/") {
-				continue
-			}
-		} else {
-			// 指定目录 - 只列出该目录下的直接子项
-			if !strings.HasPrefix(normalizedName, innerPath) {
-				continue
-			}
-			// Remove the inner path prefix
-			relativePath := strings.TrimPrefix(normalizedName, innerPath)
-			// Only include direct children
-			if strings.Contains(strings.TrimSuffix(relativePath, "/"), "/") {
-				continue
+		if !MatchesInnerPath(fileName, innerPath) {
+			continue
+		}
+
+		// Encrypted entries are listed and flagged from the central directory
+		files = append(files, newZipEntry(file, fileName))
+		matched = append(matched, file)
+	}
+
+	if _, err := verifyZipPassword(reader, matched, password); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// CheckPassword verifies password against the first encrypted entry. Only
+// that entry's encryption header is read, not its content.
+func (z *ZipFormat) CheckPassword(ctx context.Context, reader io.ReaderAt, size int64, password string) (bool, bool, error) {
+	zipReader, err := openZipReader(reader, size)
+	if err != nil {
+		return false, false, utils.WrapError(err, "failed to open ZIP archive")
+	}
+
+	encrypted, err := verifyZipPassword(reader, zipReader.File, password)
+	if errors.Is(err, ErrPasswordIncorrect) {
+		return true, false, nil
+	}
+	if err != nil {
+		return encrypted, false, err
+	}
+	return encrypted, !encrypted || password != "", nil
+}
+
+// verifyZipPassword reports whether any of files is encrypted, which the
+// central directory flags tell without reading entry data. With a password
+// it also reads the encryption header of the first encrypted entry and
+// returns ErrPasswordIncorrect if the password doesn't match.
+func verifyZipPassword(reader io.ReaderAt, files []*zip.File, password string) (bool, error) {
+	for _, file := range files {
+		if !file.IsEncrypted() {
+			continue
+		}
+		if password == "" {
+			return true, nil
+		}
+
+		// yeka/zip decrypts ZipCrypto entries whole without checking the
+		// password, so their header is checked here
+		if !isZipAES(file) {
+			if err := checkZipCryptoPassword(reader, file, password); err != nil {
+				return true, err
 			}
+			return true, nil
 		}
 
-		// Verify password if file is encrypted
-		if file.IsEncrypted() {
-			if !passwordVerified {
-				if password == "" {
-					return nil, ErrPasswordRequired
-				}
-				file.SetPassword(password)
-				rc, err := file.Open()
-				if err != nil {
-					if strings.Contains(err.Error(), "password") {
-						return nil, ErrPasswordIncorrect
-					}
-					return nil, utils.WrapError(err, "failed to open encrypted file")
-				}
-				rc.Close()
-				passwordVerified = true
-			} else {
-				file.SetPassword(password)
+		file.SetPassword(password)
+		rc, err := file.Open()
+		if err != nil {
+			if strings.Contains(err.Error(), "password") {
+				return true, ErrPasswordIncorrect
 			}
+			return true, utils.WrapError(err, "failed to verify password")
 		}
+		rc.Close()
+		return true, nil
+	}
+	return false, nil
+}
 
-		isDir := strings.HasSuffix(fileName, "/") || file.FileInfo().IsDir()
+// zipCryptoHeaderLen is the size of the encryption header in front of
+// ZipCrypto-encrypted data
+const zipCryptoHeaderLen = 12
 
-		files = append(files, FileEntry{
-			Path:           fileName,
-			Size:           int64(file.UncompressedSize64),
-			CompressedSize: int64(file.CompressedSize64),
-			ModTime:        file.FileInfo().ModTime(),
-			IsDir:          isDir,
-		})
+// isZipAES reports whether an encrypted entry uses WinZip AES rather than
+// ZipCrypto, which its AES extra field (0x9901) tells
+func isZipAES(file *zip.File) bool {
+	_, _, ok := zipAESExtra(file)
+	return ok
+}
+
+// zipAESExtra returns the vendor version (1 for AE-1, 2 for AE-2) and key
+// strength (1-3 for AES-128 to AES-256) of file's AES extra field
+func zipAESExtra(file *zip.File) (version uint16, strength byte, ok bool) {
+	extra := file.Extra
+	for len(extra) >= 4 {
+		tag := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		if 4+size > len(extra) {
+			break
+		}
+		if tag == 0x9901 {
+			if size < 7 {
+				return 0, 0, true
+			}
+			return binary.LittleEndian.Uint16(extra[4:]), extra[8], true
+		}
+		extra = extra[4+size:]
 	}
+	return 0, 0, false
+}
 
-	return files, nil
+// checkZipCryptoPassword decrypts the ZipCrypto header of file with
+// password and compares its last byte with the high byte of the CRC-32,
+// or of the modification time for entries with a data descriptor, whose
+// CRC-32 isn't known when the header is written. A wrong password matches
+// by chance one time in 256.
+func checkZipCryptoPassword(reader io.ReaderAt, file *zip.File, password string) error {
+	offset, err := file.DataOffset()
+	if err != nil {
+		return utils.WrapError(err, "failed to locate file data")
+	}
+	header := make([]byte, zipCryptoHeaderLen)
+	if _, err := reader.ReadAt(header, offset); err != nil {
+		return utils.WrapError(err, "failed to read encryption header")
+	}
+
+	check := byte(file.CRC32 >> 24)
+	if file.Flags&0x8 != 0 {
+		check = byte(file.ModifiedTime >> 8)
+	}
+	if zip.NewZipCrypto([]byte(password)).Decrypt(header)[zipCryptoHeaderLen-1] != check {
+		return ErrPasswordIncorrect
+	}
+	return nil
 }
 
 // ExtractFile extracts a single file from the ZIP archive
 func (z *ZipFormat) ExtractFile(ctx context.Context, reader io.ReaderAt, size int64, filePath string, password string) (io.ReadCloser, int64, error) {
-	zipReader, err := zip.NewReader(reader, size)
+	zipReader, err := openZipReader(reader, size)
 	if err != nil {
 		return nil, 0, utils.WrapError(err, "failed to open ZIP archive")
 	}
@@ -241,14 +273,33 @@ func (z *ZipFormat) ExtractFile(ctx context.Context, reader io.ReaderAt, size in
 				if password == "" {
 					return nil, 0, ErrPasswordRequired
 				}
+				if !isZipAES(file) {
+					if err := checkZipCryptoPassword(reader, file, password); err != nil {
+						return nil, 0, err
+					}
+				}
 				file.SetPassword(password)
 			}
 
+			if open, ok := zipMethodReaders[file.Method]; ok {
+				rc, err := openZipMethod(reader, file, open)
+				if err != nil {
+					if file.IsEncrypted() && strings.Contains(err.Error(), "password") {
+						return nil, 0, ErrPasswordIncorrect
+					}
+					return nil, 0, err
+				}
+				return rc, int64(file.UncompressedSize64), nil
+			}
+
 			rc, err := file.Open()
 			if err != nil {
 				if file.IsEncrypted() && strings.Contains(err.Error(), "password") {
 					return nil, 0, ErrPasswordIncorrect
 				}
+				if errors.Is(err, zip.ErrAlgorithm) {
+					return nil, 0, &UnsupportedMethodError{Method: uint64(file.Method), Name: zipMethodName(file.Method)}
+				}
 				return nil, 0, utils.WrapError(err, "failed to open file")
 			}
 
@@ -259,6 +310,486 @@ func (z *ZipFormat) ExtractFile(ctx context.Context, reader io.ReaderAt, size in
 	return nil, 0, ErrFileNotFound
 }
 
+// ZIP method codes decompressed by zipMethodReaders
+const (
+	zipMethodBzip2 = 12
+	zipMethodLZMA  = 14
+)
+
+// zipMethodReaders decompress the methods yeka/zip can't. Unlike a
+// zip.Decompressor they get the member's uncompressed size, which LZMA
+// data written without an end marker needs to know where it stops.
+var zipMethodReaders = map[uint16]func(r io.Reader, size int64) (io.Reader, error){
+	zipMethodBzip2: func(r io.Reader, size int64) (io.Reader, error) {
+		return bzip2.NewReader(r), nil
+	},
+	zipMethodLZMA: newZipLZMAReader,
+}
+
+// openZipMethod decompresses the data of a member with open, decrypting
+// it first if it is encrypted, and checks its CRC-32 like file.Open does.
+// The password must already be set on an encrypted file.
+func openZipMethod(reader io.ReaderAt, file *zip.File, open func(io.Reader, int64) (io.Reader, error)) (io.ReadCloser, error) {
+	var data io.Reader
+	var closer io.Closer
+	if file.IsEncrypted() {
+		rc, err := openZipDecrypted(file)
+		if err != nil {
+			return nil, err
+		}
+		data, closer = rc, rc
+	} else {
+		offset, err := file.DataOffset()
+		if err != nil {
+			return nil, utils.WrapError(err, "failed to locate file data")
+		}
+		data = io.NewSectionReader(reader, offset, int64(file.CompressedSize64))
+	}
+
+	r, err := open(bufio.NewReader(data), int64(file.UncompressedSize64))
+	if err != nil {
+		if closer != nil {
+			closer.Close()
+		}
+		return nil, utils.WrapError(err, "failed to open %s data", zipMethodName(file.Method))
+	}
+	crc, checkCRC := zipExpectedCRC(reader, file)
+	return &zipChecksumReader{
+		r:        io.LimitReader(r, int64(file.UncompressedSize64)),
+		size:     int64(file.UncompressedSize64),
+		crc:      crc,
+		checkCRC: checkCRC,
+		hash:     crc32.NewIEEE(),
+		closer:   closer,
+	}, nil
+}
+
+// zipExpectedCRC returns the CRC-32 the content of file must have. There
+// is none to check for empty members, for AE-2 encrypted ones, which store
+// none, and for members flagged as having a data descriptor whose headers
+// leave the CRC-32 at 0 when the descriptor can't be read.
+func zipExpectedCRC(reader io.ReaderAt, file *zip.File) (uint32, bool) {
+	if file.UncompressedSize64 == 0 {
+		return 0, false
+	}
+	if version, _, ok := zipAESExtra(file); ok && version == 2 {
+		return 0, false
+	}
+	if file.CRC32 != 0 || file.Flags&0x8 == 0 {
+		return file.CRC32, true
+	}
+
+	// The descriptor follows the data, with or without its signature
+	offset, err := file.DataOffset()
+	if err != nil {
+		return 0, false
+	}
+	var descriptor [8]byte
+	if _, err := reader.ReadAt(descriptor[:], offset+int64(file.CompressedSize64)); err != nil {
+		return 0, false
+	}
+	if binary.LittleEndian.Uint32(descriptor[:]) == zipDataDescriptorSignature {
+		return binary.LittleEndian.Uint32(descriptor[4:]), true
+	}
+	return binary.LittleEndian.Uint32(descriptor[:]), true
+}
+
+// zipDataDescriptorSignature optionally starts a data descriptor
+const zipDataDescriptorSignature = 0x08074b50
+
+// openZipDecrypted returns the decrypted, still compressed data of an
+// encrypted member. yeka/zip only decrypts while decompressing with a
+// method it knows, so a copy of the member is opened as if stored, with
+// the size of the compressed data and no checksum to verify.
+func openZipDecrypted(file *zip.File) (io.ReadCloser, error) {
+	overhead := int64(zipCryptoHeaderLen)
+	if _, strength, ok := zipAESExtra(file); ok {
+		if strength < 1 || strength > 3 {
+			return nil, utils.WrapError(utils.ErrArchiveCorrupted, "unknown AES strength %d", strength)
+		}
+		// Salt, password verifier and authentication code
+		overhead = int64(4+4*int(strength)) + 2 + 10
+	}
+	size := int64(file.CompressedSize64) - overhead
+	if size < 0 {
+		return nil, utils.WrapError(utils.ErrArchiveCorrupted, "encrypted data shorter than its header")
+	}
+
+	stored := *file
+	stored.Method = zip.Store
+	stored.Flags &^= 0x8 // The data descriptor's CRC-32 is the content's
+	stored.CRC32 = 0
+	stored.UncompressedSize64 = uint64(size)
+	rc, err := stored.Open()
+	if err != nil {
+		return nil, utils.WrapError(err, "failed to decrypt file")
+	}
+	return rc, nil
+}
+
+// newZipLZMAReader reads LZMA data as ZIP stores it: a 2-byte encoder
+// version and the length of the properties that follow, without the
+// uncompressed size of the classic .lzma header
+func newZipLZMAReader(r io.Reader, size int64) (io.Reader, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	props := make([]byte, binary.LittleEndian.Uint16(header[2:]))
+	if len(props) != 5 {
+		return nil, utils.WrapError(utils.ErrArchiveCorrupted, "LZMA properties of %d bytes", len(props))
+	}
+	if _, err := io.ReadFull(r, props); err != nil {
+		return nil, err
+	}
+
+	classic := make([]byte, lzma.HeaderLen)
+	copy(classic, props)
+	binary.LittleEndian.PutUint64(classic[5:], uint64(size))
+	return lzma.NewReader(io.MultiReader(bytes.NewReader(classic), r))
+}
+
+// zipChecksumReader fails the read that reaches the end of a member
+// whose data doesn't match its size and CRC-32
+type zipChecksumReader struct {
+	r        io.Reader
+	size     int64
+	read     int64
+	crc      uint32
+	checkCRC bool // False when the member has no CRC-32 to check
+	hash     hash.Hash32
+	closer   io.Closer // Decrypting reader under r, if any
+}
+
+func (c *zipChecksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.hash.Write(p[:n])
+	c.read += int64(n)
+	if err == io.EOF {
+		if c.read != c.size {
+			return n, io.ErrUnexpectedEOF
+		}
+		if c.checkCRC && c.hash.Sum32() != c.crc {
+			return n, zip.ErrChecksum
+		}
+	}
+	return n, err
+}
+
+func (c *zipChecksumReader) Close() error {
+	if c.closer != nil {
+		return c.closer.Close()
+	}
+	return nil
+}
+
+// ExtractRaw returns the compressed data of a stored or deflated member.
+// Encrypted members and other methods fail with ErrNotSupported.
+func (z *ZipFormat) ExtractRaw(ctx context.Context, reader io.ReaderAt, size int64, filePath string, password string) (io.ReadCloser, int64, string, error) {
+	zipReader, err := openZipReader(reader, size)
+	if err != nil {
+		return nil, 0, "", utils.WrapError(err, "failed to open ZIP archive")
+	}
+
+	filePath = utils.NormalizePath(filePath)
+
+	for _, file := range zipReader.File {
+		if utils.NormalizePath(decodeName(file.Name)) != filePath {
+			continue
+		}
+
+		// Encrypted data carries headers and trailers around the
+		// compressed stream
+		if file.IsEncrypted() {
+			return nil, 0, "", utils.WrapError(ErrNotSupported, "raw data of encrypted entries")
+		}
+		if file.Method != zip.Store && file.Method != zip.Deflate {
+			return nil, 0, "", utils.WrapError(ErrNotSupported, "raw data of %s entries", zipMethodName(file.Method))
+		}
+
+		offset, err := file.DataOffset()
+		if err != nil {
+			return nil, 0, "", utils.WrapError(err, "failed to locate file data")
+		}
+		compressedSize := int64(file.CompressedSize64)
+		return sectionReadCloser{io.NewSectionReader(reader, offset, compressedSize)}, compressedSize, zipMethodName(file.Method), nil
+	}
+
+	return nil, 0, "", ErrFileNotFound
+}
+
+// sectionReadCloser is a SectionReader with a no-op Close, so the raw
+// data of a member can be read from any offset
+type sectionReadCloser struct {
+	*io.SectionReader
+}
+
+func (sectionReadCloser) Close() error {
+	return nil
+}
+
+// DebugInfo describes where the ZIP's end of central directory record and
+// central directory are, and for each central directory entry its local
+// header offset, flags and method
+func (z *ZipFormat) DebugInfo(ctx context.Context, reader io.ReaderAt, size int64, password string) (map[string]interface{}, error) {
+	end, err := findZipDirectoryEnd(reader, size)
+	if err != nil {
+		return nil, err
+	}
+
+	window := end
+	if window > zipDirectoryEndLen+0xFFFF {
+		window = zipDirectoryEndLen + 0xFFFF
+	}
+	tail, err := readTail(reader, end, window)
+	if err != nil {
+		return nil, err
+	}
+	p := findZipDirectoryEndInBlock(tail)
+	if p < 0 {
+		return nil, utils.WrapError(utils.ErrArchiveCorrupted, "ZIP end of central directory not found")
+	}
+	record := tail[p : p+zipDirectoryEndLen]
+	eocdOffset := end - window + int64(p)
+
+	entries := uint64(binary.LittleEndian.Uint16(record[10:]))
+	dirSize := uint64(binary.LittleEndian.Uint32(record[12:]))
+	dirOffset := uint64(binary.LittleEndian.Uint32(record[16:]))
+	info := map[string]interface{}{
+		"eocdOffset":    eocdOffset,
+		"commentLength": binary.LittleEndian.Uint16(record[20:]),
+		"trailingBytes": size - end,
+		"zip64":         false,
+	}
+
+	// The central directory ends where the (ZIP64) end record starts;
+	// anything before its recorded offset was prepended, e.g. an SFX stub
+	dirEnd := eocdOffset
+	if entries == 0xFFFF || dirSize == 0xFFFFFFFF || dirOffset == 0xFFFFFFFF {
+		locator := make([]byte, 20)
+		if eocdOffset >= 20 {
+			if _, err := reader.ReadAt(locator, eocdOffset-20); err != nil {
+				return nil, utils.WrapError(err, "failed to read ZIP64 locator")
+			}
+		}
+		if binary.LittleEndian.Uint32(locator) == 0x07064b50 {
+			zip64Offset := int64(binary.LittleEndian.Uint64(locator[8:]))
+			zip64End := make([]byte, 56)
+			if _, err := reader.ReadAt(zip64End, zip64Offset); err != nil {
+				return nil, utils.WrapError(err, "failed to read ZIP64 end of central directory")
+			}
+			if binary.LittleEndian.Uint32(zip64End) == 0x06064b50 {
+				entries = binary.LittleEndian.Uint64(zip64End[32:])
+				dirSize = binary.LittleEndian.Uint64(zip64End[40:])
+				dirOffset = binary.LittleEndian.Uint64(zip64End[48:])
+				dirEnd = zip64Offset
+				info["zip64"] = true
+				info["zip64EocdOffset"] = zip64Offset
+			}
+		}
+	}
+	info["entries"] = entries
+	info["centralDirectoryOffset"] = dirOffset
+	info["centralDirectorySize"] = dirSize
+	prepended := dirEnd - int64(dirSize) - int64(dirOffset)
+	info["prependedBytes"] = prepended
+
+	// Only the start of a huge directory is needed for maxDebugEntries
+	readSize := int64(dirSize)
+	if readSize > 4<<20 {
+		readSize = 4 << 20
+	}
+	dirStart := int64(dirOffset) + prepended
+	if dirStart < 0 || dirStart+readSize > size {
+		return info, utils.WrapError(utils.ErrArchiveCorrupted, "central directory at %d is outside the file", dirStart)
+	}
+	dir := make([]byte, readSize)
+	if _, err := reader.ReadAt(dir, dirStart); err != nil && err != io.EOF {
+		return info, utils.WrapError(err, "failed to read central directory")
+	}
+
+	var files []map[string]interface{}
+	for len(dir) >= 46 && binary.LittleEndian.Uint32(dir) == 0x02014b50 {
+		if len(files) == maxDebugEntries {
+			break
+		}
+		nameLen := int(binary.LittleEndian.Uint16(dir[28:]))
+		extraLen := int(binary.LittleEndian.Uint16(dir[30:]))
+		commentLen := int(binary.LittleEndian.Uint16(dir[32:]))
+		if len(dir) < 46+nameLen+extraLen+commentLen {
+			break
+		}
+		flags := binary.LittleEndian.Uint16(dir[8:])
+		compressedSize := uint64(binary.LittleEndian.Uint32(dir[20:]))
+		uncompressedSize := uint64(binary.LittleEndian.Uint32(dir[24:]))
+		headerOffset := uint64(binary.LittleEndian.Uint32(dir[42:]))
+		uncompressedSize, compressedSize, headerOffset = zip64EntryFields(dir[46+nameLen:46+nameLen+extraLen], uncompressedSize, compressedSize, headerOffset)
+
+		files = append(files, map[string]interface{}{
+			"name":              decodeName(string(dir[46 : 46+nameLen])),
+			"localHeaderOffset": headerOffset,
+			"flags":             flags,
+			"encrypted":         flags&0x1 != 0,
+			"dataDescriptor":    flags&0x8 != 0,
+			"utf8":              flags&0x800 != 0,
+			"method":            zipMethodName(binary.LittleEndian.Uint16(dir[10:])),
+			"compressedSize":    compressedSize,
+			"size":              uncompressedSize,
+		})
+		dir = dir[46+nameLen+extraLen+commentLen:]
+	}
+	info["files"] = files
+	info["filesTruncated"] = uint64(len(files)) < entries
+	return info, nil
+}
+
+// zip64EntryFields replaces the sizes and offset a central directory entry
+// marks as stored in its ZIP64 extra field with the values found there
+func zip64EntryFields(extra []byte, size, compressedSize, offset uint64) (uint64, uint64, uint64) {
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		n := int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+n {
+			break
+		}
+		if id == 0x0001 {
+			field := extra[4 : 4+n]
+			for _, value := range []*uint64{&size, &compressedSize, &offset} {
+				if *value == 0xFFFFFFFF && len(field) >= 8 {
+					*value = binary.LittleEndian.Uint64(field)
+					field = field[8:]
+				}
+			}
+			break
+		}
+		extra = extra[4+n:]
+	}
+	return size, compressedSize, offset
+}
+
+// zipDirectoryEndLen is the size of the end of central directory record
+// without its comment
+const zipDirectoryEndLen = 22
+
+// zipTailWindow is the first tail window searched for the end of central
+// directory record; each further attempt reads four times as much
+const zipTailWindow = 1 << 10
+
+// maxZipTailScan caps how far from the end the record is searched for. A
+// comment takes at most 64KB; the rest allows for data appended after the
+// archive, e.g. by signing or installer tools.
+const maxZipTailScan = 4 << 20
+
+// openZipReader opens a ZIP archive after locating its end of central
+// directory record. The zip package only searches the last 64KB, so data
+// appended after the record is cut off first.
+func openZipReader(reader io.ReaderAt, size int64) (*zip.Reader, error) {
+	end, err := findZipDirectoryEnd(reader, size)
+	if err != nil {
+		return nil, err
+	}
+	if end < size {
+		return zip.NewReader(io.NewSectionReader(reader, 0, end), end)
+	}
+	return zip.NewReader(reader, size)
+}
+
+// findZipDirectoryEnd searches progressively larger tail windows for the
+// end of central directory record and returns the offset just past it and
+// its comment
+func findZipDirectoryEnd(reader io.ReaderAt, size int64) (int64, error) {
+	for window := int64(zipTailWindow); ; window *= 4 {
+		if window > size {
+			window = size
+		}
+		if window > maxZipTailScan {
+			window = maxZipTailScan
+		}
+
+		buf, err := readTail(reader, size, window)
+		if err != nil {
+			return 0, err
+		}
+		if p := findZipDirectoryEndInBlock(buf); p >= 0 {
+			commentLen := int64(binary.LittleEndian.Uint16(buf[p+zipDirectoryEndLen-2:]))
+			return size - window + int64(p) + zipDirectoryEndLen + commentLen, nil
+		}
+
+		if window == size || window == maxZipTailScan {
+			return 0, utils.WrapError(utils.ErrArchiveCorrupted, "ZIP end of central directory not found")
+		}
+	}
+}
+
+// findZipDirectoryEndInBlock returns the position of the last end of
+// central directory record in b whose comment fits in b, or -1
+func findZipDirectoryEndInBlock(b []byte) int {
+	for i := len(b) - zipDirectoryEndLen; i >= 0; i-- {
+		if b[i] == 'P' && b[i+1] == 'K' && b[i+2] == 0x05 && b[i+3] == 0x06 {
+			commentLen := int(binary.LittleEndian.Uint16(b[i+zipDirectoryEndLen-2:]))
+			if i+zipDirectoryEndLen+commentLen <= len(b) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// readTail reads the last n bytes of reader
+func readTail(reader io.ReaderAt, size, n int64) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := reader.ReadAt(buf, size-n); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// newZipEntry builds a FileEntry from a ZIP central directory record
+func newZipEntry(file *zip.File, fileName string) FileEntry {
+	return FileEntry{
+		Path:           fileName,
+		Size:           int64(file.UncompressedSize64),
+		CompressedSize: int64(file.CompressedSize64),
+		ModTime:        file.FileInfo().ModTime(),
+		IsDir:          strings.HasSuffix(fileName, "/") || file.FileInfo().IsDir(),
+		Method:         zipMethodName(file.Method),
+		IsEncrypted:    file.IsEncrypted(),
+		CRC32:          file.CRC32,
+	}
+}
+
+// zipMethodName maps a ZIP compression method code to a readable name
+func zipMethodName(method uint16) string {
+	switch method {
+	case 0:
+		return "Store"
+	case 1:
+		return "Shrink"
+	case 6:
+		return "Implode"
+	case 8:
+		return "Deflate"
+	case 9:
+		return "Deflate64"
+	case 12:
+		return "BZIP2"
+	case 14:
+		return "LZMA"
+	case 93:
+		return "Zstandard"
+	case 95:
+		return "XZ"
+	case 96:
+		return "JPEG"
+	case 97:
+		return "WavPack"
+	case 98:
+		return "PPMd"
+	default:
+		return "Method " + strconv.Itoa(int(method))
+	}
+}
+
 // decodeName handles various character encodings in ZIP file names
 func decodeName(name string) string {
 	b := []byte(name)
@@ -323,4 +854,5 @@ func getEncoding(charset string) encoding.Encoding {
 
 func init() {
 	RegisterFormat(NewZipFormat())
+	zip.RegisterDecompressor(zipMethodDeflate64, newDeflate64Reader)
 }
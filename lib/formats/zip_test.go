@@ -0,0 +1,426 @@
+package formats
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/NORMAL-EX/stream-7z/internal/testarchive"
+	"github.com/NORMAL-EX/stream-7z/lib/utils"
+	"github.com/ulikunitz/xz/lzma"
+	"github.com/yeka/zip"
+)
+
+// bzip2Content compressed with bzip2 -9, which the standard library can
+// only decompress
+var (
+	bzip2Content    = strings.Repeat("bzip2 compressed content\n", 40)
+	bzip2Compressed = []byte{
+		0x42, 0x5a, 0x68, 0x39, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59, 0x92, 0x9c, 0xef, 0x7c, 0x00, 0x00,
+		0x63, 0xd9, 0x80, 0x00, 0x10, 0x40, 0x00, 0x10, 0x00, 0x1e, 0x23, 0xdc, 0x10, 0x20, 0x00, 0x70,
+		0x53, 0x00, 0x04, 0xd0, 0x29, 0x54, 0x4c, 0x46, 0x0c, 0xa6, 0x04, 0xf8, 0x27, 0x02, 0x78, 0x26,
+		0xc2, 0x6e, 0x13, 0xf0, 0x98, 0x13, 0xe8, 0x98, 0x13, 0x22, 0x64, 0x4d, 0xc4, 0xd0, 0x4f, 0x02,
+		0x7a, 0x26, 0x04, 0xec, 0x4e, 0x44, 0xe0, 0x4c, 0x84, 0xc8, 0x9f, 0xc5, 0xdc, 0x91, 0x4e, 0x14,
+		0x24, 0x24, 0xa7, 0x3b, 0xdf, 0x00,
+	}
+)
+
+// precompressedWriter lets the zip writer produce BZIP2 members, which it
+// can't compress: the content written must be bzip2Content, and
+// bzip2Compressed is written in its place
+type precompressedWriter struct {
+	w       io.Writer
+	content bytes.Buffer
+}
+
+func (p *precompressedWriter) Write(b []byte) (int, error) {
+	return p.content.Write(b)
+}
+
+func (p *precompressedWriter) Close() error {
+	if p.content.String() != bzip2Content {
+		return errors.New("no BZIP2 data for this content")
+	}
+	_, err := p.w.Write(bzip2Compressed)
+	return err
+}
+
+func init() {
+	zip.RegisterCompressor(zipMethodBzip2, func(w io.Writer) (io.WriteCloser, error) {
+		return &precompressedWriter{w: w}, nil
+	})
+}
+
+func TestZipExtractEncryptedBzip2(t *testing.T) {
+	ctx := context.Background()
+
+	for _, test := range []struct {
+		name       string
+		encryption zip.EncryptionMethod
+	}{
+		{"AES", zip.AES256Encryption},
+		{"ZipCrypto", zip.StandardEncryption},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			reader := bytes.NewReader(testarchive.Zip(t, testarchive.Entry{
+				Name: "member.txt", Content: bzip2Content, Method: zipMethodBzip2,
+				Password: "secret", Encryption: test.encryption,
+			}))
+
+			rc, size, err := NewZipFormat().ExtractFile(ctx, reader, reader.Size(), "member.txt", "secret")
+			if err != nil {
+				t.Fatalf("ExtractFile failed: %v", err)
+			}
+			data, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil || string(data) != bzip2Content || size != int64(len(bzip2Content)) {
+				t.Errorf("unexpected content %q of size %d (%v)", data, size, err)
+			}
+
+			if _, _, err := NewZipFormat().ExtractFile(ctx, reader, reader.Size(), "member.txt", "wrong"); !errors.Is(err, ErrPasswordIncorrect) {
+				t.Errorf("expected ErrPasswordIncorrect, got %v", err)
+			}
+		})
+	}
+}
+
+func TestZipExtractBzip2AndLZMA(t *testing.T) {
+	ctx := context.Background()
+
+	extract := func(t *testing.T, reader *bytes.Reader) (string, error) {
+		t.Helper()
+		rc, _, err := NewZipFormat().ExtractFile(ctx, reader, reader.Size(), "member.txt", "")
+		if err != nil {
+			t.Fatalf("ExtractFile failed: %v", err)
+		}
+		defer rc.Close()
+		data, err := io.ReadAll(rc)
+		return string(data), err
+	}
+
+	t.Run("bzip2", func(t *testing.T) {
+		reader := bytes.NewReader(testarchive.Zip(t, testarchive.Entry{Name: "member.txt", Method: zipMethodBzip2, Compressed: bzip2Compressed, Content: bzip2Content}))
+
+		files, err := NewZipFormat().ListFiles(ctx, reader, reader.Size(), "", "")
+		if err != nil || len(files) != 1 || files[0].Method != "BZIP2" {
+			t.Fatalf("expected one BZIP2 member, got %+v (%v)", files, err)
+		}
+		if data, err := extract(t, reader); err != nil || data != bzip2Content {
+			t.Errorf("unexpected content %q (%v)", data, err)
+		}
+
+		// Data not matching the recorded size and CRC-32 fails once read
+		corrupt := bytes.NewReader(testarchive.Zip(t, testarchive.Entry{Name: "member.txt", Method: zipMethodBzip2, Compressed: bzip2Compressed, Content: bzip2Content + "!"}))
+		if _, err := extract(t, corrupt); err == nil {
+			t.Error("expected a size mismatch to fail")
+		}
+	})
+
+	t.Run("bzip2 CRC-32", func(t *testing.T) {
+		crc := crc32.ChecksumIEEE([]byte(bzip2Content))
+		wrong := crc ^ 1
+		tests := []struct {
+			name          string
+			crc           uint32
+			descriptorCRC *uint32
+			valid         bool
+		}{
+			{"recorded", crc, nil, true},
+			// 0 is checked like any CRC-32 unless a descriptor holds it
+			{"zero", 0, nil, false},
+			{"in the descriptor", 0, &crc, true},
+			{"wrong in the descriptor", 0, &wrong, false},
+		}
+		for _, test := range tests {
+			reader := bytes.NewReader(testarchive.Zip(t, testarchive.Entry{
+				Name: "member.txt", Method: zipMethodBzip2, Compressed: bzip2Compressed, Content: bzip2Content,
+				CRC: &test.crc, DescriptorCRC: test.descriptorCRC,
+			}))
+			data, err := extract(t, reader)
+			if test.valid && (err != nil || data != bzip2Content) {
+				t.Errorf("%s: unexpected content %q (%v)", test.name, data, err)
+			}
+			if !test.valid && !errors.Is(err, zip.ErrChecksum) {
+				t.Errorf("%s: expected a checksum error, got %v", test.name, err)
+			}
+		}
+	})
+
+	for _, eos := range []bool{false, true} {
+		t.Run("LZMA end marker "+strconv.FormatBool(eos), func(t *testing.T) {
+			content := strings.Repeat("lzma compressed content\n", 100)
+
+			var classic bytes.Buffer
+			w, err := lzma.WriterConfig{Size: int64(len(content)), EOSMarker: eos}.NewWriter(&classic)
+			if err != nil {
+				t.Fatalf("failed to create LZMA writer: %v", err)
+			}
+			w.Write([]byte(content))
+			w.Close()
+
+			// ZIP keeps the properties but replaces the size with a version
+			// and the properties length
+			compressed := append([]byte{9, 20, 5, 0}, classic.Bytes()[:5]...)
+			compressed = append(compressed, classic.Bytes()[lzma.HeaderLen:]...)
+
+			reader := bytes.NewReader(testarchive.Zip(t, testarchive.Entry{Name: "member.txt", Method: zipMethodLZMA, Compressed: compressed, Content: content}))
+			if data, err := extract(t, reader); err != nil || data != content {
+				t.Errorf("unexpected content %q (%v)", data, err)
+			}
+		})
+	}
+
+	t.Run("unsupported", func(t *testing.T) {
+		reader := bytes.NewReader(testarchive.Zip(t, testarchive.Entry{Name: "member.txt", Method: 93, Compressed: []byte("zstd"), Content: "content"}))
+		_, _, err := NewZipFormat().ExtractFile(ctx, reader, reader.Size(), "member.txt", "")
+		var methodErr *UnsupportedMethodError
+		if !errors.Is(err, ErrUnsupportedMethod) || !errors.As(err, &methodErr) {
+			t.Fatalf("expected ErrUnsupportedMethod, got %v", err)
+		}
+		if methodErr.Method != 93 || methodErr.Name != "Zstandard" {
+			t.Errorf("expected method 93 (Zstandard), got %d (%s)", methodErr.Method, methodErr.Name)
+		}
+	})
+}
+
+func TestZipMethodName(t *testing.T) {
+	tests := []struct {
+		method   uint16
+		expected string
+	}{
+		{0, "Store"},
+		{8, "Deflate"},
+		{9, "Deflate64"},
+		{12, "BZIP2"},
+		{14, "LZMA"},
+		{93, "Zstandard"},
+		{1234, "Method 1234"},
+	}
+
+	for _, test := range tests {
+		result := zipMethodName(test.method)
+		if result != test.expected {
+			t.Errorf("zipMethodName(%d) = %q, expected %q", test.method, result, test.expected)
+		}
+	}
+}
+
+func TestZipListFilesReportsMethod(t *testing.T) {
+	reader := bytes.NewReader(testarchive.Zip(t, []testarchive.Entry{
+		{Name: "stored.txt", Content: "stored content", Method: zip.Store},
+		{Name: "deflated.txt", Content: "deflated content deflated content", Method: zip.Deflate},
+	}...))
+
+	files, err := NewZipFormat().ListFiles(context.Background(), reader, reader.Size(), "", "")
+	if err != nil {
+		t.Fatalf("ListFiles failed: %v", err)
+	}
+
+	methods := make(map[string]string)
+	for _, f := range files {
+		methods[f.Path] = f.Method
+	}
+
+	if methods["stored.txt"] != "Store" {
+		t.Errorf("stored.txt method = %q, expected Store", methods["stored.txt"])
+	}
+	if methods["deflated.txt"] != "Deflate" {
+		t.Errorf("deflated.txt method = %q, expected Deflate", methods["deflated.txt"])
+	}
+}
+
+func TestZipMixedEncryptionListsWithoutPassword(t *testing.T) {
+	reader := bytes.NewReader(testarchive.Zip(t, []testarchive.Entry{
+		{Name: "public.txt", Content: "public content", Method: zip.Deflate},
+		{Name: "secret.txt", Content: "secret content", Method: zip.Deflate, Password: "pass"},
+	}...))
+	z := NewZipFormat()
+	ctx := context.Background()
+
+	info, err := z.GetInfo(ctx, reader, reader.Size(), "")
+	if err != nil {
+		t.Fatalf("GetInfo without password failed: %v", err)
+	}
+	if !info.IsEncrypted || !info.RequiresPassword {
+		t.Errorf("expected IsEncrypted and RequiresPassword, got %v/%v", info.IsEncrypted, info.RequiresPassword)
+	}
+	if info.TotalFiles != 2 {
+		t.Errorf("expected 2 files, got %d", info.TotalFiles)
+	}
+
+	files, err := z.ListFiles(ctx, reader, reader.Size(), "", "")
+	if err != nil {
+		t.Fatalf("ListFiles without password failed: %v", err)
+	}
+	for _, f := range files {
+		expected := f.Path == "secret.txt"
+		if f.IsEncrypted != expected {
+			t.Errorf("%s IsEncrypted = %v, expected %v", f.Path, f.IsEncrypted, expected)
+		}
+	}
+
+	rc, _, err := z.ExtractFile(ctx, reader, reader.Size(), "public.txt", "")
+	if err != nil {
+		t.Fatalf("extracting plaintext entry failed: %v", err)
+	}
+	content, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(content) != "public content" {
+		t.Errorf("unexpected content %q", content)
+	}
+
+	if _, _, err := z.ExtractFile(ctx, reader, reader.Size(), "secret.txt", ""); !errors.Is(err, ErrPasswordRequired) {
+		t.Errorf("expected ErrPasswordRequired for encrypted entry, got %v", err)
+	}
+
+	if _, err := z.GetInfo(ctx, reader, reader.Size(), "wrong"); !errors.Is(err, ErrPasswordIncorrect) {
+		t.Errorf("expected ErrPasswordIncorrect with wrong password, got %v", err)
+	}
+}
+
+func TestZipCryptoWrongPassword(t *testing.T) {
+	reader := bytes.NewReader(testarchive.Zip(t, []testarchive.Entry{
+		{Name: "secret.txt", Content: "secret content", Method: zip.Deflate, Password: "pass", Encryption: zip.StandardEncryption},
+	}...))
+	z := NewZipFormat()
+	ctx := context.Background()
+
+	if encrypted, valid, err := z.CheckPassword(ctx, reader, reader.Size(), "wrong"); err != nil || !encrypted || valid {
+		t.Errorf("expected a wrong ZipCrypto password to be rejected, got encrypted=%v valid=%v (%v)", encrypted, valid, err)
+	}
+	if _, err := z.GetInfo(ctx, reader, reader.Size(), "wrong"); !errors.Is(err, ErrPasswordIncorrect) {
+		t.Errorf("expected ErrPasswordIncorrect from GetInfo, got %v", err)
+	}
+	if _, _, err := z.ExtractFile(ctx, reader, reader.Size(), "secret.txt", "wrong"); !errors.Is(err, ErrPasswordIncorrect) {
+		t.Errorf("expected ErrPasswordIncorrect from ExtractFile, got %v", err)
+	}
+
+	if _, valid, err := z.CheckPassword(ctx, reader, reader.Size(), "pass"); err != nil || !valid {
+		t.Fatalf("expected the right password to be accepted, got %v (%v)", valid, err)
+	}
+	rc, _, err := z.ExtractFile(ctx, reader, reader.Size(), "secret.txt", "pass")
+	if err != nil {
+		t.Fatalf("ExtractFile failed: %v", err)
+	}
+	defer rc.Close()
+	if content, err := io.ReadAll(rc); err != nil || string(content) != "secret content" {
+		t.Errorf("unexpected content %q (%v)", content, err)
+	}
+}
+
+// directoryOnlyReader fails reads that end before the central directory,
+// so opening an entry's local header or data is an error while the tail
+// scan for the end record still works
+type directoryOnlyReader struct {
+	*bytes.Reader
+	directoryStart int64
+}
+
+func (r directoryOnlyReader) ReadAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) <= r.directoryStart {
+		return 0, errors.New("read of entry data")
+	}
+	return r.Reader.ReadAt(p, off)
+}
+
+func TestZipEncryptedListsFromDirectoryFlags(t *testing.T) {
+	reader := bytes.NewReader(testarchive.Zip(t, []testarchive.Entry{
+		{Name: "a.txt", Content: "secret a", Method: zip.Deflate, Password: "pass"},
+		{Name: "b.txt", Content: "secret b", Method: zip.Deflate, Password: "pass"},
+	}...))
+	size := reader.Size()
+
+	// The end of central directory record holds the directory offset
+	end := make([]byte, zipDirectoryEndLen)
+	reader.ReadAt(end, size-zipDirectoryEndLen)
+	restricted := directoryOnlyReader{reader, int64(binary.LittleEndian.Uint32(end[16:20]))}
+
+	z := NewZipFormat()
+	ctx := context.Background()
+
+	info, err := z.GetInfo(ctx, restricted, size, "")
+	if err != nil {
+		t.Fatalf("GetInfo without password failed: %v", err)
+	}
+	if !info.IsEncrypted || !info.RequiresPassword {
+		t.Errorf("expected IsEncrypted and RequiresPassword, got %v/%v", info.IsEncrypted, info.RequiresPassword)
+	}
+
+	files, err := z.ListFiles(ctx, restricted, size, "", "")
+	if err != nil {
+		t.Fatalf("ListFiles without password failed: %v", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected 2 files, got %d", len(files))
+	}
+	for _, f := range files {
+		if !f.IsEncrypted {
+			t.Errorf("expected %s to be flagged encrypted", f.Path)
+		}
+	}
+
+	// Verifying a password has to open an entry
+	if _, err := z.ListFiles(ctx, restricted, size, "", "pass"); err == nil {
+		t.Error("expected a password to be verified against an entry")
+	}
+}
+
+// withZipComment sets the archive comment in the end of central directory
+// record of data, which testarchive.Zip writes without one
+func withZipComment(data []byte, comment []byte) []byte {
+	out := append([]byte(nil), data...)
+	out[len(out)-2] = byte(len(comment))
+	out[len(out)-1] = byte(len(comment) >> 8)
+	return append(out, comment...)
+}
+
+func TestZipDirectoryEndScan(t *testing.T) {
+	base := bytes.NewReader(testarchive.Zip(t, testarchive.Entry{Name: "a.txt", Content: "a", Method: zip.Deflate}))
+	data := make([]byte, base.Size())
+	base.ReadAt(data, 0)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"near-max comment", withZipComment(data, bytes.Repeat([]byte("c"), 65000))},
+		{"trailing data past 64KB", append(append([]byte(nil), data...), bytes.Repeat([]byte{0xEE}, 200<<10)...)},
+		{"comment and trailing data", append(withZipComment(data, bytes.Repeat([]byte("c"), 65535)), bytes.Repeat([]byte{0xEE}, 100<<10)...)},
+	}
+
+	for _, test := range tests {
+		reader := bytes.NewReader(test.data)
+		files, err := NewZipFormat().ListFiles(context.Background(), reader, reader.Size(), "", "")
+		if err != nil {
+			t.Errorf("%s: ListFiles failed: %v", test.name, err)
+			continue
+		}
+		if len(files) != 1 || files[0].Path != "a.txt" {
+			t.Errorf("%s: expected a.txt, got %v", test.name, files)
+		}
+	}
+
+	reader := bytes.NewReader(data[:len(data)-zipDirectoryEndLen])
+	if _, err := NewZipFormat().ListFiles(context.Background(), reader, reader.Size(), "", ""); !errors.Is(err, utils.ErrArchiveCorrupted) {
+		t.Errorf("expected ErrArchiveCorrupted without an end record, got %v", err)
+	}
+}
+
+func TestZipTotalCompressedSize(t *testing.T) {
+	reader := bytes.NewReader(testarchive.Zip(t, testarchive.Entry{Name: "member.txt", Method: zipMethodBzip2, Compressed: bzip2Compressed, Content: bzip2Content}))
+
+	info, err := NewZipFormat().GetInfo(context.Background(), reader, reader.Size(), "")
+	if err != nil {
+		t.Fatalf("GetInfo failed: %v", err)
+	}
+	if info.TotalSize != int64(len(bzip2Content)) || info.TotalCompressedSize != int64(len(bzip2Compressed)) {
+		t.Errorf("expected %d bytes compressed to %d, got %d to %d",
+			len(bzip2Content), len(bzip2Compressed), info.TotalSize, info.TotalCompressedSize)
+	}
+}
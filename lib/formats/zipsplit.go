@@ -0,0 +1,408 @@
+package formats
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/NORMAL-EX/stream-7z/lib/utils"
+)
+
+// A split ZIP archive (zip -s) is stored as name.z01, name.z02, ... and
+// name.zip, the last volume, which holds the central directory. Offsets in
+// the directory are relative to the volume ("disk") an entry starts on.
+// JoinSplitZip presents the volumes as one archive the zip package can
+// read: the volumes back to back, with the directory rewritten to point
+// at offsets within the whole.
+
+const (
+	zipSpanningSignature     = 0x08074b50 // PK\x07\x08, at the start of the first volume
+	zipSpanningTempSignature = 0x30304b50 // PK00, written by tools that split to one volume
+	zipLocalHeaderSignature  = 0x04034b50
+	zipCentralSignature      = 0x02014b50
+	zipDirectoryEndSignature = 0x06054b50
+	zip64EndSignature        = 0x06064b50
+	zip64LocatorSignature    = 0x07064b50
+
+	zipCentralHeaderLen = 46
+	zip64EndLen         = 56
+	zip64LocatorLen     = 20
+	zip64ExtraID        = 0x0001
+)
+
+// zipDirectoryEnd holds the fields of the end of central directory
+// records a split archive needs, from the zip64 record where present
+type zipDirectoryEnd struct {
+	disk      uint32 // Number of the volume holding the record
+	dirDisk   uint32 // Volume the central directory starts on
+	entries   uint64
+	dirSize   uint64
+	dirOffset uint64 // Relative to the start of dirDisk
+	comment   []byte
+}
+
+// SplitZipVolumes returns how many volumes the split ZIP archive whose
+// last volume is reader spans, or 1 for an archive that isn't split
+func SplitZipVolumes(reader io.ReaderAt, size int64) (int, error) {
+	end, err := readZipDirectoryEnd(reader, size)
+	if err != nil {
+		return 0, err
+	}
+	return int(end.disk) + 1, nil
+}
+
+// readZipDirectoryEnd reads the end of central directory record of the
+// volume in reader, and the zip64 one if the record defers to it
+func readZipDirectoryEnd(reader io.ReaderAt, size int64) (*zipDirectoryEnd, error) {
+	end, err := findZipDirectoryEnd(reader, size)
+	if err != nil {
+		return nil, err
+	}
+	start := end - zipDirectoryEndLen - 0xffff
+	if start < 0 {
+		start = 0
+	}
+	buf := make([]byte, end-start)
+	if _, err := reader.ReadAt(buf, start); err != nil && err != io.EOF {
+		return nil, err
+	}
+	p := findZipDirectoryEndInBlock(buf)
+	if p < 0 {
+		return nil, utils.WrapError(utils.ErrArchiveCorrupted, "ZIP end of central directory not found")
+	}
+	record := buf[p:]
+	recordOffset := start + int64(p)
+
+	d := &zipDirectoryEnd{
+		disk:      uint32(binary.LittleEndian.Uint16(record[4:])),
+		dirDisk:   uint32(binary.LittleEndian.Uint16(record[6:])),
+		entries:   uint64(binary.LittleEndian.Uint16(record[10:])),
+		dirSize:   uint64(binary.LittleEndian.Uint32(record[12:])),
+		dirOffset: uint64(binary.LittleEndian.Uint32(record[16:])),
+		comment:   append([]byte(nil), record[zipDirectoryEndLen:]...),
+	}
+	if d.disk != 0xffff && d.dirDisk != 0xffff && d.entries != 0xffff &&
+		d.dirSize != 0xffffffff && d.dirOffset != 0xffffffff {
+		return d, nil
+	}
+
+	// The zip64 locator directly precedes the record. Its offset is
+	// relative to the volume holding the zip64 record, which tools write
+	// on the last volume along with the rest of the directory end.
+	if recordOffset < zip64LocatorLen {
+		return d, nil
+	}
+	locator := make([]byte, zip64LocatorLen)
+	if _, err := reader.ReadAt(locator, recordOffset-zip64LocatorLen); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(locator) != zip64LocatorSignature {
+		return d, nil
+	}
+	zip64Offset := recordOffset - zip64LocatorLen - zip64EndLen
+	if zip64Offset < 0 {
+		return nil, utils.WrapError(utils.ErrArchiveCorrupted, "ZIP64 end of central directory not found")
+	}
+	record = make([]byte, zip64EndLen)
+	if _, err := reader.ReadAt(record, zip64Offset); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(record) != zip64EndSignature {
+		return nil, utils.WrapError(utils.ErrArchiveCorrupted, "ZIP64 end of central directory not found")
+	}
+	d.disk = binary.LittleEndian.Uint32(record[16:])
+	d.dirDisk = binary.LittleEndian.Uint32(record[20:])
+	d.entries = binary.LittleEndian.Uint64(record[32:])
+	d.dirSize = binary.LittleEndian.Uint64(record[40:])
+	d.dirOffset = binary.LittleEndian.Uint64(record[48:])
+	return d, nil
+}
+
+// JoinSplitZip returns the volumes of a split ZIP archive, in order with
+// the .zip file last, as one archive and its size. The first volume may
+// start with the spanning signature (PK\x07\x08), which is left in place:
+// nothing refers to it once the directory has been rewritten.
+func JoinSplitZip(volumes []io.ReaderAt, sizes []int64) (io.ReaderAt, int64, error) {
+	if len(volumes) == 0 || len(volumes) != len(sizes) {
+		return nil, 0, fmt.Errorf("split ZIP needs one size per volume")
+	}
+
+	magic := make([]byte, 4)
+	if _, err := volumes[0].ReadAt(magic, 0); err != nil {
+		return nil, 0, utils.WrapError(err, "failed to read the first ZIP volume")
+	}
+	switch binary.LittleEndian.Uint32(magic) {
+	case zipSpanningSignature, zipSpanningTempSignature, zipLocalHeaderSignature:
+	default:
+		return nil, 0, utils.WrapError(utils.ErrArchiveCorrupted, "the first volume of the split ZIP doesn't start with a ZIP header")
+	}
+
+	last := len(volumes) - 1
+	end, err := readZipDirectoryEnd(volumes[last], sizes[last])
+	if err != nil {
+		return nil, 0, err
+	}
+	if int(end.disk) != last {
+		return nil, 0, utils.WrapError(utils.ErrArchiveCorrupted, "split ZIP has %d volumes, found %d", end.disk+1, len(volumes))
+	}
+	if int(end.dirDisk) > last {
+		return nil, 0, utils.WrapError(utils.ErrArchiveCorrupted, "ZIP central directory is on missing volume %d", end.dirDisk+1)
+	}
+
+	joined := &volumeReader{starts: make([]int64, len(volumes)), volumes: volumes}
+	for i, size := range sizes {
+		joined.starts[i] = joined.size
+		joined.size += size
+	}
+
+	dirStart := joined.starts[end.dirDisk] + int64(end.dirOffset)
+	if dirStart > joined.size || end.dirSize > uint64(joined.size-dirStart) {
+		return nil, 0, utils.WrapError(utils.ErrArchiveCorrupted, "ZIP central directory extends past the last volume")
+	}
+	directory := make([]byte, end.dirSize)
+	if _, err := joined.ReadAt(directory, dirStart); err != nil && err != io.EOF {
+		return nil, 0, utils.WrapError(err, "failed to read the ZIP central directory")
+	}
+
+	tail, err := rewriteSplitDirectory(directory, end, joined.starts, dirStart)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &overlayReader{base: joined, at: dirStart, data: tail}, dirStart + int64(len(tail)), nil
+}
+
+// rewriteSplitDirectory returns the central directory and end records of
+// the joined archive: every entry on disk 0 at its offset in the whole,
+// with the directory itself at dirStart
+func rewriteSplitDirectory(directory []byte, end *zipDirectoryEnd, starts []int64, dirStart int64) ([]byte, error) {
+	var out bytes.Buffer
+	var entries uint64
+	for p := 0; p < len(directory); entries++ {
+		if len(directory)-p < zipCentralHeaderLen || binary.LittleEndian.Uint32(directory[p:]) != zipCentralSignature {
+			break
+		}
+		header := append([]byte(nil), directory[p:p+zipCentralHeaderLen]...)
+		nameLen := int(binary.LittleEndian.Uint16(header[28:]))
+		extraLen := int(binary.LittleEndian.Uint16(header[30:]))
+		commentLen := int(binary.LittleEndian.Uint16(header[32:]))
+		recordEnd := p + zipCentralHeaderLen + nameLen + extraLen + commentLen
+		if recordEnd > len(directory) {
+			return nil, utils.WrapError(utils.ErrArchiveCorrupted, "truncated ZIP central directory entry")
+		}
+		name := directory[p+zipCentralHeaderLen : p+zipCentralHeaderLen+nameLen]
+		extra := directory[p+zipCentralHeaderLen+nameLen : p+zipCentralHeaderLen+nameLen+extraLen]
+		comment := directory[p+zipCentralHeaderLen+nameLen+extraLen : recordEnd]
+
+		offset, extra, err := globalEntryOffset(header, extra, starts)
+		if err != nil {
+			return nil, utils.WrapError(err, "ZIP entry %q", name)
+		}
+		binary.LittleEndian.PutUint16(header[30:], uint16(len(extra)))
+		binary.LittleEndian.PutUint16(header[34:], 0)
+		if offset >= 0xffffffff {
+			binary.LittleEndian.PutUint32(header[42:], 0xffffffff)
+		} else {
+			binary.LittleEndian.PutUint32(header[42:], uint32(offset))
+		}
+		if len(extra) > 0xffff {
+			return nil, utils.WrapError(utils.ErrArchiveCorrupted, "ZIP entry %q has too many extra fields", name)
+		}
+
+		out.Write(header)
+		out.Write(name)
+		out.Write(extra)
+		out.Write(comment)
+		p = recordEnd
+	}
+	if entries != end.entries {
+		return nil, utils.WrapError(utils.ErrArchiveCorrupted, "ZIP central directory holds %d entries, expected %d", entries, end.entries)
+	}
+
+	dirSize := uint64(out.Len())
+	dirOffset := uint64(dirStart)
+	if entries >= 0xffff || dirSize >= 0xffffffff || dirOffset >= 0xffffffff {
+		zip64End := make([]byte, zip64EndLen)
+		binary.LittleEndian.PutUint32(zip64End, zip64EndSignature)
+		binary.LittleEndian.PutUint64(zip64End[4:], zip64EndLen-12)
+		binary.LittleEndian.PutUint16(zip64End[12:], 45) // Version made by
+		binary.LittleEndian.PutUint16(zip64End[14:], 45) // Version needed
+		binary.LittleEndian.PutUint64(zip64End[24:], entries)
+		binary.LittleEndian.PutUint64(zip64End[32:], entries)
+		binary.LittleEndian.PutUint64(zip64End[40:], dirSize)
+		binary.LittleEndian.PutUint64(zip64End[48:], dirOffset)
+
+		locator := make([]byte, zip64LocatorLen)
+		binary.LittleEndian.PutUint32(locator, zip64LocatorSignature)
+		binary.LittleEndian.PutUint64(locator[8:], dirOffset+dirSize)
+		binary.LittleEndian.PutUint32(locator[16:], 1)
+
+		out.Write(zip64End)
+		out.Write(locator)
+		if entries > 0xffff {
+			entries = 0xffff
+		}
+		if dirSize > 0xffffffff {
+			dirSize = 0xffffffff
+		}
+		if dirOffset > 0xffffffff {
+			dirOffset = 0xffffffff
+		}
+	}
+
+	record := make([]byte, zipDirectoryEndLen)
+	binary.LittleEndian.PutUint32(record, zipDirectoryEndSignature)
+	binary.LittleEndian.PutUint16(record[8:], uint16(entries))
+	binary.LittleEndian.PutUint16(record[10:], uint16(entries))
+	binary.LittleEndian.PutUint32(record[12:], uint32(dirSize))
+	binary.LittleEndian.PutUint32(record[16:], uint32(dirOffset))
+	binary.LittleEndian.PutUint16(record[20:], uint16(len(end.comment)))
+	out.Write(record)
+	out.Write(end.comment)
+	return out.Bytes(), nil
+}
+
+// globalEntryOffset returns the offset of the local header of the central
+// directory entry header in the joined volumes, and its extra fields with
+// the zip64 field rebuilt for disk 0: sizes kept, the offset only if it
+// no longer fits in 32 bits
+func globalEntryOffset(header, extra []byte, starts []int64) (int64, []byte, error) {
+	size := uint64(binary.LittleEndian.Uint32(header[24:]))
+	compressed := uint64(binary.LittleEndian.Uint32(header[20:]))
+	offset := uint64(binary.LittleEndian.Uint32(header[42:]))
+	disk := uint64(binary.LittleEndian.Uint16(header[34:]))
+
+	var zip64 []byte
+	rest := make([]byte, 0, len(extra))
+	for len(extra) >= 4 {
+		id := binary.LittleEndian.Uint16(extra)
+		n := int(binary.LittleEndian.Uint16(extra[2:]))
+		if 4+n > len(extra) {
+			break
+		}
+		if id == zip64ExtraID {
+			zip64 = extra[4 : 4+n]
+		} else {
+			rest = append(rest, extra[:4+n]...)
+		}
+		extra = extra[4+n:]
+	}
+
+	// Zip64 values are present, in this order, for the fields set to all ones
+	for _, field := range []*uint64{&size, &compressed, &offset} {
+		if *field != 0xffffffff {
+			continue
+		}
+		if len(zip64) < 8 {
+			return 0, nil, utils.WrapError(utils.ErrArchiveCorrupted, "missing ZIP64 field")
+		}
+		*field = binary.LittleEndian.Uint64(zip64)
+		zip64 = zip64[8:]
+	}
+	if disk == 0xffff {
+		if len(zip64) < 4 {
+			return 0, nil, utils.WrapError(utils.ErrArchiveCorrupted, "missing ZIP64 disk number")
+		}
+		disk = uint64(binary.LittleEndian.Uint32(zip64))
+	}
+	if disk >= uint64(len(starts)) {
+		return 0, nil, utils.WrapError(utils.ErrArchiveCorrupted, "starts on missing volume %d", disk+1)
+	}
+	global := starts[disk] + int64(offset)
+
+	var values []uint64
+	if binary.LittleEndian.Uint32(header[24:]) == 0xffffffff {
+		values = append(values, size)
+	}
+	if binary.LittleEndian.Uint32(header[20:]) == 0xffffffff {
+		values = append(values, compressed)
+	}
+	if global >= 0xffffffff {
+		values = append(values, uint64(global))
+	}
+	if len(values) > 0 {
+		field := make([]byte, 4+8*len(values))
+		binary.LittleEndian.PutUint16(field, zip64ExtraID)
+		binary.LittleEndian.PutUint16(field[2:], uint16(8*len(values)))
+		for i, v := range values {
+			binary.LittleEndian.PutUint64(field[4+8*i:], v)
+		}
+		rest = append(field, rest...)
+	}
+	return global, rest, nil
+}
+
+// volumeReader reads volumes as if they were one file, back to back
+type volumeReader struct {
+	volumes []io.ReaderAt
+	starts  []int64 // Offset of each volume in the whole
+	size    int64
+}
+
+func (v *volumeReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	n := 0
+	for len(p) > 0 {
+		if off >= v.size {
+			return n, io.EOF
+		}
+		// The last volume starting at or before off
+		i := sort.Search(len(v.starts), func(i int) bool { return v.starts[i] > off }) - 1
+		volumeEnd := v.size
+		if i+1 < len(v.starts) {
+			volumeEnd = v.starts[i+1]
+		}
+		chunk := p
+		if int64(len(chunk)) > volumeEnd-off {
+			chunk = chunk[:volumeEnd-off]
+		}
+		m, err := v.volumes[i].ReadAt(chunk, off-v.starts[i])
+		n += m
+		if m < len(chunk) {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF // A volume was shorter than its size
+			}
+			return n, err
+		}
+		p, off = p[m:], off+int64(m)
+	}
+	return n, nil
+}
+
+// overlayReader reads base up to at and data from there on
+type overlayReader struct {
+	base io.ReaderAt
+	at   int64
+	data []byte
+}
+
+func (o *overlayReader) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	if off < o.at {
+		chunk := p
+		if int64(len(chunk)) > o.at-off {
+			chunk = chunk[:o.at-off]
+		}
+		m, err := o.base.ReadAt(chunk, off)
+		n += m
+		if m < len(chunk) {
+			return n, err
+		}
+		p, off = p[m:], off+int64(m)
+	}
+	if len(p) == 0 {
+		return n, nil
+	}
+	if off-o.at >= int64(len(o.data)) {
+		return n, io.EOF
+	}
+	m := copy(p, o.data[off-o.at:])
+	n += m
+	if m < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,138 @@
+package lib
+
+import (
+	"context"
+
+	"github.com/NORMAL-EX/stream-7z/lib/formats"
+)
+
+// directoryIndex holds the parsed archive directory for one password so
+// listing calls can be answered without re-reading it over HTTP
+type directoryIndex struct {
+	password string
+	done     chan struct{} // Closed once info/err are set
+	info     *formats.ArchiveInfo
+	err      error
+}
+
+// index returns the parsed directory for password, reading it at most once.
+// Concurrent callers wait for the read already in flight.
+func (a *Archive) index(ctx context.Context, password string) (*formats.ArchiveInfo, error) {
+	a.indexMu.Lock()
+	idx := a.dirIndex
+	if idx != nil && idx.password == password {
+		a.indexMu.Unlock()
+		return waitIndex(ctx, idx)
+	}
+
+	idx = &directoryIndex{password: password, done: make(chan struct{})}
+	a.dirIndex = idx
+	a.indexMu.Unlock()
+
+	a.loadIndex(ctx, idx)
+	return cloneInfo(idx.info), idx.err
+}
+
+// invalidateIndex drops the cached directory
+func (a *Archive) invalidateIndex() {
+	a.indexMu.Lock()
+	a.dirIndex = nil
+	a.root = nil
+	a.indexMu.Unlock()
+}
+
+// rootListing is the top level of an archive listed with one password
+type rootListing struct {
+	password string
+	files    []formats.FileEntry
+}
+
+// cachedRoot returns a copy of the cached top level listed with password
+func (a *Archive) cachedRoot(password string) ([]formats.FileEntry, bool) {
+	a.indexMu.Lock()
+	defer a.indexMu.Unlock()
+
+	if a.root == nil || a.root.password != password {
+		return nil, false
+	}
+	return append([]formats.FileEntry(nil), a.root.files...), true
+}
+
+// storeRoot caches the top level listed with password
+func (a *Archive) storeRoot(password string, files []formats.FileEntry) {
+	a.indexMu.Lock()
+	a.root = &rootListing{password: password, files: append([]formats.FileEntry(nil), files...)}
+	a.indexMu.Unlock()
+}
+
+// loadIndex reads the directory into idx and marks it done
+func (a *Archive) loadIndex(ctx context.Context, idx *directoryIndex) {
+	src := a.source()
+	idx.info, idx.err = src.format.GetInfo(ctx, src.data, src.size, idx.password)
+	if idx.err != nil {
+		// Don't keep failures around, the next call should retry
+		a.indexMu.Lock()
+		if a.dirIndex == idx {
+			a.dirIndex = nil
+		}
+		a.indexMu.Unlock()
+	}
+	close(idx.done)
+}
+
+// warmIndex starts reading the directory in the background right after
+// open. Errors (e.g. a password-protected 7z header) are ignored; the first
+// listing call then reads the directory itself.
+func (a *Archive) warmIndex(ctx context.Context) {
+	idx := &directoryIndex{done: make(chan struct{})}
+
+	a.indexMu.Lock()
+	a.dirIndex = idx
+	a.indexMu.Unlock()
+
+	go a.loadIndex(ctx, idx)
+}
+
+// hasCentralDirectory reports whether format keeps its directory in one
+// place, so it can be read cheaply without scanning the whole archive
+func hasCentralDirectory(format formats.Format) bool {
+	switch format.Name() {
+	case "zip", "7z":
+		return true
+	}
+	return false
+}
+
+// indexed reports whether listings are answered from the cached
+// directory: always for formats with a central directory, and for
+// streaming archives, which can only be read once
+func (a *Archive) indexed() bool {
+	return hasCentralDirectory(a.source().format) || a.stream != nil
+}
+
+// waitIndex waits for idx to be populated
+func waitIndex(ctx context.Context, idx *directoryIndex) (*formats.ArchiveInfo, error) {
+	select {
+	case <-idx.done:
+		return cloneInfo(idx.info), idx.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// cloneInfo copies info so callers can't modify the cached directory
+func cloneInfo(info *formats.ArchiveInfo) *formats.ArchiveInfo {
+	if info == nil {
+		return nil
+	}
+
+	clone := *info
+	clone.Files = append([]formats.FileEntry(nil), info.Files...)
+	if info.Metadata != nil {
+		clone.Metadata = make(map[string]string, len(info.Metadata))
+		for k, v := range info.Metadata {
+			clone.Metadata[k] = v
+		}
+	}
+	return &clone
+}
@@ -0,0 +1,198 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/NORMAL-EX/stream-7z/internal/testarchive"
+)
+
+// newCountingServer serves data like newFileServer and counts GET requests
+func newCountingServer(t *testing.T, data []byte) (*httptest.Server, *int64) {
+	t.Helper()
+
+	var gets int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			atomic.AddInt64(&gets, 1)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &gets
+}
+
+// waitForIndex blocks until the background directory read has finished
+func waitForIndex(t *testing.T, archive *Archive) {
+	t.Helper()
+
+	archive.indexMu.Lock()
+	idx := archive.dirIndex
+	archive.indexMu.Unlock()
+	if idx == nil {
+		t.Fatal("expected a directory index to be loading")
+	}
+	<-idx.done
+}
+
+func TestEagerIndexServesListingFromCache(t *testing.T) {
+	server, gets := newCountingServer(t, testarchive.Zip(t, testarchive.Pairs("hello.txt", "hello")...))
+
+	archive, err := NewArchive(server.URL+"/archive.zip", DefaultConfig().WithEagerIndex(true))
+	if err != nil {
+		t.Fatalf("NewArchive failed: %v", err)
+	}
+	defer archive.Close()
+
+	waitForIndex(t, archive)
+	before := atomic.LoadInt64(gets)
+
+	info, err := archive.GetInfo("")
+	if err != nil {
+		t.Fatalf("GetInfo failed: %v", err)
+	}
+	if info.TotalFiles != 1 {
+		t.Errorf("expected 1 file, got %d", info.TotalFiles)
+	}
+
+	files, err := archive.ListFiles("/", "")
+	if err != nil {
+		t.Fatalf("ListFiles failed: %v", err)
+	}
+	if len(files) != 1 || files[0].Path != "hello.txt" {
+		t.Errorf("unexpected listing %+v", files)
+	}
+
+	if after := atomic.LoadInt64(gets); after != before {
+		t.Errorf("expected listing to be served from the index, got %d new requests", after-before)
+	}
+}
+
+func TestEagerIndexDisabledByDefault(t *testing.T) {
+	server, _ := newCountingServer(t, testarchive.Zip(t, testarchive.Pairs("hello.txt", "hello")...))
+
+	archive, err := NewArchive(server.URL+"/archive.zip", nil)
+	if err != nil {
+		t.Fatalf("NewArchive failed: %v", err)
+	}
+	defer archive.Close()
+
+	if archive.dirIndex != nil {
+		t.Error("expected no directory index without EagerIndex")
+	}
+}
+
+func TestDirectoryCachedAcrossCalls(t *testing.T) {
+	server, gets := newCountingServer(t, testarchive.Zip(t, testarchive.Pairs("hello.txt", "hello")...))
+
+	// Without read-ahead or preloading every directory read goes to the server
+	config := DefaultConfig().WithFetchSizes(0, 0).WithWholeDownloadThreshold(0)
+	archive, err := NewArchive(server.URL+"/archive.zip", config)
+	if err != nil {
+		t.Fatalf("NewArchive failed: %v", err)
+	}
+	defer archive.Close()
+
+	if _, err := archive.GetInfo(""); err != nil {
+		t.Fatalf("GetInfo failed: %v", err)
+	}
+	before := atomic.LoadInt64(gets)
+
+	if _, err := archive.ListFiles("", ""); err != nil {
+		t.Fatalf("ListFiles failed: %v", err)
+	}
+	if _, err := archive.ListFiles("/", ""); err != nil {
+		t.Fatalf("ListFiles(/) failed: %v", err)
+	}
+
+	if after := atomic.LoadInt64(gets); after != before {
+		t.Errorf("expected cached listings, got %d new requests", after-before)
+	}
+
+	if err := archive.Reopen(); err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	before = atomic.LoadInt64(gets)
+
+	if _, err := archive.ListFiles("", ""); err != nil {
+		t.Fatalf("ListFiles after Reopen failed: %v", err)
+	}
+	if atomic.LoadInt64(gets) == before {
+		t.Error("expected Reopen to drop the cached directory")
+	}
+}
+
+func TestSmallArchiveDownloadedOnce(t *testing.T) {
+	server, gets := newCountingServer(t, testarchive.Zip(t, testarchive.Pairs("hello.txt", "hello")...))
+
+	archive, err := NewArchive(server.URL+"/archive.zip", nil)
+	if err != nil {
+		t.Fatalf("NewArchive failed: %v", err)
+	}
+	defer archive.Close()
+
+	if _, err := archive.ListFiles("", ""); err != nil {
+		t.Fatalf("ListFiles failed: %v", err)
+	}
+	reader, _, err := archive.ExtractFile("hello.txt", "")
+	if err != nil {
+		t.Fatalf("ExtractFile failed: %v", err)
+	}
+	reader.Close()
+
+	if n := atomic.LoadInt64(gets); n != 1 {
+		t.Errorf("expected a single GET for a small archive, got %d", n)
+	}
+}
+
+func TestListRootMatchesShallowListing(t *testing.T) {
+	names := []string{"a.txt", "docs/b.txt", "docs/deep/c.txt", "z.txt"}
+
+	var tarData bytes.Buffer
+	w := tar.NewWriter(&tarData)
+	for _, name := range names {
+		w.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: 1})
+		w.Write([]byte("x"))
+	}
+	w.Close()
+
+	archives := map[string][]byte{
+		"archive.zip": testarchive.Zip(t, testarchive.Pairs("a.txt", "x", "docs/b.txt", "x", "docs/deep/c.txt", "x", "z.txt", "x")...),
+		"archive.tar": tarData.Bytes(),
+	}
+	for name, data := range archives {
+		server, gets := newCountingServer(t, data)
+		archive, err := NewArchive(server.URL+"/"+name, DefaultConfig().WithWholeDownloadThreshold(0))
+		if err != nil {
+			t.Fatalf("%s: NewArchive failed: %v", name, err)
+		}
+		defer archive.Close()
+
+		root, err := archive.ListRoot("")
+		if err != nil {
+			t.Fatalf("%s: ListRoot failed: %v", name, err)
+		}
+		shallow, err := archive.ListFiles("/", "")
+		if err != nil {
+			t.Fatalf("%s: ListFiles failed: %v", name, err)
+		}
+		if len(root) == 0 || !reflect.DeepEqual(root, shallow) {
+			t.Errorf("%s: ListRoot returned %+v, ListFiles(\"/\") %+v", name, root, shallow)
+		}
+
+		before := atomic.LoadInt64(gets)
+		if _, err := archive.ListRoot(""); err != nil {
+			t.Fatalf("%s: second ListRoot failed: %v", name, err)
+		}
+		if n := atomic.LoadInt64(gets) - before; n != 0 {
+			t.Errorf("%s: expected a repeated ListRoot to be cached, it made %d requests", name, n)
+		}
+	}
+}
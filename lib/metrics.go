@@ -0,0 +1,59 @@
+package lib
+
+import (
+	"time"
+
+	"github.com/NORMAL-EX/stream-7z/lib/rangehttp"
+	"github.com/NORMAL-EX/stream-7z/lib/tracing"
+)
+
+// MetricsRecorder receives measurements of what archives do on the
+// network, which Archive.Stats only sums up. Implementations must be safe
+// for concurrent use.
+type MetricsRecorder interface {
+	// ObserveRangeRequest is called for every read of an archive's data:
+	// the bytes read, how long it took, and whether it was served from
+	// memory (a preloaded archive or the read-ahead buffer) instead of a
+	// range request
+	ObserveRangeRequest(bytes int64, duration time.Duration, cached bool)
+
+	// ObserveOperation is called when an archive operation ends. op is
+	// the span name, e.g. "archive.Open" or "archive.ListFiles". For
+	// "archive.ExtractFile" the duration runs until the reader is closed.
+	ObserveOperation(op string, duration time.Duration, err error)
+}
+
+// readObserver returns the range reader observer feeding Metrics, if set
+func (c *Config) readObserver() rangehttp.ReadObserver {
+	if c.Metrics == nil {
+		return nil
+	}
+	return c.Metrics.ObserveRangeRequest
+}
+
+// observeSpan returns span reporting the operation to Metrics when it ends
+func (c *Config) observeSpan(op string, span tracing.Span) tracing.Span {
+	if c.Metrics == nil {
+		return span
+	}
+	return &observedSpan{Span: span, op: op, start: time.Now(), metrics: c.Metrics}
+}
+
+// observedSpan times the operation of a span
+type observedSpan struct {
+	tracing.Span
+	op      string
+	start   time.Time
+	err     error
+	metrics MetricsRecorder
+}
+
+func (s *observedSpan) RecordError(err error) {
+	s.err = err
+	s.Span.RecordError(err)
+}
+
+func (s *observedSpan) End() {
+	s.metrics.ObserveOperation(s.op, time.Since(s.start), s.err)
+	s.Span.End()
+}
@@ -0,0 +1,90 @@
+package lib
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/NORMAL-EX/stream-7z/internal/testarchive"
+)
+
+// recordingMetrics keeps every observation
+type recordingMetrics struct {
+	mu         sync.Mutex
+	reads      []observedRead
+	operations map[string][]error
+}
+
+type observedRead struct {
+	bytes  int64
+	cached bool
+}
+
+func (m *recordingMetrics) ObserveRangeRequest(bytes int64, duration time.Duration, cached bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reads = append(m.reads, observedRead{bytes: bytes, cached: cached})
+}
+
+func (m *recordingMetrics) ObserveOperation(op string, duration time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.operations == nil {
+		m.operations = make(map[string][]error)
+	}
+	m.operations[op] = append(m.operations[op], err)
+}
+
+func TestMetricsRecorder(t *testing.T) {
+	server := newFileServer(t, testarchive.Zip(t, testarchive.Pairs("hello.txt", "hello")...), "application/zip")
+
+	for _, preload := range []bool{false, true} {
+		metrics := &recordingMetrics{}
+		config := DefaultConfig().WithMetricsRecorder(metrics)
+		if !preload {
+			config.WithWholeDownloadThreshold(0)
+		}
+
+		archive, err := NewArchive(server.URL+"/archive.zip", config)
+		if err != nil {
+			t.Fatalf("NewArchive failed: %v", err)
+		}
+		if _, err := archive.ListFiles("", ""); err != nil {
+			t.Fatalf("ListFiles failed: %v", err)
+		}
+		reader, _, err := archive.ExtractFile("hello.txt", "")
+		if err != nil {
+			t.Fatalf("ExtractFile failed: %v", err)
+		}
+		io.ReadAll(reader)
+		reader.Close()
+		archive.ExtractFile("missing.txt", "")
+		archive.Close()
+
+		var fetched, cached int
+		for _, read := range metrics.reads {
+			if read.cached {
+				cached++
+			} else if read.bytes > 0 {
+				fetched++
+			}
+		}
+		if fetched == 0 {
+			t.Errorf("preload %v: expected range requests to be observed", preload)
+		}
+		if preload && (fetched != 1 || cached == 0) {
+			t.Errorf("preload %v: expected one download and reads served from memory, got %d fetched, %d cached", preload, fetched, cached)
+		}
+
+		if errs := metrics.operations["archive.Open"]; len(errs) != 1 || errs[0] != nil {
+			t.Errorf("preload %v: expected one successful archive.Open, got %v", preload, errs)
+		}
+		if errs := metrics.operations["archive.ListFiles"]; len(errs) != 1 {
+			t.Errorf("preload %v: expected one archive.ListFiles, got %v", preload, errs)
+		}
+		if errs := metrics.operations["archive.ExtractFile"]; len(errs) != 2 || errs[0] != nil || errs[1] == nil {
+			t.Errorf("preload %v: expected a successful and a failed archive.ExtractFile, got %v", preload, errs)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package lib
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NORMAL-EX/stream-7z/lib/formats"
+	"github.com/NORMAL-EX/stream-7z/lib/rangehttp"
+	"github.com/NORMAL-EX/stream-7z/lib/utils"
+)
+
+// maxOpenErrors bounds the URLs an OpenErrorCache remembers
+const maxOpenErrors = 10000
+
+// OpenErrorCache remembers for a short time the URLs that failed to open
+// as archives, so repeated requests for a missing or unsupported file are
+// answered without contacting the origin again. Only failures that won't
+// go away on their own are cached: client errors like 404 and files that
+// aren't a supported archive. Timeouts, network errors and 5xx responses
+// are not. One cache can be shared by any number of configs.
+type OpenErrorCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]openError
+}
+
+type openError struct {
+	err     error
+	expires time.Time
+}
+
+// NewOpenErrorCache creates a cache keeping failures for ttl
+func NewOpenErrorCache(ttl time.Duration) *OpenErrorCache {
+	return &OpenErrorCache{
+		ttl:     ttl,
+		entries: make(map[string]openError),
+	}
+}
+
+// lookup returns the cached failure for archiveURL, if any
+func (c *OpenErrorCache) lookup(archiveURL string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[archiveURL]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, archiveURL)
+		return nil
+	}
+	return entry.err
+}
+
+// store caches err for archiveURL if it is a lasting failure
+func (c *OpenErrorCache) store(archiveURL string, err error) {
+	// data: URLs fail without a request, and are too large to keep as keys
+	if c.ttl <= 0 || !isLastingOpenError(err) || strings.HasPrefix(archiveURL, "data:") {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if len(c.entries) >= maxOpenErrors {
+		for u, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, u)
+			}
+		}
+		if len(c.entries) >= maxOpenErrors {
+			return
+		}
+	}
+	c.entries[archiveURL] = openError{err: err, expires: now.Add(c.ttl)}
+}
+
+// isLastingOpenError reports whether opening the same URL again would fail
+// the same way, as opposed to transient failures that may recover
+func isLastingOpenError(err error) bool {
+	var statusErr *rangehttp.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 400 && statusErr.StatusCode < 500 &&
+			statusErr.StatusCode != http.StatusRequestTimeout &&
+			statusErr.StatusCode != http.StatusTooManyRequests
+	}
+	return errors.Is(err, utils.ErrUnsupportedFormat) ||
+		errors.Is(err, utils.ErrNotAnArchive) ||
+		errors.Is(err, utils.ErrUnexpectedContentType) ||
+		errors.Is(err, formats.ErrEncryptedContainer)
+}
@@ -0,0 +1,72 @@
+package lib
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/NORMAL-EX/stream-7z/lib/rangehttp"
+	"github.com/NORMAL-EX/stream-7z/lib/utils"
+)
+
+func TestOpenErrorCacheServesRepeatedFailures(t *testing.T) {
+	var requests int32
+	status := int32(http.StatusNotFound)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	t.Cleanup(server.Close)
+
+	cache := NewOpenErrorCache(time.Minute)
+	config := DefaultConfig().WithHeadRetries(0, 0).WithOpenErrorCache(cache)
+
+	_, first := NewArchive(server.URL+"/missing.zip", config)
+	var statusErr *rangehttp.StatusError
+	if !errors.As(first, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected a 404 status error, got %v", first)
+	}
+	before := atomic.LoadInt32(&requests)
+
+	// A clone shares the cache
+	_, second := NewArchive(server.URL+"/missing.zip", config.Clone())
+	if second != first {
+		t.Errorf("expected the cached error, got %v", second)
+	}
+	if n := atomic.LoadInt32(&requests); n != before {
+		t.Errorf("expected no request for the cached failure, origin saw %d more", n-before)
+	}
+
+	// Server errors may recover and are never cached
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	for i := 0; i < 2; i++ {
+		before = atomic.LoadInt32(&requests)
+		NewArchive(server.URL+"/flaky.zip", config)
+		if atomic.LoadInt32(&requests) == before {
+			t.Fatalf("attempt %d: expected a 503 failure to reach the origin", i+1)
+		}
+	}
+}
+
+func TestOpenErrorCacheExpires(t *testing.T) {
+	cache := NewOpenErrorCache(20 * time.Millisecond)
+	notArchive := utils.WrapError(utils.ErrUnsupportedFormat, "unable to detect archive format")
+
+	cache.store("http://example.com/a.bin", notArchive)
+	if cache.lookup("http://example.com/a.bin") != notArchive {
+		t.Fatal("expected the failure to be cached")
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	if err := cache.lookup("http://example.com/a.bin"); err != nil {
+		t.Errorf("expected the entry to expire, got %v", err)
+	}
+
+	cache.store("http://example.com/b.zip", errors.New("HEAD request failed: connection reset"))
+	if err := cache.lookup("http://example.com/b.zip"); err != nil {
+		t.Errorf("expected a network error not to be cached, got %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package lib
+
+import (
+	"net/http"
+	"time"
+)
+
+// Profile is a preset trading memory for latency, applied with
+// Config.WithProfile. It sets:
+//
+//	                         LowMemory   Balanced   LowLatency
+//	MinFetchSize             16KB        32KB       256KB
+//	MaxFetchSize             128KB       1MB        8MB
+//	WholeDownloadThreshold   0           1MB        16MB
+//	BufferSize               8KB         32KB       256KB
+//	EagerIndex               false       false      true
+//	MaxIdleConns             16          100        100
+//	MaxIdleConnsPerHost      2           10         32
+//	IdleConnTimeout          30s         90s        120s
+//
+// Balanced is what DefaultConfig uses. LowMemory suits a server keeping
+// many archives open at once: reads fetch little beyond what is asked
+// for, nothing is preloaded and few idle connections are kept.
+// LowLatency suits browsing a single archive interactively: small
+// archives are downloaded whole, reads fetch large ranges and the
+// directory is read as soon as the archive is opened.
+type Profile int
+
+const (
+	// ProfileBalanced is the default configuration
+	ProfileBalanced Profile = iota
+	// ProfileLowMemory minimizes buffering
+	ProfileLowMemory
+	// ProfileLowLatency maximizes read-ahead and caching
+	ProfileLowLatency
+)
+
+// String returns the profile's name
+func (p Profile) String() string {
+	switch p {
+	case ProfileLowMemory:
+		return "low-memory"
+	case ProfileLowLatency:
+		return "low-latency"
+	default:
+		return "balanced"
+	}
+}
+
+// profileSettings are the values a Profile sets
+type profileSettings struct {
+	minFetchSize           int64
+	maxFetchSize           int64
+	wholeDownloadThreshold int64
+	bufferSize             int
+	eagerIndex             bool
+	maxIdleConns           int
+	maxIdleConnsPerHost    int
+	idleConnTimeout        time.Duration
+}
+
+var profiles = map[Profile]profileSettings{
+	ProfileLowMemory: {
+		minFetchSize:           16 * 1024,
+		maxFetchSize:           128 * 1024,
+		wholeDownloadThreshold: 0,
+		bufferSize:             8 * 1024,
+		eagerIndex:             false,
+		maxIdleConns:           16,
+		maxIdleConnsPerHost:    2,
+		idleConnTimeout:        30 * time.Second,
+	},
+	ProfileBalanced: {
+		minFetchSize:           32 * 1024,
+		maxFetchSize:           1024 * 1024,
+		wholeDownloadThreshold: 1024 * 1024,
+		bufferSize:             32 * 1024,
+		eagerIndex:             false,
+		maxIdleConns:           100,
+		maxIdleConnsPerHost:    10,
+		idleConnTimeout:        90 * time.Second,
+	},
+	ProfileLowLatency: {
+		minFetchSize:           256 * 1024,
+		maxFetchSize:           8 * 1024 * 1024,
+		wholeDownloadThreshold: 16 * 1024 * 1024,
+		bufferSize:             256 * 1024,
+		eagerIndex:             true,
+		maxIdleConns:           100,
+		maxIdleConnsPerHost:    32,
+		idleConnTimeout:        120 * time.Second,
+	},
+}
+
+// WithProfile applies the fetch, preload, buffer and connection pool
+// settings of profile (see Profile). Options set afterwards override it.
+// The pool settings are applied to a copy of an *http.Transport, so
+// archives opened before share no connections with those opened after;
+// other transports are left unchanged.
+func (c *Config) WithProfile(profile Profile) *Config {
+	settings, ok := profiles[profile]
+	if !ok {
+		settings = profiles[ProfileBalanced]
+	}
+
+	c.MinFetchSize = settings.minFetchSize
+	c.MaxFetchSize = settings.maxFetchSize
+	c.WholeDownloadThreshold = settings.wholeDownloadThreshold
+	c.BufferSize = settings.bufferSize
+	c.EagerIndex = settings.eagerIndex
+
+	if c.HTTPClient != nil {
+		if transport, ok := c.HTTPClient.Transport.(*http.Transport); ok {
+			transport = transport.Clone()
+			transport.MaxIdleConns = settings.maxIdleConns
+			transport.MaxIdleConnsPerHost = settings.maxIdleConnsPerHost
+			transport.IdleConnTimeout = settings.idleConnTimeout
+
+			client := *c.HTTPClient
+			client.Transport = transport
+			c.HTTPClient = &client
+			c.resetTransport()
+		}
+	}
+	return c
+}
@@ -8,8 +8,10 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/NORMAL-EX/stream-7z/lib/tracing"
 	"github.com/NORMAL-EX/stream-7z/lib/utils"
 )
 
@@ -18,8 +20,18 @@ type Client struct {
 	httpClient *http.Client
 	headers    map[string]string
 	userAgent  string
+	accept     string
+	minimal    bool // Send no headers beyond the configured ones
 	timeout    time.Duration
+	tracer     tracing.Tracer
+	signer     RequestSigner // nil = requests go out unsigned
 	mu         sync.RWMutex
+
+	// Bytes servers without Range support may send, counting the prefix
+	// discarded to reach the requested offset (0 = no limit)
+	fallbackLimit    int64
+	fallbackBytes    int64
+	fallbackExceeded int32
 }
 
 // NewClient creates a new Range HTTP client
@@ -39,15 +51,98 @@ func NewClient(httpClient *http.Client, headers map[string]string, userAgent str
 		httpClient: httpClient,
 		headers:    headersCopy,
 		userAgent:  userAgent,
+		accept:     DefaultAccept,
 		timeout:    timeout,
+		tracer:     tracing.Noop(),
+	}
+}
+
+// DefaultAccept is the Accept header sent when none is configured
+const DefaultAccept = "*/*"
+
+// setHeaders applies the Accept headers, custom headers and User-Agent to req.
+// Custom headers take precedence over the configured values.
+func (c *Client) setHeaders(req *http.Request) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.minimal {
+		// Only what was configured. The transport doesn't ask for
+		// compression on Range and HEAD requests, so Accept-Encoding can
+		// go too, and an empty User-Agent stops Go from sending its own.
+		for k, v := range c.headers {
+			req.Header.Set(k, v)
+		}
+		if c.accept != "" {
+			req.Header.Set("Accept", c.accept)
+		}
+		if c.userAgent != "" {
+			req.Header.Set("User-Agent", c.userAgent)
+		} else if req.Header.Get("User-Agent") == "" {
+			req.Header.Set("User-Agent", "")
+		}
+		return
+	}
+
+	// Byte offsets only make sense on the raw file. Setting this explicitly
+	// also stops the transport from transparently decompressing responses.
+	req.Header.Set("Accept-Encoding", "identity")
+	if c.accept != "" {
+		req.Header.Set("Accept", c.accept)
+	}
+	for k, v := range c.headers {
+		req.Header.Set(k, v)
+	}
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+}
+
+// RequestSigner authenticates a request once all its headers are set,
+// e.g. by adding an AWS Signature Version 4 Authorization header
+type RequestSigner interface {
+	SignRequest(req *http.Request) error
+}
+
+// do signs req, if a signer is set, and sends it
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	c.mu.RLock()
+	signer := c.signer
+	c.mu.RUnlock()
+
+	if signer != nil {
+		if err := signer.SignRequest(req); err != nil {
+			return nil, utils.WrapError(err, "failed to sign request")
+		}
 	}
+	return c.httpClient.Do(req)
 }
 
-// RangeRequest performs a Range HTTP request
+// RangeRequest performs a Range HTTP request. Its span ends when the
+// returned body is closed and records the bytes read from it.
 func (c *Client) RangeRequest(ctx context.Context, url string, start, length int64) (io.ReadCloser, error) {
+	ctx, span := c.getTracer().Start(ctx, "rangehttp.RangeRequest",
+		tracing.Int64("range.start", start),
+		tracing.Int64("range.length", length),
+	)
+
+	body, err := c.rangeRequest(ctx, url, start, length)
+	if err != nil {
+		span.RecordError(err)
+		span.End()
+		return nil, err
+	}
+	return &tracedBody{ReadCloser: body, span: span}, nil
+}
+
+func (c *Client) rangeRequest(ctx context.Context, url string, start, length int64) (io.ReadCloser, error) {
 	if length == 0 {
 		return io.NopCloser(strings.NewReader("")), nil
 	}
+	if c.FallbackExceeded() {
+		// The server already ignored Range once; don't download the file again
+		return nil, utils.WrapError(utils.ErrRangeNotSupported, "fallback limit of %d bytes reached", atomic.LoadInt64(&c.fallbackLimit))
+	}
 
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
@@ -55,14 +150,7 @@ func (c *Client) RangeRequest(ctx context.Context, url string, start, length int
 	}
 
 	// Set headers
-	c.mu.RLock()
-	for k, v := range c.headers {
-		req.Header.Set(k, v)
-	}
-	if c.userAgent != "" {
-		req.Header.Set("User-Agent", c.userAgent)
-	}
-	c.mu.RUnlock()
+	c.setHeaders(req)
 
 	// Set Range header
 	if length > 0 {
@@ -72,21 +160,36 @@ func (c *Client) RangeRequest(ctx context.Context, url string, start, length int
 		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", start))
 	}
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(req)
 	if err != nil {
 		return nil, utils.WrapError(err, "HTTP request failed")
 	}
 
+	if err := checkContentEncoding(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
 	// Check status code
-	if resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusOK {
+	if resp.StatusCode == http.StatusPartialContent {
+		return checkContentRange(resp, start, length)
+	}
+	if resp.StatusCode == http.StatusOK {
 		// Some servers return 200 OK instead of 206 Partial Content
-		// We need to verify the Content-Range header
-		if resp.StatusCode == http.StatusOK && start > 0 {
+		if length == -1 && resp.ContentLength >= 0 {
+			length = resp.ContentLength - start
+		}
+		transferred := start
+		if length > 0 {
+			transferred += length
+		}
+		if err := c.chargeFallback(transferred); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		if start > 0 {
 			// Server doesn't support range requests
 			// We need to discard the bytes before start
-			if length == -1 {
-				length = resp.ContentLength - start
-			}
 			return &skipReader{
 				reader: resp.Body,
 				skip:   start,
@@ -96,39 +199,216 @@ func (c *Client) RangeRequest(ctx context.Context, url string, start, length int
 		return resp.Body, nil
 	}
 
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		resp.Body.Close()
+		return nil, &RangeNotSatisfiableError{Size: unsatisfiedRangeSize(resp)}
+	}
+
 	resp.Body.Close()
-	return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	return nil, &StatusError{StatusCode: resp.StatusCode}
+}
+
+// RangeNotSatisfiableError reports a 416 response: the requested range
+// starts beyond the end of the file, which has Size bytes (-1 when the
+// response didn't say)
+type RangeNotSatisfiableError struct {
+	Size int64
+}
+
+func (e *RangeNotSatisfiableError) Error() string {
+	if e.Size < 0 {
+		return "range not satisfiable"
+	}
+	return fmt.Sprintf("range not satisfiable, the file has %d bytes", e.Size)
+}
+
+// Unwrap makes the error match a *StatusError for 416
+func (e *RangeNotSatisfiableError) Unwrap() error {
+	return &StatusError{StatusCode: http.StatusRequestedRangeNotSatisfiable}
+}
+
+// unsatisfiedRangeSize returns the size a 416 response reports in its
+// "Content-Range: bytes */<size>" header, or -1
+func unsatisfiedRangeSize(resp *http.Response) int64 {
+	contentRange := strings.TrimSpace(resp.Header.Get("Content-Range"))
+	if !strings.HasPrefix(contentRange, "bytes */") {
+		return -1
+	}
+	size, err := strconv.ParseInt(strings.TrimPrefix(contentRange, "bytes */"), 10, 64)
+	if err != nil || size < 0 {
+		return -1
+	}
+	return size
+}
+
+// chargeFallback counts n bytes against the fallback limit, failing with
+// utils.ErrRangeNotSupported once a server ignoring Range requests would
+// have sent more than allowed
+func (c *Client) chargeFallback(n int64) error {
+	limit := atomic.LoadInt64(&c.fallbackLimit)
+	total := atomic.AddInt64(&c.fallbackBytes, n)
+	if limit > 0 && total > limit {
+		atomic.AddInt64(&c.fallbackBytes, -n)
+		atomic.StoreInt32(&c.fallbackExceeded, 1)
+		return utils.WrapError(utils.ErrRangeNotSupported, "reading without Range support would transfer more than %d bytes", limit)
+	}
+	return nil
+}
+
+// StatusError reports a response status the client can't use
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d", e.StatusCode)
+}
+
+// checkContentEncoding fails if the server encoded the body (e.g. gzip)
+// even though identity was requested, since sizes and offsets would then
+// refer to the encoded bytes rather than the archive
+func checkContentEncoding(resp *http.Response) error {
+	encoding := strings.TrimSpace(resp.Header.Get("Content-Encoding"))
+	if encoding == "" || strings.EqualFold(encoding, "identity") {
+		return nil
+	}
+	return utils.WrapError(utils.ErrContentEncoded, "server responded with Content-Encoding %q", encoding)
+}
+
+// checkContentRange verifies that a 206 response covers the requested range.
+// A wider range that still contains the request (e.g. aligned by a proxy) is
+// trimmed; anything else fails with ErrRangeMismatch rather than letting the
+// archive parser read the wrong bytes.
+func checkContentRange(resp *http.Response, start, length int64) (io.ReadCloser, error) {
+	contentRange := resp.Header.Get("Content-Range")
+	if contentRange == "" {
+		// Nothing to validate against
+		return resp.Body, nil
+	}
+
+	gotStart, gotEnd, ok := parseContentRange(contentRange)
+	if !ok {
+		resp.Body.Close()
+		return nil, utils.WrapError(utils.ErrRangeMismatch, "invalid Content-Range %q", contentRange)
+	}
+
+	end := gotEnd
+	if length > 0 {
+		end = start + length - 1
+	}
+
+	if gotStart > start || gotEnd < end {
+		resp.Body.Close()
+		return nil, utils.WrapError(utils.ErrRangeMismatch, "requested bytes %d-%d, got Content-Range %q", start, end, contentRange)
+	}
+
+	if gotStart == start && gotEnd == end {
+		return resp.Body, nil
+	}
+
+	return &skipReader{
+		reader: resp.Body,
+		skip:   start - gotStart,
+		length: end - start + 1,
+	}, nil
+}
+
+// parseContentRange parses a "bytes start-end/total" Content-Range value
+func parseContentRange(value string) (start, end int64, ok bool) {
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, "bytes ") {
+		return 0, 0, false
+	}
+	value = strings.TrimSpace(strings.TrimPrefix(value, "bytes "))
+
+	rangePart, _, _ := strings.Cut(value, "/")
+	startStr, endStr, found := strings.Cut(rangePart, "-")
+	if !found {
+		return 0, 0, false
+	}
+
+	start, err1 := strconv.ParseInt(startStr, 10, 64)
+	end, err2 := strconv.ParseInt(endStr, 10, 64)
+	if err1 != nil || err2 != nil || start < 0 || end < start {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// HeadInfo describes the remote file as reported by a HEAD request
+type HeadInfo struct {
+	Size          int64  // Content length in bytes (-1 if unknown)
+	SupportsRange bool   // Whether the server advertises byte ranges
+	ContentType   string // Content-Type header as sent by the server
+	ETag          string // ETag header, empty if not sent
+	LastModified  string // Last-Modified header, empty if not sent
+}
+
+// Validator returns the ETag, or Last-Modified if there is none, which
+// identifies this version of the file. It is empty when the server sent
+// neither.
+func (h *HeadInfo) Validator() string {
+	if h.ETag != "" {
+		return h.ETag
+	}
+	return h.LastModified
 }
 
 // HeadRequest performs a HEAD request to get file size and check Range support
 func (c *Client) HeadRequest(ctx context.Context, url string) (size int64, supportsRange bool, err error) {
-	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	info, err := c.Head(ctx, url)
 	if err != nil {
-		return 0, false, utils.WrapError(err, "failed to create HEAD request")
+		return 0, false, err
 	}
+	return info.Size, info.SupportsRange, nil
+}
 
-	// Set headers
-	c.mu.RLock()
-	for k, v := range c.headers {
-		req.Header.Set(k, v)
+// Head performs a HEAD request and returns what the server reports about the file
+func (c *Client) Head(ctx context.Context, url string) (*HeadInfo, error) {
+	ctx, span := c.getTracer().Start(ctx, "rangehttp.Head")
+	defer span.End()
+
+	info, err := c.head(ctx, url)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
 	}
-	if c.userAgent != "" {
-		req.Header.Set("User-Agent", c.userAgent)
+	span.SetAttributes(
+		tracing.Int64("file.size", info.Size),
+		tracing.Bool("range.supported", info.SupportsRange),
+	)
+	return info, nil
+}
+
+func (c *Client) head(ctx context.Context, url string) (*HeadInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return nil, utils.WrapError(err, "failed to create HEAD request")
 	}
-	c.mu.RUnlock()
 
-	resp, err := c.httpClient.Do(req)
+	// Set headers
+	c.setHeaders(req)
+
+	resp, err := c.do(req)
 	if err != nil {
-		return 0, false, utils.WrapError(err, "HEAD request failed")
+		return nil, utils.WrapError(err, "HEAD request failed")
 	}
 	defer resp.Body.Close()
 
+	if err := checkContentEncoding(resp); err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented {
+		// Some servers only answer GET; a one-byte range reports the size too
+		return c.ProbeRange(ctx, url)
+	}
 	if resp.StatusCode != http.StatusOK {
-		return 0, false, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return nil, &StatusError{StatusCode: resp.StatusCode}
 	}
 
 	// Get content length
-	size = resp.ContentLength
+	size := resp.ContentLength
 	if size < 0 {
 		// Try to parse from Content-Length header
 		if cl := resp.Header.Get("Content-Length"); cl != "" {
@@ -138,9 +418,91 @@ func (c *Client) HeadRequest(ctx context.Context, url string) (size int64, suppo
 
 	// Check if server supports range requests
 	acceptRanges := resp.Header.Get("Accept-Ranges")
-	supportsRange = acceptRanges == "bytes"
 
-	return size, supportsRange, nil
+	return &HeadInfo{
+		Size:          size,
+		SupportsRange: acceptRanges == "bytes",
+		ContentType:   resp.Header.Get("Content-Type"),
+		ETag:          resp.Header.Get("ETag"),
+		LastModified:  resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// ProbeRange learns what Head would from a GET of the first byte, for
+// servers that disallow HEAD or don't report a size in it. A 206 response
+// carries the total size in Content-Range and proves range support; a
+// server ignoring the range sends the whole file with 200, whose body is
+// dropped unread. An empty file is answered with 416 and "bytes */0".
+func (c *Client) ProbeRange(ctx context.Context, url string) (*HeadInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, utils.WrapError(err, "failed to create HTTP request")
+	}
+	c.setHeaders(req)
+	req.Header.Set("Range", "bytes=0-0")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, utils.WrapError(err, "HTTP request failed")
+	}
+	defer resp.Body.Close()
+
+	if err := checkContentEncoding(resp); err != nil {
+		return nil, err
+	}
+
+	info := &HeadInfo{
+		Size:         -1,
+		ContentType:  resp.Header.Get("Content-Type"),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		contentRange := resp.Header.Get("Content-Range")
+		if contentRange == "" {
+			return nil, utils.WrapError(utils.ErrRangeMismatch, "206 response without Content-Range")
+		}
+		total, ok := parseContentRangeTotal(contentRange)
+		if !ok {
+			return nil, utils.WrapError(utils.ErrRangeMismatch, "invalid Content-Range %q", contentRange)
+		}
+		info.Size = total
+		info.SupportsRange = true
+	case http.StatusOK:
+		info.Size = resp.ContentLength
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Only an empty file can't satisfy the first byte
+		if strings.TrimSpace(resp.Header.Get("Content-Range")) != "bytes */0" {
+			return nil, &StatusError{StatusCode: resp.StatusCode}
+		}
+		info.Size = 0
+		info.SupportsRange = true
+	default:
+		return nil, &StatusError{StatusCode: resp.StatusCode}
+	}
+	return info, nil
+}
+
+// parseContentRangeTotal returns the total size from a "bytes start-end/total"
+// Content-Range value, or -1 if the server sent "*"
+func parseContentRangeTotal(value string) (int64, bool) {
+	if _, _, ok := parseContentRange(value); !ok {
+		return 0, false
+	}
+	_, total, found := strings.Cut(value, "/")
+	if !found {
+		return 0, false
+	}
+	total = strings.TrimSpace(total)
+	if total == "*" {
+		return -1, true
+	}
+	size, err := strconv.ParseInt(total, 10, 64)
+	if err != nil || size < 0 {
+		return 0, false
+	}
+	return size, true
 }
 
 // SetHeader sets a custom header
@@ -150,6 +512,64 @@ func (c *Client) SetHeader(key, value string) {
 	c.headers[key] = value
 }
 
+// SetAccept sets the Accept header value (empty = don't send one)
+func (c *Client) SetAccept(accept string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.accept = accept
+}
+
+// SetMinimalHeaders makes requests carry only Range, Host and the
+// headers, User-Agent and Accept set on the client; without a User-Agent
+// none is sent at all
+func (c *Client) SetMinimalHeaders(minimal bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.minimal = minimal
+}
+
+// SetTracer sets the tracer requests report spans to (nil = no tracing)
+func (c *Client) SetTracer(tracer tracing.Tracer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if tracer == nil {
+		tracer = tracing.Noop()
+	}
+	c.tracer = tracer
+}
+
+// SetSigner sets the signer every request is passed to just before it is
+// sent (nil = no signing)
+func (c *Client) SetSigner(signer RequestSigner) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.signer = signer
+}
+
+// SetFallbackLimit limits the bytes the client accepts from servers that
+// answer range requests with the whole file, including the bytes skipped
+// to reach each offset. Requests beyond it fail with
+// utils.ErrRangeNotSupported (0 = no limit).
+func (c *Client) SetFallbackLimit(limit int64) {
+	atomic.StoreInt64(&c.fallbackLimit, limit)
+}
+
+// FallbackBytes returns the bytes counted against the fallback limit
+func (c *Client) FallbackBytes() int64 {
+	return atomic.LoadInt64(&c.fallbackBytes)
+}
+
+// FallbackExceeded reports whether a request was refused by SetFallbackLimit
+func (c *Client) FallbackExceeded() bool {
+	return atomic.LoadInt32(&c.fallbackExceeded) == 1
+}
+
+func (c *Client) getTracer() tracing.Tracer {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.tracer
+}
+
 // SetHeaders sets multiple headers
 func (c *Client) SetHeaders(headers map[string]string) {
 	c.mu.Lock()
@@ -205,3 +625,27 @@ func (s *skipReader) Read(p []byte) (n int, err error) {
 func (s *skipReader) Close() error {
 	return s.reader.Close()
 }
+
+// tracedBody counts the bytes read from a response body and ends its
+// request's span on Close
+type tracedBody struct {
+	io.ReadCloser
+	span      tracing.Span
+	read      int64
+	closeOnce sync.Once
+}
+
+func (b *tracedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	return n, err
+}
+
+func (b *tracedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.closeOnce.Do(func() {
+		b.span.SetAttributes(tracing.Int64("bytes.fetched", b.read))
+		b.span.End()
+	})
+	return err
+}
@@ -0,0 +1,307 @@
+package rangehttp
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/NORMAL-EX/stream-7z/lib/utils"
+)
+
+const testData = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+// newRangeServer answers every request with 206 and the given byte range of
+// testData, regardless of what was asked for
+func newRangeServer(t *testing.T, start, end int) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(testData)))
+		w.WriteHeader(http.StatusPartialContent)
+		io.WriteString(w, testData[start:end+1])
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestRangeRequestRejectsWrongContentRange(t *testing.T) {
+	server := newRangeServer(t, 0, 9)
+	client := NewClient(nil, nil, "", 0)
+
+	_, err := client.RangeRequest(context.Background(), server.URL, 10, 5)
+	if !errors.Is(err, utils.ErrRangeMismatch) {
+		t.Fatalf("expected ErrRangeMismatch, got %v", err)
+	}
+}
+
+func TestRangeRequestTrimsWiderContentRange(t *testing.T) {
+	server := newRangeServer(t, 8, 19)
+	client := NewClient(nil, nil, "", 0)
+
+	reader, err := client.RangeRequest(context.Background(), server.URL, 10, 5)
+	if err != nil {
+		t.Fatalf("RangeRequest failed: %v", err)
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if string(data) != "abcde" {
+		t.Errorf("expected %q, got %q", "abcde", data)
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		value      string
+		start, end int64
+		ok         bool
+	}{
+		{"bytes 0-99/1000", 0, 99, true},
+		{"bytes 100-199/*", 100, 199, true},
+		{"bytes */1000", 0, 0, false},
+		{"bytes 10-5/100", 0, 0, false},
+		{"items 0-1/2", 0, 0, false},
+	}
+
+	for _, test := range tests {
+		start, end, ok := parseContentRange(test.value)
+		if ok != test.ok || start != test.start || end != test.end {
+			t.Errorf("parseContentRange(%q) = (%d, %d, %v), expected (%d, %d, %v)",
+				test.value, start, end, ok, test.start, test.end, test.ok)
+		}
+	}
+}
+
+func TestRangeRequestRequestsIdentityEncoding(t *testing.T) {
+	var acceptEncoding string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding = r.Header.Get("Accept-Encoding")
+
+		// Only compress when the client allows it, like a well-behaved server
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			io.WriteString(gz, testData)
+			gz.Close()
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(testData))
+	}))
+	defer server.Close()
+
+	client := NewClient(nil, nil, "", 0)
+	reader, err := client.RangeRequest(context.Background(), server.URL, 10, 5)
+	if err != nil {
+		t.Fatalf("RangeRequest failed: %v", err)
+	}
+	defer reader.Close()
+
+	data, _ := io.ReadAll(reader)
+	if string(data) != "abcde" {
+		t.Errorf("expected %q, got %q", "abcde", data)
+	}
+	if acceptEncoding != "identity" {
+		t.Errorf("expected Accept-Encoding identity, got %q", acceptEncoding)
+	}
+}
+
+func TestRangeRequestRejectsContentEncoding(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Misconfigured server that compresses no matter what was requested
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		io.WriteString(gz, testData)
+		gz.Close()
+	}))
+	defer server.Close()
+
+	client := NewClient(nil, nil, "", 0)
+
+	if _, err := client.RangeRequest(context.Background(), server.URL, 0, 5); !errors.Is(err, utils.ErrContentEncoded) {
+		t.Errorf("expected ErrContentEncoded from RangeRequest, got %v", err)
+	}
+	if _, err := client.Head(context.Background(), server.URL); !errors.Is(err, utils.ErrContentEncoded) {
+		t.Errorf("expected ErrContentEncoded from Head, got %v", err)
+	}
+}
+
+func TestHeadFallsBackToRangeGet(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Range") != "bytes=0-0" {
+			t.Errorf("expected a one-byte range, got %q", r.Header.Get("Range"))
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-0/%d", len(testData)))
+		w.WriteHeader(http.StatusPartialContent)
+		io.WriteString(w, testData[:1])
+	}))
+	t.Cleanup(server.Close)
+
+	info, err := NewClient(nil, nil, "", 0).Head(context.Background(), server.URL)
+	if err != nil {
+		t.Fatalf("Head failed: %v", err)
+	}
+	if info.Size != int64(len(testData)) || !info.SupportsRange || info.ContentType != "application/zip" {
+		t.Errorf("unexpected head info: %+v", info)
+	}
+}
+
+func TestParseContentRangeTotal(t *testing.T) {
+	tests := []struct {
+		value string
+		total int64
+		ok    bool
+	}{
+		{"bytes 0-0/1234", 1234, true},
+		{"bytes 0-0/*", -1, true},
+		{"bytes 0-0", 0, false},
+		{"bytes 0-0/abc", 0, false},
+		{"bytes */1234", 0, false},
+	}
+
+	for _, test := range tests {
+		total, ok := parseContentRangeTotal(test.value)
+		if total != test.total || ok != test.ok {
+			t.Errorf("parseContentRangeTotal(%q) = %d, %v; expected %d, %v", test.value, total, ok, test.total, test.ok)
+		}
+	}
+}
+
+func TestProbeRange(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        int
+		contentRange  string
+		size          int64
+		supportsRange bool
+		wantErr       error
+	}{
+		{"partial content", http.StatusPartialContent, "bytes 0-0/1234", 1234, true, nil},
+		{"range ignored", http.StatusOK, "", int64(len(testData)), false, nil},
+		{"empty file", http.StatusRequestedRangeNotSatisfiable, "bytes */0", 0, true, nil},
+		{"missing content range", http.StatusPartialContent, "", 0, false, utils.ErrRangeMismatch},
+		{"invalid content range", http.StatusPartialContent, "bytes 0-0/abc", 0, false, utils.ErrRangeMismatch},
+	}
+
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if test.contentRange != "" {
+				w.Header().Set("Content-Range", test.contentRange)
+			}
+			w.WriteHeader(test.status)
+			if test.status == http.StatusOK {
+				io.WriteString(w, testData)
+			}
+		}))
+
+		info, err := NewClient(nil, nil, "", 0).ProbeRange(context.Background(), server.URL)
+		server.Close()
+		if test.wantErr != nil {
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("%s: expected %v, got %v", test.name, test.wantErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: ProbeRange failed: %v", test.name, err)
+			continue
+		}
+		if info.Size != test.size || info.SupportsRange != test.supportsRange {
+			t.Errorf("%s: expected size %d range %v, got %+v", test.name, test.size, test.supportsRange, info)
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+	var statusErr *StatusError
+	if _, err := NewClient(nil, nil, "", 0).ProbeRange(context.Background(), server.URL); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusForbidden {
+		t.Errorf("expected a 403 StatusError, got %v", err)
+	}
+}
+
+func TestRangeNotSatisfiable(t *testing.T) {
+	// The file shrinks from len(testData) to 20 bytes after it was opened.
+	// Without Content-Range in the 416 the size is asked for again with HEAD.
+	const shrunk = 20
+	var requests int64
+	newServer := func(reportSize bool) *httptest.Server {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet {
+				atomic.AddInt64(&requests, 1)
+			}
+			if !reportSize && r.Method == http.MethodGet {
+				var start int
+				fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start)
+				if start >= shrunk {
+					w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+					return
+				}
+			}
+			http.ServeContent(w, r, "", time.Time{}, strings.NewReader(testData[:shrunk]))
+		}))
+		t.Cleanup(server.Close)
+		return server
+	}
+
+	for _, reportSize := range []bool{true, false} {
+		server := newServer(reportSize)
+		open := func(size int64, truncate bool) *RangeReader {
+			r, err := NewRangeReader(context.Background(), NewClient(nil, nil, "", 0), server.URL, size)
+			if err != nil {
+				t.Fatalf("NewRangeReader failed: %v", err)
+			}
+			r.SetRetries(3, time.Millisecond, 0)
+			r.SetTruncateOnShrink(truncate)
+			t.Cleanup(func() { r.Close() })
+			return r
+		}
+
+		atomic.StoreInt64(&requests, 0)
+		p := make([]byte, 5)
+		if _, err := open(int64(len(testData)), false).ReadAt(p, 25); !errors.Is(err, utils.ErrArchiveChanged) {
+			t.Errorf("report size %v: expected ErrArchiveChanged, got %v", reportSize, err)
+		}
+		if n := atomic.LoadInt64(&requests); n != 1 {
+			t.Errorf("report size %v: expected the 416 not to be retried, sent %d requests", reportSize, n)
+		}
+
+		n, err := open(int64(len(testData)), true).ReadAt(p, 25)
+		if n != 0 || err != io.EOF {
+			t.Errorf("report size %v: expected io.EOF past the new end when truncating, got %d, %v", reportSize, n, err)
+		}
+
+		// The size didn't change, yet the server refuses a range inside it
+		if _, err := open(shrunk+10, false).ReadAt(p, shrunk+1); !errors.Is(err, utils.ErrArchiveChanged) {
+			t.Errorf("report size %v: expected ErrArchiveChanged for a larger opened size, got %v", reportSize, err)
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(testData)))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+	}))
+	defer server.Close()
+	r, _ := NewRangeReader(context.Background(), NewClient(nil, nil, "", 0), server.URL, int64(len(testData)))
+	defer r.Close()
+	if _, err := r.ReadAt(make([]byte, 5), 0); !errors.Is(err, utils.ErrArchiveCorrupted) {
+		t.Errorf("expected ErrArchiveCorrupted when the size is unchanged, got %v", err)
+	}
+}
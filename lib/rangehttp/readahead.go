@@ -0,0 +1,97 @@
+package rangehttp
+
+import "sync"
+
+// readAhead adapts how much RangeReader fetches per request to the access
+// pattern. Sequential reads double the fetch size up to max so scans need
+// few requests; a random read drops it back to min so small lookups don't
+// over-fetch. The extra bytes of the last fetch are kept to serve the
+// reads that follow.
+type readAhead struct {
+	mu        sync.Mutex
+	min, max  int64
+	fetchSize int64
+	lastEnd   int64  // End offset of the previous read
+	buf       []byte // Bytes of the last fetch
+	bufOff    int64  // Offset of buf within the file
+}
+
+// enabled reports whether adaptive sizing is on
+func (ra *readAhead) enabled() bool {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+	return ra.min > 0
+}
+
+// readAt serves p from the buffered fetch if possible, otherwise fetches
+// at least the current fetch size starting at off
+func (ra *readAhead) readAt(r *RangeReader, p []byte, off int64) (int, error) {
+	length := int64(len(p))
+
+	ra.mu.Lock()
+	if off >= ra.bufOff && off+length <= ra.bufOff+int64(len(ra.buf)) {
+		n := copy(p, ra.buf[off-ra.bufOff:])
+		ra.lastEnd = off + length
+		ra.mu.Unlock()
+		r.observe(int64(n), 0, true)
+		return n, nil
+	}
+
+	if off == ra.lastEnd && ra.fetchSize > 0 {
+		ra.fetchSize *= 2
+		if ra.fetchSize > ra.max {
+			ra.fetchSize = ra.max
+		}
+	} else {
+		ra.fetchSize = ra.min
+	}
+
+	fetchLength := ra.fetchSize
+	if fetchLength < length {
+		fetchLength = length
+	}
+	if off+fetchLength > r.size {
+		fetchLength = r.size - off
+	}
+	ra.mu.Unlock()
+
+	if fetchLength == length {
+		n, err := r.fetch(p, off)
+		ra.mu.Lock()
+		ra.lastEnd = off + int64(n)
+		ra.mu.Unlock()
+		return n, err
+	}
+
+	buf := make([]byte, fetchLength)
+	n, err := r.fetch(buf, off)
+	if err != nil {
+		return copy(p, buf[:n]), err
+	}
+
+	ra.mu.Lock()
+	ra.buf = buf
+	ra.bufOff = off
+	ra.lastEnd = off + length
+	ra.mu.Unlock()
+
+	return copy(p, buf), nil
+}
+
+// SetFetchSizes enables adaptive request sizing. Each request fetches at
+// least min bytes after a random read, growing up to max on sequential
+// reads. min <= 0 disables it: every ReadAt then issues a request for
+// exactly the bytes asked for.
+func (r *RangeReader) SetFetchSizes(min, max int64) {
+	if max < min {
+		max = min
+	}
+
+	r.readAhead.mu.Lock()
+	defer r.readAhead.mu.Unlock()
+
+	r.readAhead.min = min
+	r.readAhead.max = max
+	r.readAhead.fetchSize = 0
+	r.readAhead.buf = nil
+}
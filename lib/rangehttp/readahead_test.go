@@ -0,0 +1,113 @@
+package rangehttp
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newCountingRangeServer serves data with Range support and counts requests
+// and bytes sent
+func newCountingRangeServer(t *testing.T, data []byte) (*httptest.Server, *int64, *int64) {
+	t.Helper()
+
+	var requests, sent int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		cw := &countingWriter{ResponseWriter: w, n: &sent}
+		http.ServeContent(cw, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &requests, &sent
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	n *int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	atomic.AddInt64(w.n, int64(len(p)))
+	return w.ResponseWriter.Write(p)
+}
+
+// scan reads the first length bytes sequentially in chunk-sized ReadAt calls
+func scan(t *testing.T, r *RangeReader, length int64, chunk int) {
+	t.Helper()
+
+	buf := make([]byte, chunk)
+	for off := int64(0); off < length; off += int64(chunk) {
+		if _, err := r.ReadAt(buf, off); err != nil {
+			t.Fatalf("ReadAt(%d) failed: %v", off, err)
+		}
+	}
+}
+
+func TestReadAheadSequentialScan(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	server, requests, _ := newCountingRangeServer(t, data)
+	client := NewClient(nil, nil, "", 0)
+
+	// One request per ReadAt: 256 requests for 1MB in 4KB reads
+	exact, err := NewRangeReader(context.Background(), client, server.URL, int64(len(data)))
+	if err != nil {
+		t.Fatalf("NewRangeReader failed: %v", err)
+	}
+	scan(t, exact, exact.Size(), 4096)
+	exactRequests := atomic.SwapInt64(requests, 0)
+
+	adaptive, err := NewRangeReader(context.Background(), client, server.URL, int64(len(data)))
+	if err != nil {
+		t.Fatalf("NewRangeReader failed: %v", err)
+	}
+	adaptive.SetFetchSizes(32*1024, 1<<20)
+	scan(t, adaptive, adaptive.Size(), 4096)
+	adaptiveRequests := atomic.LoadInt64(requests)
+
+	if exactRequests != 256 {
+		t.Errorf("expected 256 requests without read-ahead, got %d", exactRequests)
+	}
+	// 32K, 64K, 128K, 256K, 512K and the remaining 32K
+	if adaptiveRequests > 6 {
+		t.Errorf("expected at most 6 requests with read-ahead, got %d", adaptiveRequests)
+	}
+}
+
+func TestReadAheadRandomAccessStaysSmall(t *testing.T) {
+	data := make([]byte, 4<<20)
+	server, requests, sent := newCountingRangeServer(t, data)
+	client := NewClient(nil, nil, "", 0)
+
+	r, err := NewRangeReader(context.Background(), client, server.URL, int64(len(data)))
+	if err != nil {
+		t.Fatalf("NewRangeReader failed: %v", err)
+	}
+	r.SetFetchSizes(32*1024, 1<<20)
+
+	// Grow the fetch size with a sequential scan, then jump around
+	scan(t, r, 1<<20, 4096)
+	atomic.StoreInt64(requests, 0)
+	atomic.StoreInt64(sent, 0)
+
+	buf := make([]byte, 16)
+	offsets := []int64{3 << 20, 2<<20 + 12345, 3<<20 + 500000, 2<<20 + 900000}
+	for _, off := range offsets {
+		if _, err := r.ReadAt(buf, off); err != nil {
+			t.Fatalf("ReadAt(%d) failed: %v", off, err)
+		}
+	}
+
+	if n := atomic.LoadInt64(requests); n != int64(len(offsets)) {
+		t.Errorf("expected %d requests, got %d", len(offsets), n)
+	}
+	if n := atomic.LoadInt64(sent); n > int64(len(offsets))*32*1024 {
+		t.Errorf("random reads fetched %d bytes, expected at most 32KB each", n)
+	}
+}
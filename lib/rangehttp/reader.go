@@ -5,7 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/NORMAL-EX/stream-7z/lib/utils"
 )
 
 // RangeReader provides io.ReaderAt interface using HTTP Range requests
@@ -18,6 +25,45 @@ type RangeReader struct {
 	mu         sync.Mutex
 	activeReqs map[int64]io.ReadCloser // Track active readers by offset
 	closed     bool
+	readAhead  readAhead
+	data       []byte   // Whole file, once loaded by Preload
+	spill      *os.File // Whole file, once downloaded by PreloadToFile
+
+	requests     int64 // Range requests sent, updated atomically
+	bytesFetched int64 // Bytes received by them, updated atomically
+	cachedReads  int64 // Reads served from memory, updated atomically
+	maxRequests  int64 // 0 = unlimited
+	refused      int32 // Set once a read is refused by maxRequests
+
+	retries     int           // Extra attempts at a request failing transiently
+	retryDelay  time.Duration // Wait before the first retry, doubling after
+	retryBudget int64         // Retries allowed across all requests, 0 = unlimited
+	retried     int64         // Retries spent, updated atomically
+	exhausted   int32         // Set once a read failed with the budget spent
+
+	observer ReadObserver // nil = not observed
+
+	truncateOnShrink bool // Read up to the new end of a file that became shorter
+
+	cache    RangeCache // nil = no shared cache
+	cacheKey string     // Identifies the file and its version in cache
+}
+
+// ReadObserver is told about every read of a RangeReader: the bytes read,
+// how long it took and whether it was served from memory (a preloaded
+// file or the read-ahead buffer) rather than by a range request
+type ReadObserver func(bytes int64, duration time.Duration, cached bool)
+
+// RangeCache keeps byte ranges fetched by range requests so readers of
+// the same file can share them. Implementations must be safe for
+// concurrent use.
+type RangeCache interface {
+	// Get fills p with the bytes at off of the file identified by key and
+	// reports whether they were all cached
+	Get(key string, off int64, p []byte) bool
+	// Put stores the bytes fetched at off. data must not be modified
+	// afterwards.
+	Put(key string, off int64, data []byte)
 }
 
 // NewRangeReader creates a new RangeReader for the given URL
@@ -43,6 +89,20 @@ func NewRangeReader(ctx context.Context, client *Client, url string, size int64)
 	}, nil
 }
 
+// NewMemoryReader creates a RangeReader serving data from memory, for
+// archives that don't come from an HTTP server
+func NewMemoryReader(ctx context.Context, data []byte) *RangeReader {
+	childCtx, cancel := context.WithCancel(ctx)
+
+	return &RangeReader{
+		ctx:        childCtx,
+		cancel:     cancel,
+		size:       int64(len(data)),
+		activeReqs: make(map[int64]io.ReadCloser),
+		data:       data,
+	}
+}
+
 // ReadAt reads len(p) bytes starting at offset off
 func (r *RangeReader) ReadAt(p []byte, off int64) (n int, err error) {
 	r.mu.Lock()
@@ -50,6 +110,7 @@ func (r *RangeReader) ReadAt(p []byte, off int64) (n int, err error) {
 		r.mu.Unlock()
 		return 0, errors.New("reader is closed")
 	}
+	data, spill := r.data, r.spill
 	r.mu.Unlock()
 
 	if off < 0 {
@@ -60,35 +121,344 @@ func (r *RangeReader) ReadAt(p []byte, off int64) (n int, err error) {
 		return 0, io.EOF
 	}
 
+	if data != nil {
+		n = copy(p, data[off:])
+		r.observe(int64(n), 0, true)
+		return n, nil
+	}
+
 	// Calculate read length
 	length := int64(len(p))
 	if off+length > r.size {
 		length = r.size - off
 	}
 
+	if spill != nil {
+		n, err = spill.ReadAt(p[:length], off)
+		r.observe(int64(n), 0, true)
+		return n, err
+	}
+
+	if r.readAhead.enabled() {
+		return r.readAhead.readAt(r, p[:length], off)
+	}
+	return r.fetch(p[:length], off)
+}
+
+// fetch reads exactly len(p) bytes at off with a range request, retried
+// as configured by SetRetries, or from the shared cache if it holds them.
+// Failures other than io.EOF are returned as a *TransferError.
+func (r *RangeReader) fetch(p []byte, off int64) (int, error) {
+	length := int64(len(p))
+
+	if r.cache != nil && r.cache.Get(r.cacheKey, off, p) {
+		r.observe(length, 0, true)
+		return len(p), nil
+	}
+
+	if atomic.LoadInt32(&r.exhausted) == 1 {
+		// The origin already failed more often than the budget allows
+		err := utils.WrapError(utils.ErrRetryBudgetExceeded, "%d retries spent", atomic.LoadInt64(&r.retryBudget))
+		return 0, &TransferError{Offset: off, Length: length, Err: err}
+	}
+
+	total := 0
+	for attempt := 0; ; attempt++ {
+		// A failed body keeps what it delivered; the retry asks for the rest
+		n, err := r.fetchOnce(p[total:], off+int64(total))
+		total += n
+		if err == nil {
+			break
+		}
+		retry, err := r.retry(attempt, err)
+		if !retry {
+			if errors.Is(err, utils.ErrRetryBudgetExceeded) {
+				atomic.StoreInt32(&r.exhausted, 1)
+			}
+			if err == io.EOF {
+				// The file shrank and SetTruncateOnShrink is set
+				return total, err
+			}
+			return total, &TransferError{Offset: off, Length: length, Err: err}
+		}
+	}
+
+	if r.cache != nil {
+		r.cache.Put(r.cacheKey, off, append([]byte(nil), p...))
+	}
+	return total, nil
+}
+
+// fetchOnce reads exactly len(p) bytes at off with a single range request
+func (r *RangeReader) fetchOnce(p []byte, off int64) (int, error) {
+	length := int64(len(p))
+
+	if err := r.countRequest(); err != nil {
+		return 0, err
+	}
+
 	// Perform range request
+	start := time.Now()
 	reader, err := r.client.RangeRequest(r.ctx, r.url, off, length)
 	if err != nil {
+		r.observe(0, time.Since(start), false)
+		var notSatisfiable *RangeNotSatisfiableError
+		if errors.As(err, &notSatisfiable) {
+			return r.rangeNotSatisfiable(p, off, notSatisfiable.Size)
+		}
 		return 0, err
 	}
 	defer reader.Close()
 
 	// Read data
 	total := 0
+	defer func() {
+		atomic.AddInt64(&r.bytesFetched, int64(total))
+		r.observe(int64(total), time.Since(start), false)
+	}()
 	for total < int(length) {
 		nn, err := reader.Read(p[total:])
 		total += nn
 		if err != nil {
 			if err == io.EOF && total == int(length) {
-				return total, nil
+				break
 			}
 			return total, err
 		}
 	}
-
 	return total, nil
 }
 
+// rangeNotSatisfiable handles a 416 for len(p) bytes at off, which lie
+// within the size the reader was opened with. size is the one the response
+// reported, or -1 to fetch it again with a HEAD request. A file that became
+// shorter fails with utils.ErrArchiveChanged, or with SetTruncateOnShrink
+// is read up to its new end, followed by io.EOF. A file whose size didn't
+// change fails with utils.ErrArchiveCorrupted.
+func (r *RangeReader) rangeNotSatisfiable(p []byte, off, size int64) (int, error) {
+	end := off + int64(len(p)) - 1
+	if size < 0 {
+		info, err := r.client.Head(r.ctx, r.url)
+		if err != nil {
+			return 0, utils.WrapError(utils.ErrArchiveChanged, "range %d-%d not satisfiable, and fetching the size again failed: %v", off, end, err)
+		}
+		size = info.Size
+	}
+
+	switch {
+	case size == r.size:
+		return 0, utils.WrapError(utils.ErrArchiveCorrupted, "server refused range %d-%d of a %d byte file", off, end, size)
+	case size > r.size || !r.truncateOnShrink:
+		return 0, utils.WrapError(utils.ErrArchiveChanged, "file size changed from %d to %d bytes", r.size, size)
+	case off >= size:
+		return 0, io.EOF
+	}
+
+	n, err := r.fetchOnce(p[:size-off], off)
+	if err == nil {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// SetTruncateOnShrink makes reads of a file that became shorter since
+// the reader was opened return the bytes up to its new end and io.EOF,
+// rather than fail with utils.ErrArchiveChanged
+func (r *RangeReader) SetTruncateOnShrink(truncate bool) {
+	r.truncateOnShrink = truncate
+}
+
+// countRequest counts a range request about to be sent, refusing it if
+// it would exceed the request limit
+func (r *RangeReader) countRequest() error {
+	n := atomic.AddInt64(&r.requests, 1)
+	if max := atomic.LoadInt64(&r.maxRequests); max > 0 && n > max {
+		atomic.AddInt64(&r.requests, -1)
+		atomic.StoreInt32(&r.refused, 1)
+		return utils.WrapError(utils.ErrRangeBudgetExceeded, "more than %d range requests", max)
+	}
+	return nil
+}
+
+// Preload downloads the whole file with a single request so that all
+// later ReadAt calls are served from memory. Meant for small files, where
+// the round trips of many small range requests dominate.
+func (r *RangeReader) Preload() error {
+	data := make([]byte, r.size)
+	if _, err := r.fetch(data, 0); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.data = data
+	r.mu.Unlock()
+	return nil
+}
+
+// spillPrefix starts the names of the temporary files of PreloadToFile
+const spillPrefix = "stream-7z-spill-"
+
+// spillBytes is the size of the temporary files of all readers, updated
+// atomically
+var spillBytes int64
+
+// ErrSpillFull is returned by PreloadToFile when the file doesn't fit in
+// the space left for temporary files
+var ErrSpillFull = errors.New("temporary file space limit reached")
+
+// SpillBytes returns the bytes held by the temporary files of all readers
+func SpillBytes() int64 {
+	return atomic.LoadInt64(&spillBytes)
+}
+
+// PreloadToFile downloads the whole file like Preload, but into a
+// temporary file in dir rather than memory, for files too large to keep
+// there. maxBytes caps the size of the temporary files of all readers
+// together (0 = no limit); a file that doesn't fit fails with
+// ErrSpillFull before anything is downloaded. The file is removed when
+// the reader is closed.
+func (r *RangeReader) PreloadToFile(dir string, maxBytes int64) error {
+	if total := atomic.AddInt64(&spillBytes, r.size); maxBytes > 0 && total > maxBytes {
+		atomic.AddInt64(&spillBytes, -r.size)
+		return utils.WrapError(ErrSpillFull, "%d bytes needed", r.size)
+	}
+
+	file, err := os.CreateTemp(dir, spillPrefix+"*")
+	if err != nil {
+		atomic.AddInt64(&spillBytes, -r.size)
+		return utils.WrapError(err, "failed to create temporary file")
+	}
+	if err := r.download(file); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		atomic.AddInt64(&spillBytes, -r.size)
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		file.Close()
+		atomic.AddInt64(&spillBytes, -r.size)
+		return os.Remove(file.Name())
+	}
+	r.spill = file
+	return nil
+}
+
+// CleanSpillDir removes the temporary files PreloadToFile left in dir
+// when the process was killed before closing its readers. It must not
+// run while readers spilling to dir are open. It returns the number of
+// files removed.
+func CleanSpillDir(dir string) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !isSpillName(entry.Name()) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// isSpillName reports whether name is one os.CreateTemp gives the
+// temporary files of PreloadToFile
+func isSpillName(name string) bool {
+	suffix := strings.TrimPrefix(name, spillPrefix)
+	if suffix == name || suffix == "" {
+		return false
+	}
+	for _, c := range suffix {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// download copies the whole file to w with a single range request
+func (r *RangeReader) download(w io.Writer) error {
+	if err := r.countRequest(); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	reader, err := r.client.RangeRequest(r.ctx, r.url, 0, r.size)
+	if err != nil {
+		r.observe(0, time.Since(start), false)
+		return err
+	}
+	defer reader.Close()
+
+	n, err := io.CopyN(w, reader, r.size)
+	atomic.AddInt64(&r.bytesFetched, n)
+	r.observe(n, time.Since(start), false)
+	return err
+}
+
+// SetObserver sets the function told about every read. It must be called
+// before the first read.
+func (r *RangeReader) SetObserver(observer ReadObserver) {
+	r.observer = observer
+}
+
+// observe reports a read to the observer, if any
+func (r *RangeReader) observe(bytes int64, duration time.Duration, cached bool) {
+	if cached {
+		atomic.AddInt64(&r.cachedReads, 1)
+	}
+	if r.observer != nil {
+		r.observer(bytes, duration, cached)
+	}
+}
+
+// SetCache makes the reader look up ranges in cache before requesting
+// them, and store the ranges it fetches. key must identify the file and
+// its version, e.g. the URL and ETag. It must be called before the first
+// read.
+func (r *RangeReader) SetCache(cache RangeCache, key string) {
+	r.cache = cache
+	r.cacheKey = key
+}
+
+// SetMaxRequests limits the range requests the reader sends; reads that
+// would need more fail with utils.ErrRangeBudgetExceeded (0 = no limit)
+func (r *RangeReader) SetMaxRequests(max int) {
+	atomic.StoreInt64(&r.maxRequests, int64(max))
+}
+
+// Requests returns the number of range requests sent so far
+func (r *RangeReader) Requests() int64 {
+	return atomic.LoadInt64(&r.requests)
+}
+
+// BytesFetched returns the number of bytes received from range requests
+func (r *RangeReader) BytesFetched() int64 {
+	return atomic.LoadInt64(&r.bytesFetched)
+}
+
+// CachedReads returns the number of reads served from memory: the
+// preloaded file, the read-ahead buffer or the shared cache
+func (r *RangeReader) CachedReads() int64 {
+	return atomic.LoadInt64(&r.cachedReads)
+}
+
+// BudgetExceeded reports whether a read was refused by SetMaxRequests
+func (r *RangeReader) BudgetExceeded() bool {
+	return atomic.LoadInt32(&r.refused) == 1
+}
+
 // Size returns the total size of the remote file
 func (r *RangeReader) Size() int64 {
 	return r.size
@@ -131,6 +501,12 @@ func (r *RangeReader) Close() error {
 	}
 	r.activeReqs = nil
 
+	if r.spill != nil {
+		r.spill.Close()
+		os.Remove(r.spill.Name())
+		r.spill = nil
+		atomic.AddInt64(&spillBytes, -r.size)
+	}
 	return nil
 }
 
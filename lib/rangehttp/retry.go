@@ -0,0 +1,112 @@
+package rangehttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/NORMAL-EX/stream-7z/lib/utils"
+)
+
+// TransferError reports a read of the archive's bytes that failed, as
+// opposed to bytes that were read but fail to decompress. Range reads
+// return it once their retries are spent. It unwraps to Err, so
+// errors.Is and errors.As still match the cause.
+type TransferError struct {
+	Offset int64 // First byte of the failed read
+	Length int64
+	Err    error
+}
+
+func (e *TransferError) Error() string {
+	return fmt.Sprintf("failed to read bytes %d-%d: %v", e.Offset, e.Offset+e.Length-1, e.Err)
+}
+
+func (e *TransferError) Unwrap() error {
+	return e.Err
+}
+
+// IsTransferError reports whether err comes from reading the archive's
+// bytes rather than from what they decompress to
+func IsTransferError(err error) bool {
+	var transferErr *TransferError
+	return errors.As(err, &transferErr)
+}
+
+// IsTransient reports whether a failed request may succeed when sent
+// again. Client errors like 404 and bad responses are final.
+func IsTransient(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= http.StatusInternalServerError ||
+			statusErr.StatusCode == http.StatusTooManyRequests
+	}
+	if errors.Is(err, utils.ErrContentEncoded) || errors.Is(err, utils.ErrRangeMismatch) ||
+		errors.Is(err, utils.ErrRangeBudgetExceeded) || errors.Is(err, utils.ErrRangeNotSupported) ||
+		errors.Is(err, utils.ErrArchiveChanged) || errors.Is(err, utils.ErrArchiveCorrupted) ||
+		errors.Is(err, utils.ErrRetryBudgetExceeded) || err == io.EOF {
+		return false
+	}
+	// A rejected certificate won't be accepted on the next attempt either
+	if msg := err.Error(); strings.Contains(msg, "x509:") || strings.Contains(msg, "tls:") {
+		return false
+	}
+	// Anything else failed before a response arrived, e.g. a reset connection
+	return true
+}
+
+// SetRetries makes a failed range request be sent up to retries more
+// times when the failure is transient, waiting delay before the first
+// retry and doubling it after each further one. budget caps the retries
+// of all requests together (0 = no cap): once it is spent, reads fail
+// with utils.ErrRetryBudgetExceeded on their first transient error
+// rather than each retrying on its own against an origin that is down.
+func (r *RangeReader) SetRetries(retries int, delay time.Duration, budget int) {
+	r.retries = retries
+	r.retryDelay = delay
+	atomic.StoreInt64(&r.retryBudget, int64(budget))
+}
+
+// Retries returns the number of range requests sent again after a
+// transient failure
+func (r *RangeReader) Retries() int64 {
+	return atomic.LoadInt64(&r.retried)
+}
+
+// RetryBudgetExceeded reports whether a read failed because the retry
+// budget was spent
+func (r *RangeReader) RetryBudgetExceeded() bool {
+	return atomic.LoadInt32(&r.exhausted) == 1
+}
+
+// retry decides whether the attempt-th request, which failed with err, is
+// sent again, and waits before it is. The returned error replaces err when
+// the retry budget is spent.
+func (r *RangeReader) retry(attempt int, err error) (bool, error) {
+	if attempt >= r.retries || !IsTransient(r.ctx, err) {
+		return false, err
+	}
+
+	n := atomic.AddInt64(&r.retried, 1)
+	if budget := atomic.LoadInt64(&r.retryBudget); budget > 0 && n > budget {
+		atomic.AddInt64(&r.retried, -1)
+		return false, utils.WrapError(utils.ErrRetryBudgetExceeded, "%d retries spent, last error: %v", budget, err)
+	}
+
+	timer := time.NewTimer(r.retryDelay << attempt)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true, nil
+	case <-r.ctx.Done():
+		return false, err
+	}
+}
@@ -0,0 +1,147 @@
+package lib
+
+import (
+	"container/list"
+	"strconv"
+	"sync"
+
+	"github.com/NORMAL-EX/stream-7z/lib/rangehttp"
+)
+
+// SharedCache keeps byte ranges fetched by range requests so that every
+// Archive opened for the same file reuses them, e.g. a server opening a
+// popular archive once per request. Ranges are keyed by the URL and the
+// ETag (or Last-Modified) the server reported, so a replaced file is never
+// served from stale ranges; files whose server sends neither are not
+// cached. The least recently used ranges are dropped once the cache holds
+// more than its byte or entry limit. One cache can be shared by any
+// number of configs and is safe for concurrent use.
+type SharedCache struct {
+	maxBytes   int64
+	maxEntries int
+
+	mu     sync.Mutex
+	lru    *list.List                 // *cachedRange, most recently used first
+	files  map[string][]*list.Element // Ranges of each file key
+	bytes  int64
+	hits   int64
+	misses int64
+}
+
+// cachedRange is one fetched byte range of a file
+type cachedRange struct {
+	key  string
+	off  int64
+	data []byte
+}
+
+// SharedCacheStats describes the contents and use of a SharedCache
+type SharedCacheStats struct {
+	Entries int
+	Bytes   int64
+	Hits    int64
+	Misses  int64
+}
+
+// NewSharedCache creates a cache holding at most maxBytes of archive data
+// in at most maxEntries ranges (0 = no entry limit)
+func NewSharedCache(maxBytes int64, maxEntries int) *SharedCache {
+	return &SharedCache{
+		maxBytes:   maxBytes,
+		maxEntries: maxEntries,
+		lru:        list.New(),
+		files:      make(map[string][]*list.Element),
+	}
+}
+
+// Get fills p from a cached range of key covering [off, off+len(p))
+func (c *SharedCache) Get(key string, off int64, p []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	end := off + int64(len(p))
+	for _, elem := range c.files[key] {
+		r := elem.Value.(*cachedRange)
+		if r.off <= off && end <= r.off+int64(len(r.data)) {
+			copy(p, r.data[off-r.off:])
+			c.lru.MoveToFront(elem)
+			c.hits++
+			return true
+		}
+	}
+	c.misses++
+	return false
+}
+
+// Put stores data fetched at off of key, evicting the least recently used
+// ranges to stay within the limits. Ranges larger than the whole cache
+// are not stored.
+func (c *SharedCache) Put(key string, off int64, data []byte) {
+	size := int64(len(data))
+	if size == 0 || size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, elem := range c.files[key] {
+		r := elem.Value.(*cachedRange)
+		if r.off <= off && off+size <= r.off+int64(len(r.data)) {
+			// Another reader stored it first
+			c.lru.MoveToFront(elem)
+			return
+		}
+	}
+
+	elem := c.lru.PushFront(&cachedRange{key: key, off: off, data: data})
+	c.files[key] = append(c.files[key], elem)
+	c.bytes += size
+
+	for c.bytes > c.maxBytes || (c.maxEntries > 0 && c.lru.Len() > c.maxEntries) {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops elem from the cache; the caller holds c.mu
+func (c *SharedCache) remove(elem *list.Element) {
+	r := c.lru.Remove(elem).(*cachedRange)
+	c.bytes -= int64(len(r.data))
+
+	ranges := c.files[r.key]
+	for i, e := range ranges {
+		if e == elem {
+			ranges = append(ranges[:i], ranges[i+1:]...)
+			break
+		}
+	}
+	if len(ranges) == 0 {
+		delete(c.files, r.key)
+	} else {
+		c.files[r.key] = ranges
+	}
+}
+
+// Stats returns the number and size of the cached ranges and how often
+// lookups found them
+func (c *SharedCache) Stats() SharedCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return SharedCacheStats{
+		Entries: c.lru.Len(),
+		Bytes:   c.bytes,
+		Hits:    c.hits,
+		Misses:  c.misses,
+	}
+}
+
+// useSharedCache connects reader to the config's shared cache, if any,
+// when the server identified the file's version
+func (c *Config) useSharedCache(reader *rangehttp.RangeReader, archiveURL string, info *rangehttp.HeadInfo) {
+	if c.SharedCache == nil || info.Validator() == "" {
+		return
+	}
+	key := archiveURL + "\x00" + info.Validator() + "\x00" + strconv.FormatInt(info.Size, 10)
+	reader.SetCache(c.SharedCache, key)
+}
@@ -0,0 +1,159 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/NORMAL-EX/stream-7z/internal/testarchive"
+)
+
+func TestSharedCacheLookup(t *testing.T) {
+	cache := NewSharedCache(1024, 0)
+	cache.Put("a", 100, []byte("0123456789"))
+
+	p := make([]byte, 4)
+	if !cache.Get("a", 103, p) || string(p) != "3456" {
+		t.Errorf("expected a range inside the cached one to hit, got %q", p)
+	}
+	if cache.Get("a", 108, p) {
+		t.Error("expected a range running past the cached one to miss")
+	}
+	if cache.Get("b", 103, p) {
+		t.Error("expected another key to miss")
+	}
+
+	stats := cache.Stats()
+	if stats.Entries != 1 || stats.Bytes != 10 || stats.Hits != 1 || stats.Misses != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestSharedCacheEviction(t *testing.T) {
+	cache := NewSharedCache(30, 0)
+	cache.Put("a", 0, make([]byte, 10))
+	cache.Put("a", 10, make([]byte, 10))
+	cache.Put("a", 20, make([]byte, 10))
+
+	// Touch the first range, so the second is the least recently used
+	cache.Get("a", 0, make([]byte, 1))
+	cache.Put("a", 30, make([]byte, 10))
+
+	if cache.Get("a", 10, make([]byte, 1)) {
+		t.Error("expected the least recently used range to be evicted")
+	}
+	if !cache.Get("a", 0, make([]byte, 1)) || !cache.Get("a", 30, make([]byte, 1)) {
+		t.Error("expected the recently used ranges to be kept")
+	}
+	if stats := cache.Stats(); stats.Bytes != 30 || stats.Entries != 3 {
+		t.Errorf("expected 30 bytes in 3 ranges, got %+v", stats)
+	}
+
+	// Larger than the whole cache
+	cache.Put("b", 0, make([]byte, 31))
+	if cache.Get("b", 0, make([]byte, 1)) {
+		t.Error("expected a range larger than the cache not to be stored")
+	}
+
+	limited := NewSharedCache(1024, 2)
+	for i := 0; i < 5; i++ {
+		limited.Put("a", int64(i*10), make([]byte, 10))
+	}
+	if stats := limited.Stats(); stats.Entries != 2 {
+		t.Errorf("expected the entry limit to keep 2 ranges, got %d", stats.Entries)
+	}
+}
+
+func TestSharedCacheConcurrent(t *testing.T) {
+	cache := NewSharedCache(64*100, 50)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			key := fmt.Sprintf("file%d", g%3)
+			p := make([]byte, 64)
+			for i := 0; i < 500; i++ {
+				off := int64(i%40) * 64
+				if cache.Get(key, off, p) {
+					if p[0] != byte(off/64) {
+						t.Errorf("wrong data for %s at %d", key, off)
+						return
+					}
+					continue
+				}
+				data := bytes.Repeat([]byte{byte(off / 64)}, 64)
+				cache.Put(key, off, data)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if stats := cache.Stats(); stats.Entries > 50 || stats.Bytes > 64*100 {
+		t.Errorf("limits exceeded: %+v", stats)
+	}
+}
+
+func TestSharedCacheAcrossArchives(t *testing.T) {
+	data := testarchive.Zip(t, testarchive.Pairs("a.txt", "alpha", "b.txt", "beta")...)
+
+	var gets int64
+	etag := `"v1"`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			atomic.AddInt64(&gets, 1)
+		}
+		if r.URL.Path != "/untagged.zip" {
+			w.Header().Set("ETag", etag)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+
+	cache := NewSharedCache(1024*1024, 0)
+	config := DefaultConfig().WithWholeDownloadThreshold(0).WithSharedCache(cache)
+
+	list := func(path string) {
+		t.Helper()
+		archive, err := NewArchive(server.URL+path, config)
+		if err != nil {
+			t.Fatalf("NewArchive failed: %v", err)
+		}
+		defer archive.Close()
+		if files, err := archive.ListFiles("", ""); err != nil || len(files) != 2 {
+			t.Fatalf("expected 2 files, got %d (%v)", len(files), err)
+		}
+	}
+
+	list("/a.zip")
+	first := atomic.LoadInt64(&gets)
+	if first == 0 {
+		t.Fatal("expected the first archive to send range requests")
+	}
+
+	list("/a.zip")
+	if n := atomic.LoadInt64(&gets); n != first {
+		t.Errorf("expected the second archive to be served from the cache, sent %d more requests", n-first)
+	}
+
+	// A new version of the file doesn't reuse the old ranges
+	etag = `"v2"`
+	list("/a.zip")
+	if n := atomic.LoadInt64(&gets); n == first {
+		t.Error("expected a changed ETag to fetch again")
+	}
+
+	// Without an ETag or Last-Modified nothing is cached
+	before := atomic.LoadInt64(&gets)
+	list("/untagged.zip")
+	list("/untagged.zip")
+	if n := atomic.LoadInt64(&gets) - before; n < 2*(first) {
+		t.Errorf("expected untagged files to be fetched every time, sent %d requests", n)
+	}
+}
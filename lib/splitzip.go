@@ -0,0 +1,123 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/NORMAL-EX/stream-7z/lib/formats"
+	"github.com/NORMAL-EX/stream-7z/lib/rangehttp"
+	"github.com/NORMAL-EX/stream-7z/lib/utils"
+)
+
+// maxSplitZipVolumes caps the volumes opened for one split ZIP archive,
+// since the count comes from the archive and each volume costs a HEAD
+// request
+const maxSplitZipVolumes = 1000
+
+// splitZip is a split ZIP archive opened from its last volume
+type splitZip struct {
+	data    io.ReaderAt              // The volumes joined, as formats.JoinSplitZip returns them
+	size    int64                    // Size of data
+	volumes []*rangehttp.RangeReader // Every volume but the last, which the Archive reads already
+}
+
+// openSplitZip checks whether the .zip file at archiveURL, read by last,
+// is the last volume of a split archive (name.z01, name.z02, ..., name.zip)
+// and opens the other volumes if so. It returns nil for other files,
+// leaving them to format detection.
+func openSplitZip(ctx context.Context, client *rangehttp.Client, archiveURL string, last *rangehttp.RangeReader, size int64, config *Config) (*splitZip, error) {
+	count, err := formats.SplitZipVolumes(last, size)
+	if err != nil || count <= 1 {
+		return nil, nil
+	}
+	if count > maxSplitZipVolumes {
+		return nil, utils.WrapError(utils.ErrUnsupportedFormat, "split ZIP with %d volumes exceeds the limit of %d", count, maxSplitZipVolumes)
+	}
+	config.debugf(ctx, "Opening split ZIP archive with %d volumes\n", count)
+
+	split := &splitZip{}
+	readers := make([]io.ReaderAt, 0, count)
+	sizes := make([]int64, 0, count)
+	total := size
+	for n := 1; n < count; n++ {
+		volumeURL, err := splitZipVolumeURL(archiveURL, n)
+		if err != nil {
+			split.close()
+			return nil, err
+		}
+		reader, volumeSize, err := openVolume(ctx, client, volumeURL, config)
+		if err != nil {
+			split.close()
+			return nil, utils.WrapError(err, "failed to open ZIP volume %d of %d", n, count)
+		}
+		split.volumes = append(split.volumes, reader)
+		readers = append(readers, reader)
+		sizes = append(sizes, volumeSize)
+
+		total += volumeSize
+		if config.MaxFileSize > 0 && total > config.MaxFileSize {
+			split.close()
+			return nil, fmt.Errorf("file size %d exceeds maximum allowed size %d", total, config.MaxFileSize)
+		}
+	}
+
+	split.data, split.size, err = formats.JoinSplitZip(append(readers, last), append(sizes, size))
+	if err != nil {
+		split.close()
+		return nil, utils.WrapError(err, "failed to join split ZIP volumes")
+	}
+	return split, nil
+}
+
+// close closes the volume readers
+func (s *splitZip) close() {
+	for _, reader := range s.volumes {
+		reader.Close()
+	}
+}
+
+// splitZipVolumeURL returns the URL of volume n of the split ZIP whose
+// last volume is at archiveURL: the extension becomes .z01 for the first,
+// .z02 for the second and so on, in the case of the original
+func splitZipVolumeURL(archiveURL string, n int) (string, error) {
+	u, err := url.Parse(archiveURL)
+	if err != nil {
+		return "", utils.WrapError(utils.ErrInvalidURL, "invalid URL: %s", archiveURL)
+	}
+	ext := path.Ext(u.Path)
+	volumeExt := fmt.Sprintf(".z%02d", n)
+	if ext == strings.ToUpper(ext) {
+		volumeExt = strings.ToUpper(volumeExt)
+	}
+	u.Path = strings.TrimSuffix(u.Path, ext) + volumeExt
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// openVolume sends the HEAD request for one volume of a multi-volume
+// archive and returns a reader for it set up like the archive's own
+func openVolume(ctx context.Context, client *rangehttp.Client, volumeURL string, config *Config) (*rangehttp.RangeReader, int64, error) {
+	headInfo, err := headArchive(ctx, client, volumeURL, config)
+	if err != nil {
+		return nil, 0, err
+	}
+	if headInfo.Size == 0 {
+		return nil, 0, utils.WrapError(utils.ErrArchiveCorrupted, "volume is empty")
+	}
+
+	reader, err := rangehttp.NewRangeReader(ctx, client, volumeURL, headInfo.Size)
+	if err != nil {
+		return nil, 0, err
+	}
+	reader.SetFetchSizes(config.fetchSizes())
+	reader.SetMaxRequests(config.MaxRangeRequests)
+	reader.SetRetries(config.RangeRetries, config.RangeRetryDelay, config.RetryBudget)
+	reader.SetTruncateOnShrink(config.TruncateOnShrink)
+	reader.SetObserver(config.readObserver())
+	config.useSharedCache(reader, volumeURL, headInfo)
+	return reader, headInfo.Size, nil
+}
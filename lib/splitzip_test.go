@@ -0,0 +1,133 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/NORMAL-EX/stream-7z/internal/testarchive"
+)
+
+// splitZipData splits a ZIP archive the way zip -s does: the spanning
+// signature is put in front, the data is cut at offset at of the result,
+// and the central directory, which must lie past at, is rewritten with
+// offsets relative to the volume each entry starts on
+func splitZipData(t *testing.T, data []byte, at int) (first, last []byte) {
+	t.Helper()
+
+	end := data[len(data)-22:]
+	if binary.LittleEndian.Uint32(end) != 0x06054b50 {
+		t.Fatal("the archive must end with an end of central directory record without comment")
+	}
+	dirOffset := int(binary.LittleEndian.Uint32(end[16:])) + 4
+	if dirOffset <= at {
+		t.Fatalf("the central directory at %d must be on the last volume", dirOffset)
+	}
+
+	joined := append([]byte("PK\x07\x08"), data...)
+	for p := dirOffset; binary.LittleEndian.Uint32(joined[p:]) == 0x02014b50; {
+		offset := int(binary.LittleEndian.Uint32(joined[p+42:])) + 4
+		if offset >= at {
+			binary.LittleEndian.PutUint16(joined[p+34:], 1)
+			offset -= at
+		}
+		binary.LittleEndian.PutUint32(joined[p+42:], uint32(offset))
+		p += 46 + int(binary.LittleEndian.Uint16(joined[p+28:])) +
+			int(binary.LittleEndian.Uint16(joined[p+30:])) + int(binary.LittleEndian.Uint16(joined[p+32:]))
+	}
+
+	end = joined[len(joined)-22:]
+	binary.LittleEndian.PutUint16(end[4:], 1) // This disk
+	binary.LittleEndian.PutUint16(end[6:], 1) // Disk the directory starts on
+	binary.LittleEndian.PutUint32(end[16:], uint32(dirOffset-at))
+	return joined[:at], joined[at:]
+}
+
+func TestSplitZip(t *testing.T) {
+	random := make([]byte, 8192)
+	rand.New(rand.NewSource(1)).Read(random)
+	data := testarchive.Zip(t, testarchive.Pairs(
+		"first.txt", "stored before the cut",
+		"spans.bin", string(random), // Incompressible, so the cut falls inside it
+		"last.txt", "stored after the cut",
+	)...)
+	z01, zip := splitZipData(t, data, 4096)
+
+	volumes := map[string][]byte{"/archive.z01": z01, "/archive.zip": zip}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		volume, ok := volumes[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(volume))
+	}))
+	defer server.Close()
+
+	archive, err := NewArchive(server.URL+"/archive.zip", DefaultConfig().WithWholeDownloadThreshold(0))
+	if err != nil {
+		t.Fatalf("NewArchive failed: %v", err)
+	}
+	defer archive.Close()
+
+	if archive.Format() != "zip" {
+		t.Errorf("expected zip, got %s", archive.Format())
+	}
+	files, err := archive.ListFiles("", "")
+	if err != nil {
+		t.Fatalf("ListFiles failed: %v", err)
+	}
+	if len(files) != 3 || files[1].Path != "spans.bin" || files[1].Size != int64(len(random)) {
+		t.Errorf("unexpected listing %+v", files)
+	}
+
+	for name, expected := range map[string]string{
+		"first.txt": "stored before the cut",
+		"spans.bin": string(random),
+		"last.txt":  "stored after the cut",
+	} {
+		reader, _, err := archive.ExtractFile(name, "")
+		if err != nil {
+			t.Errorf("ExtractFile(%q) failed: %v", name, err)
+			continue
+		}
+		content, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil || string(content) != expected {
+			t.Errorf("ExtractFile(%q) read %d bytes (%v), expected %d", name, len(content), err, len(expected))
+		}
+	}
+	if stats := archive.Stats(); stats.RangeRequests == 0 {
+		t.Error("expected the range requests of both volumes to be counted")
+	}
+
+	// Without its first volume the archive can't be read
+	delete(volumes, "/archive.z01")
+	if _, err := NewArchive(server.URL+"/archive.zip", DefaultConfig()); err == nil {
+		t.Error("expected opening a split ZIP with a missing volume to fail")
+	}
+}
+
+func TestSplitZipVolumeURL(t *testing.T) {
+	tests := []struct {
+		url      string
+		n        int
+		expected string
+	}{
+		{"https://example.com/files/backup.zip", 1, "https://example.com/files/backup.z01"},
+		{"https://example.com/files/backup.zip?token=abc", 12, "https://example.com/files/backup.z12?token=abc"},
+		{"https://example.com/BACKUP.ZIP", 3, "https://example.com/BACKUP.Z03"},
+		{"https://example.com/my%20backup.zip", 1, "https://example.com/my%20backup.z01"},
+	}
+	for _, test := range tests {
+		got, err := splitZipVolumeURL(test.url, test.n)
+		if err != nil || got != test.expected {
+			t.Errorf("splitZipVolumeURL(%q, %d) = %q, %v, expected %q", test.url, test.n, got, err, test.expected)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NORMAL-EX/stream-7z/lib/formats"
+	"github.com/NORMAL-EX/stream-7z/lib/rangehttp"
+	"github.com/NORMAL-EX/stream-7z/lib/utils"
+)
+
+// streamHeadSize is how much of a stream is kept in memory for detection
+const streamHeadSize = 64 * 1024
+
+// NewStreamingArchive reads an archive of size bytes from r in a single
+// forward pass, without Range requests, e.g. from the body of a response
+// the caller already has open. extHint is the archive's extension (like
+// ".tar.gz") and is only used to speed up detection; it may be empty.
+//
+// Only formats that can be read front to back are supported: TAR
+// (including tar.gz, tar.bz2 and tar.xz) and RAR. ZIP and 7z keep their
+// directory at the end of the file and fail with formats.ErrNotSupported.
+// There is no random access: the first GetInfo or ListFiles call reads
+// the whole stream and its listing is kept for later calls, and TAR
+// members can be extracted in archive order (as with
+// SequentialExtraction) as long as the archive hasn't been listed.
+// Anything needing data the stream has already passed fails with
+// utils.ErrStreamRewind. r is not closed by the archive.
+func NewStreamingArchive(r io.Reader, size int64, extHint string, config *Config) (*Archive, error) {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	if size <= 0 {
+		return nil, utils.ErrUnknownSize
+	}
+	if config.MaxFileSize > 0 && size > config.MaxFileSize {
+		return nil, fmt.Errorf("file size %d exceeds maximum allowed size %d", size, config.MaxFileSize)
+	}
+	if config.Offset < 0 || (config.Offset > 0 && config.Offset >= size) {
+		return nil, fmt.Errorf("offset %d is outside the file (size %d)", config.Offset, size)
+	}
+
+	stream, err := newForwardReader(r, size)
+	if err != nil {
+		return nil, utils.WrapError(err, "failed to read archive header")
+	}
+
+	// Detection only sees the buffered head, so it can't consume the stream
+	ext := strings.ToLower(extHint)
+	if ext != "" && !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	format, offset, err := detectFormat(context.Background(), bytes.NewReader(stream.head), size, config.Offset, ext, "", config.TrustExtension)
+	if err != nil {
+		if errors.Is(err, formats.ErrEncryptedContainer) {
+			return nil, utils.WrapError(err, "unable to open archive")
+		}
+		return nil, utils.WrapError(utils.ErrUnsupportedFormat, "unable to detect archive format")
+	}
+	if hasCentralDirectory(format) {
+		return nil, utils.WrapError(formats.ErrNotSupported, "%s archives need random access and can't be read from a stream", format.Name())
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if config.Timeout < 0 {
+		ctx, cancel = context.WithCancel(context.Background())
+	} else {
+		timeout := config.Timeout
+		if timeout == 0 {
+			timeout = 120 * time.Second // Default 120 seconds
+		}
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	}
+
+	return &Archive{
+		config: config,
+		src: &archiveSource{
+			size:   size - offset,
+			offset: offset,
+			data:   payloadReader(stream, offset, size),
+			format: format,
+		},
+		stream: stream,
+		ctx:    ctx,
+		cancel: cancel,
+	}, nil
+}
+
+// forwardReader serves ReadAt from a plain io.Reader that can only move
+// forward. The first bytes are kept so format detection and the start of
+// each pass can read them again; reads past them must not go backwards.
+type forwardReader struct {
+	mu   sync.Mutex
+	r    io.Reader
+	size int64
+	head []byte
+	pos  int64 // Offset of the next byte r returns
+}
+
+// newForwardReader reads the head of r
+func newForwardReader(r io.Reader, size int64) (*forwardReader, error) {
+	headSize := int64(streamHeadSize)
+	if size < headSize {
+		headSize = size
+	}
+	head := make([]byte, headSize)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	return &forwardReader{r: r, size: size, head: head, pos: headSize}, nil
+}
+
+// ReadAt reads len(p) bytes at off, skipping forward in the stream as needed
+func (f *forwardReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := 0
+	headLen := int64(len(f.head))
+	if off < headLen {
+		n = copy(p, f.head[off:])
+		if n == len(p) {
+			return n, nil
+		}
+		off += int64(n)
+	}
+
+	if off < f.pos {
+		return n, utils.WrapError(utils.ErrStreamRewind, "offset %d, stream at %d", off, f.pos)
+	}
+	if off > f.pos {
+		skipped, err := io.CopyN(io.Discard, f.r, off-f.pos)
+		f.pos += skipped
+		if err != nil {
+			return n, &rangehttp.TransferError{Offset: f.pos, Length: int64(len(p) - n), Err: unexpectedEOF(err)}
+		}
+	}
+
+	want := p[n:]
+	if remaining := f.size - off; int64(len(want)) > remaining {
+		want = want[:remaining]
+	}
+	read, err := io.ReadFull(f.r, want)
+	f.pos += int64(read)
+	n += read
+	if err != nil {
+		return n, &rangehttp.TransferError{Offset: f.pos, Length: int64(len(want) - read), Err: unexpectedEOF(err)}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// unexpectedEOF reports a stream ending before its declared size as io.ErrUnexpectedEOF
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
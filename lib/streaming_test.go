@@ -0,0 +1,142 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/NORMAL-EX/stream-7z/internal/testarchive"
+	"github.com/NORMAL-EX/stream-7z/lib/formats"
+	"github.com/NORMAL-EX/stream-7z/lib/utils"
+)
+
+// onlyReader hides every method of the underlying reader except Read
+type onlyReader struct {
+	r io.Reader
+}
+
+func (o onlyReader) Read(p []byte) (int, error) {
+	return o.r.Read(p)
+}
+
+// readMember extracts and reads filePath. Members at the start of a
+// stream open from the buffered head, so a rewind may only show on Read.
+func readMember(archive *Archive, filePath string) error {
+	reader, _, err := archive.ExtractFile(filePath, "")
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = io.Copy(io.Discard, reader)
+	return err
+}
+
+func TestStreamingArchive(t *testing.T) {
+	// Members larger than the buffered head, so reads go to the stream
+	data, contents := buildTestTarGz(t, 4, 40*1024)
+	size := int64(len(data))
+
+	t.Run("listing", func(t *testing.T) {
+		archive, err := NewStreamingArchive(onlyReader{bytes.NewReader(data)}, size, "tar.gz", nil)
+		if err != nil {
+			t.Fatalf("NewStreamingArchive failed: %v", err)
+		}
+		defer archive.Close()
+
+		if archive.Format() != "tar" {
+			t.Fatalf("expected tar, got %s", archive.Format())
+		}
+		info, err := archive.GetInfo("")
+		if err != nil {
+			t.Fatalf("GetInfo failed: %v", err)
+		}
+		if info.TotalFiles != len(contents) {
+			t.Errorf("expected %d files, got %d", len(contents), info.TotalFiles)
+		}
+
+		// The listing is kept; the stream can't be read again
+		files, err := archive.ListFiles("", "")
+		if err != nil || len(files) != len(contents) {
+			t.Fatalf("expected ListFiles from the kept listing, got %d files, %v", len(files), err)
+		}
+		if err := readMember(archive, "file3.bin"); !errors.Is(err, utils.ErrStreamRewind) {
+			t.Errorf("expected ErrStreamRewind after listing, got %v", err)
+		}
+	})
+
+	t.Run("in-order extraction", func(t *testing.T) {
+		archive, err := NewStreamingArchive(onlyReader{bytes.NewReader(data)}, size, "", nil)
+		if err != nil {
+			t.Fatalf("NewStreamingArchive failed: %v", err)
+		}
+		defer archive.Close()
+
+		extractAll(t, archive, contents, []int{0, 2, 3})
+		if err := readMember(archive, "file1.bin"); !errors.Is(err, utils.ErrStreamRewind) {
+			t.Errorf("expected ErrStreamRewind going back, got %v", err)
+		}
+		if stats := archive.Stats(); stats.RangeRequests != 0 {
+			t.Errorf("expected no range requests, got %d", stats.RangeRequests)
+		}
+	})
+
+	t.Run("truncated stream", func(t *testing.T) {
+		archive, err := NewStreamingArchive(onlyReader{bytes.NewReader(data[:size-1024])}, size, "", nil)
+		if err != nil {
+			t.Fatalf("NewStreamingArchive failed: %v", err)
+		}
+		defer archive.Close()
+
+		if _, err := archive.GetInfo(""); err == nil {
+			t.Error("expected GetInfo to fail on a truncated stream")
+		}
+	})
+
+	t.Run("zip", func(t *testing.T) {
+		zipData := testarchive.Zip(t, testarchive.Pairs("hello.txt", "hello")...)
+		_, err := NewStreamingArchive(onlyReader{bytes.NewReader(zipData)}, int64(len(zipData)), ".zip", nil)
+		if !errors.Is(err, formats.ErrNotSupported) {
+			t.Errorf("expected ErrNotSupported for ZIP, got %v", err)
+		}
+	})
+}
+
+func TestForwardReader(t *testing.T) {
+	data := make([]byte, streamHeadSize+1000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	reader, err := newForwardReader(onlyReader{bytes.NewReader(data)}, int64(len(data)))
+	if err != nil {
+		t.Fatalf("newForwardReader failed: %v", err)
+	}
+
+	check := func(off int64, length int) error {
+		p := make([]byte, length)
+		n, err := reader.ReadAt(p, off)
+		if err == nil && !bytes.Equal(p[:n], data[off:off+int64(n)]) {
+			return fmt.Errorf("content mismatch at %d", off)
+		}
+		return err
+	}
+
+	// Straddling the end of the head, then skipping forward
+	if err := check(streamHeadSize-10, 20); err != nil {
+		t.Fatalf("read across the head failed: %v", err)
+	}
+	if err := check(streamHeadSize+500, 100); err != nil {
+		t.Fatalf("read skipping forward failed: %v", err)
+	}
+	// The head can always be read again
+	if err := check(0, 10); err != nil {
+		t.Fatalf("read in the head failed: %v", err)
+	}
+	if err := check(streamHeadSize+100, 10); !errors.Is(err, utils.ErrStreamRewind) {
+		t.Errorf("expected ErrStreamRewind, got %v", err)
+	}
+	if err := check(streamHeadSize+900, 200); err != io.EOF {
+		t.Errorf("expected io.EOF reading past the end, got %v", err)
+	}
+}
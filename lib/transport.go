@@ -0,0 +1,139 @@
+package lib
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// HostResolver resolves host names to IP addresses. *net.Resolver
+// implements it; a custom implementation can pin or filter addresses.
+type HostResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// dialSettingsChanged reports whether the config customizes how connections are dialed
+func (c *Config) dialSettingsChanged() bool {
+	return c.Resolver != nil || c.DNSServer != "" || c.DialTimeout != 0 || c.FallbackDelay != 0
+}
+
+// httpClient returns the HTTP client to use for requests. When dialing or
+// TLS is customized, it is built once and reused so archives opened with the
+// same config share one connection pool.
+func (c *Config) httpClient() (*http.Client, error) {
+	if c.rootCAsErr != nil {
+		return nil, c.rootCAsErr
+	}
+	if c.clientCertErr != nil {
+		return nil, c.clientCertErr
+	}
+	if c.HTTPClient == nil || (!c.dialSettingsChanged() && c.TLSConfig == nil && !c.DisableHTTP2 && c.ResponseHeaderTimeout == 0) {
+		return c.HTTPClient, nil
+	}
+
+	c.transportMu.Lock()
+	defer c.transportMu.Unlock()
+
+	if c.transportClient == nil {
+		c.transportClient = buildHTTPClient(c)
+	}
+	return c.transportClient, nil
+}
+
+// buildHTTPClient clones the config's *http.Transport with the dial, TLS,
+// timeout and HTTP/2 settings applied; other transports are used unchanged
+func buildHTTPClient(config *Config) *http.Client {
+	var transport *http.Transport
+	switch t := config.HTTPClient.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = t.Clone()
+	default:
+		return config.HTTPClient
+	}
+	if config.dialSettingsChanged() {
+		transport.DialContext = newDialContext(config)
+	}
+	if config.TLSConfig != nil {
+		transport.TLSClientConfig = config.TLSConfig.Clone()
+	}
+	if config.ResponseHeaderTimeout != 0 {
+		transport.ResponseHeaderTimeout = config.ResponseHeaderTimeout
+	}
+
+	// A custom dialer or TLS config turns off Go's automatic HTTP/2 unless forced
+	if config.DisableHTTP2 {
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	} else {
+		transport.ForceAttemptHTTP2 = true
+	}
+
+	client := *config.HTTPClient
+	client.Transport = transport
+	return &client
+}
+
+// newDialContext builds a DialContext honoring the config's resolver settings.
+// With a proxy configured, only the proxy's address is resolved this way;
+// the target host is resolved by the proxy.
+func newDialContext(config *Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:       config.DialTimeout,
+		FallbackDelay: config.FallbackDelay,
+		KeepAlive:     30 * time.Second,
+	}
+
+	resolver := config.Resolver
+	if resolver == nil && config.DNSServer != "" {
+		dnsServer := config.DNSServer
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, dnsServer)
+			},
+		}
+	}
+
+	switch r := resolver.(type) {
+	case nil:
+		return dialer.DialContext
+	case *net.Resolver:
+		// The dialer resolves itself and keeps happy-eyeballs dialing
+		dialer.Resolver = r
+		return dialer.DialContext
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, addr)
+		}
+
+		addrs, err := resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if len(addrs) == 0 {
+			return nil, &net.DNSError{Err: "no addresses found", Name: host, IsNotFound: true}
+		}
+
+		// Try each address in turn, returning the first connection that succeeds
+		var dialErr error
+		for _, ip := range addrs {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			dialErr = errors.Join(dialErr, err)
+		}
+		return nil, dialErr
+	}
+}
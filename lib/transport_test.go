@@ -0,0 +1,318 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/NORMAL-EX/stream-7z/internal/testarchive"
+)
+
+// staticResolver maps host names to fixed addresses
+type staticResolver map[string]string
+
+func (r staticResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ip, ok := r[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return []net.IPAddr{{IP: net.ParseIP(ip)}}, nil
+}
+
+func TestNewArchiveUsesCustomResolver(t *testing.T) {
+	server := newFileServer(t, testarchive.Zip(t, testarchive.Pairs("hello.txt", "hello")...), "application/zip")
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	config := DefaultConfig().
+		WithResolver(staticResolver{"archives.test": "127.0.0.1"}).
+		WithDialTimeout(5 * time.Second)
+
+	archive, err := NewArchive("http://archives.test:"+port+"/archive.zip", config)
+	if err != nil {
+		t.Fatalf("NewArchive via custom resolver failed: %v", err)
+	}
+	defer archive.Close()
+
+	if archive.Format() != "zip" {
+		t.Errorf("expected zip, got %s", archive.Format())
+	}
+}
+
+func TestConfigHTTPClientWithDialSettings(t *testing.T) {
+	config := DefaultConfig()
+	if client, _ := config.httpClient(); client != config.HTTPClient {
+		t.Error("expected the configured client to be used as-is")
+	}
+
+	config.WithDNSServer("127.0.0.1:53")
+	client, _ := config.httpClient()
+	if client == config.HTTPClient {
+		t.Fatal("expected a client with a custom dialer")
+	}
+	if config.HTTPClient.Transport.(*http.Transport).DialContext != nil {
+		t.Error("building the client modified the original transport")
+	}
+	if rebuilt, _ := config.httpClient(); rebuilt != client {
+		t.Error("expected the built client to be reused")
+	}
+
+	config.WithDialTimeout(time.Second)
+	if rebuilt, _ := config.httpClient(); rebuilt == client {
+		t.Error("expected changed dial settings to rebuild the client")
+	}
+}
+
+// newTLSFileServer serves data over HTTPS with a self-signed certificate
+func newTLSFileServer(t *testing.T, data []byte) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// serverCAPEM returns the PEM encoding of the test server's certificate
+func serverCAPEM(server *httptest.Server) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+}
+
+func TestNewArchiveWithRootCAs(t *testing.T) {
+	server := newTLSFileServer(t, testarchive.Zip(t, testarchive.Pairs("hello.txt", "hello")...))
+
+	if _, err := NewArchive(server.URL+"/archive.zip", DefaultConfig()); err == nil {
+		t.Fatal("expected certificate verification to fail without the custom CA")
+	}
+
+	archive, err := NewArchive(server.URL+"/archive.zip", DefaultConfig().WithRootCAs(serverCAPEM(server)))
+	if err != nil {
+		t.Fatalf("NewArchive with custom CA failed: %v", err)
+	}
+	archive.Close()
+
+	archive, err = NewArchive(server.URL+"/archive.zip", DefaultConfig().WithInsecureSkipVerify(true))
+	if err != nil {
+		t.Fatalf("NewArchive with skip-verify failed: %v", err)
+	}
+	archive.Close()
+
+	config := DefaultConfig().WithRootCAs([]byte("not a certificate"))
+	if _, err := NewArchive(server.URL+"/archive.zip", config); err == nil {
+		t.Error("expected invalid CA PEM to be reported")
+	}
+
+	// Valid PEM passed afterwards replaces the invalid one
+	archive, err = NewArchive(server.URL+"/archive.zip", config.WithRootCAs(serverCAPEM(server)))
+	if err != nil {
+		t.Fatalf("expected valid CA PEM to clear the earlier error, got %v", err)
+	}
+	archive.Close()
+}
+
+func TestNewArchiveWithClientCert(t *testing.T) {
+	certPEM, keyPEM := generateClientCert(t)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(testarchive.Zip(t, testarchive.Pairs("hello.txt", "hello")...)))
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	config := DefaultConfig().WithRootCAs(serverCAPEM(server))
+	if _, err := NewArchive(server.URL+"/archive.zip", config); err == nil {
+		t.Fatal("expected the server to reject a client without certificate")
+	}
+
+	archive, err := NewArchive(server.URL+"/archive.zip", config.Clone().WithClientCert(certPEM, keyPEM))
+	if err != nil {
+		t.Fatalf("NewArchive with client certificate failed: %v", err)
+	}
+	archive.Close()
+
+	// A failed setting is reported on its own and cleared by a valid pair
+	config = config.Clone().WithClientCert(certPEM, []byte("not a key"))
+	if _, err := NewArchive(server.URL+"/archive.zip", config.Clone().WithRootCAs(serverCAPEM(server))); err == nil {
+		t.Fatal("expected an invalid client certificate to be reported after another TLS setting succeeded")
+	}
+	archive, err = NewArchive(server.URL+"/archive.zip", config.WithClientCert(certPEM, keyPEM))
+	if err != nil {
+		t.Fatalf("expected a valid client certificate to clear the earlier error, got %v", err)
+	}
+	archive.Close()
+}
+
+// generateClientCert creates a self-signed client certificate and key in PEM form
+func generateClientCert(t *testing.T) (certPEM, keyPEM []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "stream-7z test client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM
+}
+
+// newHTTP2FileServer serves data over HTTPS with HTTP/2 enabled, counting
+// new connections and recording the protocol of each request
+func newHTTP2FileServer(t *testing.T, data []byte) (*httptest.Server, *int64, *int64) {
+	t.Helper()
+
+	var conns, http2Requests int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 {
+			atomic.AddInt64(&http2Requests, 1)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	server.EnableHTTP2 = true
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	return server, &conns, &http2Requests
+}
+
+// readInParallel issues concurrent ReadAt calls against the archive's reader
+func readInParallel(t *testing.T, archive *Archive, readers int) {
+	t.Helper()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, readers)
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func(off int64) {
+			defer wg.Done()
+			buf := make([]byte, 16)
+			if _, err := archive.src.reader.ReadAt(buf, off); err != nil {
+				errs <- err
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("parallel ReadAt failed: %v", err)
+	}
+}
+
+func TestParallelReadsMultiplexOverHTTP2(t *testing.T) {
+	server, conns, http2Requests := newHTTP2FileServer(t, testarchive.Zip(t, testarchive.Pairs("hello.txt", "hello")...))
+
+	archive, err := NewArchive(server.URL+"/archive.zip", DefaultConfig().WithRootCAs(serverCAPEM(server)))
+	if err != nil {
+		t.Fatalf("NewArchive failed: %v", err)
+	}
+	defer archive.Close()
+
+	readInParallel(t, archive, 16)
+
+	if n := atomic.LoadInt64(conns); n != 1 {
+		t.Errorf("expected all requests on one connection, got %d connections", n)
+	}
+	if atomic.LoadInt64(http2Requests) == 0 {
+		t.Error("expected requests to use HTTP/2")
+	}
+}
+
+func TestParallelReadsWithHTTP2Disabled(t *testing.T) {
+	server, _, http2Requests := newHTTP2FileServer(t, testarchive.Zip(t, testarchive.Pairs("hello.txt", "hello")...))
+
+	config := DefaultConfig().WithRootCAs(serverCAPEM(server)).WithHTTP2(false)
+	archive, err := NewArchive(server.URL+"/archive.zip", config)
+	if err != nil {
+		t.Fatalf("NewArchive failed: %v", err)
+	}
+	defer archive.Close()
+
+	readInParallel(t, archive, 16)
+
+	if n := atomic.LoadInt64(http2Requests); n != 0 {
+		t.Errorf("expected HTTP/1.1 only, got %d HTTP/2 requests", n)
+	}
+}
+
+func TestResponseHeaderTimeoutFailsFast(t *testing.T) {
+	// Accept connections but never answer them
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	defer func() {
+		mu.Lock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		mu.Unlock()
+	}()
+
+	// A long overall timeout must not keep us waiting on a dead origin
+	config := DefaultConfig().
+		WithTimeout(time.Hour).
+		WithResponseHeaderTimeout(200 * time.Millisecond).
+		WithHeadRetries(0, 0)
+
+	start := time.Now()
+	_, err = NewArchive("http://"+listener.Addr().String()+"/archive.zip", config)
+	if err == nil {
+		t.Fatal("expected NewArchive to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected to fail within the response header timeout, took %v", elapsed)
+	}
+}
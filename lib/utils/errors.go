@@ -21,6 +21,30 @@ var (
 	// ErrRangeNotSupported indicates the server does not support HTTP Range requests
 	ErrRangeNotSupported = errors.New("server does not support range requests")
 
+	// ErrUnknownSize indicates the server reported the size of the file neither for HEAD nor for a Range request
+	ErrUnknownSize = errors.New("server did not report the file size")
+
+	// ErrRangeMismatch indicates the server answered a Range request with a different byte range
+	ErrRangeMismatch = errors.New("server returned a different byte range than requested")
+
+	// ErrContentEncoded indicates the server compressed the response with a Content-Encoding,
+	// which makes byte offsets meaningless
+	ErrContentEncoded = errors.New("server applied a content encoding to the archive bytes")
+
+	// ErrRangeBudgetExceeded indicates reading the archive took more range requests than allowed,
+	// e.g. because its layout is fragmented into many small reads
+	ErrRangeBudgetExceeded = errors.New("range request budget exceeded")
+
+	// ErrRetryBudgetExceeded indicates range requests failed more often than the retry budget
+	// allows, e.g. because the origin is down
+	ErrRetryBudgetExceeded = errors.New("retry budget exceeded")
+
+	// ErrTooManyReaders indicates the archive already has the maximum number of extract readers open
+	ErrTooManyReaders = errors.New("too many open extract readers")
+
+	// ErrStreamRewind indicates a streaming archive was asked for data it has already read past
+	ErrStreamRewind = errors.New("stream already read past the requested position")
+
 	// ErrArchiveCorrupted indicates the archive file appears to be corrupted
 	ErrArchiveCorrupted = errors.New("archive file is corrupted or invalid")
 
@@ -35,8 +59,47 @@ var (
 
 	// ErrPathTraversal indicates an attempt to access files outside archive
 	ErrPathTraversal = errors.New("path traversal detected")
+
+	// ErrNotAnArchive indicates the URL served a web page or API response instead of an archive
+	ErrNotAnArchive = errors.New("the URL returned a web page, not an archive file")
+
+	// ErrArchiveChanged indicates the file on the server changed size while the archive was being read
+	ErrArchiveChanged = errors.New("archive changed on the server while it was being read")
+
+	// ErrUnexpectedContentType indicates the server's Content-Type is not one of the expected types
+	ErrUnexpectedContentType = errors.New("unexpected content type")
 )
 
+// ExtractError reports which archive member failed to extract and why.
+// It unwraps to Cause, so errors.Is still matches the underlying sentinel.
+type ExtractError struct {
+	Path  string // Member path within the archive
+	Cause error
+}
+
+func (e *ExtractError) Error() string {
+	return fmt.Sprintf("failed to extract %q: %v", e.Path, e.Cause)
+}
+
+func (e *ExtractError) Unwrap() error {
+	return e.Cause
+}
+
+// DecompressionError reports member data that was read but failed to
+// decompress or verify, e.g. a bad Deflate block or a CRC-32 mismatch.
+// Reading it again gives the same result, so it isn't worth a retry.
+type DecompressionError struct {
+	Cause error
+}
+
+func (e *DecompressionError) Error() string {
+	return fmt.Sprintf("failed to decompress: %v", e.Cause)
+}
+
+func (e *DecompressionError) Unwrap() error {
+	return e.Cause
+}
+
 // WrapError wraps an error with additional context
 func WrapError(err error, format string, args ...interface{}) error {
 	if err == nil {
@@ -50,6 +113,12 @@ func IsPasswordError(err error) bool {
 	return errors.Is(err, ErrWrongPassword) || errors.Is(err, ErrPasswordRequired)
 }
 
+// IsDecompressionError checks if the error is a *DecompressionError
+func IsDecompressionError(err error) bool {
+	var decompressionErr *DecompressionError
+	return errors.As(err, &decompressionErr)
+}
+
 // IsNotFoundError checks if the error is related to file not found
 func IsNotFoundError(err error) bool {
 	return errors.Is(err, ErrFileNotFound)
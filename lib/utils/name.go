@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// MaxDisplayNameLength is the length in bytes SanitizeName cuts names to
+const MaxDisplayNameLength = 4096
+
+// SanitizeName makes an archive member name safe to show in a terminal or
+// pass to consumers that choke on control characters. Control characters
+// (including newlines, escapes and NUL), bidirectional overrides and
+// invalid UTF-8 are escaped as \xNN or \uNNNN, and names longer than
+// MaxDisplayNameLength are cut. suspicious reports whether the name had
+// to be changed. The result is for display only; members must still be
+// addressed by their original name.
+func SanitizeName(name string) (sanitized string, suspicious bool) {
+	var b strings.Builder
+	for i := 0; i < len(name); {
+		r, size := utf8.DecodeRuneInString(name[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			fmt.Fprintf(&b, `\x%02x`, name[i])
+			suspicious = true
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, r)
+			suspicious = true
+		case isHiddenControl(r):
+			fmt.Fprintf(&b, `\u%04x`, r)
+			suspicious = true
+		default:
+			b.WriteString(name[i : i+size])
+		}
+		i += size
+	}
+
+	sanitized = b.String()
+	if len(sanitized) > MaxDisplayNameLength {
+		cut := MaxDisplayNameLength
+		for cut > 0 && !utf8.RuneStart(sanitized[cut]) {
+			cut--
+		}
+		sanitized = sanitized[:cut] + "…"
+		suspicious = true
+	}
+	return sanitized, suspicious
+}
+
+// isHiddenControl reports whether r is a C1 control character or changes
+// the text direction, which can make a name display as something else
+func isHiddenControl(r rune) bool {
+	return (r >= 0x80 && r <= 0x9f) ||
+		(r >= 0x202a && r <= 0x202e) ||
+		(r >= 0x2066 && r <= 0x2069)
+}
+
+// NFC returns name in Unicode Normalization Form C, where accented
+// letters are single code points as most systems type them. It can be
+// passed to Config.WithPathNormalizer.
+func NFC(name string) string {
+	return norm.NFC.String(name)
+}
+
+// NFD returns name in Unicode Normalization Form D, where accented
+// letters are decomposed into a base letter and combining marks, the way
+// macOS stores file names
+func NFD(name string) string {
+	return norm.NFD.String(name)
+}
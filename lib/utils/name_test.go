@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		input      string
+		expected   string
+		suspicious bool
+	}{
+		{"docs/readme.txt", "docs/readme.txt", false},
+		{"照片/猫.jpg", "照片/猫.jpg", false},
+		{"evil\nname.txt", `evil\x0aname.txt`, true},
+		{"\x1b[31mred\x1b[0m.txt", `\x1b[31mred\x1b[0m.txt`, true},
+		{"nul\x00byte", `nul\x00byte`, true},
+		{"bad\xffutf8", `bad\xffutf8`, true},
+		{"invoice\u202egpj.exe", `invoice\u202egpj.exe`, true},
+	}
+
+	for _, test := range tests {
+		sanitized, suspicious := SanitizeName(test.input)
+		if sanitized != test.expected || suspicious != test.suspicious {
+			t.Errorf("SanitizeName(%q) = %q, %v, expected %q, %v", test.input, sanitized, suspicious, test.expected, test.suspicious)
+		}
+	}
+
+	long := strings.Repeat("é", MaxDisplayNameLength)
+	sanitized, suspicious := SanitizeName(long)
+	if !suspicious || len(sanitized) > MaxDisplayNameLength+len("…") || !strings.HasSuffix(sanitized, "é…") {
+		t.Errorf("expected an overlong name to be cut at a character boundary, got %d bytes", len(sanitized))
+	}
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"path"
+	"path/filepath"
 	"strings"
 )
 
@@ -17,6 +18,21 @@ func NormalizePath(p string) string {
 	return p
 }
 
+// CanonicalPath returns a member name in the form clients are shown:
+// forward slashes, including for names stored with Windows separators, no
+// leading slash or "./", and a trailing slash only for directories. It is
+// for display; the stored name may no longer match it.
+func CanonicalPath(p string, isDir bool) string {
+	p = NormalizePath(strings.ReplaceAll(p, "\\", "/"))
+	if p == "." {
+		p = ""
+	}
+	if isDir && p != "" {
+		p += "/"
+	}
+	return p
+}
+
 // IsValidPath checks if a path is valid and not attempting path traversal
 func IsValidPath(p string) bool {
 	// Check for path traversal attempts
@@ -31,6 +47,37 @@ func IsValidPath(p string) bool {
 	return true
 }
 
+// IsUnsafePath reports whether an archive member name would escape the
+// directory it is extracted to if used as is: absolute paths (including
+// Windows drive and UNC paths), ".." segments with either separator, and
+// names containing NUL
+func IsUnsafePath(name string) bool {
+	if strings.ContainsRune(name, 0) {
+		return true
+	}
+	if strings.HasPrefix(name, "/") || strings.HasPrefix(name, "\\") {
+		return true
+	}
+	if len(name) >= 2 && name[1] == ':' && (name[0]|0x20) >= 'a' && (name[0]|0x20) <= 'z' {
+		return true
+	}
+	for _, segment := range strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// SafeJoin returns the local path for member name below root, failing
+// with ErrPathTraversal for names that would land outside root
+func SafeJoin(root, name string) (string, error) {
+	if !IsValidPath(name) || IsUnsafePath(strings.TrimLeft(name, "/")) {
+		return "", ErrPathTraversal
+	}
+	return filepath.Join(root, filepath.FromSlash(NormalizePath(name))), nil
+}
+
 // GetFileName extracts the file name from a path
 func GetFileName(p string) string {
 	return path.Base(p)
@@ -57,7 +104,7 @@ func PathMatchesPrefix(filePath, prefix string) bool {
 	filePath = NormalizePath(filePath)
 	prefix = NormalizePath(prefix)
 	
-	if prefix == "" {
+	if prefix == "" || prefix == "." {
 		return true
 	}
 	
@@ -25,6 +25,33 @@ func TestNormalizePath(t *testing.T) {
 	}
 }
 
+func TestCanonicalPath(t *testing.T) {
+	tests := []struct {
+		input    string
+		isDir    bool
+		expected string
+	}{
+		{"path/to/file", false, "path/to/file"},
+		{`path\to\file`, false, "path/to/file"},
+		{"/etc/passwd", false, "etc/passwd"},
+		{`\abs\file`, false, "abs/file"},
+		{"./docs/readme.txt", false, "docs/readme.txt"},
+		{"./docs", true, "docs/"},
+		{"docs/", true, "docs/"},
+		{"docs//sub/", true, "docs/sub/"},
+		{"file/", false, "file"},
+		{"./", true, ""},
+		{"", false, ""},
+	}
+
+	for _, test := range tests {
+		result := CanonicalPath(test.input, test.isDir)
+		if result != test.expected {
+			t.Errorf("CanonicalPath(%q, %v) = %q, expected %q", test.input, test.isDir, result, test.expected)
+		}
+	}
+}
+
 func TestIsValidPath(t *testing.T) {
 	tests := []struct {
 		input string
@@ -165,3 +192,38 @@ func TestIsNotFoundError(t *testing.T) {
 		t.Error("ErrWrongPassword should not be a not found error")
 	}
 }
+
+func TestIsUnsafePath(t *testing.T) {
+	tests := []struct {
+		input  string
+		unsafe bool
+	}{
+		{"docs/readme.txt", false},
+		{"a..b.txt", false},
+		{"/etc/cron.d/evil", true},
+		{"../../x", true},
+		{"docs/../../x", true},
+		{"..\\..\\windows\\evil.dll", true},
+		{"\\\\server\\share\\x", true},
+		{"C:\\Windows\\evil.dll", true},
+		{"c:evil", true},
+		{"nul\x00.txt", true},
+	}
+
+	for _, test := range tests {
+		if result := IsUnsafePath(test.input); result != test.unsafe {
+			t.Errorf("IsUnsafePath(%q) = %v, expected %v", test.input, result, test.unsafe)
+		}
+	}
+}
+
+func TestSafeJoin(t *testing.T) {
+	if target, err := SafeJoin("/data", "/docs/a.txt"); err != nil || target != "/data/docs/a.txt" {
+		t.Errorf("SafeJoin(/data, /docs/a.txt) = %q, %v", target, err)
+	}
+	for _, name := range []string{"../x", "docs/../../x", "C:\\x"} {
+		if _, err := SafeJoin("/data", name); err != ErrPathTraversal {
+			t.Errorf("SafeJoin(/data, %q): expected ErrPathTraversal, got %v", name, err)
+		}
+	}
+}